@@ -0,0 +1,361 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package azure provides wrappers around Microsoft Azure compute APIs.
+// It is assumed that the program itself also runs on an Azure VM as APIs operate on
+// the current subscription/resource group/location and, unless specified otherwise,
+// VMs are attached to the current subnet. Credentials are obtained with
+// azidentity.NewDefaultAzureCredential (environment, managed identity or az login).
+//
+// See https://docs.microsoft.com/en-us/azure/virtual-machines/linux/ for details.
+// Go SDK:
+// https://pkg.go.dev/github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v6
+// Boot diagnostics:
+// https://docs.microsoft.com/en-us/azure/virtual-machines/boot-diagnostics
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v6"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v6"
+)
+
+type Context struct {
+	Subscription  string
+	ResourceGroup string
+	Location      string
+	Instance      string
+	InternalIP    string
+	Subnet        string
+
+	vms  *armcompute.VirtualMachinesClient
+	nics *armnetwork.InterfacesClient
+
+	// apiRateGate prevents us from hitting Azure Resource Manager throttling limits.
+	apiRateGate <-chan time.Time
+}
+
+func NewContext() (*Context, error) {
+	ctx := &Context{
+		apiRateGate: time.NewTicker(time.Second / 5).C,
+	}
+	meta := new(struct {
+		Compute struct {
+			Name              string
+			Location          string
+			ResourceGroupName string
+			SubscriptionId    string
+		}
+		Network struct {
+			Interface []struct {
+				Ipv4 struct {
+					IpAddress []struct {
+						PrivateIpAddress string
+					}
+				}
+			}
+		}
+	})
+	if err := getMeta(meta); err != nil {
+		return nil, fmt.Errorf("failed to query azure instance metadata: %v", err)
+	}
+	ctx.Subscription = meta.Compute.SubscriptionId
+	ctx.Instance = meta.Compute.Name
+	ctx.Location = meta.Compute.Location
+	ctx.ResourceGroup = meta.Compute.ResourceGroupName
+	if ifaces := meta.Network.Interface; len(ifaces) != 0 && len(ifaces[0].Ipv4.IpAddress) != 0 {
+		ctx.InternalIP = ifaces[0].Ipv4.IpAddress[0].PrivateIpAddress
+	}
+	if ctx.Subscription == "" || ctx.Instance == "" || ctx.ResourceGroup == "" || ctx.InternalIP == "" {
+		return nil, fmt.Errorf("failed to get current subscription, instance name, resource group and internal IP")
+	}
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain azure credentials: %v", err)
+	}
+	if ctx.vms, err = armcompute.NewVirtualMachinesClient(ctx.Subscription, cred, nil); err != nil {
+		return nil, fmt.Errorf("failed to create compute client: %v", err)
+	}
+	if ctx.nics, err = armnetwork.NewInterfacesClient(ctx.Subscription, cred, nil); err != nil {
+		return nil, fmt.Errorf("failed to create network client: %v", err)
+	}
+	<-ctx.apiRateGate
+	self, err := ctx.vms.Get(context.Background(), ctx.ResourceGroup, ctx.Instance, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query current instance: %v", err)
+	}
+	if self.Properties == nil || self.Properties.NetworkProfile == nil ||
+		len(self.Properties.NetworkProfile.NetworkInterfaces) == 0 {
+		return nil, fmt.Errorf("current instance has no network interfaces")
+	}
+	nicID, err := arm.ParseResourceID(*self.Properties.NetworkProfile.NetworkInterfaces[0].ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse current instance interface id: %v", err)
+	}
+	<-ctx.apiRateGate
+	nic, err := ctx.nics.Get(context.Background(), nicID.ResourceGroupName, nicID.Name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query current instance subnet: %v", err)
+	}
+	if nic.Properties == nil || len(nic.Properties.IPConfigurations) == 0 ||
+		nic.Properties.IPConfigurations[0].Properties == nil ||
+		nic.Properties.IPConfigurations[0].Properties.Subnet == nil {
+		return nil, fmt.Errorf("current instance interface has no subnet")
+	}
+	ctx.Subnet = *nic.Properties.IPConfigurations[0].Properties.Subnet.ID
+	return ctx, nil
+}
+
+// CreateInstance creates a VM with the given size from a managed image (name in the current
+// resource group or resource ID), authorizes the public key in sshkey file for user
+// and returns internal IP of the VM.
+func (ctx *Context) CreateInstance(name, size, image, user, sshkey, subnet string, lowPriority bool) (string, error) {
+	if subnet == "" {
+		subnet = ctx.Subnet
+	}
+	if !strings.HasPrefix(image, "/") {
+		image = fmt.Sprintf("/subscriptions/%v/resourceGroups/%v/providers/Microsoft.Compute/images/%v",
+			ctx.Subscription, ctx.ResourceGroup, image)
+	}
+	pubKey, err := ioutil.ReadFile(sshkey)
+	if err != nil {
+		return "", fmt.Errorf("failed to read public key: %v", err)
+	}
+	tags := map[string]*string{"syzkaller": to.Ptr("1")}
+
+	// No public IP and no security group: the VM is reachable only from the manager subnet.
+	<-ctx.apiRateGate
+	nicOp, err := ctx.nics.BeginCreateOrUpdate(context.Background(), ctx.ResourceGroup, nicName(name),
+		armnetwork.Interface{
+			Location: to.Ptr(ctx.Location),
+			Tags:     tags,
+			Properties: &armnetwork.InterfacePropertiesFormat{
+				IPConfigurations: []*armnetwork.InterfaceIPConfiguration{{
+					Name: to.Ptr("ipconfig"),
+					Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{
+						Subnet:                    &armnetwork.Subnet{ID: to.Ptr(subnet)},
+						PrivateIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodDynamic),
+					},
+				}},
+			},
+		}, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create network interface: %v", err)
+	}
+	nic, err := nicOp.PollUntilDone(context.Background(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create network interface: %v", err)
+	}
+	ip := ""
+	if nic.Properties != nil && len(nic.Properties.IPConfigurations) != 0 &&
+		nic.Properties.IPConfigurations[0].Properties != nil &&
+		nic.Properties.IPConfigurations[0].Properties.PrivateIPAddress != nil {
+		ip = *nic.Properties.IPConfigurations[0].Properties.PrivateIPAddress
+	}
+	if ip == "" {
+		return "", fmt.Errorf("didn't find instance internal IP address")
+	}
+
+	vm := armcompute.VirtualMachine{
+		Location: to.Ptr(ctx.Location),
+		Tags:     tags,
+		Properties: &armcompute.VirtualMachineProperties{
+			HardwareProfile: &armcompute.HardwareProfile{
+				VMSize: to.Ptr(armcompute.VirtualMachineSizeTypes(size)),
+			},
+			StorageProfile: &armcompute.StorageProfile{
+				ImageReference: &armcompute.ImageReference{ID: to.Ptr(image)},
+				OSDisk: &armcompute.OSDisk{
+					CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
+					DeleteOption: to.Ptr(armcompute.DiskDeleteOptionTypesDelete),
+				},
+			},
+			OSProfile: &armcompute.OSProfile{
+				ComputerName:  to.Ptr(name),
+				AdminUsername: to.Ptr(user),
+				LinuxConfiguration: &armcompute.LinuxConfiguration{
+					DisablePasswordAuthentication: to.Ptr(true),
+					SSH: &armcompute.SSHConfiguration{
+						PublicKeys: []*armcompute.SSHPublicKey{{
+							Path:    to.Ptr(fmt.Sprintf("/home/%v/.ssh/authorized_keys", user)),
+							KeyData: to.Ptr(string(pubKey)),
+						}},
+					},
+				},
+			},
+			NetworkProfile: &armcompute.NetworkProfile{
+				NetworkInterfaces: []*armcompute.NetworkInterfaceReference{{
+					ID: nic.ID,
+					Properties: &armcompute.NetworkInterfaceReferenceProperties{
+						Primary:      to.Ptr(true),
+						DeleteOption: to.Ptr(armcompute.DeleteOptionsDelete),
+					},
+				}},
+			},
+			// Managed boot diagnostics storage, gives us access to the serial console log.
+			DiagnosticsProfile: &armcompute.DiagnosticsProfile{
+				BootDiagnostics: &armcompute.BootDiagnostics{Enabled: to.Ptr(true)},
+			},
+		},
+	}
+
+retry:
+	if lowPriority {
+		vm.Properties.Priority = to.Ptr(armcompute.VirtualMachinePriorityTypesSpot)
+		vm.Properties.EvictionPolicy = to.Ptr(armcompute.VirtualMachineEvictionPolicyTypesDelete)
+		vm.Properties.BillingProfile = &armcompute.BillingProfile{MaxPrice: to.Ptr(-1.0)}
+	} else {
+		vm.Properties.Priority = nil
+		vm.Properties.EvictionPolicy = nil
+		vm.Properties.BillingProfile = nil
+	}
+	<-ctx.apiRateGate
+	op, err := ctx.vms.BeginCreateOrUpdate(context.Background(), ctx.ResourceGroup, name, vm, nil)
+	if err == nil {
+		_, err = op.PollUntilDone(context.Background(), nil)
+	}
+	if err != nil {
+		if lowPriority && isCapacityError(err) {
+			// Fallback to a regular VM.
+			ctx.deleteVM(name, true)
+			lowPriority = false
+			goto retry
+		}
+		return "", fmt.Errorf("failed to create instance: %v", err)
+	}
+	return ip, nil
+}
+
+// DeleteInstance deletes the VM together with its disk and network interface.
+// If wait is not set, it only starts the deletion.
+func (ctx *Context) DeleteInstance(name string, wait bool) error {
+	found, err := ctx.deleteVM(name, wait)
+	if err != nil {
+		return err
+	}
+	// The interface is deleted together with the VM, but it is left behind
+	// when VM creation fails, or when there is no VM at all.
+	if wait || !found {
+		<-ctx.apiRateGate
+		op, err := ctx.nics.BeginDelete(context.Background(), ctx.ResourceGroup, nicName(name), nil)
+		if err == nil && wait {
+			_, err = op.PollUntilDone(context.Background(), nil)
+		}
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete network interface: %v", err)
+		}
+	}
+	return nil
+}
+
+func (ctx *Context) deleteVM(name string, wait bool) (bool, error) {
+	<-ctx.apiRateGate
+	op, err := ctx.vms.BeginDelete(context.Background(), ctx.ResourceGroup, name, nil)
+	if err == nil && wait {
+		_, err = op.PollUntilDone(context.Background(), nil)
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to delete instance: %v", err)
+	}
+	return true, nil
+}
+
+func (ctx *Context) IsInstanceRunning(name string) bool {
+	<-ctx.apiRateGate
+	view, err := ctx.vms.InstanceView(context.Background(), ctx.ResourceGroup, name, nil)
+	if err != nil {
+		return false
+	}
+	for _, status := range view.Statuses {
+		if status.Code != nil && strings.HasPrefix(*status.Code, "PowerState/") {
+			return *status.Code == "PowerState/running"
+		}
+	}
+	return false
+}
+
+// BootLog returns serial console output of the VM captured by boot diagnostics.
+// Note: the log is periodically flushed by Azure, so it lags behind the actual output.
+func (ctx *Context) BootLog(name string) ([]byte, error) {
+	<-ctx.apiRateGate
+	res, err := ctx.vms.RetrieveBootDiagnosticsData(context.Background(), ctx.ResourceGroup, name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve boot diagnostics: %v", err)
+	}
+	if res.SerialConsoleLogBlobURI == nil {
+		return nil, fmt.Errorf("boot diagnostics has no serial console log")
+	}
+	// The URI is a short-lived SAS URI of the log blob, it does not need credentials.
+	resp, err := http.Get(*res.SerialConsoleLogBlobURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch serial console log: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch serial console log: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch serial console log: %v", resp.Status)
+	}
+	return body, nil
+}
+
+func nicName(name string) string {
+	return name + "-nic"
+}
+
+func isNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+func isCapacityError(err error) bool {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	for _, code := range []string{"SkuNotAvailable", "AllocationFailed", "OverconstrainedAllocationRequest",
+		"ZonalAllocationFailed", "SpotVMPriceTooLow"} {
+		if respErr.ErrorCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+func getMeta(v interface{}) error {
+	req, err := http.NewRequest("GET", "http://169.254.169.254/metadata/instance?api-version=2021-02-01", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Metadata", "true")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata request failed: %v", resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -4,6 +4,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/google/syzkaller/fileutil"
+	. "github.com/google/syzkaller/rpctype"
 	"github.com/google/syzkaller/sys"
 	"github.com/google/syzkaller/vm"
 )
@@ -36,22 +38,34 @@ type Config struct {
 	Debug    bool   // dump all VM output to console
 	Output   string // one of stdout/dmesg/file (useful only for local VM)
 
-	Hub_Addr string
-	Hub_Key  string
+	Hub_Addr      string
+	Hub_Key       string
+	Hub_Transport string // "rpc" (default) or "grpc" (hub_addr must point to the hub grpc address)
+	Hub_Timeout   int    // timeout of hub calls in seconds over grpc (default: 600)
+	Hub_Tls       bool   // connect to hub over TLS (implied by the other hub_tls params)
+	Hub_Tls_Ca    string // CA that signs the hub certificate (default: system roots)
+	Hub_Tls_Cert  string // client certificate for hubs that require mutual TLS
+	Hub_Tls_Key   string // private key for hub_tls_cert
 
 	Syzkaller string   // path to syzkaller checkout (syz-manager will look for binaries in bin subdir)
 	Type      string   // VM type (qemu, kvm, local)
-	Count     int      // number of VMs (don't secify for adb, instead specify devices)
-	Devices   []string // device IDs for adb
+	Arch      string   // target arch: amd64, arm64 or ppc64le (default: host arch), see vm.BinDir and README
+	Count     int      // number of VMs (don't secify for adb and physical, instead specify devices)
+	Devices   []string // device IDs for adb, machine names for physical
 	Procs     int      // number of parallel processes inside of every VM
 
+	Boot_Parallelism int // max number of VMs booted at the same time (default: all)
+
 	Sandbox string // type of sandbox to use during fuzzing:
 	// "none": don't do anything special (has false positives, e.g. due to killing init)
 	// "setuid": impersonate into user nobody (65534), default
 	// "namespace": create a new namespace for fuzzer using CLONE_NEWNS/CLONE_NEWNET/CLONE_NEWPID/etc,
 	//	requires building kernel with CONFIG_NAMESPACES, CONFIG_UTS_NS, CONFIG_USER_NS, CONFIG_PID_NS and CONFIG_NET_NS.
 
-	Machine_Type string // GCE machine type (e.g. "n1-highcpu-2")
+	Vm      json.RawMessage // backend-specific parameters, see Params type in vm/<type> package
+	Console json.RawMessage // console transport that overrides the backend default (optional), see vm.ConsoleConfig
+	Network json.RawMessage // private network for VMs (optional; qemu, libvirt, firecracker and chv), see vm.NetworkConfig
+	Hooks   json.RawMessage // scripts run at VM lifecycle points (optional), see vm.HooksConfig
 
 	Cover bool // use kcov coverage (default: true)
 	Leak  bool // do memory leak checking
@@ -86,11 +100,17 @@ func parse(data []byte) (*Config, map[int]bool, []*regexp.Regexp, error) {
 	if err := json.Unmarshal(data, cfg); err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
-	if _, err := os.Stat(filepath.Join(cfg.Syzkaller, "bin/syz-fuzzer")); err != nil {
-		return nil, nil, nil, fmt.Errorf("bad config syzkaller param: can't find bin/syz-fuzzer")
+	if cfg.Arch == "" {
+		cfg.Arch = vm.HostArch
+	}
+	if vm.Archs[cfg.Arch] == nil {
+		return nil, nil, nil, fmt.Errorf("bad config arch param: unknown arch %v", cfg.Arch)
 	}
-	if _, err := os.Stat(filepath.Join(cfg.Syzkaller, "bin/syz-executor")); err != nil {
-		return nil, nil, nil, fmt.Errorf("bad config syzkaller param: can't find bin/syz-executor")
+	for _, bin := range []string{"syz-fuzzer", "syz-executor"} {
+		if _, err := os.Stat(filepath.Join(vm.BinDir(cfg.Syzkaller, cfg.Arch), bin)); err != nil {
+			rel, _ := filepath.Rel(cfg.Syzkaller, vm.BinDir(cfg.Syzkaller, cfg.Arch))
+			return nil, nil, nil, fmt.Errorf("bad config syzkaller param: can't find %v/%v", rel, bin)
+		}
 	}
 	if cfg.Http == "" {
 		return nil, nil, nil, fmt.Errorf("config param http is empty")
@@ -115,19 +135,14 @@ func parse(data []byte) (*Config, map[int]bool, []*regexp.Regexp, error) {
 		if len(cfg.Devices) != 0 {
 			return nil, nil, nil, fmt.Errorf("type %v does not support devices param", cfg.Type)
 		}
-	case "adb":
+	case "adb", "physical":
 		if cfg.Count != 0 {
-			return nil, nil, nil, fmt.Errorf("don't specify count for adb, instead specify devices")
+			return nil, nil, nil, fmt.Errorf("don't specify count for %v, instead specify devices", cfg.Type)
 		}
 		if len(cfg.Devices) == 0 {
-			return nil, nil, nil, fmt.Errorf("specify at least 1 adb device")
+			return nil, nil, nil, fmt.Errorf("specify at least 1 %v device", cfg.Type)
 		}
 		cfg.Count = len(cfg.Devices)
-	case "gce":
-		if cfg.Machine_Type == "" {
-			return nil, nil, nil, fmt.Errorf("machine_type parameter is empty (required for gce)")
-		}
-		fallthrough
 	default:
 		if cfg.Count <= 0 || cfg.Count > 1000 {
 			return nil, nil, nil, fmt.Errorf("invalid config param count: %v, want (1, 1000]", cfg.Count)
@@ -136,6 +151,44 @@ func parse(data []byte) (*Config, map[int]bool, []*regexp.Regexp, error) {
 			return nil, nil, nil, fmt.Errorf("type %v does not support devices param", cfg.Type)
 		}
 	}
+	switch cfg.Hub_Transport {
+	case "":
+		cfg.Hub_Transport = "rpc"
+	case "rpc", "grpc":
+	default:
+		return nil, nil, nil, fmt.Errorf("config param hub_transport must be rpc or grpc, got %q", cfg.Hub_Transport)
+	}
+	if cfg.Hub_Timeout < 0 {
+		return nil, nil, nil, fmt.Errorf("invalid config param hub_timeout: %v", cfg.Hub_Timeout)
+	}
+	if cfg.Hub_Timeout == 0 {
+		cfg.Hub_Timeout = 600
+	}
+	if _, err := HubTLS(cfg); err != nil {
+		return nil, nil, nil, fmt.Errorf("bad config hub_tls params: %v", err)
+	}
+	if cfg.Boot_Parallelism < 0 {
+		return nil, nil, nil, fmt.Errorf("invalid config param boot_parallelism: %v, want >= 0", cfg.Boot_Parallelism)
+	}
+	if cfg.Type != "none" {
+		// Requires the backend package to be linked into the binary.
+		if _, err := vm.ParseParams(cfg.Type, cfg.Vm); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if _, err := vm.ParseConsole(cfg.Console); err != nil {
+		return nil, nil, nil, err
+	}
+	network, err := vm.ParseNetwork(cfg.Network)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if network != nil && cfg.Type != "none" && !vm.SupportsNetwork(cfg.Type) {
+		return nil, nil, nil, fmt.Errorf("config param network is not supported by type %v", cfg.Type)
+	}
+	if _, err := vm.ParseHooks(cfg.Hooks); err != nil {
+		return nil, nil, nil, err
+	}
 	if cfg.Rpc == "" {
 		cfg.Rpc = "localhost:0"
 	}
@@ -177,6 +230,15 @@ func parse(data []byte) (*Config, map[int]bool, []*regexp.Regexp, error) {
 }
 
 func parseSyscalls(cfg *Config) (map[int]bool, error) {
+	if cfg.Arch != vm.HostArch {
+		// The manager uses syscall descriptions of the host arch, and call IDs of the host arch
+		// mean different calls for the fuzzer, so it enables all calls of the target arch.
+		if len(cfg.Enable_Syscalls) != 0 || len(cfg.Disable_Syscalls) != 0 {
+			return nil, fmt.Errorf("config params enable_syscalls and disable_syscalls are not supported for arch %v",
+				cfg.Arch)
+		}
+		return nil, nil
+	}
 	match := func(call *sys.Call, str string) bool {
 		if str == call.CallName || str == call.Name {
 			return true
@@ -253,26 +315,46 @@ func CreateVMConfig(cfg *Config, index int) (*vm.Config, error) {
 	if index < 0 || index >= cfg.Count {
 		return nil, fmt.Errorf("invalid VM index %v (count %v)", index, cfg.Count)
 	}
+	params, err := vm.ParseParams(cfg.Type, cfg.Vm)
+	if err != nil {
+		return nil, err
+	}
+	console, err := vm.ParseConsole(cfg.Console)
+	if err != nil {
+		return nil, err
+	}
+	network, err := vm.ParseNetwork(cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := vm.ParseHooks(cfg.Hooks)
+	if err != nil {
+		return nil, err
+	}
 	workdir, err := fileutil.ProcessTempDir(cfg.Workdir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create instance temp dir: %v", err)
 	}
 	vmCfg := &vm.Config{
-		Name:        fmt.Sprintf("%v-%v-%v", cfg.Type, cfg.Name, index),
-		Index:       index,
-		Workdir:     workdir,
-		Bin:         cfg.Bin,
-		BinArgs:     cfg.Bin_Args,
-		Kernel:      cfg.Kernel,
-		Cmdline:     cfg.Cmdline,
-		Image:       cfg.Image,
-		Initrd:      cfg.Initrd,
-		Sshkey:      cfg.Sshkey,
-		Executor:    filepath.Join(cfg.Syzkaller, "bin", "syz-executor"),
-		Cpu:         cfg.Cpu,
-		Mem:         cfg.Mem,
-		Debug:       cfg.Debug,
-		MachineType: cfg.Machine_Type,
+		Name:     fmt.Sprintf("%v-%v-%v", cfg.Type, cfg.Name, index),
+		Index:    index,
+		Arch:     cfg.Arch,
+		Workdir:  workdir,
+		Bin:      cfg.Bin,
+		BinArgs:  cfg.Bin_Args,
+		Kernel:   cfg.Kernel,
+		Cmdline:  cfg.Cmdline,
+		Image:    cfg.Image,
+		Initrd:   cfg.Initrd,
+		Sshkey:   cfg.Sshkey,
+		Executor: filepath.Join(vm.BinDir(cfg.Syzkaller, cfg.Arch), "syz-executor"),
+		Cpu:      cfg.Cpu,
+		Mem:      cfg.Mem,
+		Debug:    cfg.Debug,
+		Params:   params,
+		Console:  console,
+		Network:  network,
+		Hooks:    hooks,
 	}
 	if len(cfg.Devices) != 0 {
 		vmCfg.Device = cfg.Devices[index]
@@ -280,6 +362,14 @@ func CreateVMConfig(cfg *Config, index int) (*vm.Config, error) {
 	return vmCfg, nil
 }
 
+// HubTLS returns TLS config for connections to hub, or nil if hub does not use TLS.
+func HubTLS(cfg *Config) (*tls.Config, error) {
+	if !cfg.Hub_Tls && cfg.Hub_Tls_Ca == "" && cfg.Hub_Tls_Cert == "" && cfg.Hub_Tls_Key == "" {
+		return nil, nil
+	}
+	return ClientTLS(cfg.Hub_Tls_Cert, cfg.Hub_Tls_Key, cfg.Hub_Tls_Ca, "")
+}
+
 func checkUnknownFields(data []byte) (string, error) {
 	// While https://github.com/golang/go/issues/15314 is not resolved
 	// we don't have a better way than to enumerate all known fields.
@@ -302,11 +392,19 @@ func checkUnknownFields(data []byte) (string, error) {
 		"Output",
 		"Hub_Addr",
 		"Hub_Key",
+		"Hub_Transport",
+		"Hub_Timeout",
+		"Hub_Tls",
+		"Hub_Tls_Ca",
+		"Hub_Tls_Cert",
+		"Hub_Tls_Key",
 		"Syzkaller",
 		"Type",
+		"Arch",
 		"Count",
 		"Devices",
 		"Procs",
+		"Boot_Parallelism",
 		"Cover",
 		"Sandbox",
 		"Leak",
@@ -314,7 +412,10 @@ func checkUnknownFields(data []byte) (string, error) {
 		"Disable_Syscalls",
 		"Suppressions",
 		"Initrd",
-		"Machine_Type",
+		"Vm",
+		"Console",
+		"Network",
+		"Hooks",
 	}
 	f := make(map[string]interface{})
 	if err := json.Unmarshal(data, &f); err != nil {
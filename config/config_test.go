@@ -4,7 +4,13 @@
 package config
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/google/syzkaller/vm"
 )
 
 func TestUnknown(t *testing.T) {
@@ -14,3 +20,58 @@ func TestUnknown(t *testing.T) {
 		t.Fatalf("unknown field is not detected (%v)", err)
 	}
 }
+
+func TestNetworkUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binDir := vm.BinDir(dir, vm.HostArch)
+	os.MkdirAll(binDir, 0700)
+	for _, bin := range []string{"syz-fuzzer", "syz-executor"} {
+		if err := ioutil.WriteFile(filepath.Join(binDir, bin), nil, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm.Register("test-nonet", nil, nil)
+	data := fmt.Sprintf(`{"http": "localhost:0", "workdir": "/w", "vmlinux": "/v", "syzkaller": %q,
+		"type": "test-nonet", "count": 1, "network": {}}`, dir)
+	_, _, _, err = parse([]byte(data))
+	if want := "config param network is not supported by type test-nonet"; err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %v", err, want)
+	}
+}
+
+func TestCrossArchSyscalls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	arch := "arm64"
+	if vm.HostArch == arch {
+		arch = "amd64"
+	}
+	binDir := vm.BinDir(dir, arch)
+	os.MkdirAll(binDir, 0700)
+	for _, bin := range []string{"syz-fuzzer", "syz-executor"} {
+		if err := ioutil.WriteFile(filepath.Join(binDir, bin), nil, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm.Register("test-cross", nil, nil)
+	data := fmt.Sprintf(`{"http": "localhost:0", "workdir": "/w", "vmlinux": "/v", "syzkaller": %q,
+		"type": "test-cross", "count": 1, "arch": %q`, dir, arch)
+	_, syscalls, _, err := parse([]byte(data + "}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(syscalls) != 0 {
+		t.Fatalf("got %v enabled syscalls for arch %v, want none", len(syscalls), arch)
+	}
+	_, _, _, err = parse([]byte(data + `, "enable_syscalls": ["open"]}`))
+	if err == nil {
+		t.Fatalf("enable_syscalls is accepted for arch %v", arch)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package ec2 provides wrappers around Amazon Elastic Compute Cloud (EC2) APIs.
+// It is assumed that the program itself also runs on EC2 as APIs operate on the current region
+// and, unless specified otherwise, instances are created in the current subnet/security groups.
+// The wrappers use the aws command line tool, which must be installed and have credentials
+// (e.g. via an instance profile).
+//
+// See https://docs.aws.amazon.com/cli/latest/reference/ec2/index.html for details.
+// Working with serial console:
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/ec2-serial-console.html
+package ec2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type Context struct {
+	Region         string
+	Instance       string
+	InternalIP     string
+	Subnet         string
+	SecurityGroups []string
+
+	// apiRateGate prevents us from hitting EC2 API request rate limits.
+	apiRateGate <-chan time.Time
+	token       string
+}
+
+func NewContext() (*Context, error) {
+	ctx := &Context{
+		apiRateGate: time.NewTicker(time.Second / 5).C,
+	}
+	var err error
+	if ctx.token, err = ctx.getToken(); err != nil {
+		return nil, fmt.Errorf("failed to get ec2 metadata token: %v", err)
+	}
+	if ctx.Region, err = ctx.getMeta("placement/region"); err != nil {
+		return nil, fmt.Errorf("failed to query ec2 region: %v", err)
+	}
+	if ctx.Instance, err = ctx.getMeta("instance-id"); err != nil {
+		return nil, fmt.Errorf("failed to query ec2 instance id: %v", err)
+	}
+	if ctx.InternalIP, err = ctx.getMeta("local-ipv4"); err != nil {
+		return nil, fmt.Errorf("failed to query ec2 internal IP: %v", err)
+	}
+	mac, err := ctx.getMeta("mac")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ec2 mac: %v", err)
+	}
+	if ctx.Subnet, err = ctx.getMeta("network/interfaces/macs/" + mac + "/subnet-id"); err != nil {
+		return nil, fmt.Errorf("failed to query ec2 subnet: %v", err)
+	}
+	groups, err := ctx.getMeta("network/interfaces/macs/" + mac + "/security-group-ids")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ec2 security groups: %v", err)
+	}
+	ctx.SecurityGroups = strings.Fields(groups)
+	return ctx, nil
+}
+
+// CreateInstance creates an instance tagged with name, waits for it to start running
+// and returns its ID and internal IP.
+func (ctx *Context) CreateInstance(name, instanceType, image, keyName, subnet string,
+	securityGroups []string, spot bool) (string, string, error) {
+	if subnet == "" {
+		subnet = ctx.Subnet
+	}
+	if len(securityGroups) == 0 {
+		securityGroups = ctx.SecurityGroups
+	}
+	args := []string{
+		"ec2", "run-instances",
+		"--image-id", image,
+		"--instance-type", instanceType,
+		"--key-name", keyName,
+		"--subnet-id", subnet,
+		"--security-group-ids",
+	}
+	args = append(args, securityGroups...)
+	args = append(args,
+		"--count", "1",
+		"--instance-initiated-shutdown-behavior", "terminate",
+		"--tag-specifications", fmt.Sprintf("ResourceType=instance,Tags=[{Key=Name,Value=%v},{Key=syzkaller,Value=1}]", name),
+	)
+	spotArgs := []string{
+		"--instance-market-options",
+		"MarketType=spot,SpotOptions={SpotInstanceType=one-time,InstanceInterruptionBehavior=terminate}",
+	}
+
+retry:
+	runArgs := args
+	if spot {
+		runArgs = append(runArgs, spotArgs...)
+	}
+	out, err := ctx.aws(runArgs...)
+	if err != nil {
+		if spot && isCapacityError(err) {
+			// Fallback to an on-demand instance.
+			spot = false
+			goto retry
+		}
+		return "", "", fmt.Errorf("failed to create instance: %v", err)
+	}
+	reservation := new(struct {
+		Instances []struct {
+			InstanceId string
+		}
+	})
+	if err := json.Unmarshal(out, reservation); err != nil || len(reservation.Instances) != 1 {
+		return "", "", fmt.Errorf("failed to parse run-instances output: %v\n%s", err, out)
+	}
+	id := reservation.Instances[0].InstanceId
+	if _, err := ctx.aws("ec2", "wait", "instance-running", "--instance-ids", id); err != nil {
+		ctx.DeleteInstance(id, false)
+		return "", "", fmt.Errorf("instance %v failed to start: %v", id, err)
+	}
+	inst, err := ctx.describeInstance(id)
+	if err != nil {
+		ctx.DeleteInstance(id, false)
+		return "", "", err
+	}
+	if inst.PrivateIpAddress == "" {
+		ctx.DeleteInstance(id, false)
+		return "", "", fmt.Errorf("didn't find instance internal IP address")
+	}
+	return id, inst.PrivateIpAddress, nil
+}
+
+func (ctx *Context) DeleteInstance(id string, wait bool) error {
+	if _, err := ctx.aws("ec2", "terminate-instances", "--instance-ids", id); err != nil {
+		if strings.Contains(err.Error(), "InvalidInstanceID.NotFound") {
+			return nil
+		}
+		return fmt.Errorf("failed to delete instance: %v", err)
+	}
+	if wait {
+		if _, err := ctx.aws("ec2", "wait", "instance-terminated", "--instance-ids", id); err != nil {
+			return fmt.Errorf("failed to wait for instance termination: %v", err)
+		}
+	}
+	return nil
+}
+
+// DeleteInstancesByName deletes all live instances tagged with name
+// (e.g. left over from a previous run of the program).
+func (ctx *Context) DeleteInstancesByName(name string) error {
+	out, err := ctx.aws("ec2", "describe-instances",
+		"--filters", "Name=tag:Name,Values="+name,
+		"Name=instance-state-name,Values=pending,running,stopping,stopped",
+		"--query", "Reservations[].Instances[].InstanceId")
+	if err != nil {
+		return fmt.Errorf("failed to list instances: %v", err)
+	}
+	var ids []string
+	if err := json.Unmarshal(out, &ids); err != nil {
+		return fmt.Errorf("failed to parse describe-instances output: %v\n%s", err, out)
+	}
+	for _, id := range ids {
+		if err := ctx.DeleteInstance(id, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ctx *Context) IsInstanceRunning(id string) bool {
+	inst, err := ctx.describeInstance(id)
+	if err != nil {
+		return false
+	}
+	return inst.State.Name == "running"
+}
+
+// ImportKeyPair registers public key from publicKeyFile under name.
+func (ctx *Context) ImportKeyPair(name, publicKeyFile string) error {
+	ctx.aws("ec2", "delete-key-pair", "--key-name", name)
+	if _, err := ctx.aws("ec2", "import-key-pair", "--key-name", name,
+		"--public-key-material", "fileb://"+publicKeyFile); err != nil {
+		return fmt.Errorf("failed to import key pair: %v", err)
+	}
+	return nil
+}
+
+func (ctx *Context) DeleteKeyPair(name string) error {
+	if _, err := ctx.aws("ec2", "delete-key-pair", "--key-name", name); err != nil {
+		return fmt.Errorf("failed to delete key pair: %v", err)
+	}
+	return nil
+}
+
+// PushSerialConsoleKey authorizes public key from publicKeyFile for the instance serial console.
+// The key is valid for 60 seconds, so it needs to be pushed right before connecting.
+func (ctx *Context) PushSerialConsoleKey(id, publicKeyFile string) error {
+	if _, err := ctx.aws("ec2-instance-connect", "send-serial-console-ssh-public-key",
+		"--instance-id", id, "--serial-port", "0", "--ssh-public-key", "file://"+publicKeyFile); err != nil {
+		return fmt.Errorf("failed to push serial console key: %v", err)
+	}
+	return nil
+}
+
+// SerialConsoleAddr returns ssh user@host of the instance serial console.
+func (ctx *Context) SerialConsoleAddr(id string) string {
+	return fmt.Sprintf("%v.port0@serial-console.ec2-instance-connect.%v.aws", id, ctx.Region)
+}
+
+type instance struct {
+	InstanceId       string
+	PrivateIpAddress string
+	State            struct {
+		Name string
+	}
+}
+
+func (ctx *Context) describeInstance(id string) (*instance, error) {
+	out, err := ctx.aws("ec2", "describe-instances", "--instance-ids", id,
+		"--query", "Reservations[0].Instances[0]")
+	if err != nil {
+		return nil, fmt.Errorf("error getting instance %v details: %v", id, err)
+	}
+	inst := new(instance)
+	if err := json.Unmarshal(out, inst); err != nil {
+		return nil, fmt.Errorf("failed to parse describe-instances output: %v\n%s", err, out)
+	}
+	return inst, nil
+}
+
+func (ctx *Context) aws(args ...string) ([]byte, error) {
+	<-ctx.apiRateGate
+	args = append(args, "--region", ctx.Region, "--output", "json")
+	out, err := exec.Command("aws", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("aws %v failed: %v\n%s", strings.Join(args[:2], " "), err, out)
+	}
+	return out, nil
+}
+
+func isCapacityError(err error) bool {
+	for _, code := range []string{"InsufficientInstanceCapacity", "SpotMaxPriceTooLow",
+		"MaxSpotInstanceCountExceeded", "InsufficientCapacity"} {
+		if strings.Contains(err.Error(), code) {
+			return true
+		}
+	}
+	return false
+}
+
+const metaURL = "http://169.254.169.254/latest/"
+
+func (ctx *Context) getToken() (string, error) {
+	req, err := http.NewRequest("PUT", metaURL+"api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	return doMetaRequest(req)
+}
+
+func (ctx *Context) getMeta(path string) (string, error) {
+	req, err := http.NewRequest("GET", metaURL+"meta-data/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("X-aws-ec2-metadata-token", ctx.token)
+	return doMetaRequest(req)
+}
+
+func doMetaRequest(req *http.Request) (string, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata request %v failed: %v", req.URL.Path, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -8,21 +8,20 @@
 // In particular, API reference:
 // https://cloud.google.com/compute/docs/reference/latest
 // and Go API wrappers:
-// https://godoc.org/google.golang.org/api/compute/v0.beta
+// https://godoc.org/google.golang.org/api/compute/v1
 package gce
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
 
-	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/compute/v0.beta"
+	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
 )
 
 type Context struct {
@@ -43,13 +42,11 @@ func NewContext() (*Context, error) {
 	ctx := &Context{
 		apiRateGate: time.NewTicker(time.Second / 10).C,
 	}
-	background := context.Background()
-	tokenSource, err := google.DefaultTokenSource(background, compute.CloudPlatformScope)
+	var err error
+	ctx.computeService, err = compute.NewService(context.Background(), option.WithScopes(compute.CloudPlatformScope))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get a token source: %v", err)
+		return nil, fmt.Errorf("failed to create compute service: %v", err)
 	}
-	httpClient := oauth2.NewClient(background, tokenSource)
-	ctx.computeService, _ = compute.New(httpClient)
 	// Obtain project name, zone and current instance IP address.
 	ctx.ProjectID, err = ctx.getMeta("project/project-id")
 	if err != nil {
@@ -90,7 +87,10 @@ func NewContext() (*Context, error) {
 	return ctx, nil
 }
 
-func (ctx *Context) CreateInstance(name, machineType, image, sshkey string) (string, error) {
+// CreateInstance creates and starts a new instance and returns its internal IP.
+// If preemptible is set, a preemptible instance is created if there is capacity for it,
+// otherwise a regular one.
+func (ctx *Context) CreateInstance(name, machineType, image, sshkey string, preemptible bool) (string, error) {
 	prefix := "https://www.googleapis.com/compute/v1/projects/" + ctx.ProjectID
 	instance := &compute.Instance{
 		Name:        name,
@@ -111,22 +111,22 @@ func (ctx *Context) CreateInstance(name, machineType, image, sshkey string) (str
 			Items: []*compute.MetadataItems{
 				{
 					Key:   "ssh-keys",
-					Value: "syzkaller:" + sshkey,
+					Value: googleapi.String("syzkaller:" + sshkey),
 				},
 				{
 					Key:   "serial-port-enable",
-					Value: "1",
+					Value: googleapi.String("1"),
 				},
 			},
 		},
 		NetworkInterfaces: []*compute.NetworkInterface{
-			&compute.NetworkInterface{
+			{
 				Network: "global/networks/default",
 			},
 		},
 		Scheduling: &compute.Scheduling{
-			AutomaticRestart:  false,
-			Preemptible:       true,
+			AutomaticRestart:  googleapi.Bool(false),
+			Preemptible:       preemptible,
 			OnHostMaintenance: "TERMINATE",
 		},
 	}
@@ -137,7 +137,7 @@ retry:
 	if err != nil {
 		return "", fmt.Errorf("failed to create instance: %v", err)
 	}
-	if err := ctx.waitForCompletion("zone", "create image", op.Name, false); err != nil {
+	if err := ctx.waitForCompletion("zone", "create instance", op.Name, false); err != nil {
 		if _, ok := err.(resourcePoolExhaustedError); ok && instance.Scheduling.Preemptible {
 			instance.Scheduling.Preemptible = false
 			goto retry
@@ -175,7 +175,7 @@ func (ctx *Context) DeleteInstance(name string, wait bool) error {
 		return fmt.Errorf("failed to delete instance: %v", err)
 	}
 	if wait {
-		if err := ctx.waitForCompletion("zone", "delete image", op.Name, true); err != nil {
+		if err := ctx.waitForCompletion("zone", "delete instance", op.Name, true); err != nil {
 			return err
 		}
 	}
@@ -191,6 +191,33 @@ func (ctx *Context) IsInstanceRunning(name string) bool {
 	return instance.Status == "RUNNING"
 }
 
+// IsInstancePreempted checks whether the instance was preempted.
+// Preempted instances are stopped, so this is useful to tell preemption from other failures
+// of instances that are not running.
+func (ctx *Context) IsInstancePreempted(name string) (bool, error) {
+	<-ctx.apiRateGate
+	instance, err := ctx.computeService.Instances.Get(ctx.ProjectID, ctx.ZoneID, name).Do()
+	if err != nil {
+		return false, fmt.Errorf("failed to get instance %v: %v", name, err)
+	}
+	if instance.Scheduling == nil || !instance.Scheduling.Preemptible {
+		return false, nil
+	}
+	<-ctx.apiRateGate
+	ops, err := ctx.computeService.ZoneOperations.List(ctx.ProjectID, ctx.ZoneID).
+		Filter(`operationType = "compute.instances.preempted"`).Do()
+	if err != nil {
+		return false, fmt.Errorf("failed to list operations: %v", err)
+	}
+	for _, op := range ops.Items {
+		// Instance names are reused, so match the instance ID.
+		if op.TargetId == instance.Id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (ctx *Context) CreateImage(imageName, gcsFile string) error {
 	image := &compute.Image{
 		Name: imageName,
@@ -0,0 +1,263 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package hcloud provides wrappers around Hetzner Cloud APIs.
+// It is assumed that the program itself also runs on a Hetzner Cloud server
+// as servers are created in the current datacenter. API token is taken from
+// HCLOUD_TOKEN environment variable.
+//
+// See https://docs.hetzner.cloud for API reference.
+package hcloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type Context struct {
+	Datacenter string
+	Instance   string
+	PublicIP   string
+
+	token string
+	// apiRateGate prevents us from hitting API rate limits (3600 requests per hour).
+	apiRateGate <-chan time.Time
+}
+
+type Server struct {
+	ID        int
+	Name      string
+	Status    string
+	PublicNet struct {
+		IPv4 struct {
+			IP string
+		}
+	} `json:"public_net"`
+}
+
+type action struct {
+	ID     int
+	Status string
+	Error  *struct {
+		Code    string
+		Message string
+	}
+}
+
+func NewContext() (*Context, error) {
+	ctx := &Context{
+		token:       os.Getenv("HCLOUD_TOKEN"),
+		apiRateGate: time.NewTicker(time.Second).C,
+	}
+	if ctx.token == "" {
+		return nil, fmt.Errorf("HCLOUD_TOKEN is not set")
+	}
+	var err error
+	if ctx.Instance, err = getMeta("hostname"); err != nil {
+		return nil, fmt.Errorf("failed to query hcloud hostname: %v", err)
+	}
+	if ctx.Datacenter, err = getMeta("availability-zone"); err != nil {
+		return nil, fmt.Errorf("failed to query hcloud datacenter: %v", err)
+	}
+	if ctx.PublicIP, err = getMeta("public-ipv4"); err != nil {
+		return nil, fmt.Errorf("failed to query hcloud public IP: %v", err)
+	}
+	return ctx, nil
+}
+
+// CreateSSHKey registers the public key under name and returns its ID.
+func (ctx *Context) CreateSSHKey(name, publicKey string) (int, error) {
+	ctx.DeleteSSHKey(name)
+	req := map[string]interface{}{
+		"name":       name,
+		"public_key": publicKey,
+		"labels":     map[string]string{"syzkaller": "1"},
+	}
+	res := new(struct {
+		SSHKey struct {
+			ID int
+		} `json:"ssh_key"`
+	})
+	if err := ctx.call("POST", "/ssh_keys", req, res); err != nil {
+		return 0, fmt.Errorf("failed to create ssh key: %v", err)
+	}
+	return res.SSHKey.ID, nil
+}
+
+func (ctx *Context) DeleteSSHKey(name string) error {
+	res := new(struct {
+		SSHKeys []struct {
+			ID int
+		} `json:"ssh_keys"`
+	})
+	if err := ctx.call("GET", "/ssh_keys?name="+url.QueryEscape(name), nil, res); err != nil {
+		return fmt.Errorf("failed to query ssh keys: %v", err)
+	}
+	for _, key := range res.SSHKeys {
+		if err := ctx.call("DELETE", fmt.Sprintf("/ssh_keys/%v", key.ID), nil, nil); err != nil {
+			return fmt.Errorf("failed to delete ssh key: %v", err)
+		}
+	}
+	return nil
+}
+
+// CreateServer creates a server from an image or snapshot,
+// waits for it to start and returns the server.
+func (ctx *Context) CreateServer(name, serverType, image string, sshKey int) (*Server, error) {
+	req := map[string]interface{}{
+		"name":               name,
+		"server_type":        serverType,
+		"image":              image,
+		"datacenter":         ctx.Datacenter,
+		"ssh_keys":           []int{sshKey},
+		"start_after_create": true,
+		"labels":             map[string]string{"syzkaller": "1"},
+	}
+	res := new(struct {
+		Server Server
+		Action action
+	})
+	if err := ctx.call("POST", "/servers", req, res); err != nil {
+		return nil, fmt.Errorf("failed to create server: %v", err)
+	}
+	if err := ctx.waitForAction(res.Action.ID); err != nil {
+		ctx.DeleteServer(res.Server.ID)
+		return nil, fmt.Errorf("failed to create server: %v", err)
+	}
+	if res.Server.PublicNet.IPv4.IP == "" {
+		ctx.DeleteServer(res.Server.ID)
+		return nil, fmt.Errorf("didn't find server public IP address")
+	}
+	return &res.Server, nil
+}
+
+// DeleteServersByName deletes all servers with the name
+// (e.g. left over from a previous run of the program).
+func (ctx *Context) DeleteServersByName(name string) error {
+	res := new(struct {
+		Servers []Server
+	})
+	if err := ctx.call("GET", "/servers?name="+url.QueryEscape(name), nil, res); err != nil {
+		return fmt.Errorf("failed to query servers: %v", err)
+	}
+	for _, srv := range res.Servers {
+		if err := ctx.DeleteServer(srv.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ctx *Context) DeleteServer(id int) error {
+	if err := ctx.call("DELETE", fmt.Sprintf("/servers/%v", id), nil, nil); err != nil {
+		if strings.Contains(err.Error(), "not_found") {
+			return nil
+		}
+		return fmt.Errorf("failed to delete server: %v", err)
+	}
+	return nil
+}
+
+func (ctx *Context) IsServerRunning(id int) bool {
+	res := new(struct {
+		Server Server
+	})
+	if err := ctx.call("GET", fmt.Sprintf("/servers/%v", id), nil, res); err != nil {
+		return false
+	}
+	return res.Server.Status == "running"
+}
+
+func (ctx *Context) waitForAction(id int) error {
+	for {
+		time.Sleep(2 * time.Second)
+		res := new(struct {
+			Action action
+		})
+		if err := ctx.call("GET", fmt.Sprintf("/actions/%v", id), nil, res); err != nil {
+			return err
+		}
+		switch res.Action.Status {
+		case "running":
+			continue
+		case "success":
+			return nil
+		case "error":
+			if res.Action.Error != nil {
+				return fmt.Errorf("action failed: %v: %v", res.Action.Error.Code, res.Action.Error.Message)
+			}
+			return fmt.Errorf("action failed")
+		default:
+			return fmt.Errorf("unknown action status %q", res.Action.Status)
+		}
+	}
+}
+
+const apiURL = "https://api.hetzner.cloud/v1"
+
+func (ctx *Context) call(method, path string, req, res interface{}) error {
+	<-ctx.apiRateGate
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	httpReq, err := http.NewRequest(method, apiURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Add("Authorization", "Bearer "+ctx.token)
+	httpReq.Header.Add("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		apiErr := new(struct {
+			Error struct {
+				Code    string
+				Message string
+			}
+		})
+		if json.Unmarshal(data, apiErr) == nil && apiErr.Error.Code != "" {
+			return fmt.Errorf("%v %v: %v: %v", method, path, apiErr.Error.Code, apiErr.Error.Message)
+		}
+		return fmt.Errorf("%v %v: %v", method, path, resp.Status)
+	}
+	if res != nil {
+		if err := json.Unmarshal(data, res); err != nil {
+			return fmt.Errorf("failed to parse %v %v response: %v", method, path, err)
+		}
+	}
+	return nil
+}
+
+func getMeta(path string) (string, error) {
+	resp, err := http.Get("http://169.254.169.254/hetzner/v1/metadata/" + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata request %v failed: %v", path, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
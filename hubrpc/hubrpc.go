@@ -0,0 +1,464 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package hubrpc implements transports for syz-manager to syz-hub communication:
+// Go net/rpc and gRPC. The gRPC service is defined in this package (there is no .proto file):
+// messages are rpctype.Hub* types encoded with gob.
+// Connect and Sync are streaming methods, so that large corpora are sent in chunks
+// that fit into gRPC message size limits; other methods are unary.
+// Every chunk carries the manager name and key, the server checks them on the first chunk
+// and rejects the stream before receiving the rest. Every call has a deadline.
+package hubrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/rpc"
+	"time"
+
+	"github.com/google/syzkaller/rpctype"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// Client is a connection to hub.
+type Client interface {
+	Connect(a *rpctype.HubConnectArgs) error
+	Sync(a *rpctype.HubSyncArgs) (*rpctype.HubSyncRes, error)
+	AddRepros(a *rpctype.HubAddReprosArgs) error
+	GetRepros(a *rpctype.HubGetReprosArgs) (*rpctype.HubGetReprosRes, error)
+	AddCrashes(a *rpctype.HubAddCrashesArgs) error
+	Close() error
+}
+
+// Server is implemented by hub.
+type Server interface {
+	// Authenticate checks manager credentials before the rest of a Connect or Sync stream is received.
+	Authenticate(name, key string) error
+	Connect(a *rpctype.HubConnectArgs, r *int) error
+	Sync(a *rpctype.HubSyncArgs, r *rpctype.HubSyncRes) error
+	AddRepros(a *rpctype.HubAddReprosArgs, r *int) error
+	GetRepros(a *rpctype.HubGetReprosArgs, r *rpctype.HubGetReprosRes) error
+	AddCrashes(a *rpctype.HubAddCrashesArgs, r *int) error
+}
+
+// Dial connects to hub at addr with the given transport ("rpc" or "grpc"), over TLS if tlsCfg is not nil.
+// timeout is the deadline of every grpc call.
+func Dial(transport, addr string, tlsCfg *tls.Config, timeout time.Duration) (Client, error) {
+	switch transport {
+	case "", "rpc":
+		conn, err := rpctype.Dial(addr, tlsCfg)
+		if err != nil {
+			return nil, err
+		}
+		return rpcClient{conn}, nil
+	case "grpc":
+		return dialGrpc(addr, tlsCfg, timeout)
+	default:
+		return nil, fmt.Errorf("unknown hub transport %q", transport)
+	}
+}
+
+type rpcClient struct {
+	*rpc.Client
+}
+
+func (c rpcClient) Connect(a *rpctype.HubConnectArgs) error {
+	return c.Call("Hub.Connect", a, nil)
+}
+
+func (c rpcClient) Sync(a *rpctype.HubSyncArgs) (*rpctype.HubSyncRes, error) {
+	r := new(rpctype.HubSyncRes)
+	if err := c.Call("Hub.Sync", a, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c rpcClient) AddRepros(a *rpctype.HubAddReprosArgs) error {
+	return c.Call("Hub.AddRepros", a, nil)
+}
+
+func (c rpcClient) GetRepros(a *rpctype.HubGetReprosArgs) (*rpctype.HubGetReprosRes, error) {
+	r := new(rpctype.HubGetReprosRes)
+	if err := c.Call("Hub.GetRepros", a, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c rpcClient) AddCrashes(a *rpctype.HubAddCrashesArgs) error {
+	return c.Call("Hub.AddCrashes", a, nil)
+}
+
+const (
+	serviceName = "syzkaller.Hub"
+	// Programs are sent in chunks of about this size (the default grpc message size limit is 4MB).
+	chunkSize = 1 << 20
+	// maxMsgSize limits size of a single message, it leaves room for programs larger than chunkSize.
+	maxMsgSize = 16 << 20
+	// keepalivePeriod is how often idle connections are pinged, it allows to detect broken
+	// connections through NATs and load balancers that drop idle connections.
+	keepalivePeriod = time.Minute
+)
+
+// maxStreamSize limits total size of programs received in a Connect or Sync stream.
+var maxStreamSize = 256 << 20
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*Server)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddRepros",
+			Handler:    addReprosHandler,
+		},
+		{
+			MethodName: "GetRepros",
+			Handler:    getReprosHandler,
+		},
+		{
+			MethodName: "AddCrashes",
+			Handler:    addCrashesHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       connectHandler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Sync",
+			Handler:       syncHandler,
+			ClientStreams: true,
+			ServerStreams: true,
+		},
+	},
+}
+
+// NewServer returns a grpc server that serves hub, over TLS if tlsCfg is not nil.
+func NewServer(hub Server, tlsCfg *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maxMsgSize),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             keepalivePeriod / 2,
+			PermitWithoutStream: true,
+		}),
+	}
+	if tlsCfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	s := grpc.NewServer(opts...)
+	s.RegisterService(&serviceDesc, hub)
+	return s
+}
+
+// Connect: client sends HubConnectArgs with the corpus split into chunks, server replies with int.
+func connectHandler(srv interface{}, stream grpc.ServerStream) error {
+	a := new(rpctype.HubConnectArgs)
+	if err := recvFirst(stream, a); err != nil {
+		return err
+	}
+	if err := authenticate(srv, a.Name, a.Key); err != nil {
+		return err
+	}
+	size := progsSize(a.Corpus)
+	for {
+		chunk := new(rpctype.HubConnectArgs)
+		if err := stream.RecvMsg(chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if size += progsSize(chunk.Corpus); size > maxStreamSize {
+			return errTooLarge
+		}
+		a.Corpus = append(a.Corpus, chunk.Corpus...)
+	}
+	if err := stream.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	if err := srv.(Server).Connect(a, nil); err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	return stream.SendMsg(new(int))
+}
+
+// Sync: client sends HubSyncArgs with added programs split into chunks,
+// server replies with HubSyncRes chunks.
+func syncHandler(srv interface{}, stream grpc.ServerStream) error {
+	a := new(rpctype.HubSyncArgs)
+	if err := recvFirst(stream, a); err != nil {
+		return err
+	}
+	if err := authenticate(srv, a.Name, a.Key); err != nil {
+		return err
+	}
+	size := progsSize(a.Add) + hashesSize(a.Del)
+	for {
+		chunk := new(rpctype.HubSyncArgs)
+		if err := stream.RecvMsg(chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if size += progsSize(chunk.Add) + hashesSize(chunk.Del); size > maxStreamSize {
+			return errTooLarge
+		}
+		a.Add = append(a.Add, chunk.Add...)
+		a.Del = append(a.Del, chunk.Del...)
+	}
+	if err := stream.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	r := new(rpctype.HubSyncRes)
+	if err := srv.(Server).Sync(a, r); err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	for _, inputs := range split(r.Inputs) {
+		if err := stream.SendMsg(&rpctype.HubSyncRes{Inputs: inputs}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errTooLarge = status.Error(codes.ResourceExhausted, "stream is too large")
+
+func recvFirst(stream grpc.ServerStream, a interface{}) error {
+	if err := stream.RecvMsg(a); err == io.EOF {
+		return status.Error(codes.InvalidArgument, "empty stream")
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// authenticate checks credentials from the first chunk of a stream, so that unauthorized
+// managers are rejected before the rest of the stream is received.
+func authenticate(srv interface{}, name, key string) error {
+	if err := srv.(Server).Authenticate(name, key); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+func progsSize(progs [][]byte) int {
+	size := 0
+	for _, p := range progs {
+		size += len(p)
+	}
+	return size
+}
+
+func hashesSize(hashes []string) int {
+	size := 0
+	for _, h := range hashes {
+		size += len(h)
+	}
+	return size
+}
+
+func addReprosHandler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	_ grpc.UnaryServerInterceptor) (interface{}, error) {
+	a := new(rpctype.HubAddReprosArgs)
+	if err := dec(a); err != nil {
+		return nil, err
+	}
+	if err := srv.(Server).AddRepros(a, nil); err != nil {
+		return nil, status.Error(codes.Unknown, err.Error())
+	}
+	return new(int), nil
+}
+
+func getReprosHandler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	_ grpc.UnaryServerInterceptor) (interface{}, error) {
+	a := new(rpctype.HubGetReprosArgs)
+	if err := dec(a); err != nil {
+		return nil, err
+	}
+	r := new(rpctype.HubGetReprosRes)
+	if err := srv.(Server).GetRepros(a, r); err != nil {
+		return nil, status.Error(codes.Unknown, err.Error())
+	}
+	return r, nil
+}
+
+func addCrashesHandler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	_ grpc.UnaryServerInterceptor) (interface{}, error) {
+	a := new(rpctype.HubAddCrashesArgs)
+	if err := dec(a); err != nil {
+		return nil, err
+	}
+	if err := srv.(Server).AddCrashes(a, nil); err != nil {
+		return nil, status.Error(codes.Unknown, err.Error())
+	}
+	return new(int), nil
+}
+
+type grpcClient struct {
+	conn    *grpc.ClientConn
+	timeout time.Duration
+}
+
+func dialGrpc(addr string, tlsCfg *tls.Config, timeout time.Duration) (*grpcClient, error) {
+	opts := []grpc.DialOption{
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName), grpc.MaxCallRecvMsgSize(maxMsgSize)),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                keepalivePeriod,
+			PermitWithoutStream: true,
+		}),
+	}
+	if tlsCfg != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClient{conn: conn, timeout: timeout}, nil
+}
+
+func (c *grpcClient) Connect(a *rpctype.HubConnectArgs) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], "/"+serviceName+"/Connect")
+	if err != nil {
+		return err
+	}
+	first := *a
+	first.Corpus = nil
+	chunks := split(a.Corpus)
+	if len(chunks) == 0 {
+		chunks = [][][]byte{nil}
+	}
+	for _, corpus := range chunks {
+		first.Corpus = corpus
+		if err := stream.SendMsg(&first); err != nil {
+			return recvError(stream, err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(new(int))
+}
+
+func (c *grpcClient) Sync(a *rpctype.HubSyncArgs) (*rpctype.HubSyncRes, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[1], "/"+serviceName+"/Sync")
+	if err != nil {
+		return nil, err
+	}
+	chunks := split(a.Add)
+	if len(chunks) == 0 {
+		chunks = [][][]byte{nil}
+	}
+	for i, add := range chunks {
+		chunk := &rpctype.HubSyncArgs{Name: a.Name, Key: a.Key, Add: add}
+		if i == 0 {
+			chunk.Del = a.Del
+		}
+		if err := stream.SendMsg(chunk); err != nil {
+			return nil, recvError(stream, err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	r := new(rpctype.HubSyncRes)
+	for {
+		chunk := new(rpctype.HubSyncRes)
+		if err := stream.RecvMsg(chunk); err == io.EOF {
+			return r, nil
+		} else if err != nil {
+			return nil, err
+		}
+		r.Inputs = append(r.Inputs, chunk.Inputs...)
+	}
+}
+
+func (c *grpcClient) AddRepros(a *rpctype.HubAddReprosArgs) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.conn.Invoke(ctx, "/"+serviceName+"/AddRepros", a, new(int))
+}
+
+func (c *grpcClient) GetRepros(a *rpctype.HubGetReprosArgs) (*rpctype.HubGetReprosRes, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	r := new(rpctype.HubGetReprosRes)
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/GetRepros", a, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *grpcClient) AddCrashes(a *rpctype.HubAddCrashesArgs) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.conn.Invoke(ctx, "/"+serviceName+"/AddCrashes", a, new(int))
+}
+
+// recvError returns the actual error of the call if SendMsg has failed with io.EOF.
+func recvError(stream grpc.ClientStream, err error) error {
+	if err != io.EOF {
+		return err
+	}
+	return stream.RecvMsg(new(interface{}))
+}
+
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// split splits programs into chunks of about chunkSize bytes.
+func split(progs [][]byte) [][][]byte {
+	var chunks [][][]byte
+	size := 0
+	for _, p := range progs {
+		if len(chunks) == 0 || size+len(p) > chunkSize && size != 0 {
+			chunks = append(chunks, nil)
+			size = 0
+		}
+		chunks[len(chunks)-1] = append(chunks[len(chunks)-1], p)
+		size += len(p)
+	}
+	return chunks
+}
+
+const codecName = "gob"
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) Name() string {
+	return codecName
+}
+
+func init() {
+	encoding.RegisterCodec(gobCodec{})
+}
@@ -0,0 +1,267 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package hubrpc
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/rpctype"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testHub struct {
+	connect *rpctype.HubConnectArgs
+	sync    *rpctype.HubSyncArgs
+	inputs  [][]byte
+	repros  []rpctype.HubRepro
+	crashes []rpctype.HubCrash
+	delay   time.Duration
+	auths   int
+}
+
+func (hub *testHub) Authenticate(name, key string) error {
+	hub.auths++
+	if key != "key" {
+		return fmt.Errorf("unauthorized manager")
+	}
+	return nil
+}
+
+func (hub *testHub) Connect(a *rpctype.HubConnectArgs, r *int) error {
+	if a.Key != "key" {
+		return fmt.Errorf("unauthorized manager")
+	}
+	hub.connect = a
+	return nil
+}
+
+func (hub *testHub) Sync(a *rpctype.HubSyncArgs, r *rpctype.HubSyncRes) error {
+	time.Sleep(hub.delay)
+	hub.sync = a
+	r.Inputs = hub.inputs
+	return nil
+}
+
+func (hub *testHub) AddRepros(a *rpctype.HubAddReprosArgs, r *int) error {
+	hub.repros = append(hub.repros, a.Repros...)
+	return nil
+}
+
+func (hub *testHub) GetRepros(a *rpctype.HubGetReprosArgs, r *rpctype.HubGetReprosRes) error {
+	if a.Key != "key" {
+		return fmt.Errorf("unauthorized manager")
+	}
+	r.Repros = hub.repros
+	return nil
+}
+
+func (hub *testHub) AddCrashes(a *rpctype.HubAddCrashesArgs, r *int) error {
+	hub.crashes = append(hub.crashes, a.Crashes...)
+	return nil
+}
+
+// progs returns n programs of size bytes each.
+func progs(n, size int) [][]byte {
+	var res [][]byte
+	for i := 0; i < n; i++ {
+		res = append(res, bytes.Repeat([]byte{byte('a' + i%26)}, size))
+	}
+	return res
+}
+
+func testTransport(t *testing.T, transport string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := &testHub{inputs: progs(10, 1<<19)}
+	switch transport {
+	case "rpc":
+		s := rpc.NewServer()
+		if err := s.RegisterName("Hub", hub); err != nil {
+			t.Fatal(err)
+		}
+		go s.Accept(ln)
+		defer ln.Close()
+	case "grpc":
+		s := NewServer(hub, nil)
+		go s.Serve(ln)
+		defer s.Stop()
+	}
+	c, err := Dial(transport, ln.Addr().String(), nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	connect := &rpctype.HubConnectArgs{
+		Name:   "manager",
+		Key:    "key",
+		OS:     "linux",
+		Arch:   "arm64",
+		Fresh:  true,
+		Calls:  []string{"getpid"},
+		Corpus: progs(10, 1<<19),
+	}
+	if err := c.Connect(connect); err != nil {
+		t.Fatal(err)
+	}
+	if hub.connect.Name != "manager" || hub.connect.OS != "linux" || hub.connect.Arch != "arm64" ||
+		!hub.connect.Fresh || len(hub.connect.Calls) != 1 ||
+		len(hub.connect.Corpus) != len(connect.Corpus) || !bytes.Equal(hub.connect.Corpus[9], connect.Corpus[9]) {
+		t.Fatalf("hub got bad connect args")
+	}
+	res, err := c.Sync(&rpctype.HubSyncArgs{Name: "manager", Key: "key", Add: progs(3, 1<<21), Del: []string{"sig"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hub.sync.Add) != 3 || len(hub.sync.Del) != 1 {
+		t.Fatalf("hub got %v added and %v deleted programs, want 3 and 1", len(hub.sync.Add), len(hub.sync.Del))
+	}
+	if len(res.Inputs) != len(hub.inputs) || !bytes.Equal(res.Inputs[9], hub.inputs[9]) {
+		t.Fatalf("got %v inputs, want %v", len(res.Inputs), len(hub.inputs))
+	}
+	if err := c.Connect(&rpctype.HubConnectArgs{Name: "manager", Key: "bad"}); err == nil {
+		t.Fatalf("connect with bad key succeeded")
+	}
+	repro := rpctype.HubRepro{Title: "crash", Prog: []byte("getpid()\n"), CProg: []byte("int main() {}")}
+	if err := c.AddRepros(&rpctype.HubAddReprosArgs{Name: "manager", Key: "key",
+		Repros: []rpctype.HubRepro{repro}}); err != nil {
+		t.Fatal(err)
+	}
+	repros, err := c.GetRepros(&rpctype.HubGetReprosArgs{Name: "manager", Key: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repros.Repros) != 1 || repros.Repros[0].Title != repro.Title ||
+		!bytes.Equal(repros.Repros[0].Prog, repro.Prog) || !bytes.Equal(repros.Repros[0].CProg, repro.CProg) {
+		t.Fatalf("got bad repros: %+v", repros.Repros)
+	}
+	if _, err := c.GetRepros(&rpctype.HubGetReprosArgs{Name: "manager", Key: "bad"}); err == nil {
+		t.Fatalf("get repros with bad key succeeded")
+	}
+	crash := rpctype.HubCrash{Title: "crash", Report: []byte("report")}
+	if err := c.AddCrashes(&rpctype.HubAddCrashesArgs{Name: "manager", Key: "key",
+		Crashes: []rpctype.HubCrash{crash, crash}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(hub.crashes) != 2 || hub.crashes[1].Title != crash.Title || !bytes.Equal(hub.crashes[1].Report, crash.Report) {
+		t.Fatalf("got bad crashes: %+v", hub.crashes)
+	}
+}
+
+func TestRPC(t *testing.T) {
+	testTransport(t, "rpc")
+}
+
+func TestGrpc(t *testing.T) {
+	testTransport(t, "grpc")
+}
+
+func TestGrpcDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(&testHub{delay: time.Second}, nil)
+	go s.Serve(ln)
+	defer s.Stop()
+	c, err := Dial("grpc", ln.Addr().String(), nil, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Sync(&rpctype.HubSyncArgs{Name: "manager", Key: "key"})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+}
+
+func TestGrpcStreamAuth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := new(testHub)
+	s := NewServer(hub, nil)
+	go s.Serve(ln)
+	defer s.Stop()
+	c, err := Dial("grpc", ln.Addr().String(), nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Connect(&rpctype.HubConnectArgs{Name: "manager", Key: "bad", Corpus: progs(10, chunkSize)})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want permission denied", err)
+	}
+	_, err = c.Sync(&rpctype.HubSyncArgs{Name: "manager", Key: "bad", Add: progs(10, chunkSize)})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want permission denied", err)
+	}
+	if hub.connect != nil || hub.sync != nil || hub.auths != 2 {
+		t.Fatalf("unauthorized streams reached the hub")
+	}
+}
+
+func TestGrpcStreamSize(t *testing.T) {
+	defer func(size int) { maxStreamSize = size }(maxStreamSize)
+	maxStreamSize = 3 * chunkSize
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := new(testHub)
+	s := NewServer(hub, nil)
+	go s.Serve(ln)
+	defer s.Stop()
+	c, err := Dial("grpc", ln.Addr().String(), nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Sync(&rpctype.HubSyncArgs{Name: "manager", Key: "key", Add: progs(3, chunkSize)}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Sync(&rpctype.HubSyncArgs{Name: "manager", Key: "key", Add: progs(4, chunkSize)})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want resource exhausted", err)
+	}
+	err = c.Connect(&rpctype.HubConnectArgs{Name: "manager", Key: "key", Corpus: progs(4, chunkSize)})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want resource exhausted", err)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		progs  [][]byte
+		chunks int
+	}{
+		{nil, 0},
+		{progs(1, 10), 1},
+		{progs(1, 2*chunkSize), 1},
+		{progs(4, chunkSize/2), 2},
+		{progs(3, chunkSize), 3},
+	}
+	for i, test := range tests {
+		chunks := split(test.progs)
+		if len(chunks) != test.chunks {
+			t.Errorf("test #%v: got %v chunks, want %v", i, len(chunks), test.chunks)
+		}
+		n := 0
+		for _, chunk := range chunks {
+			n += len(chunk)
+		}
+		if n != len(test.progs) {
+			t.Errorf("test #%v: got %v programs, want %v", i, n, len(test.progs))
+		}
+	}
+}
@@ -517,6 +517,34 @@ func (p *parser) failf(msg string, args ...interface{}) {
 	p.e = fmt.Errorf("%v\nline #%v: %v", fmt.Sprintf(msg, args...), p.l, p.s)
 }
 
+// Canonicalize returns canonical serialized form of the program, so that programs that differ
+// only in comments, formatting, resource numbering and values of output args
+// have the same canonical form. Values of all input args (including sizes) are kept,
+// because e.g. wrong sizes are what triggers bugs.
+func Canonicalize(data []byte) (canon []byte, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			canon, err = nil, fmt.Errorf("failed to canonicalize program: %v", e)
+		}
+	}()
+	p, err := Deserialize(data)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil || len(p.Calls) == 0 {
+		return nil, fmt.Errorf("program does not contain any calls")
+	}
+	for _, c := range p.Calls {
+		foreachArg(c, func(arg, _ *Arg, _ *[]*Arg) {
+			// Values of output args are overwritten by kernel.
+			if arg.Kind == ArgConst && arg.Type.Dir() == sys.DirOut {
+				arg.Val = arg.Type.Default()
+			}
+		})
+	}
+	return p.Serialize(), nil
+}
+
 // CallSet returns a set of all calls in the program.
 // It does very conservative parsing and is intended to parse paste/future serialization formats.
 func CallSet(data []byte) (map[string]struct{}, error) {
@@ -4,6 +4,7 @@
 package prog
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
 	"sort"
@@ -93,3 +94,54 @@ func TestCallSetRandom(t *testing.T) {
 		}
 	}
 }
+
+func TestCanonicalize(t *testing.T) {
+	canon := "r0 = open(&(0x7f0000000000)=\"2e00\", 0x0, 0x0)\n" +
+		"write(r0, &(0x7f0000001000)=\"0102\", 0x2)\n"
+	tests := []string{
+		canon,
+		"# comment\n" +
+			"r5 = open(&(0x7f0000000000)=\"2e00\", 0x0, 0x0)\n" +
+			"\n" +
+			"write(r5, &(0x7f0000001000)=\"0102\", 0x2)\n",
+	}
+	for i, test := range tests {
+		res, err := Canonicalize([]byte(test))
+		if err != nil {
+			t.Fatalf("test #%v: failed to canonicalize: %v", i, err)
+		}
+		if string(res) != canon {
+			t.Fatalf("test #%v: got:\n%s\nwant:\n%s", i, res, canon)
+		}
+	}
+	// Sizes are kept as is, wrong sizes trigger bugs.
+	wrongSize := "r0 = open(&(0x7f0000000000)=\"2e00\", 0x0, 0x0)\n" +
+		"write(r0, &(0x7f0000001000)=\"0102\", 0x1000)\n"
+	if res, err := Canonicalize([]byte(wrongSize)); err != nil || string(res) != wrongSize {
+		t.Fatalf("program with wrong size is canonicalized to:\n%s\nerr: %v", res, err)
+	}
+	if _, err := Canonicalize([]byte("foo$bar()\n")); err == nil {
+		t.Fatalf("canonicalized program with unknown call")
+	}
+}
+
+func TestCanonicalizeRandom(t *testing.T) {
+	rs, iters := initTest(t)
+	for i := 0; i < iters; i++ {
+		data := Generate(rs, 10, nil).Serialize()
+		if _, err := Deserialize(data); err != nil {
+			continue // canonicalization is only possible for programs that can be deserialized
+		}
+		canon, err := Canonicalize(data)
+		if err != nil {
+			t.Fatalf("failed to canonicalize: %v\n%s", err, data)
+		}
+		canon1, err := Canonicalize(canon)
+		if err != nil {
+			t.Fatalf("failed to canonicalize: %v\n%s", err, canon)
+		}
+		if !bytes.Equal(canon, canon1) {
+			t.Fatalf("canonical form is not stable:\n%s\nvs:\n%s", canon, canon1)
+		}
+	}
+}
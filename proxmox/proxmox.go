@@ -0,0 +1,415 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package proxmox provides wrappers around Proxmox VE APIs.
+// APIs operate on a single cluster node. API token is taken from PROXMOX_TOKEN
+// environment variable in the USER@REALM!TOKENID=SECRET form.
+//
+// See https://pve.proxmox.com/pve-docs/api-viewer for API reference.
+package proxmox
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Context struct {
+	Node string
+
+	api    *url.URL
+	token  string
+	tls    *tls.Config
+	client *http.Client
+	// apiRateGate prevents us from overloading pveproxy.
+	apiRateGate <-chan time.Time
+}
+
+type VM struct {
+	VMID   int
+	Name   string
+	Status string
+}
+
+// NewContext creates a context for the API endpoint apiURL (e.g. "https://pve:8006") and the node.
+// If insecure is set, TLS certificate of the endpoint is not verified (PVE uses a self-signed one by default).
+func NewContext(apiURL, node string, insecure bool) (*Context, error) {
+	api, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proxmox url: %v", err)
+	}
+	ctx := &Context{
+		Node:        node,
+		api:         api,
+		token:       os.Getenv("PROXMOX_TOKEN"),
+		tls:         &tls.Config{InsecureSkipVerify: insecure},
+		apiRateGate: time.NewTicker(time.Second / 10).C,
+	}
+	if ctx.token == "" {
+		return nil, fmt.Errorf("PROXMOX_TOKEN is not set")
+	}
+	ctx.client = &http.Client{Transport: &http.Transport{TLSClientConfig: ctx.tls}}
+	res := new(struct {
+		Version string
+	})
+	if err := ctx.call("GET", "/version", nil, res); err != nil {
+		return nil, fmt.Errorf("failed to query proxmox version: %v", err)
+	}
+	return ctx, nil
+}
+
+// CloneVM creates a linked clone of the template VM with the given name,
+// applies config (e.g. cores, memory, cloud-init parameters) and starts it.
+// Returns ID of the new VM.
+func (ctx *Context) CloneVM(template int, name string, config map[string]string) (int, error) {
+	var id json.Number
+	if err := ctx.call("GET", "/cluster/nextid", nil, &id); err != nil {
+		return 0, fmt.Errorf("failed to allocate vm id: %v", err)
+	}
+	vmid, err := id.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse vm id %q: %v", id, err)
+	}
+	clone := url.Values{
+		"newid": {fmt.Sprint(vmid)},
+		"name":  {name},
+		"full":  {"0"},
+	}
+	if err := ctx.task("POST", fmt.Sprintf("/nodes/%v/qemu/%v/clone", ctx.Node, template), clone); err != nil {
+		return 0, fmt.Errorf("failed to clone vm: %v", err)
+	}
+	params := url.Values{}
+	for k, v := range config {
+		params.Set(k, v)
+	}
+	if err := ctx.call("POST", fmt.Sprintf("/nodes/%v/qemu/%v/config", ctx.Node, vmid), params, nil); err != nil {
+		ctx.DeleteVM(int(vmid))
+		return 0, fmt.Errorf("failed to configure vm: %v", err)
+	}
+	if err := ctx.task("POST", fmt.Sprintf("/nodes/%v/qemu/%v/status/start", ctx.Node, vmid), nil); err != nil {
+		ctx.DeleteVM(int(vmid))
+		return 0, fmt.Errorf("failed to start vm: %v", err)
+	}
+	return int(vmid), nil
+}
+
+// DeleteVMsByName deletes all VMs with the name on the node
+// (e.g. left over from a previous run of the program).
+func (ctx *Context) DeleteVMsByName(name string) error {
+	var vms []VM
+	if err := ctx.call("GET", fmt.Sprintf("/nodes/%v/qemu", ctx.Node), nil, &vms); err != nil {
+		return fmt.Errorf("failed to query vms: %v", err)
+	}
+	for _, vm := range vms {
+		if vm.Name != name {
+			continue
+		}
+		if err := ctx.DeleteVM(vm.VMID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ctx *Context) DeleteVM(vmid int) error {
+	ctx.task("POST", fmt.Sprintf("/nodes/%v/qemu/%v/status/stop", ctx.Node, vmid), nil)
+	if err := ctx.task("DELETE", fmt.Sprintf("/nodes/%v/qemu/%v?purge=1", ctx.Node, vmid), nil); err != nil {
+		return fmt.Errorf("failed to delete vm: %v", err)
+	}
+	return nil
+}
+
+func (ctx *Context) IsVMRunning(vmid int) bool {
+	res := new(VM)
+	if err := ctx.call("GET", fmt.Sprintf("/nodes/%v/qemu/%v/status/current", ctx.Node, vmid), nil, res); err != nil {
+		return false
+	}
+	return res.Status == "running"
+}
+
+// VMAddress returns IPv4 address of the VM as reported by qemu-guest-agent.
+func (ctx *Context) VMAddress(vmid int) (string, error) {
+	res := new(struct {
+		Result []struct {
+			Name        string
+			IPAddresses []struct {
+				IPAddressType string `json:"ip-address-type"`
+				IPAddress     string `json:"ip-address"`
+			} `json:"ip-addresses"`
+		}
+	})
+	if err := ctx.call("GET", fmt.Sprintf("/nodes/%v/qemu/%v/agent/network-get-interfaces", ctx.Node, vmid), nil, res); err != nil {
+		return "", err
+	}
+	for _, iface := range res.Result {
+		if iface.Name == "lo" {
+			continue
+		}
+		for _, addr := range iface.IPAddresses {
+			if addr.IPAddressType == "ipv4" {
+				return addr.IPAddress, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("vm has no address yet")
+}
+
+// SerialConsole connects to serial0 of the VM via termproxy websocket
+// and returns a stream of the console output.
+func (ctx *Context) SerialConsole(vmid int) (io.ReadCloser, error) {
+	term := new(struct {
+		Port   json.Number
+		Ticket string
+		User   string
+	})
+	path := fmt.Sprintf("/nodes/%v/qemu/%v", ctx.Node, vmid)
+	if err := ctx.call("POST", path+"/termproxy", url.Values{"serial": {"serial0"}}, term); err != nil {
+		return nil, fmt.Errorf("failed to start termproxy: %v", err)
+	}
+	query := url.Values{"port": {term.Port.String()}, "vncticket": {term.Ticket}}
+	con, err := ctx.dialWebsocket("/api2/json" + path + "/vncwebsocket?" + query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to termproxy: %v", err)
+	}
+	if err := con.write([]byte(term.User + ":" + term.Ticket + "\n")); err != nil {
+		con.Close()
+		return nil, err
+	}
+	ok, err := con.readMessage()
+	if err != nil || string(ok) != "OK" {
+		con.Close()
+		return nil, fmt.Errorf("termproxy authentication failed: %v %q", err, ok)
+	}
+	go con.keepalive()
+	return con, nil
+}
+
+// task performs an API call that starts a task and waits for the task to finish.
+func (ctx *Context) task(method, path string, params url.Values) error {
+	var upid string
+	if err := ctx.call(method, path, params, &upid); err != nil {
+		return err
+	}
+	for {
+		time.Sleep(time.Second)
+		res := new(struct {
+			Status     string
+			ExitStatus string
+		})
+		if err := ctx.call("GET", fmt.Sprintf("/nodes/%v/tasks/%v/status", ctx.Node, url.PathEscape(upid)), nil, res); err != nil {
+			return err
+		}
+		if res.Status == "running" {
+			continue
+		}
+		if res.ExitStatus != "OK" {
+			return fmt.Errorf("task %v failed: %v", upid, res.ExitStatus)
+		}
+		return nil
+	}
+}
+
+func (ctx *Context) call(method, path string, params url.Values, res interface{}) error {
+	<-ctx.apiRateGate
+	var body io.Reader
+	if params != nil {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequest(method, ctx.api.String()+"/api2/json"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "PVEAPIToken="+ctx.token)
+	if params != nil {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := ctx.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v %v: %v\n%s", method, path, resp.Status, data)
+	}
+	if res != nil {
+		wrapper := new(struct {
+			Data json.RawMessage
+		})
+		if err := json.Unmarshal(data, wrapper); err != nil {
+			return fmt.Errorf("failed to parse %v %v response: %v", method, path, err)
+		}
+		if err := json.Unmarshal(wrapper.Data, res); err != nil {
+			return fmt.Errorf("failed to parse %v %v response: %v", method, path, err)
+		}
+	}
+	return nil
+}
+
+// websocket is a minimal RFC 6455 client sufficient for termproxy.
+type websocket struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	mu      sync.Mutex
+	pending []byte
+	closed  chan bool
+}
+
+func (ctx *Context) dialWebsocket(path string) (*websocket, error) {
+	host := ctx.api.Host
+	if ctx.api.Port() == "" {
+		host += ":8006"
+	}
+	conn, err := tls.Dial("tcp", host, ctx.tls)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 16)
+	rand.Read(key)
+	req, err := http.NewRequest("GET", "https://"+ctx.api.Host+path, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Add("Authorization", "PVEAPIToken="+ctx.token)
+	req.Header.Add("Upgrade", "websocket")
+	req.Header.Add("Connection", "Upgrade")
+	req.Header.Add("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	req.Header.Add("Sec-WebSocket-Version", "13")
+	req.Header.Add("Sec-WebSocket-Protocol", "binary")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket upgrade failed: %v", resp.Status)
+	}
+	return &websocket{conn: conn, r: r, closed: make(chan bool)}, nil
+}
+
+func (ws *websocket) Read(buf []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		msg, err := ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		ws.pending = msg
+	}
+	n := copy(buf, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+func (ws *websocket) Close() error {
+	select {
+	case <-ws.closed:
+	default:
+		close(ws.closed)
+	}
+	return ws.conn.Close()
+}
+
+// keepalive sends termproxy pings, otherwise the proxy closes idle connections.
+func (ws *websocket) keepalive() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ws.write([]byte("2")); err != nil {
+				return
+			}
+		case <-ws.closed:
+			return
+		}
+	}
+}
+
+// readMessage returns payload of the next data frame, control frames are handled internally.
+func (ws *websocket) readMessage() ([]byte, error) {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(ws.r, hdr[:]); err != nil {
+			return nil, err
+		}
+		opcode := hdr[0] & 0xf
+		size := uint64(hdr[1] & 0x7f)
+		switch size {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+				return nil, err
+			}
+			size = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+				return nil, err
+			}
+			size = binary.BigEndian.Uint64(ext[:])
+		}
+		if size > 1<<24 {
+			return nil, fmt.Errorf("websocket frame is too large: %v", size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(ws.r, payload); err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case 0x0, 0x1, 0x2:
+			return payload, nil
+		case 0x8:
+			return nil, io.EOF
+		case 0x9:
+			ws.writeFrame(0xa, payload)
+		}
+	}
+}
+
+func (ws *websocket) write(data []byte) error {
+	return ws.writeFrame(0x2, data)
+}
+
+func (ws *websocket) writeFrame(opcode byte, data []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	buf := new(bytes.Buffer)
+	buf.WriteByte(0x80 | opcode)
+	// Client frames must be masked and we don't send large frames.
+	if len(data) >= 126 {
+		return fmt.Errorf("websocket frame is too large: %v", len(data))
+	}
+	buf.WriteByte(0x80 | byte(len(data)))
+	var mask [4]byte
+	rand.Read(mask[:])
+	buf.Write(mask[:])
+	for i, v := range data {
+		buf.WriteByte(v ^ mask[i%4])
+	}
+	_, err := ws.conn.Write(buf.Bytes())
+	return err
+}
@@ -44,8 +44,12 @@ func Run(crashLog []byte, cfg *config.Config, vmIndexes []int) (*Result, error)
 	if len(vmIndexes) == 0 {
 		return nil, fmt.Errorf("no VMs provided")
 	}
-	if _, err := os.Stat(filepath.Join(cfg.Syzkaller, "bin/syz-execprog")); err != nil {
-		return nil, fmt.Errorf("bin/syz-execprog is missing (run 'make execprog')")
+	if cfg.Arch != vm.HostArch {
+		// Programs are minimized and converted to C with syscall descriptions of the host arch.
+		return nil, fmt.Errorf("reproduction is not supported for arch %v", cfg.Arch)
+	}
+	if _, err := os.Stat(filepath.Join(vm.BinDir(cfg.Syzkaller, cfg.Arch), "syz-execprog")); err != nil {
+		return nil, fmt.Errorf("syz-execprog for %v is missing (run 'make execprog')", cfg.Arch)
 	}
 	entries := prog.ParseLog(crashLog)
 	if len(entries) == 0 {
@@ -86,21 +90,17 @@ func Run(crashLog []byte, cfg *config.Config, vmIndexes []int) (*Result, error)
 						continue
 
 					}
-					execprogBin, err := vmInst.Copy(filepath.Join(cfg.Syzkaller, "bin/syz-execprog"))
-					if err != nil {
-						Logf(0, "reproducing crash '%v': failed to copy to VM: %v", crashDesc, err)
-						vmInst.Close()
-						time.Sleep(10 * time.Second)
-						continue
-					}
-					executorBin, err := vmInst.Copy(filepath.Join(cfg.Syzkaller, "bin/syz-executor"))
+					bins, err := vmInst.CopyAll([]string{
+						filepath.Join(vm.BinDir(cfg.Syzkaller, cfg.Arch), "syz-execprog"),
+						filepath.Join(vm.BinDir(cfg.Syzkaller, cfg.Arch), "syz-executor"),
+					})
 					if err != nil {
 						Logf(0, "reproducing crash '%v': failed to copy to VM: %v", crashDesc, err)
 						vmInst.Close()
 						time.Sleep(10 * time.Second)
 						continue
 					}
-					inst = &instance{vmInst, vmIndex, execprogBin, executorBin}
+					inst = &instance{vmInst, vmIndex, bins[0], bins[1]}
 					break
 				}
 				if inst == nil {
@@ -296,8 +296,17 @@ func (ctx *context) testProg(p *prog.Prog, duration time.Duration, opts csource.
 	if opts.Repeat {
 		repeat = "0"
 	}
-	command := fmt.Sprintf("%v -executor %v -cover=0 -procs=%v -repeat=%v -sandbox %v -threaded=%v -collide=%v %v",
-		inst.execprogBin, inst.executorBin, opts.Procs, repeat, opts.Sandbox, opts.Threaded, opts.Collide, vmProgFile)
+	command := &vm.Command{Args: []string{
+		inst.execprogBin,
+		"-executor=" + inst.executorBin,
+		"-cover=0",
+		fmt.Sprintf("-procs=%v", opts.Procs),
+		"-repeat=" + repeat,
+		"-sandbox=" + opts.Sandbox,
+		fmt.Sprintf("-threaded=%v", opts.Threaded),
+		fmt.Sprintf("-collide=%v", opts.Collide),
+		vmProgFile,
+	}}
 	Logf(2, "reproducing crash '%v': testing program (duration=%v, %+v): %s",
 		ctx.crashDesc, duration, opts, p)
 	return ctx.testImpl(inst, command, duration)
@@ -317,15 +326,15 @@ func (ctx *context) testBin(bin string, duration time.Duration, reboot bool) (cr
 		return false, fmt.Errorf("failed to copy to VM: %v", err)
 	}
 	Logf(2, "reproducing crash '%v': testing compiled C program", ctx.crashDesc)
-	return ctx.testImpl(inst, bin, duration)
+	return ctx.testImpl(inst, &vm.Command{Args: []string{bin}}, duration)
 }
 
-func (ctx *context) testImpl(inst vm.Instance, command string, duration time.Duration) (crashed bool, err error) {
-	outc, errc, err := inst.Run(duration, nil, command)
+func (ctx *context) testImpl(inst vm.Instance, command *vm.Command, duration time.Duration) (crashed bool, err error) {
+	outc, errc, err := vm.RunCommand(inst, duration, nil, command)
 	if err != nil {
 		return false, fmt.Errorf("failed to run command in VM: %v", err)
 	}
-	desc, text, output, crashed, timedout := vm.MonitorExecution(outc, errc, false, false)
+	desc, text, output, crashed, timedout := vm.MonitorExecution(inst, outc, errc, false, false)
 	_, _, _ = text, output, timedout
 	if !crashed {
 		Logf(2, "reproducing crash '%v': program did not crash", ctx.crashDesc)
@@ -46,6 +46,8 @@ type PollRes struct {
 type HubConnectArgs struct {
 	Name   string
 	Key    string
+	OS     string // target OS of the manager (linux if empty)
+	Arch   string // target arch of the manager (amd64 if empty)
 	Fresh  bool
 	Calls  []string
 	Corpus [][]byte
@@ -61,3 +63,37 @@ type HubSyncArgs struct {
 type HubSyncRes struct {
 	Inputs [][]byte
 }
+
+// HubRepro is a crash reproducer exchanged between managers via hub.
+type HubRepro struct {
+	Title string // crash description
+	Prog  []byte // syz reproducer
+	CProg []byte // C reproducer (optional)
+}
+
+type HubAddReprosArgs struct {
+	Name   string
+	Key    string
+	Repros []HubRepro
+}
+
+type HubGetReprosArgs struct {
+	Name string
+	Key  string
+}
+
+type HubGetReprosRes struct {
+	Repros []HubRepro
+}
+
+// HubCrash is a crash found by a manager.
+type HubCrash struct {
+	Title  string // crash description
+	Report []byte // crash report (optional)
+}
+
+type HubAddCrashesArgs struct {
+	Name    string
+	Key     string
+	Crashes []HubCrash
+}
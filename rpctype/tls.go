@@ -0,0 +1,84 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package rpctype
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+// ServerTLS returns TLS config for an rpc server with certificate cert and private key key.
+// If ca is not empty, clients must present a certificate signed by ca (mutual TLS).
+func ServerTLS(cert, key, ca string) (*tls.Config, error) {
+	keyPair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls certificate: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if ca != "" {
+		if cfg.ClientCAs, err = loadCA(ca); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientTLS returns TLS config for an rpc client.
+// If ca is empty, the server certificate is verified against system roots.
+// If cert is not empty, the client presents certificate cert with private key key.
+// serverName overrides the name the server certificate is verified against (optional).
+func ClientTLS(cert, key, ca, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if ca != "" {
+		var err error
+		if cfg.RootCAs, err = loadCA(ca); err != nil {
+			return nil, err
+		}
+	}
+	if cert != "" || key != "" {
+		keyPair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{keyPair}
+	}
+	return cfg, nil
+}
+
+func loadCA(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in tls ca %v", file)
+	}
+	return pool, nil
+}
+
+// Dial connects to an rpc server at addr, over TLS if tlsCfg is not nil.
+func Dial(addr string, tlsCfg *tls.Config) (*rpc.Client, error) {
+	if tlsCfg == nil {
+		return rpc.Dial("tcp", addr)
+	}
+	dialer := &net.Dialer{Timeout: time.Minute, KeepAlive: time.Minute}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
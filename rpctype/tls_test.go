@@ -0,0 +1,141 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package rpctype
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type certGen struct {
+	t      *testing.T
+	dir    string
+	serial int64
+}
+
+// gen writes certificate name.crt and key name.key signed by parent (self-signed if parent is nil).
+func (g *certGen) gen(name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	g.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(g.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	g.write(name+".crt", &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	g.write(name+".key", &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	return cert, key
+}
+
+func (g *certGen) write(name string, block *pem.Block) {
+	if err := ioutil.WriteFile(filepath.Join(g.dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+func (g *certGen) file(name string) string {
+	return filepath.Join(g.dir, name)
+}
+
+type EchoServer struct{}
+
+func (s *EchoServer) Echo(a *string, r *string) error {
+	*r = *a
+	return nil
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := &certGen{t: t, dir: dir}
+	ca, caKey := g.gen("ca", nil, nil)
+	g.gen("server", ca, caKey)
+	g.gen("client", ca, caKey)
+	g.gen("other", nil, nil)
+
+	serverCfg, err := ServerTLS(g.file("server.crt"), g.file("server.key"), g.file("ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rpc.NewServer()
+	s.Register(new(EchoServer))
+	go s.Accept(ln)
+
+	call := func(cert, key, ca string) error {
+		clientCfg, err := ClientTLS(cert, key, ca, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := Dial(ln.Addr().String(), clientCfg)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		var res string
+		if err := conn.Call("EchoServer.Echo", "hello", &res); err != nil {
+			return err
+		}
+		if res != "hello" {
+			t.Fatalf("got %q, want %q", res, "hello")
+		}
+		return nil
+	}
+	if err := call(g.file("client.crt"), g.file("client.key"), g.file("ca.crt")); err != nil {
+		t.Fatalf("client with certificate failed: %v", err)
+	}
+	if err := call("", "", g.file("ca.crt")); err == nil {
+		t.Fatalf("client without certificate succeeded")
+	}
+	if err := call(g.file("other.crt"), g.file("other.key"), g.file("ca.crt")); err == nil {
+		t.Fatalf("client with untrusted certificate succeeded")
+	}
+	if err := call(g.file("client.crt"), g.file("client.key"), g.file("other.crt")); err == nil {
+		t.Fatalf("client trusts server signed by unknown CA")
+	}
+}
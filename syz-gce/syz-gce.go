@@ -29,6 +29,7 @@ import (
 	"github.com/google/syzkaller/config"
 	"github.com/google/syzkaller/gce"
 	. "github.com/google/syzkaller/log"
+	gcevm "github.com/google/syzkaller/vm/gce"
 	"golang.org/x/net/context"
 )
 
@@ -48,6 +49,10 @@ type Config struct {
 	Name          string
 	Hub_Addr      string
 	Hub_Key       string
+	Hub_Tls       bool
+	Hub_Tls_Ca    string
+	Hub_Tls_Cert  string
+	Hub_Tls_Key   string
 	Image_Archive string
 	Image_Path    string
 	Image_Name    string
@@ -248,10 +253,21 @@ func writeManagerConfig(httpPort int, file string) error {
 	if len(tag) != 0 && tag[len(tag)-1] == '\n' {
 		tag = tag[:len(tag)-1]
 	}
+	vmParams, err := json.Marshal(&gcevm.Params{
+		Machine_Type: cfg.Machine_Type,
+		Preemptible:  true,
+	})
+	if err != nil {
+		return err
+	}
 	managerCfg := &config.Config{
 		Name:         cfg.Name,
 		Hub_Addr:     cfg.Hub_Addr,
 		Hub_Key:      cfg.Hub_Key,
+		Hub_Tls:      cfg.Hub_Tls,
+		Hub_Tls_Ca:   cfg.Hub_Tls_Ca,
+		Hub_Tls_Cert: cfg.Hub_Tls_Cert,
+		Hub_Tls_Key:  cfg.Hub_Tls_Key,
 		Http:         fmt.Sprintf(":%v", httpPort),
 		Rpc:          ":0",
 		Workdir:      "workdir",
@@ -259,7 +275,7 @@ func writeManagerConfig(httpPort int, file string) error {
 		Tag:          string(tag),
 		Syzkaller:    "gopath/src/github.com/google/syzkaller",
 		Type:         "gce",
-		Machine_Type: cfg.Machine_Type,
+		Vm:           vmParams,
 		Count:        cfg.Machine_Count,
 		Image:        cfg.Image_Name,
 		Sandbox:      cfg.Sandbox,
@@ -0,0 +1,152 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	. "github.com/google/syzkaller/log"
+	. "github.com/google/syzkaller/rpctype"
+)
+
+// HTTP/JSON API mirrors Hub.Connect and Hub.Sync rpc methods for clients that don't speak net/rpc.
+// Requests are POSTed as JSON objects to /api/connect and /api/sync, programs are passed
+// as text. Responses are JSON objects, errors are returned with a non-200 status
+// as {"error": "message"}. For example:
+//
+//	curl -d '{"name": "m", "key": "k", "os": "linux", "arch": "amd64", "calls": ["getpid"], "corpus": ["getpid()\n"]}' https://hub/api/connect
+//	curl -d '{"name": "m", "key": "k", "add": ["getpid()\n"]}' https://hub/api/sync
+//
+// The API is served on a separate api address of the hub rather than on the http dashboard,
+// with the same TLS setup as the rpc endpoint (including client certificate checks if tls_ca is set).
+
+type APIConnectArgs struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	OS     string   `json:"os"`
+	Arch   string   `json:"arch"`
+	Fresh  bool     `json:"fresh"`
+	Calls  []string `json:"calls"`
+	Corpus []string `json:"corpus"`
+}
+
+type APISyncArgs struct {
+	Name string   `json:"name"`
+	Key  string   `json:"key"`
+	Add  []string `json:"add"`
+	Del  []string `json:"del"` // hashes of deleted programs (sha1 of the program text)
+}
+
+type APISyncRes struct {
+	Inputs []string `json:"inputs"`
+}
+
+const apiMaxRequest = 64 << 20
+
+func (hub *Hub) serveAPI(addr string, tlsCfg *tls.Config) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		Fatalf("failed to listen on %v: %v", addr, err)
+	}
+	Logf(0, "serving api on tcp://%v (tls=%v)", ln.Addr(), tlsCfg != nil)
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/connect", hub.httpAPIConnect)
+	mux.HandleFunc("/api/sync", hub.httpAPISync)
+	go func() {
+		err := http.Serve(ln, mux)
+		Fatalf("failed to serve api: %v", err)
+	}()
+}
+
+func (hub *Hub) httpAPIConnect(w http.ResponseWriter, r *http.Request) {
+	a := new(APIConnectArgs)
+	if !apiParse(w, r, a) {
+		return
+	}
+	args := &HubConnectArgs{
+		Name:   a.Name,
+		Key:    a.Key,
+		OS:     a.OS,
+		Arch:   a.Arch,
+		Fresh:  a.Fresh,
+		Calls:  a.Calls,
+		Corpus: apiProgs(a.Corpus),
+	}
+	if err := hub.Connect(args, nil); err != nil {
+		apiError(w, err)
+		return
+	}
+	apiReply(w, struct{}{})
+}
+
+func (hub *Hub) httpAPISync(w http.ResponseWriter, r *http.Request) {
+	a := new(APISyncArgs)
+	if !apiParse(w, r, a) {
+		return
+	}
+	args := &HubSyncArgs{
+		Name: a.Name,
+		Key:  a.Key,
+		Add:  apiProgs(a.Add),
+		Del:  a.Del,
+	}
+	res := new(HubSyncRes)
+	if err := hub.Sync(args, res); err != nil {
+		apiError(w, err)
+		return
+	}
+	reply := &APISyncRes{Inputs: []string{}}
+	for _, inp := range res.Inputs {
+		reply.Inputs = append(reply.Inputs, string(inp))
+	}
+	apiReply(w, reply)
+}
+
+func apiParse(w http.ResponseWriter, r *http.Request, a interface{}) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		apiReplyStatus(w, http.StatusMethodNotAllowed, map[string]string{"error": "only POST is supported"})
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxRequest)).Decode(a); err != nil {
+		apiReplyStatus(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("bad request: %v", err)})
+		return false
+	}
+	return true
+}
+
+func apiProgs(progs []string) [][]byte {
+	var res [][]byte
+	for _, p := range progs {
+		res = append(res, []byte(p))
+	}
+	return res
+}
+
+func apiError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if err == errUnauthorized {
+		status = http.StatusForbidden
+	}
+	apiReplyStatus(w, status, map[string]string{"error": err.Error()})
+}
+
+func apiReply(w http.ResponseWriter, reply interface{}) {
+	apiReplyStatus(w, http.StatusOK, reply)
+}
+
+func apiReplyStatus(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		Logf(0, "failed to write api reply: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/google/syzkaller/syz-hub/state"
+)
+
+func TestAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-api-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := state.Make(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal([]byte(`{"managers": [{"name": "m0", "key": "k0"}, {"name": "m1", "key": "k1"}]}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	hub := &Hub{st: st}
+	if hub.keys, err = parseKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/connect", hub.httpAPIConnect)
+	mux.HandleFunc("/api/sync", hub.httpAPISync)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	post := func(path string, args, res interface{}) int {
+		data, err := json.Marshal(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(srv.URL+path, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if res != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	calls := []string{"getpid", "gettid"}
+	if status := post("/api/connect", &APIConnectArgs{Name: "m0", Key: "bad", Calls: calls}, nil); status != http.StatusForbidden {
+		t.Fatalf("connect with bad key: status %v", status)
+	}
+	if status := post("/api/sync", &APISyncArgs{Name: "m0", Key: "k0"}, nil); status != http.StatusInternalServerError {
+		t.Fatalf("sync of unconnected manager: status %v", status)
+	}
+	for _, a := range []*APIConnectArgs{
+		{Name: "m0", Key: "k0", Fresh: true, Calls: calls, Corpus: []string{"getpid()\n"}},
+		{Name: "m1", Key: "k1", Fresh: true, Calls: calls},
+	} {
+		if status := post("/api/connect", a, nil); status != http.StatusOK {
+			t.Fatalf("connect %v: status %v", a.Name, status)
+		}
+	}
+	res := new(APISyncRes)
+	if status := post("/api/sync", &APISyncArgs{Name: "m0", Key: "k0", Add: []string{"gettid()\n"}}, res); status != http.StatusOK {
+		t.Fatalf("sync m0: status %v", status)
+	}
+	if len(res.Inputs) != 0 {
+		t.Fatalf("m0 got own inputs: %q", res.Inputs)
+	}
+	res = new(APISyncRes)
+	if status := post("/api/sync", &APISyncArgs{Name: "m1", Key: "k1"}, res); status != http.StatusOK {
+		t.Fatalf("sync m1: status %v", status)
+	}
+	if len(res.Inputs) != 2 {
+		t.Fatalf("m1 got inputs %q, want 2 programs", res.Inputs)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET request: status %v", resp.StatusCode)
+	}
+}
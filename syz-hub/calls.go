@@ -0,0 +1,72 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Managers receive only inputs that consist of calls enabled in the manager.
+// In addition to the calls reported by the manager, the hub config can restrict
+// calls per manager with Enable_Syscalls/Disable_Syscalls lists. The lists use
+// the same format as in the manager config: call name ("open"), call variant name
+// ("open$dir") or prefix ending with "*" ("open$*").
+
+type callFilter struct {
+	enable  []string
+	disable []string
+}
+
+// parseCallFilters returns call filters of managers in cfg,
+// managers without Enable_Syscalls and Disable_Syscalls don't have a filter.
+func parseCallFilters(cfg *Config) (map[string]*callFilter, error) {
+	filters := make(map[string]*callFilter)
+	for _, mgr := range cfg.Managers {
+		if len(mgr.Enable_Syscalls) == 0 && len(mgr.Disable_Syscalls) == 0 {
+			continue
+		}
+		for _, c := range append(mgr.Enable_Syscalls, mgr.Disable_Syscalls...) {
+			if c == "" || c == "*" {
+				return nil, fmt.Errorf("manager %v: bad syscall pattern %q", mgr.Name, c)
+			}
+		}
+		filters[mgr.Name] = &callFilter{
+			enable:  mgr.Enable_Syscalls,
+			disable: mgr.Disable_Syscalls,
+		}
+	}
+	return filters, nil
+}
+
+// filter returns calls allowed by the filter.
+func (f *callFilter) filter(calls []string) []string {
+	if f == nil {
+		return calls
+	}
+	var res []string
+	for _, c := range calls {
+		if len(f.enable) != 0 && !matchCall(c, f.enable) || matchCall(c, f.disable) {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+func matchCall(call string, patterns []string) bool {
+	callName := call
+	if i := strings.IndexByte(call, '$'); i != -1 {
+		callName = call[:i]
+	}
+	for _, p := range patterns {
+		if p == call || p == callName {
+			return true
+		}
+		if len(p) > 1 && p[len(p)-1] == '*' && strings.HasPrefix(call, p[:len(p)-1]) {
+			return true
+		}
+	}
+	return false
+}
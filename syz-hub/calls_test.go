@@ -0,0 +1,44 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCallFilters(t *testing.T) {
+	data := []byte(`{"managers": [
+		{"name": "all", "key": "k"},
+		{"name": "enable", "key": "k", "enable_syscalls": ["open", "read$*", "getpid"]},
+		{"name": "disable", "key": "k", "disable_syscalls": ["open$dir", "read"]},
+		{"name": "both", "key": "k", "enable_syscalls": ["open"], "disable_syscalls": ["open$dir"]}
+	]}`)
+	cfg := new(Config)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		t.Fatal(err)
+	}
+	filters, err := parseCallFilters(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := []string{"open", "open$dir", "read", "read$eventfd", "write", "getpid"}
+	tests := map[string][]string{
+		"all":     calls,
+		"enable":  {"open", "open$dir", "read$eventfd", "getpid"},
+		"disable": {"open", "write", "getpid"},
+		"both":    {"open"},
+	}
+	for name, want := range tests {
+		if got := filters[name].filter(calls); !reflect.DeepEqual(got, want) {
+			t.Errorf("manager %v: got calls %v, want %v", name, got, want)
+		}
+	}
+
+	cfg.Managers[0].Disable_Syscalls = []string{"*"}
+	if _, err := parseCallFilters(cfg); err == nil {
+		t.Fatalf("parsed bad syscall pattern")
+	}
+}
@@ -10,12 +10,18 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/google/syzkaller/hash"
 	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/syz-hub/state"
 )
 
 func (hub *Hub) initHttp(addr string) {
 	http.HandleFunc("/", hub.httpSummary)
+	http.HandleFunc("/crash", hub.httpCrash)
+	http.HandleFunc("/manager", hub.httpManager)
+	http.HandleFunc("/metrics", hub.httpMetrics)
 
 	ln, err := net.Listen("tcp4", addr)
 	if err != nil {
@@ -32,8 +38,10 @@ func (hub *Hub) httpSummary(w http.ResponseWriter, r *http.Request) {
 	hub.mu.Lock()
 	defer hub.mu.Unlock()
 
+	now := time.Now()
 	data := &UISummaryData{
-		Log: CachedLogOutput(),
+		Log:     CachedLogOutput(),
+		Samples: uiSamples(hub.st.History),
 	}
 	total := UIManager{
 		Name:   "total",
@@ -41,18 +49,29 @@ func (hub *Hub) httpSummary(w http.ResponseWriter, r *http.Request) {
 	}
 	for name, mgr := range hub.st.Managers {
 		total.Added += mgr.Added
-		total.Deleted += mgr.Added
+		total.Deleted += mgr.Deleted
 		total.New += mgr.New
-		data.Managers = append(data.Managers, UIManager{
-			Name:    name,
-			Corpus:  len(mgr.Corpus),
-			Added:   mgr.Added,
-			Deleted: mgr.Deleted,
-			New:     mgr.New,
-		})
+		data.Managers = append(data.Managers, uiManager(name, mgr, now))
 	}
 	sort.Sort(UIManagerArray(data.Managers))
 	data.Managers = append([]UIManager{total}, data.Managers...)
+	repros := make(map[string]bool)
+	for _, repro := range hub.st.Repros {
+		repros[repro.Title] = true
+	}
+	for sig, crash := range hub.st.Crashes {
+		data.Crashes = append(data.Crashes, UICrash{
+			ID:        sig.String(),
+			Title:     crash.Title,
+			Count:     crash.Count,
+			Managers:  len(crash.Managers),
+			FirstSeen: crash.FirstSeen.Format(dateFormat),
+			LastSeen:  crash.LastSeen.Format(dateFormat),
+			Repro:     repros[crash.Title],
+			lastSeen:  crash.LastSeen,
+		})
+	}
+	sort.Sort(UICrashArray(data.Crashes))
 	if err := summaryTemplate.Execute(w, data); err != nil {
 		Logf(0, "failed to execute template: %v", err)
 		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
@@ -60,17 +79,159 @@ func (hub *Hub) httpSummary(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (hub *Hub) httpCrash(w http.ResponseWriter, r *http.Request) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	sig, err := hash.FromString(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad crash id: %v", err), http.StatusBadRequest)
+		return
+	}
+	crash := hub.st.Crashes[sig]
+	if crash == nil {
+		http.Error(w, fmt.Sprintf("can't find crash %v", sig.String()), http.StatusNotFound)
+		return
+	}
+	data := &UICrashData{
+		Title:  crash.Title,
+		Report: string(crash.Report),
+	}
+	for name, cm := range crash.Managers {
+		data.Managers = append(data.Managers, UICrashManager{
+			Name:      name,
+			Count:     cm.Count,
+			FirstSeen: cm.FirstSeen.Format(dateFormat),
+			LastSeen:  cm.LastSeen.Format(dateFormat),
+		})
+	}
+	sort.Sort(UICrashManagerArray(data.Managers))
+	if err := crashTemplate.Execute(w, data); err != nil {
+		Logf(0, "failed to execute template: %v", err)
+		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (hub *Hub) httpManager(w http.ResponseWriter, r *http.Request) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	name := r.FormValue("name")
+	mgr := hub.st.Managers[name]
+	if mgr == nil {
+		http.Error(w, fmt.Sprintf("can't find manager %v", name), http.StatusNotFound)
+		return
+	}
+	data := &UIManagerData{
+		UIManager: uiManager(name, mgr, time.Now()),
+		Connected: formatTime(mgr.Connected),
+		Samples:   uiSamples(mgr.History),
+	}
+	if err := managerTemplate.Execute(w, data); err != nil {
+		Logf(0, "failed to execute template: %v", err)
+		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// staleSyncPeriod is the time after which a manager that does not sync is considered stale
+// (managers sync every minute).
+const staleSyncPeriod = 10 * time.Minute
+
+func uiManager(name string, mgr *state.Manager, now time.Time) UIManager {
+	status := "ok"
+	if mgr.Connected.IsZero() {
+		status = "not connected"
+	} else if mgr.LastSync.IsZero() || now.Sub(mgr.LastSync) > staleSyncPeriod {
+		status = "stale"
+	}
+	lastSync := "never"
+	if !mgr.LastSync.IsZero() {
+		lastSync = fmt.Sprintf("%v ago", now.Sub(mgr.LastSync)/time.Second*time.Second)
+	}
+	return UIManager{
+		Name:     name,
+		Link:     true,
+		Target:   mgr.OS + "/" + mgr.Arch,
+		Corpus:   len(mgr.Corpus),
+		Added:    mgr.Added,
+		Deleted:  mgr.Deleted,
+		New:      mgr.New,
+		LastSync: lastSync,
+		Status:   status,
+	}
+}
+
+func uiSamples(history []state.StatsSample) []UISample {
+	var samples []UISample
+	for _, s := range history {
+		samples = append(samples, UISample{
+			Time:    s.Time.UnixNano() / int64(time.Millisecond),
+			Corpus:  s.Corpus,
+			Added:   s.Added,
+			Deleted: s.Deleted,
+			New:     s.New,
+		})
+	}
+	return samples
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(dateFormat)
+}
+
+// recordStats periodically records stats history that is shown on graphs.
+func (hub *Hub) recordStats() {
+	for {
+		time.Sleep(statsPeriod)
+		hub.mu.Lock()
+		hub.st.RecordStats(time.Now())
+		hub.mu.Unlock()
+	}
+}
+
+const statsPeriod = 10 * time.Minute
+
 func compileTemplate(html string) *template.Template {
-	return template.Must(template.New("").Parse(strings.Replace(html, "{{STYLE}}", htmlStyle, -1)))
+	html = strings.Replace(html, "{{STYLE}}", htmlStyle, -1)
+	html = strings.Replace(html, "{{GRAPHS}}", htmlGraphs, -1)
+	return template.Must(template.New("").Parse(html))
 }
 
+const dateFormat = "Jan 02 2006 15:04:05 MST"
+
 type UISummaryData struct {
 	Managers []UIManager
+	Crashes  []UICrash
+	Samples  []UISample
 	Log      string
 }
 
 type UIManager struct {
-	Name    string
+	Name     string
+	Link     bool
+	Target   string
+	Corpus   int
+	Added    int
+	Deleted  int
+	New      int
+	LastSync string
+	Status   string
+}
+
+type UIManagerData struct {
+	UIManager
+	Connected string
+	Samples   []UISample
+}
+
+// UISample is a stats sample for graphs, Time is in milliseconds since epoch.
+type UISample struct {
+	Time    int64
 	Corpus  int
 	Added   int
 	Deleted int
@@ -83,6 +244,42 @@ func (a UIManagerArray) Len() int           { return len(a) }
 func (a UIManagerArray) Less(i, j int) bool { return a[i].Name < a[j].Name }
 func (a UIManagerArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
+type UICrash struct {
+	ID        string
+	Title     string
+	Count     int
+	Managers  int
+	FirstSeen string
+	LastSeen  string
+	Repro     bool
+	lastSeen  time.Time
+}
+
+type UICrashArray []UICrash
+
+func (a UICrashArray) Len() int           { return len(a) }
+func (a UICrashArray) Less(i, j int) bool { return a[i].lastSeen.After(a[j].lastSeen) }
+func (a UICrashArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+type UICrashData struct {
+	Title    string
+	Report   string
+	Managers []UICrashManager
+}
+
+type UICrashManager struct {
+	Name      string
+	Count     int
+	FirstSeen string
+	LastSeen  string
+}
+
+type UICrashManagerArray []UICrashManager
+
+func (a UICrashManagerArray) Len() int           { return len(a) }
+func (a UICrashManagerArray) Less(i, j int) bool { return a[i].Name < a[j].Name }
+func (a UICrashManagerArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
 var summaryTemplate = compileTemplate(`
 <!doctype html>
 <html>
@@ -98,18 +295,49 @@ var summaryTemplate = compileTemplate(`
 	<caption>Managers:</caption>
 	<tr>
 		<th>Name</th>
+		<th>Target</th>
 		<th>Corpus</th>
 		<th>Added</th>
 		<th>Deleted</th>
 		<th>New</th>
+		<th>Last sync</th>
+		<th>Status</th>
 	</tr>
 	{{range $m := $.Managers}}
 	<tr>
-		<td>{{$m.Name}}</td>
+		<td>{{if $m.Link}}<a href="/manager?name={{$m.Name}}">{{$m.Name}}</a>{{else}}{{$m.Name}}{{end}}</td>
+		<td>{{$m.Target}}</td>
 		<td>{{$m.Corpus}}</td>
 		<td>{{$m.Added}}</td>
 		<td>{{$m.Deleted}}</td>
 		<td>{{$m.New}}</td>
+		<td>{{$m.LastSync}}</td>
+		<td>{{$m.Status}}</td>
+	</tr>
+	{{end}}
+</table>
+<br><br>
+
+{{GRAPHS}}
+
+<table>
+	<caption>Crashes:</caption>
+	<tr>
+		<th>Title</th>
+		<th>Count</th>
+		<th>Managers</th>
+		<th>First seen</th>
+		<th>Last seen</th>
+		<th>Repro</th>
+	</tr>
+	{{range $c := $.Crashes}}
+	<tr>
+		<td><a href="/crash?id={{$c.ID}}">{{$c.Title}}</a></td>
+		<td>{{$c.Count}}</td>
+		<td>{{$c.Managers}}</td>
+		<td>{{$c.FirstSeen}}</td>
+		<td>{{$c.LastSeen}}</td>
+		<td>{{if $c.Repro}}yes{{end}}</td>
 	</tr>
 	{{end}}
 </table>
@@ -128,6 +356,102 @@ Log:
 </body></html>
 `)
 
+var managerTemplate = compileTemplate(`
+<!doctype html>
+<html>
+<head>
+	<title>{{.Name}} - syz-hub</title>
+	{{STYLE}}
+</head>
+<body>
+<b>{{.Name}}</b>
+<br><br>
+
+<table>
+	<tr><td>Target</td><td>{{.Target}}</td></tr>
+	<tr><td>Status</td><td>{{.Status}}</td></tr>
+	<tr><td>Connected</td><td>{{.Connected}}</td></tr>
+	<tr><td>Last sync</td><td>{{.LastSync}}</td></tr>
+	<tr><td>Corpus</td><td>{{.Corpus}}</td></tr>
+	<tr><td>Added</td><td>{{.Added}}</td></tr>
+	<tr><td>Deleted</td><td>{{.Deleted}}</td></tr>
+	<tr><td>New</td><td>{{.New}}</td></tr>
+</table>
+<br><br>
+
+{{GRAPHS}}
+
+</body></html>
+`)
+
+// htmlGraphs renders graphs of .Samples: corpus size and programs added/deleted/sent per stats period.
+const htmlGraphs = `
+<div id="corpus_graph" style="width: 100%; height: 300px"></div>
+<div id="programs_graph" style="width: 100%; height: 300px"></div>
+<script type="text/javascript" src="https://www.gstatic.com/charts/loader.js"></script>
+<script type="text/javascript">
+	google.charts.load("current", {"packages": ["corechart"]});
+	google.charts.setOnLoadCallback(function() {
+		var corpus = new google.visualization.DataTable();
+		corpus.addColumn("datetime", "Time");
+		corpus.addColumn("number", "Corpus");
+		var programs = new google.visualization.DataTable();
+		programs.addColumn("datetime", "Time");
+		programs.addColumn("number", "Added");
+		programs.addColumn("number", "Deleted");
+		programs.addColumn("number", "New");
+		{{range $s := $.Samples}}
+		corpus.addRow([new Date({{$s.Time}}), {{$s.Corpus}}]);
+		programs.addRow([new Date({{$s.Time}}), {{$s.Added}}, {{$s.Deleted}}, {{$s.New}}]);
+		{{end}}
+		var options = {legend: {position: "bottom"}, hAxis: {format: "MMM dd HH:mm"}};
+		new google.visualization.LineChart(document.getElementById("corpus_graph")).draw(corpus,
+			Object.assign({title: "Corpus size"}, options));
+		new google.visualization.LineChart(document.getElementById("programs_graph")).draw(programs,
+			Object.assign({title: "Programs added, deleted and sent to managers"}, options));
+	});
+</script>
+`
+
+var crashTemplate = compileTemplate(`
+<!doctype html>
+<html>
+<head>
+	<title>{{.Title}}</title>
+	{{STYLE}}
+</head>
+<body>
+<b>{{.Title}}</b>
+<br><br>
+
+<table>
+	<caption>Managers:</caption>
+	<tr>
+		<th>Name</th>
+		<th>Count</th>
+		<th>First seen</th>
+		<th>Last seen</th>
+	</tr>
+	{{range $m := $.Managers}}
+	<tr>
+		<td>{{$m.Name}}</td>
+		<td>{{$m.Count}}</td>
+		<td>{{$m.FirstSeen}}</td>
+		<td>{{$m.LastSeen}}</td>
+	</tr>
+	{{end}}
+</table>
+<br><br>
+
+Last report:
+<br>
+<textarea readonly rows="50">
+{{.Report}}
+</textarea>
+
+</body></html>
+`)
+
 const htmlStyle = `
 	<style type="text/css" media="screen">
 		table {
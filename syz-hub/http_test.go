@@ -0,0 +1,67 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/hash"
+	"github.com/google/syzkaller/syz-hub/state"
+)
+
+func TestHttp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-http-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := state.Make(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Connect("m0", "", "", false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AddCrash("m0", "WARNING in foo", []byte("<report>"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	hub := &Hub{st: st}
+
+	get := func(handler http.HandlerFunc, url string, status int) string {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != status {
+			t.Fatalf("%v: got status %v, want %v", url, w.Code, status)
+		}
+		return w.Body.String()
+	}
+	id := hash.Hash([]byte("WARNING in foo"))
+	if body := get(hub.httpSummary, "/", http.StatusOK); !strings.Contains(body, "/crash?id="+id.String()) {
+		t.Fatalf("summary does not contain the crash:\n%v", body)
+	}
+	if body := get(hub.httpCrash, "/crash?id="+id.String(), http.StatusOK); !strings.Contains(body, "&lt;report&gt;") ||
+		!strings.Contains(body, "m0") {
+		t.Fatalf("crash page does not contain the report:\n%v", body)
+	}
+	get(hub.httpCrash, "/crash?id=foo", http.StatusBadRequest)
+	other := hash.Hash([]byte("other"))
+	get(hub.httpCrash, "/crash?id="+other.String(), http.StatusNotFound)
+
+	st.RecordStats(time.Now())
+	if body := get(hub.httpSummary, "/", http.StatusOK); !strings.Contains(body, "/manager?name=m0") ||
+		!strings.Contains(body, "corpus.addRow") {
+		t.Fatalf("summary does not contain the manager stats:\n%v", body)
+	}
+	if body := get(hub.httpManager, "/manager?name=m0", http.StatusOK); !strings.Contains(body, "corpus.addRow") ||
+		!strings.Contains(body, "linux/amd64") {
+		t.Fatalf("manager page does not contain stats:\n%v", body)
+	}
+	get(hub.httpManager, "/manager?name=foo", http.StatusNotFound)
+}
@@ -4,22 +4,31 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/google/syzkaller/hubrpc"
 	. "github.com/google/syzkaller/log"
 	. "github.com/google/syzkaller/rpctype"
 	"github.com/google/syzkaller/syz-hub/state"
 )
 
 var (
-	flagConfig = flag.String("config", "", "config file")
+	flagConfig  = flag.String("config", "", "config file")
+	flagHashKey = flag.Bool("hash_key", false, "read a manager key from stdin, print its hash for the config and exit")
 
 	cfg *Config
 )
@@ -27,21 +36,47 @@ var (
 type Config struct {
 	Http     string
 	Rpc      string
+	Grpc     string // TCP address to serve gRPC (optional), see hubrpc package
+	Api      string // TCP address to serve the HTTP/JSON API (optional), see api.go
 	Workdir  string
+	Tls_Cert string // server certificate for the rpc endpoint (optional, enables TLS)
+	Tls_Key  string // private key for Tls_Cert
+	Tls_Ca   string // CA that signs manager certificates (optional, requires managers to present a certificate)
 	Managers []struct {
-		Name string
-		Key  string
+		Name             string
+		Key              string      // plain text key (deprecated, use Keys)
+		Keys             []ConfigKey // hashed keys
+		Enable_Syscalls  []string    // send only programs with these calls to the manager (optional)
+		Disable_Syscalls []string    // don't send programs with these calls to the manager (optional)
 	}
 }
 
+var errUnauthorized = errors.New("unauthorized manager")
+
 type Hub struct {
-	mu   sync.Mutex
-	st   *state.State
-	keys map[string]string
+	mu    sync.Mutex
+	st    *state.State
+	keys  map[string][]*managerKey
+	calls map[string]*callFilter
+
+	rpcStats map[string]*rpcMetrics // by method name, see observeRPC
 }
 
 func main() {
 	flag.Parse()
+	if *flagHashKey {
+		key, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		key = strings.TrimSpace(key)
+		if key == "" {
+			Fatalf("failed to read key from stdin: %v", err)
+		}
+		hash, err := hashKey(key)
+		if err != nil {
+			Fatalf("failed to hash key: %v", err)
+		}
+		fmt.Println(hash)
+		return
+	}
 	cfg = readConfig(*flagConfig)
 	EnableLogCaching(1000, 1<<20)
 
@@ -50,20 +85,36 @@ func main() {
 		Fatalf("failed to load state: %v", err)
 	}
 	hub := &Hub{
-		st:   st,
-		keys: make(map[string]string),
+		st: st,
+	}
+	if hub.keys, err = parseKeys(cfg); err != nil {
+		Fatalf("bad config: %v", err)
 	}
-	for _, mgr := range cfg.Managers {
-		hub.keys[mgr.Name] = mgr.Key
+	if hub.calls, err = parseCallFilters(cfg); err != nil {
+		Fatalf("bad config: %v", err)
 	}
+	go hub.reloadConfig()
 
 	hub.initHttp(cfg.Http)
+	go hub.recordStats()
 
+	var tlsCfg *tls.Config
+	if cfg.Tls_Cert != "" {
+		if tlsCfg, err = ServerTLS(cfg.Tls_Cert, cfg.Tls_Key, cfg.Tls_Ca); err != nil {
+			Fatalf("%v", err)
+		}
+	}
+	if cfg.Grpc != "" {
+		hub.serveGrpc(cfg.Grpc, tlsCfg)
+	}
+	if cfg.Api != "" {
+		hub.serveAPI(cfg.Api, tlsCfg)
+	}
 	ln, err := net.Listen("tcp", cfg.Rpc)
 	if err != nil {
 		Fatalf("failed to listen on %v: %v", cfg.Rpc, err)
 	}
-	Logf(0, "serving rpc on tcp://%v", ln.Addr())
+	Logf(0, "serving rpc on tcp://%v (tls=%v mutual=%v)", ln.Addr(), tlsCfg != nil, cfg.Tls_Ca != "")
 	s := rpc.NewServer()
 	s.Register(hub)
 	for {
@@ -74,33 +125,109 @@ func main() {
 		}
 		conn.(*net.TCPConn).SetKeepAlive(true)
 		conn.(*net.TCPConn).SetKeepAlivePeriod(time.Minute)
+		if tlsCfg != nil {
+			conn = tls.Server(conn, tlsCfg)
+		}
 		go s.ServeConn(conn)
 	}
 }
 
-func (hub *Hub) Connect(a *HubConnectArgs, r *int) error {
-	if key, ok := hub.keys[a.Name]; !ok || key != a.Key {
-		Logf(0, "connect from unauthorized manager %v", a.Name)
-		return fmt.Errorf("unauthorized manager")
+func (hub *Hub) serveGrpc(addr string, tlsCfg *tls.Config) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		Fatalf("failed to listen on %v: %v", addr, err)
+	}
+	Logf(0, "serving grpc on tcp://%v (tls=%v)", ln.Addr(), tlsCfg != nil)
+	s := hubrpc.NewServer(hub, tlsCfg)
+	go func() {
+		err := s.Serve(ln)
+		Fatalf("failed to serve grpc: %v", err)
+	}()
+}
+
+// reloadConfig reloads manager keys and call filters from the config on SIGHUP.
+// New call filters are applied when managers reconnect.
+func (hub *Hub) reloadConfig() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		data, err := ioutil.ReadFile(*flagConfig)
+		if err != nil {
+			Logf(0, "failed to reload config: %v", err)
+			continue
+		}
+		newCfg := new(Config)
+		if err := json.Unmarshal(data, newCfg); err != nil {
+			Logf(0, "failed to reload config: failed to parse config file: %v", err)
+			continue
+		}
+		keys, err := parseKeys(newCfg)
+		if err != nil {
+			Logf(0, "failed to reload keys: %v", err)
+			continue
+		}
+		calls, err := parseCallFilters(newCfg)
+		if err != nil {
+			Logf(0, "failed to reload call filters: %v", err)
+			continue
+		}
+		hub.mu.Lock()
+		hub.keys = keys
+		hub.calls = calls
+		hub.mu.Unlock()
+		Logf(0, "reloaded keys of %v managers", len(keys))
+	}
+}
+
+// auth checks the manager key, must be called with hub.mu held.
+func (hub *Hub) auth(what, name, key string) error {
+	keys, ok := hub.keys[name]
+	if !ok {
+		Logf(0, "%v from unknown manager %v", what, name)
+		return errUnauthorized
 	}
+	if err := checkKey(keys, key, time.Now()); err != nil {
+		Logf(0, "%v from unauthorized manager %v: %v", what, name, err)
+		return errUnauthorized
+	}
+	return nil
+}
+
+// Authenticate is used by the grpc transport to reject streams of unauthorized managers early.
+func (hub *Hub) Authenticate(name, key string) error {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return hub.auth("stream", name, key)
+}
+
+func (hub *Hub) Connect(a *HubConnectArgs, r *int) (err error) {
+	defer hub.observeRPC("Connect", time.Now(), &err)
 	hub.mu.Lock()
 	defer hub.mu.Unlock()
+	if err := hub.auth("connect", a.Name, a.Key); err != nil {
+		return err
+	}
 
-	Logf(0, "connect from %v: fresh=%v calls=%v corpus=%v", a.Name, a.Fresh, len(a.Calls), len(a.Corpus))
-	if err := hub.st.Connect(a.Name, a.Fresh, a.Calls, a.Corpus); err != nil {
+	Logf(0, "connect from %v: target=%v/%v fresh=%v calls=%v corpus=%v",
+		a.Name, a.OS, a.Arch, a.Fresh, len(a.Calls), len(a.Corpus))
+	calls := hub.calls[a.Name].filter(a.Calls)
+	if len(calls) != len(a.Calls) {
+		Logf(0, "connect from %v: %v calls are disabled in config", a.Name, len(a.Calls)-len(calls))
+	}
+	if err := hub.st.Connect(a.Name, a.OS, a.Arch, a.Fresh, calls, a.Corpus); err != nil {
 		Logf(0, "connect error: %v", err)
 		return err
 	}
 	return nil
 }
 
-func (hub *Hub) Sync(a *HubSyncArgs, r *HubSyncRes) error {
-	if key, ok := hub.keys[a.Name]; !ok || key != a.Key {
-		Logf(0, "sync from unauthorized manager %v", a.Name)
-		return fmt.Errorf("unauthorized manager")
-	}
+func (hub *Hub) Sync(a *HubSyncArgs, r *HubSyncRes) (err error) {
+	defer hub.observeRPC("Sync", time.Now(), &err)
 	hub.mu.Lock()
 	defer hub.mu.Unlock()
+	if err := hub.auth("sync", a.Name, a.Key); err != nil {
+		return err
+	}
 
 	inputs, err := hub.st.Sync(a.Name, a.Add, a.Del)
 	if err != nil {
@@ -112,6 +239,75 @@ func (hub *Hub) Sync(a *HubSyncArgs, r *HubSyncRes) error {
 	return nil
 }
 
+func (hub *Hub) AddRepros(a *HubAddReprosArgs, r *int) (err error) {
+	defer hub.observeRPC("AddRepros", time.Now(), &err)
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if err := hub.auth("add repros", a.Name, a.Key); err != nil {
+		return err
+	}
+
+	for _, repro := range a.Repros {
+		if err := hub.st.AddRepro(a.Name, repro.Title, repro.Prog, repro.CProg); err != nil {
+			Logf(0, "add repro error: %v", err)
+			return err
+		}
+		Logf(0, "repro from %v: %v", a.Name, repro.Title)
+	}
+	return nil
+}
+
+func (hub *Hub) AddCrashes(a *HubAddCrashesArgs, r *int) (err error) {
+	defer hub.observeRPC("AddCrashes", time.Now(), &err)
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if err := hub.auth("add crashes", a.Name, a.Key); err != nil {
+		return err
+	}
+
+	if mgr := hub.st.Managers[a.Name]; mgr == nil || mgr.Connected.IsZero() {
+		return fmt.Errorf("unconnected manager %v", a.Name)
+	}
+	// Bad crashes are skipped rather than fail the whole batch: crashes before them
+	// are already recorded, and the manager would resend and double count them.
+	now := time.Now()
+	skipped := 0
+	for _, crash := range a.Crashes {
+		if err := hub.st.AddCrash(a.Name, crash.Title, crash.Report, now); err != nil {
+			Logf(0, "add crash from %v error: %v", a.Name, err)
+			skipped++
+		}
+	}
+	Logf(0, "crashes from %v: %v (skipped %v)", a.Name, len(a.Crashes), skipped)
+	return nil
+}
+
+func (hub *Hub) GetRepros(a *HubGetReprosArgs, r *HubGetReprosRes) (err error) {
+	defer hub.observeRPC("GetRepros", time.Now(), &err)
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if err := hub.auth("get repros", a.Name, a.Key); err != nil {
+		return err
+	}
+
+	repros, err := hub.st.PendingRepros(a.Name)
+	if err != nil {
+		Logf(0, "get repros error: %v", err)
+		return err
+	}
+	for _, repro := range repros {
+		r.Repros = append(r.Repros, HubRepro{
+			Title: repro.Title,
+			Prog:  repro.Prog,
+			CProg: repro.CProg,
+		})
+	}
+	if len(repros) != 0 {
+		Logf(0, "sent %v repros to %v", len(repros), a.Name)
+	}
+	return nil
+}
+
 func readConfig(filename string) *Config {
 	if filename == "" {
 		Fatalf("supply config in -config flag")
@@ -124,5 +320,8 @@ func readConfig(filename string) *Config {
 	if err := json.Unmarshal(data, cfg); err != nil {
 		Fatalf("failed to parse config file: %v", err)
 	}
+	if cfg.Tls_Cert == "" && (cfg.Tls_Key != "" || cfg.Tls_Ca != "") {
+		Fatalf("tls_key and tls_ca require tls_cert")
+	}
 	return cfg
 }
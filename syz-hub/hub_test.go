@@ -0,0 +1,59 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/google/syzkaller/rpctype"
+	"github.com/google/syzkaller/syz-hub/state"
+)
+
+func TestAddCrashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := state.Make(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal([]byte(`{"managers": [{"name": "m0", "key": "k0"}]}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	hub := &Hub{st: st}
+	if hub.keys, err = parseKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	args := &HubAddCrashesArgs{
+		Name:    "m0",
+		Key:     "k0",
+		Crashes: []HubCrash{{Title: "crash 1"}, {Title: " "}, {Title: "crash 2"}},
+	}
+	if err := hub.AddCrashes(args, nil); err == nil {
+		t.Fatalf("crashes from unconnected manager are accepted")
+	}
+	if len(st.Crashes) != 0 {
+		t.Fatalf("got %v crashes from unconnected manager", len(st.Crashes))
+	}
+	if err := hub.Connect(&HubConnectArgs{Name: "m0", Key: "k0", Fresh: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.AddCrashes(args, nil); err != nil {
+		t.Fatalf("batch with a bad crash failed: %v", err)
+	}
+	if len(st.Crashes) != 2 {
+		t.Fatalf("got %v crashes, want 2", len(st.Crashes))
+	}
+	for _, crash := range st.Crashes {
+		if crash.Count != 1 {
+			t.Fatalf("crash %q is counted %v times", crash.Title, crash.Count)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Manager keys are stored in the config as salted hashes ("sha256$salt$hash", see hashKey).
+// A manager can have several keys at the same time, so a key can be rotated by adding
+// a new key, updating managers one by one and removing the old key (keys are reloaded
+// on SIGHUP). Keys with expiry stop working at the specified time.
+
+type managerKey struct {
+	salt    []byte
+	hash    []byte
+	expires time.Time // zero if the key does not expire
+}
+
+// ConfigKey is a manager key in the hub config.
+type ConfigKey struct {
+	Hash    string    // salted hash of the key, see -hash_key flag
+	Expires time.Time // key expiration time in RFC 3339 format (optional)
+}
+
+func hashKey(key string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256$%x$%x", salt, saltedHash(salt, key)), nil
+}
+
+func saltedHash(salt []byte, key string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
+
+func parseKey(cfgKey ConfigKey) (*managerKey, error) {
+	parts := strings.Split(cfgKey.Hash, "$")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return nil, fmt.Errorf("bad key hash %q, want sha256$salt$hash", cfgKey.Hash)
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad key salt %q: %v", parts[1], err)
+	}
+	hash, err := hex.DecodeString(parts[2])
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("bad key hash %q", parts[2])
+	}
+	return &managerKey{salt: salt, hash: hash, expires: cfgKey.Expires}, nil
+}
+
+// parseKeys returns keys of all managers in cfg.
+func parseKeys(cfg *Config) (map[string][]*managerKey, error) {
+	keys := make(map[string][]*managerKey)
+	for _, mgr := range cfg.Managers {
+		if mgr.Name == "" {
+			return nil, fmt.Errorf("manager without name")
+		}
+		if _, ok := keys[mgr.Name]; ok {
+			return nil, fmt.Errorf("duplicate manager %v", mgr.Name)
+		}
+		keys[mgr.Name] = nil
+		if mgr.Key != "" {
+			// Plain text keys are supported for compatibility with old configs.
+			salt := make([]byte, 16)
+			if _, err := rand.Read(salt); err != nil {
+				return nil, err
+			}
+			keys[mgr.Name] = append(keys[mgr.Name], &managerKey{salt: salt, hash: saltedHash(salt, mgr.Key)})
+		}
+		for _, cfgKey := range mgr.Keys {
+			key, err := parseKey(cfgKey)
+			if err != nil {
+				return nil, fmt.Errorf("manager %v: %v", mgr.Name, err)
+			}
+			keys[mgr.Name] = append(keys[mgr.Name], key)
+		}
+		if len(keys[mgr.Name]) == 0 {
+			return nil, fmt.Errorf("manager %v does not have keys", mgr.Name)
+		}
+	}
+	return keys, nil
+}
+
+// checkKey checks that key is one of the active keys of the manager.
+func checkKey(keys []*managerKey, key string, now time.Time) error {
+	expired := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(saltedHash(k.salt, key), k.hash) != 1 {
+			continue
+		}
+		if !k.expires.IsZero() && now.After(k.expires) {
+			expired = true
+			continue
+		}
+		return nil
+	}
+	if expired {
+		return fmt.Errorf("expired key")
+	}
+	return fmt.Errorf("unknown key")
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestKeys(t *testing.T) {
+	oldHash, err := hashKey("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newHash, err := hashKey("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := hashKey("new"); again == newHash {
+		t.Fatalf("key hash is not salted: %v", again)
+	}
+	data := []byte(`{"managers": [
+		{"name": "plain", "key": "plain-key"},
+		{"name": "rotated", "keys": [
+			{"hash": "` + oldHash + `", "expires": "2017-07-01T00:00:00Z"},
+			{"hash": "` + newHash + `"}
+		]}
+	]}`)
+	cfg := new(Config)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseKeys(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	after := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		key  string
+		now  time.Time
+		ok   bool
+	}{
+		{"plain", "plain-key", after, true},
+		{"plain", "plain", after, false},
+		{"rotated", "old", before, true},
+		{"rotated", "old", after, false},
+		{"rotated", "new", after, true},
+		{"rotated", "plain-key", before, false},
+	}
+	for _, test := range tests {
+		err := checkKey(keys[test.name], test.key, test.now)
+		if (err == nil) != test.ok {
+			t.Errorf("manager %v key %q at %v: got %v, want ok=%v", test.name, test.key, test.now, err, test.ok)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"managers": [{"name": "m"}]}`,
+		`{"managers": [{"name": "m", "key": "k"}, {"name": "m", "key": "k"}]}`,
+		`{"managers": [{"name": "m", "keys": [{"hash": "md5$00$00"}]}]}`,
+		`{"managers": [{"name": "m", "keys": [{"hash": "sha256$00$00"}]}]}`,
+	} {
+		cfg := new(Config)
+		if err := json.Unmarshal([]byte(bad), cfg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseKeys(cfg); err == nil {
+			t.Errorf("config %v: no error", bad)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+)
+
+// Metrics are exported on /metrics in Prometheus text format. Counters are reset on hub restart.
+
+// rpcBuckets are upper bounds of rpc latency histogram buckets in seconds.
+var rpcBuckets = []float64{0.001, 0.01, 0.1, 1, 10, 60, 300}
+
+type rpcMetrics struct {
+	buckets []uint64 // number of calls with latency <= rpcBuckets[i]
+	count   uint64
+	sum     float64
+	errors  uint64
+}
+
+// observeRPC records latency of an rpc call started at start,
+// it is deferred before taking hub.mu, so that the latency includes waiting for the lock.
+func (hub *Hub) observeRPC(method string, start time.Time, err *error) {
+	latency := time.Since(start).Seconds()
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.rpcStats == nil {
+		hub.rpcStats = make(map[string]*rpcMetrics)
+	}
+	stats := hub.rpcStats[method]
+	if stats == nil {
+		stats = &rpcMetrics{buckets: make([]uint64, len(rpcBuckets))}
+		hub.rpcStats[method] = stats
+	}
+	for i, b := range rpcBuckets {
+		if latency <= b {
+			stats.buckets[i]++
+		}
+	}
+	stats.count++
+	stats.sum += latency
+	if *err != nil {
+		stats.errors++
+	}
+}
+
+func (hub *Hub) httpMetrics(w http.ResponseWriter, r *http.Request) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(buf, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+	}
+	metric("syz_hub_corpus_programs", "gauge", "Number of programs in the hub corpus.")
+	fmt.Fprintf(buf, "syz_hub_corpus_programs %v\n", len(hub.st.Corpus))
+	metric("syz_hub_repros", "gauge", "Number of stored crash reproducers.")
+	fmt.Fprintf(buf, "syz_hub_repros %v\n", len(hub.st.Repros))
+	metric("syz_hub_crashes", "gauge", "Number of distinct crashes reported by managers.")
+	fmt.Fprintf(buf, "syz_hub_crashes %v\n", len(hub.st.Crashes))
+
+	var names []string
+	for name := range hub.st.Managers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	managerMetrics := []struct {
+		name string
+		typ  string
+		help string
+		val  func(name string) interface{}
+	}{
+		{"syz_hub_manager_connected", "gauge", "Whether the manager has connected since hub start.",
+			func(name string) interface{} { return boolMetric(!hub.st.Managers[name].Connected.IsZero()) }},
+		{"syz_hub_manager_last_sync_timestamp_seconds", "gauge", "Time of the last manager sync.",
+			func(name string) interface{} { return timeMetric(hub.st.Managers[name].LastSync) }},
+		{"syz_hub_manager_corpus_programs", "gauge", "Number of programs in the manager corpus.",
+			func(name string) interface{} { return len(hub.st.Managers[name].Corpus) }},
+		{"syz_hub_manager_syncs_total", "counter", "Number of manager syncs.",
+			func(name string) interface{} { return hub.st.Managers[name].Syncs }},
+		{"syz_hub_manager_inputs_added_total", "counter", "Number of programs added by the manager.",
+			func(name string) interface{} { return hub.st.Managers[name].Added }},
+		{"syz_hub_manager_inputs_deleted_total", "counter", "Number of programs deleted by the manager.",
+			func(name string) interface{} { return hub.st.Managers[name].Deleted }},
+		{"syz_hub_manager_inputs_dropped_total", "counter", "Number of programs added by the manager that failed to parse.",
+			func(name string) interface{} { return hub.st.Managers[name].Dropped }},
+		{"syz_hub_manager_inputs_sent_total", "counter", "Number of programs sent to the manager.",
+			func(name string) interface{} { return hub.st.Managers[name].New }},
+		{"syz_hub_manager_repros_added_total", "counter", "Number of reproducers added by the manager.",
+			func(name string) interface{} { return hub.st.Managers[name].Repros }},
+		{"syz_hub_manager_repros_sent_total", "counter", "Number of reproducers sent to the manager.",
+			func(name string) interface{} { return hub.st.Managers[name].NewRepros }},
+	}
+	for _, m := range managerMetrics {
+		metric(m.name, m.typ, m.help)
+		for _, name := range names {
+			fmt.Fprintf(buf, "%v{manager=\"%v\"} %v\n", m.name, escapeLabel(name), m.val(name))
+		}
+	}
+
+	var methods []string
+	for method := range hub.rpcStats {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	metric("syz_hub_rpc_duration_seconds", "histogram", "Latency of rpc calls.")
+	for _, method := range methods {
+		stats := hub.rpcStats[method]
+		for i, b := range rpcBuckets {
+			fmt.Fprintf(buf, "syz_hub_rpc_duration_seconds_bucket{method=\"%v\",le=\"%v\"} %v\n",
+				method, b, stats.buckets[i])
+		}
+		fmt.Fprintf(buf, "syz_hub_rpc_duration_seconds_bucket{method=\"%v\",le=\"+Inf\"} %v\n", method, stats.count)
+		fmt.Fprintf(buf, "syz_hub_rpc_duration_seconds_sum{method=\"%v\"} %v\n", method, stats.sum)
+		fmt.Fprintf(buf, "syz_hub_rpc_duration_seconds_count{method=\"%v\"} %v\n", method, stats.count)
+	}
+	metric("syz_hub_rpc_errors_total", "counter", "Number of failed rpc calls.")
+	for _, method := range methods {
+		fmt.Fprintf(buf, "syz_hub_rpc_errors_total{method=\"%v\"} %v\n", method, hub.rpcStats[method].errors)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		Logf(0, "failed to write metrics: %v", err)
+	}
+}
+
+func boolMetric(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+func timeMetric(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/google/syzkaller/rpctype"
+	"github.com/google/syzkaller/syz-hub/state"
+)
+
+func TestMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-metrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := state.Make(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal([]byte(`{"managers": [{"name": "m0", "key": "k0"}, {"name": "m\"1", "key": "k1"}]}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	hub := &Hub{st: st}
+	if hub.keys, err = parseKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	calls := []string{"getpid"}
+	if err := hub.Connect(&HubConnectArgs{Name: "m0", Key: "k0", Calls: calls}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Connect(&HubConnectArgs{Name: "m\"1", Key: "k1", Calls: calls}, nil); err != nil {
+		t.Fatal(err)
+	}
+	add := [][]byte{[]byte("getpid()\n"), []byte("bad program")}
+	if err := hub.Sync(&HubSyncArgs{Name: "m0", Key: "k0", Add: add}, new(HubSyncRes)); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Sync(&HubSyncArgs{Name: "m\"1", Key: "k1"}, new(HubSyncRes)); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Sync(&HubSyncArgs{Name: "m0", Key: "bad"}, new(HubSyncRes)); err == nil {
+		t.Fatalf("sync with bad key succeeded")
+	}
+
+	w := httptest.NewRecorder()
+	hub.httpMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE syz_hub_corpus_programs gauge\nsyz_hub_corpus_programs 1\n",
+		`syz_hub_manager_connected{manager="m0"} 1`,
+		`syz_hub_manager_syncs_total{manager="m0"} 1`,
+		`syz_hub_manager_inputs_added_total{manager="m0"} 2`,
+		`syz_hub_manager_inputs_dropped_total{manager="m0"} 1`,
+		`syz_hub_manager_inputs_sent_total{manager="m\"1"} 1`,
+		`syz_hub_rpc_duration_seconds_count{method="Sync"} 3`,
+		`syz_hub_rpc_duration_seconds_bucket{method="Connect",le="+Inf"} 2`,
+		`syz_hub_rpc_errors_total{method="Sync"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics:\n%v", body)
+	}
+}
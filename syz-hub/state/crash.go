@@ -0,0 +1,108 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/hash"
+)
+
+// Crash aggregates all occurrences of a crash with the same title across managers.
+type Crash struct {
+	Title     string
+	Report    []byte // the last report
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Managers  map[string]*CrashManager
+}
+
+// CrashManager holds info about occurrences of a crash on one manager.
+type CrashManager struct {
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// maxCrashReport is the max size of stored crash reports, reports are truncated to this size.
+const maxCrashReport = 64 << 10
+
+func (st *State) loadCrashes() error {
+	crashDir := filepath.Join(st.dir, "crash")
+	os.MkdirAll(crashDir, 0700)
+	files, err := ioutil.ReadDir(crashDir)
+	if err != nil {
+		return fmt.Errorf("failed to read %v dir: %v", crashDir, err)
+	}
+	for _, f := range files {
+		sig, err := hash.FromString(f.Name())
+		if err != nil {
+			return fmt.Errorf("bad file in crashes: %v", f.Name())
+		}
+		data, err := ioutil.ReadFile(filepath.Join(crashDir, f.Name()))
+		if err != nil {
+			return err
+		}
+		crash := new(Crash)
+		if err := json.Unmarshal(data, crash); err != nil {
+			return fmt.Errorf("bad file in crashes: %v: %v", f.Name(), err)
+		}
+		if crash.Managers == nil {
+			crash.Managers = make(map[string]*CrashManager)
+		}
+		st.Crashes[sig] = crash
+	}
+	return nil
+}
+
+// AddCrash records an occurrence of the crash on the manager.
+// Crashes are deduplicated by title.
+func (st *State) AddCrash(name, title string, report []byte, now time.Time) error {
+	mgr := st.Managers[name]
+	if mgr == nil || mgr.Connected.IsZero() {
+		return fmt.Errorf("unconnected manager %v", name)
+	}
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return fmt.Errorf("crash without title")
+	}
+	sig := hash.Hash([]byte(title))
+	crash := st.Crashes[sig]
+	if crash == nil {
+		crash = &Crash{
+			Title:     title,
+			FirstSeen: now,
+			Managers:  make(map[string]*CrashManager),
+		}
+		st.Crashes[sig] = crash
+	}
+	crash.Count++
+	crash.LastSeen = now
+	if len(report) != 0 {
+		if len(report) > maxCrashReport {
+			report = report[:maxCrashReport]
+		}
+		crash.Report = report
+	}
+	cm := crash.Managers[name]
+	if cm == nil {
+		cm = &CrashManager{FirstSeen: now}
+		crash.Managers[name] = cm
+	}
+	cm.Count++
+	cm.LastSeen = now
+	data, err := json.Marshal(crash)
+	if err != nil {
+		return err
+	}
+	writeFile(filepath.Join(st.dir, "crash", sig.String()), data)
+	return nil
+}
@@ -4,6 +4,8 @@
 package state
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -19,24 +21,48 @@ import (
 
 // State holds all internal syz-hub state including corpus and information about managers.
 // It is persisted to and can be restored from a directory.
+// Corpus programs are stored in canonical form (see prog.Canonicalize) and are keyed
+// by hash of the canonical form, so equivalent programs from different managers
+// are stored only once.
+//
+// Inputs are not bound to a target: an input is sent to a manager only while
+// some other manager with the same target has it in corpus. So once all managers
+// of a target delete an input, it is not sent to new managers of that target,
+// even if it stays in the corpus because managers of other targets still have it.
 type State struct {
 	seq      uint64
+	reproSeq uint64
 	dir      string
+	targets  map[string]map[hash.Sig]int // "os/arch" -> canonical sig -> number of managers that have it
 	Corpus   map[hash.Sig]*Input
+	Repros   map[hash.Sig]*Repro
+	Crashes  map[hash.Sig]*Crash
 	Managers map[string]*Manager
+	History  []StatsSample // stats of the whole hub, see RecordStats
 }
 
 // Manager represents one syz-manager instance.
 type Manager struct {
 	name      string
 	seq       uint64
+	reproSeq  uint64
 	dir       string
+	OS        string
+	Arch      string
 	Connected time.Time
+	LastSync  time.Time
 	Added     int
 	Deleted   int
 	New       int
+	Dropped   int // added programs that failed to parse
+	Syncs     int
+	Repros    int // repros added by the manager
+	NewRepros int // repros sent to the manager
 	Calls     map[string]struct{}
-	Corpus    map[hash.Sig]bool
+	Corpus    map[hash.Sig]int      // canonical sig -> number of manager programs with this canonical form
+	progs     map[hash.Sig]hash.Sig // sig of manager program -> canonical sig
+	History   []StatsSample
+	recorded  statsCounters // values of counters at the last RecordStats
 }
 
 // Input holds info about a single corpus program.
@@ -45,11 +71,26 @@ type Input struct {
 	prog []byte
 }
 
+// Repro is a crash reproducer shared by a manager.
+// Repros are sent to managers with the same target that have all repro calls enabled.
+type Repro struct {
+	seq     uint64
+	Manager string
+	OS      string
+	Arch    string
+	Title   string
+	Prog    []byte
+	CProg   []byte
+}
+
 // Make creates State and initializes it from dir.
 func Make(dir string) (*State, error) {
 	st := &State{
 		dir:      dir,
+		targets:  make(map[string]map[hash.Sig]int),
 		Corpus:   make(map[hash.Sig]*Input),
+		Repros:   make(map[hash.Sig]*Repro),
+		Crashes:  make(map[hash.Sig]*Crash),
 		Managers: make(map[string]*Manager),
 	}
 
@@ -59,8 +100,12 @@ func Make(dir string) (*State, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read %v dir: %v", corpusDir, err)
 	}
+	// Canonical forms may change with descriptions, so inputs are re-canonicalized
+	// on start and renamed if necessary. renamed maps old sigs to new sigs.
+	renamed := make(map[hash.Sig]hash.Sig)
 	for _, inp := range inputs {
-		data, err := ioutil.ReadFile(filepath.Join(corpusDir, inp.Name()))
+		fname := filepath.Join(corpusDir, inp.Name())
+		data, err := ioutil.ReadFile(fname)
 		if err != nil {
 			return nil, err
 		}
@@ -79,6 +124,23 @@ func Make(dir string) (*State, error) {
 		if sig.String() != parts[0] {
 			return nil, fmt.Errorf("bad file in corpus: %v, want hash %v", inp.Name(), sig.String())
 		}
+		if canon := canonicalize(data); !bytes.Equal(canon, data) {
+			os.Remove(fname)
+			data = canon
+			renamed[sig] = hash.Hash(data)
+			sig = renamed[sig]
+			fname = filepath.Join(corpusDir, fmt.Sprintf("%v-%v", sig.String(), seq))
+			if st.Corpus[sig] == nil {
+				writeFile(fname, data)
+			}
+		}
+		if inp := st.Corpus[sig]; inp != nil {
+			// Several inputs have the same canonical form, keep only one of them.
+			if inp.seq != seq {
+				os.Remove(fname)
+			}
+			continue
+		}
 		st.Corpus[sig] = &Input{
 			seq:  seq,
 			prog: data,
@@ -88,6 +150,46 @@ func Make(dir string) (*State, error) {
 		}
 	}
 
+	reproDir := filepath.Join(st.dir, "repro")
+	os.MkdirAll(reproDir, 0700)
+	repros, err := ioutil.ReadDir(reproDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v dir: %v", reproDir, err)
+	}
+	for _, f := range repros {
+		parts := strings.Split(f.Name(), "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad file in repros: %v", f.Name())
+		}
+		sig, err := hash.FromString(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad file in repros: %v", f.Name())
+		}
+		seq, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad file in repros: %v", f.Name())
+		}
+		data, err := ioutil.ReadFile(filepath.Join(reproDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		repro := &Repro{seq: seq}
+		if err := json.Unmarshal(data, repro); err != nil {
+			return nil, fmt.Errorf("bad file in repros: %v: %v", f.Name(), err)
+		}
+		st.Repros[sig] = repro
+		if st.reproSeq < seq {
+			st.reproSeq = seq
+		}
+	}
+
+	if err := st.loadCrashes(); err != nil {
+		return nil, err
+	}
+	if st.History, err = loadStats(filepath.Join(st.dir, "stats")); err != nil {
+		return nil, err
+	}
+
 	managersDir := filepath.Join(st.dir, "manager")
 	os.MkdirAll(managersDir, 0700)
 	managers, err := ioutil.ReadDir(managersDir)
@@ -105,8 +207,21 @@ func Make(dir string) (*State, error) {
 		if st.seq < mgr.seq {
 			st.seq = mgr.seq
 		}
+		seqStr, _ = ioutil.ReadFile(filepath.Join(mgr.dir, "repro_seq"))
+		mgr.reproSeq, _ = strconv.ParseUint(string(seqStr), 10, 64)
+		if st.reproSeq < mgr.reproSeq {
+			st.reproSeq = mgr.reproSeq
+		}
+		target, _ := ioutil.ReadFile(filepath.Join(mgr.dir, "target"))
+		mgr.setTarget(string(target))
+		lastSync, _ := ioutil.ReadFile(filepath.Join(mgr.dir, "last_sync"))
+		mgr.LastSync, _ = time.Parse(time.RFC3339, string(lastSync))
+		if mgr.History, err = loadStats(filepath.Join(mgr.dir, "stats")); err != nil {
+			return nil, err
+		}
 
-		mgr.Corpus = make(map[hash.Sig]bool)
+		mgr.Corpus = make(map[hash.Sig]int)
+		mgr.progs = make(map[hash.Sig]hash.Sig)
 		corpusDir := filepath.Join(mgr.dir, "corpus")
 		os.MkdirAll(corpusDir, 0700)
 		corpus, err := ioutil.ReadDir(corpusDir)
@@ -118,18 +233,36 @@ func Make(dir string) (*State, error) {
 			if err != nil {
 				return nil, fmt.Errorf("bad file in corpus: %v", input.Name())
 			}
-			mgr.Corpus[sig] = true
+			// The file contains sig of the canonical form,
+			// files written by older versions are empty.
+			canon := sig
+			data, err := ioutil.ReadFile(filepath.Join(corpusDir, input.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if len(data) != 0 {
+				if canon, err = hash.FromString(string(data)); err != nil {
+					return nil, fmt.Errorf("bad file in corpus: %v", input.Name())
+				}
+			}
+			if csig, ok := renamed[canon]; ok {
+				canon = csig
+			}
+			mgr.progs[sig] = canon
+			if mgr.Corpus[canon]++; mgr.Corpus[canon] == 1 {
+				st.indexAdd(mgr, canon)
+			}
 		}
 	}
 
 	return st, err
 }
 
-func (st *State) Connect(name string, fresh bool, calls []string, corpus [][]byte) error {
+func (st *State) Connect(name, targetOS, targetArch string, fresh bool, calls []string, corpus [][]byte) error {
 	st.seq++
 	mgr := st.Managers[name]
 	if mgr == nil {
-		mgr = new(Manager)
+		mgr = &Manager{name: name}
 		st.Managers[name] = mgr
 		mgr.dir = filepath.Join(st.dir, "manager", name)
 		os.MkdirAll(mgr.dir, 0700)
@@ -137,8 +270,16 @@ func (st *State) Connect(name string, fresh bool, calls []string, corpus [][]byt
 	mgr.Connected = time.Now()
 	if fresh {
 		mgr.seq = 0
+		mgr.reproSeq = 0
 	}
 	writeFile(filepath.Join(mgr.dir, "seq"), []byte(fmt.Sprint(mgr.seq)))
+	writeFile(filepath.Join(mgr.dir, "repro_seq"), []byte(fmt.Sprint(mgr.reproSeq)))
+	// The corpus is replaced and the target may change, so drop the old corpus from the index.
+	for sig := range mgr.Corpus {
+		st.indexDel(mgr, sig)
+	}
+	mgr.setTarget(targetOS + "/" + targetArch)
+	writeFile(filepath.Join(mgr.dir, "target"), []byte(mgr.target()))
 
 	mgr.Calls = make(map[string]struct{})
 	for _, c := range calls {
@@ -148,7 +289,8 @@ func (st *State) Connect(name string, fresh bool, calls []string, corpus [][]byt
 	corpusDir := filepath.Join(mgr.dir, "corpus")
 	os.RemoveAll(corpusDir)
 	os.MkdirAll(corpusDir, 0700)
-	mgr.Corpus = make(map[hash.Sig]bool)
+	mgr.Corpus = make(map[hash.Sig]int)
+	mgr.progs = make(map[hash.Sig]hash.Sig)
 	for _, prog := range corpus {
 		st.addInput(mgr, prog)
 	}
@@ -168,7 +310,16 @@ func (st *State) Sync(name string, add [][]byte, del []string) ([][]byte, error)
 				Logf(0, "manager %v: bad hash: %v", mgr.name, h)
 				continue
 			}
-			delete(mgr.Corpus, sig)
+			canon, ok := mgr.progs[sig]
+			if !ok {
+				continue
+			}
+			delete(mgr.progs, sig)
+			if mgr.Corpus[canon]--; mgr.Corpus[canon] <= 0 {
+				delete(mgr.Corpus, canon)
+				st.indexDel(mgr, canon)
+			}
+			os.Remove(filepath.Join(mgr.dir, "corpus", sig.String()))
 		}
 		st.purgeCorpus()
 	}
@@ -179,19 +330,89 @@ func (st *State) Sync(name string, add [][]byte, del []string) ([][]byte, error)
 		}
 	}
 	inputs, err := st.pendingInputs(mgr)
+	mgr.LastSync = time.Now()
+	mgr.Syncs++
+	writeFile(filepath.Join(mgr.dir, "last_sync"), []byte(mgr.LastSync.Format(time.RFC3339)))
 	mgr.Added += len(add)
 	mgr.Deleted += len(del)
 	mgr.New += len(inputs)
 	return inputs, err
 }
 
+// AddRepro adds a reproducer found by the manager.
+func (st *State) AddRepro(name, title string, syzRepro, cRepro []byte) error {
+	mgr := st.Managers[name]
+	if mgr == nil || mgr.Connected.IsZero() {
+		return fmt.Errorf("unconnected manager %v", name)
+	}
+	if title == "" {
+		return fmt.Errorf("repro without title")
+	}
+	if _, err := prog.CallSet(syzRepro); err != nil {
+		return fmt.Errorf("bad repro program: %v", err)
+	}
+	sig := hash.Hash(append([]byte(title+"\n"), syzRepro...))
+	if st.Repros[sig] != nil {
+		return nil
+	}
+	st.reproSeq++
+	repro := &Repro{
+		seq:     st.reproSeq,
+		Manager: name,
+		OS:      mgr.OS,
+		Arch:    mgr.Arch,
+		Title:   title,
+		Prog:    syzRepro,
+		CProg:   cRepro,
+	}
+	data, err := json.Marshal(repro)
+	if err != nil {
+		return err
+	}
+	st.Repros[sig] = repro
+	mgr.Repros++
+	writeFile(filepath.Join(st.dir, "repro", fmt.Sprintf("%v-%v", sig.String(), repro.seq)), data)
+	return nil
+}
+
+// PendingRepros returns repros of other managers that were added since the last call.
+func (st *State) PendingRepros(name string) ([]*Repro, error) {
+	mgr := st.Managers[name]
+	if mgr == nil || mgr.Connected.IsZero() {
+		return nil, fmt.Errorf("unconnected manager %v", name)
+	}
+	var repros []*Repro
+	for _, repro := range st.Repros {
+		if mgr.reproSeq >= repro.seq || repro.Manager == name ||
+			repro.OS != mgr.OS || repro.Arch != mgr.Arch {
+			continue
+		}
+		calls, err := prog.CallSet(repro.Prog)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract call set: %v\nprogram: %v", err, string(repro.Prog))
+		}
+		if !managerSupportsAllCalls(mgr.Calls, calls) {
+			continue
+		}
+		repros = append(repros, repro)
+	}
+	mgr.reproSeq = st.reproSeq
+	writeFile(filepath.Join(mgr.dir, "repro_seq"), []byte(fmt.Sprint(mgr.reproSeq)))
+	mgr.NewRepros += len(repros)
+	return repros, nil
+}
+
 func (st *State) pendingInputs(mgr *Manager) ([][]byte, error) {
 	if mgr.seq == st.seq {
 		return nil, nil
 	}
+	// Inputs are sent only to managers with the same target as one of the managers
+	// that have the input in corpus. mgr itself does not have the inputs it gets,
+	// so any manager counted in the target index is some other manager.
+	compatible := st.targets[mgr.target()]
 	var inputs [][]byte
 	for sig, inp := range st.Corpus {
-		if mgr.seq > inp.seq || mgr.Corpus[sig] {
+		if mgr.seq > inp.seq || mgr.Corpus[sig] != 0 || compatible[sig] == 0 {
 			continue
 		}
 		calls, err := prog.CallSet(inp.prog)
@@ -211,12 +432,28 @@ func (st *State) pendingInputs(mgr *Manager) ([][]byte, error) {
 func (st *State) addInput(mgr *Manager, input []byte) {
 	if _, err := prog.CallSet(input); err != nil {
 		Logf(0, "manager %v: failed to extract call set: %v, program:\n%v", mgr.name, err, string(input))
+		mgr.Dropped++
 		return
 	}
+	msig := hash.Hash(input)
+	if _, ok := mgr.progs[msig]; ok {
+		return
+	}
+	input = canonicalize(input)
 	sig := hash.Hash(input)
-	mgr.Corpus[sig] = true
-	fname := filepath.Join(mgr.dir, "corpus", sig.String())
-	writeFile(fname, nil)
+	if inp := st.Corpus[sig]; inp != nil && inp.seq != st.seq && !st.haveTarget(mgr, sig) {
+		// The input is new for managers with this target,
+		// bump its seq so that they receive it on the next sync.
+		fname := filepath.Join(st.dir, "corpus", sig.String())
+		os.Rename(fmt.Sprintf("%v-%v", fname, inp.seq), fmt.Sprintf("%v-%v", fname, st.seq))
+		inp.seq = st.seq
+	}
+	mgr.progs[msig] = sig
+	if mgr.Corpus[sig]++; mgr.Corpus[sig] == 1 {
+		st.indexAdd(mgr, sig)
+	}
+	fname := filepath.Join(mgr.dir, "corpus", msig.String())
+	writeFile(fname, []byte(sig.String()))
 	if st.Corpus[sig] == nil {
 		st.Corpus[sig] = &Input{
 			seq:  st.seq,
@@ -227,6 +464,56 @@ func (st *State) addInput(mgr *Manager, input []byte) {
 	}
 }
 
+// haveTarget returns true if any manager with the same target as mgr has sig in corpus.
+func (st *State) haveTarget(mgr *Manager, sig hash.Sig) bool {
+	return st.targets[mgr.target()][sig] != 0
+}
+
+// indexAdd records that sig appeared in corpus of mgr.
+func (st *State) indexAdd(mgr *Manager, sig hash.Sig) {
+	index := st.targets[mgr.target()]
+	if index == nil {
+		index = make(map[hash.Sig]int)
+		st.targets[mgr.target()] = index
+	}
+	index[sig]++
+}
+
+// indexDel records that sig disappeared from corpus of mgr.
+func (st *State) indexDel(mgr *Manager, sig hash.Sig) {
+	index := st.targets[mgr.target()]
+	if index[sig]--; index[sig] <= 0 {
+		delete(index, sig)
+	}
+}
+
+// setTarget sets manager target from "os/arch" string. Managers that don't report
+// the target are assumed to be linux/amd64 (the only target supported by older managers).
+func (mgr *Manager) setTarget(target string) {
+	mgr.OS, mgr.Arch = "linux", "amd64"
+	parts := strings.SplitN(strings.TrimSpace(target), "/", 2)
+	if parts[0] != "" {
+		mgr.OS = parts[0]
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		mgr.Arch = parts[1]
+	}
+}
+
+func (mgr *Manager) target() string {
+	return mgr.OS + "/" + mgr.Arch
+}
+
+// canonicalize returns canonical form of the program. Programs that can't be parsed
+// (e.g. contain calls that are unknown to this hub) are stored as is.
+func canonicalize(input []byte) []byte {
+	canon, err := prog.Canonicalize(input)
+	if err != nil {
+		return input
+	}
+	return canon
+}
+
 func writeFile(name string, data []byte) {
 	if err := ioutil.WriteFile(name, data, 0600); err != nil {
 		Logf(0, "failed to write file %v: %v", name, err)
@@ -234,14 +521,8 @@ func writeFile(name string, data []byte) {
 }
 
 func (st *State) purgeCorpus() {
-	used := make(map[hash.Sig]bool)
-	for _, mgr := range st.Managers {
-		for sig := range mgr.Corpus {
-			used[sig] = true
-		}
-	}
 	for sig, inp := range st.Corpus {
-		if used[sig] {
+		if st.used(sig) {
 			continue
 		}
 		delete(st.Corpus, sig)
@@ -249,6 +530,16 @@ func (st *State) purgeCorpus() {
 	}
 }
 
+// used returns true if any manager has sig in corpus.
+func (st *State) used(sig hash.Sig) bool {
+	for _, index := range st.targets {
+		if index[sig] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func managerSupportsAllCalls(mgr, prog map[string]struct{}) bool {
 	for c := range prog {
 		if _, ok := mgr[c]; !ok {
@@ -4,9 +4,14 @@
 package state
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/google/syzkaller/hash"
 )
 
 func TestState(t *testing.T) {
@@ -25,3 +30,406 @@ func TestState(t *testing.T) {
 		t.Fatalf("synced with unconnected manager")
 	}
 }
+
+func TestStateDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-state-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// All these programs have the same canonical form.
+	progs := [][]byte{
+		[]byte("r0 = open(&(0x7f0000000000)=\"2e00\", 0x0, 0x0)\nwrite(r0, &(0x7f0000001000)=\"0102\", 0x2)\n"),
+		[]byte("# comment\nr1 = open(&(0x7f0000000000)=\"2e00\", 0x0, 0x0)\nwrite(r1, &(0x7f0000001000)=\"0102\", 0x2)\n"),
+		[]byte("r3 = open(&(0x7f0000000000)=\"2e00\", 0x0, 0x0)\nwrite(r3, &(0x7f0000001000)=\"0102\", 0x2)\n"),
+	}
+	calls := []string{"open", "write"}
+	st, err := Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	if err := st.Connect("foo", "", "", true, calls, progs[:2]); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if err := st.Connect("bar", "", "", true, calls, nil); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if len(st.Corpus) != 1 {
+		t.Fatalf("got %v corpus programs, want 1", len(st.Corpus))
+	}
+	inputs, err := st.Sync("bar", progs[2:], nil)
+	if err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if len(inputs) != 0 {
+		t.Fatalf("bar got %v inputs equivalent to own programs", len(inputs))
+	}
+	if len(st.Corpus) != 1 {
+		t.Fatalf("got %v corpus programs, want 1", len(st.Corpus))
+	}
+	// foo deletes one of the equivalent programs, the program must stay in corpus.
+	sig0, sig2 := hash.Hash(progs[0]), hash.Hash(progs[2])
+	if _, err := st.Sync("foo", nil, []string{sig0.String()}); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if _, err := st.Sync("bar", nil, []string{sig2.String()}); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if len(st.Corpus) != 1 {
+		t.Fatalf("got %v corpus programs, want 1", len(st.Corpus))
+	}
+
+	st, err = Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	if len(st.Corpus) != 1 || len(st.Managers["foo"].Corpus) != 1 || len(st.Managers["bar"].Corpus) != 0 {
+		t.Fatalf("bad state after restart: corpus %v, foo %v, bar %v",
+			len(st.Corpus), len(st.Managers["foo"].Corpus), len(st.Managers["bar"].Corpus))
+	}
+	if err := st.Connect("foo", "", "", false, calls, nil); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if len(st.Corpus) != 0 {
+		t.Fatalf("got %v corpus programs, want 0", len(st.Corpus))
+	}
+}
+
+func TestStateTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-state-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	calls := []string{"getpid"}
+	prog := [][]byte{[]byte("getpid()\n")}
+	sync := func(name string, add [][]byte, want int) {
+		inputs, err := st.Sync(name, add, nil)
+		if err != nil {
+			t.Fatalf("failed to sync: %v", err)
+		}
+		if len(inputs) != want {
+			t.Fatalf("%v got %v inputs, want %v", name, len(inputs), want)
+		}
+	}
+	connect := func(name, targetOS, targetArch string) {
+		if err := st.Connect(name, targetOS, targetArch, true, calls, nil); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+	}
+	connect("amd64", "linux", "amd64")
+	connect("arm64", "linux", "arm64")
+	connect("arm64-2", "linux", "arm64")
+	connect("freebsd", "freebsd", "amd64")
+	connect("default", "", "")
+	sync("amd64", prog, 0)
+	sync("arm64", nil, 0)
+	sync("freebsd", nil, 0)
+	sync("default", nil, 1)
+	// The program becomes available to arm64 managers once an arm64 manager has it.
+	sync("arm64", prog, 0)
+	sync("arm64-2", nil, 1)
+	sync("freebsd", nil, 0)
+
+	st, err = Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	if mgr := st.Managers["freebsd"]; mgr.OS != "freebsd" || mgr.Arch != "amd64" {
+		t.Fatalf("got target %v/%v after restart, want freebsd/amd64", mgr.OS, mgr.Arch)
+	}
+}
+
+// checkIndex verifies that the per-target index matches manager corpora.
+func checkIndex(t *testing.T, st *State) {
+	want := make(map[string]map[hash.Sig]int)
+	for _, mgr := range st.Managers {
+		for sig := range mgr.Corpus {
+			if want[mgr.target()] == nil {
+				want[mgr.target()] = make(map[hash.Sig]int)
+			}
+			want[mgr.target()][sig]++
+		}
+	}
+	for target, index := range st.targets {
+		if len(index) != len(want[target]) {
+			t.Fatalf("target %v: index has %v programs, want %v", target, len(index), len(want[target]))
+		}
+		for sig, n := range index {
+			if want[target][sig] != n {
+				t.Fatalf("target %v: program %v is counted %v times, want %v", target, sig, n, want[target][sig])
+			}
+		}
+		delete(want, target)
+	}
+	if len(want) != 0 {
+		t.Fatalf("targets missing in index: %v", want)
+	}
+}
+
+func TestStateTargetIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-state-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	calls := []string{"getpid", "gettid"}
+	progs := [][]byte{[]byte("getpid()\n"), []byte("gettid()\n")}
+	for _, name := range []string{"a", "b"} {
+		if err := st.Connect(name, "linux", "arm64", true, calls, progs); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+	}
+	if err := st.Connect("c", "linux", "amd64", true, calls, progs[:1]); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	checkIndex(t, st)
+	sig := hash.Hash(progs[1])
+	if _, err := st.Sync("a", nil, []string{sig.String()}); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	checkIndex(t, st)
+	// b moves to amd64 and takes its corpus along, c gets the program that only b has.
+	if err := st.Connect("b", "linux", "amd64", false, calls, progs); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	checkIndex(t, st)
+	inputs, err := st.Sync("c", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if len(inputs) != 1 {
+		t.Fatalf("c got %v inputs, want 1", len(inputs))
+	}
+	if st.targets["linux/arm64"][sig] != 0 {
+		t.Fatalf("program deleted by all arm64 managers is still indexed for arm64")
+	}
+
+	st, err = Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	checkIndex(t, st)
+}
+
+func TestStateRepros(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-state-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	if err := st.AddRepro("foo", "crash", []byte("getpid()\n"), nil); err == nil {
+		t.Fatalf("added repro from unconnected manager")
+	}
+	connect := func(name, targetArch string, calls []string) {
+		if err := st.Connect(name, "linux", targetArch, false, calls, nil); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+	}
+	pending := func(name string, want int) {
+		repros, err := st.PendingRepros(name)
+		if err != nil {
+			t.Fatalf("failed to get repros: %v", err)
+		}
+		if len(repros) != want {
+			t.Fatalf("%v got %v repros, want %v", name, len(repros), want)
+		}
+	}
+	connect("foo", "amd64", []string{"getpid", "gettid"})
+	connect("bar", "amd64", []string{"getpid", "gettid"})
+	connect("baz", "amd64", []string{"getpid"})
+	connect("arm64", "arm64", []string{"getpid", "gettid"})
+	repro := []byte("# {Threaded:true}\ngetpid()\ngettid()\n")
+	if err := st.AddRepro("foo", "crash", repro, []byte("int main() {}")); err != nil {
+		t.Fatalf("failed to add repro: %v", err)
+	}
+	if err := st.AddRepro("bar", "crash", repro, nil); err != nil {
+		t.Fatalf("failed to add repro: %v", err)
+	}
+	if err := st.AddRepro("foo", "bad", []byte("foo"), nil); err == nil {
+		t.Fatalf("added bad repro")
+	}
+	pending("foo", 0)
+	pending("bar", 1)
+	pending("bar", 0)
+	pending("baz", 0)
+	pending("arm64", 0)
+
+	st, err = Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	if len(st.Repros) != 1 {
+		t.Fatalf("got %v repros after restart, want 1", len(st.Repros))
+	}
+	connect("bar", "amd64", []string{"getpid", "gettid"})
+	pending("bar", 0)
+	if err := st.Connect("bar", "linux", "amd64", true, []string{"getpid", "gettid"}, nil); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	pending("bar", 1)
+}
+
+func TestStateCrashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-state-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	t0 := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := st.AddCrash("foo", "crash", nil, t0); err == nil {
+		t.Fatalf("added crash from unconnected manager")
+	}
+	for _, name := range []string{"foo", "bar"} {
+		if err := st.Connect(name, "", "", false, nil, nil); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+	}
+	add := func(name, title, report string, tm time.Time) {
+		if err := st.AddCrash(name, title, []byte(report), tm); err != nil {
+			t.Fatalf("failed to add crash: %v", err)
+		}
+	}
+	add("foo", "KASAN: use-after-free in foo", "report 1", t0)
+	add("bar", "KASAN: use-after-free in foo\n", "report 2", t0.Add(time.Hour))
+	add("foo", "KASAN: use-after-free in foo", "", t0.Add(2*time.Hour))
+	add("bar", "WARNING in bar", "", t0)
+	if err := st.AddCrash("foo", " ", nil, t0); err == nil {
+		t.Fatalf("added crash without title")
+	}
+
+	st, err = Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	if len(st.Crashes) != 2 {
+		t.Fatalf("got %v crashes, want 2", len(st.Crashes))
+	}
+	crash := st.Crashes[hash.Hash([]byte("KASAN: use-after-free in foo"))]
+	if crash == nil {
+		t.Fatalf("can't find crash")
+	}
+	if crash.Count != 3 || string(crash.Report) != "report 2" ||
+		!crash.FirstSeen.Equal(t0) || !crash.LastSeen.Equal(t0.Add(2*time.Hour)) {
+		t.Fatalf("bad crash: %+v", crash)
+	}
+	foo, bar := crash.Managers["foo"], crash.Managers["bar"]
+	if foo == nil || foo.Count != 2 || !foo.FirstSeen.Equal(t0) || !foo.LastSeen.Equal(t0.Add(2*time.Hour)) {
+		t.Fatalf("bad foo crash: %+v", foo)
+	}
+	if bar == nil || bar.Count != 1 || !bar.FirstSeen.Equal(t0.Add(time.Hour)) {
+		t.Fatalf("bad bar crash: %+v", bar)
+	}
+}
+
+func TestStateStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-state-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	calls := []string{"getpid", "gettid"}
+	if err := st.Connect("foo", "", "", true, calls, [][]byte{[]byte("getpid()\n")}); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if err := st.Connect("bar", "", "", true, calls, nil); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t0 := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	st.RecordStats(t0)
+	if _, err := st.Sync("foo", [][]byte{[]byte("gettid()\n")}, nil); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if _, err := st.Sync("bar", nil, nil); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	for i := 1; i <= maxStatsSamples; i++ {
+		st.RecordStats(t0.Add(time.Duration(i) * time.Minute))
+	}
+
+	st, err = Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	foo, bar := st.Managers["foo"], st.Managers["bar"]
+	if len(st.History) != maxStatsSamples || len(foo.History) != maxStatsSamples {
+		t.Fatalf("got %v/%v samples, want %v", len(st.History), len(foo.History), maxStatsSamples)
+	}
+	if foo.LastSync.IsZero() {
+		t.Fatalf("last sync time is not restored")
+	}
+	// The first sample is dropped, the second one has the sync.
+	if s := foo.History[0]; !s.Time.Equal(t0.Add(time.Minute)) || s.Corpus != 2 || s.Added != 1 || s.New != 0 {
+		t.Fatalf("bad foo sample: %+v", s)
+	}
+	if s := bar.History[0]; s.Corpus != 0 || s.Added != 0 || s.New != 2 {
+		t.Fatalf("bad bar sample: %+v", s)
+	}
+	if s := st.History[0]; s.Corpus != 2 || s.Added != 1 || s.New != 2 {
+		t.Fatalf("bad total sample: %+v", s)
+	}
+	if s := st.History[1]; s.Corpus != 2 || s.Added != 0 || s.New != 0 {
+		t.Fatalf("bad total sample: %+v", s)
+	}
+}
+
+func TestStateStatsPartialWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-state-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	t0 := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	data, err := json.Marshal(StatsSample{Time: t0, Corpus: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The hub was killed while appending the second sample.
+	file := filepath.Join(dir, "stats")
+	if err := ioutil.WriteFile(file, append(append(data, '\n'), data[:len(data)/2]...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	st, err := Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	if len(st.History) != 1 || st.History[0].Corpus != 1 {
+		t.Fatalf("got samples %+v", st.History)
+	}
+	// The file is compacted, so new samples are not appended to the bad line.
+	st.RecordStats(t0.Add(time.Minute))
+	st, err = Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	if len(st.History) != 2 || !st.History[1].Time.Equal(t0.Add(time.Minute)) {
+		t.Fatalf("got samples %+v", st.History)
+	}
+}
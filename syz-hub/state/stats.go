@@ -0,0 +1,127 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+)
+
+// StatsSample is a point in stats history of a manager (or of the whole hub).
+// Added, Deleted and New are numbers of programs since the previous sample.
+type StatsSample struct {
+	Time    time.Time
+	Corpus  int
+	Added   int
+	Deleted int
+	New     int
+}
+
+// maxStatsSamples is the number of samples kept in history.
+const maxStatsSamples = 2000
+
+type statsCounters struct {
+	added   int
+	deleted int
+	new     int
+}
+
+// RecordStats adds a stats sample for every manager and for the whole hub.
+func (st *State) RecordStats(now time.Time) {
+	total := StatsSample{
+		Time:   now,
+		Corpus: len(st.Corpus),
+	}
+	for _, mgr := range st.Managers {
+		sample := StatsSample{
+			Time:    now,
+			Corpus:  len(mgr.Corpus),
+			Added:   mgr.Added - mgr.recorded.added,
+			Deleted: mgr.Deleted - mgr.recorded.deleted,
+			New:     mgr.New - mgr.recorded.new,
+		}
+		mgr.recorded = statsCounters{mgr.Added, mgr.Deleted, mgr.New}
+		mgr.History = appendSample(mgr.History, sample, filepath.Join(mgr.dir, "stats"))
+		total.Added += sample.Added
+		total.Deleted += sample.Deleted
+		total.New += sample.New
+	}
+	st.History = appendSample(st.History, total, filepath.Join(st.dir, "stats"))
+}
+
+func appendSample(history []StatsSample, sample StatsSample, file string) []StatsSample {
+	history = append(history, sample)
+	if len(history) > maxStatsSamples {
+		history = history[len(history)-maxStatsSamples:]
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
+		Logf(0, "failed to marshal stats: %v", err)
+		return history
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		Logf(0, "failed to write stats: %v", err)
+		return history
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		Logf(0, "failed to write stats: %v", err)
+	}
+	return history
+}
+
+// loadStats loads stats history from file (one json sample per line).
+// Bad lines (e.g. a partially written last sample) are skipped.
+// The file is compacted if it contains bad lines or more than maxStatsSamples samples.
+func loadStats(file string) ([]StatsSample, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var history []StatsSample
+	lines, bad := 0, 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var sample StatsSample
+		if err := json.Unmarshal(s.Bytes(), &sample); err != nil {
+			Logf(0, "skipping bad sample in stats file %v: %v", file, err)
+			bad++
+			continue
+		}
+		lines++
+		history = append(history, sample)
+		if len(history) > 2*maxStatsSamples {
+			history = append(history[:0], history[len(history)-maxStatsSamples:]...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(history) > maxStatsSamples {
+		history = history[len(history)-maxStatsSamples:]
+	}
+	if bad != 0 || lines > len(history) {
+		buf := new(bytes.Buffer)
+		for _, sample := range history {
+			data, err := json.Marshal(sample)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(append(data, '\n'))
+		}
+		writeFile(file, buf.Bytes())
+	}
+	return history, nil
+}
@@ -115,6 +115,27 @@ func (mgr *Manager) httpSummary(w http.ResponseWriter, r *http.Request) {
 	data.Stats = append(data.Stats, intStats...)
 	data.Log = CachedLogOutput()
 
+	metrics := mgr.vmPool.Metrics()
+	for i, slot := range mgr.vmPool.Status() {
+		m := &metrics[i]
+		data.VMs = append(data.VMs, UIVM{
+			Index:        i,
+			State:        slot.State.String(),
+			Since:        slot.Since.Format(dateFormat),
+			Boots:        slot.Boots,
+			BootFailures: slot.BootFailures,
+			Restarts:     m.Restarts,
+			Swaps:        slot.Swaps,
+			Crashes:      m.Crashes,
+			BootTime:     m.LastBoot.Seconds(),
+			ReadyTime:    m.LastReady.Seconds(),
+			CopyRate:     m.CopyThroughput() / (1 << 20),
+			Runs:         m.Runs,
+			RunTime:      m.AvgRunTime().Seconds(),
+			LastError:    slot.LastError,
+		})
+	}
+
 	if err := summaryTemplate.Execute(w, data); err != nil {
 		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
 		return
@@ -276,6 +297,7 @@ func (mgr *Manager) httpFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "oh, oh, oh!", http.StatusInternalServerError)
 		return
 	}
+	name := file
 	file = filepath.Join(mgr.cfg.Workdir, file)
 	f, err := os.Open(file)
 	if err != nil {
@@ -283,6 +305,21 @@ func (mgr *Manager) httpFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer f.Close()
+	if st, err := f.Stat(); err == nil && st.IsDir() {
+		// Instance artifacts of crashes are directories.
+		var files []string
+		filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(file, path)
+				files = append(files, rel)
+			}
+			return nil
+		})
+		if err := dirTemplate.Execute(w, &UIDirData{name, files}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	io.Copy(w, f)
 }
@@ -356,6 +393,10 @@ func (mgr *Manager) collectCrashes() ([]UICrashType, error) {
 			if _, err := os.Stat(filepath.Join(mgr.cfg.Workdir, reportFile)); err == nil {
 				crash.Report = reportFile
 			}
+			artifactsDir := filepath.Join("crashes", dir.Name(), "artifacts"+strconv.Itoa(int(index)))
+			if _, err := os.Stat(filepath.Join(mgr.cfg.Workdir, artifactsDir)); err == nil {
+				crash.Artifacts = artifactsDir
+			}
 			crashes = append(crashes, crash)
 			if maxTime.Before(f.ModTime()) {
 				maxTime = f.ModTime()
@@ -398,9 +439,27 @@ type UISummaryData struct {
 	Stats   []UIStat
 	Calls   []UICallType
 	Crashes []UICrashType
+	VMs     []UIVM
 	Log     string
 }
 
+type UIVM struct {
+	Index        int
+	State        string
+	Since        string
+	Boots        int
+	BootFailures int
+	Restarts     int
+	Swaps        int
+	Crashes      int
+	BootTime     float64 // seconds
+	ReadyTime    float64 // seconds
+	CopyRate     float64 // MB/sec
+	Runs         int
+	RunTime      float64 // average, seconds
+	LastError    string
+}
+
 type UICrashType struct {
 	Description string
 	LastTime    string
@@ -411,11 +470,12 @@ type UICrashType struct {
 }
 
 type UICrash struct {
-	Index  int
-	Time   string
-	Log    string
-	Report string
-	Tag    string
+	Index     int
+	Time      string
+	Log       string
+	Report    string
+	Artifacts string
+	Tag       string
 }
 
 type UIStat struct {
@@ -520,6 +580,45 @@ var summaryTemplate = template.Must(template.New("").Parse(addStyle(`
 </table>
 <br>
 
+<table>
+	<caption>VMs:</caption>
+	<tr>
+		<th>Index</th>
+		<th>State</th>
+		<th>Since</th>
+		<th>Boots</th>
+		<th>Boot Failures</th>
+		<th>Restarts</th>
+		<th>Swaps</th>
+		<th>Crashes</th>
+		<th>Boot Time</th>
+		<th>Ready Time</th>
+		<th>Copy MB/sec</th>
+		<th>Runs</th>
+		<th>Avg Run Time</th>
+		<th>Last Error</th>
+	</tr>
+	{{range $vm := $.VMs}}
+	<tr>
+		<td>{{$vm.Index}}</td>
+		<td>{{$vm.State}}</td>
+		<td>{{$vm.Since}}</td>
+		<td>{{$vm.Boots}}</td>
+		<td>{{$vm.BootFailures}}</td>
+		<td>{{$vm.Restarts}}</td>
+		<td>{{$vm.Swaps}}</td>
+		<td>{{$vm.Crashes}}</td>
+		<td>{{printf "%.1fs" $vm.BootTime}}</td>
+		<td>{{printf "%.1fs" $vm.ReadyTime}}</td>
+		<td>{{printf "%.1f" $vm.CopyRate}}</td>
+		<td>{{$vm.Runs}}</td>
+		<td>{{printf "%.0fs" $vm.RunTime}}</td>
+		<td>{{$vm.LastError}}</td>
+	</tr>
+	{{end}}
+</table>
+<br>
+
 <b>Log:</b>
 <br>
 <textarea id="log_textarea" readonly rows="50">
@@ -565,6 +664,7 @@ Report: <a href="/report?id={{.ID}}">{{.Triaged}}</a>
 		<th>#</th>
 		<th>Log</th>
 		<th>Report</th>
+		<th>Artifacts</th>
 		<th>Time</th>
 		<th>Tag</th>
 	</tr>
@@ -577,6 +677,11 @@ Report: <a href="/report?id={{.ID}}">{{.Triaged}}</a>
 		{{else}}
 			<td></td>
 		{{end}}
+		{{if $c.Artifacts}}
+			<td><a href="/file?name={{$c.Artifacts}}">artifacts</a></td>
+		{{else}}
+			<td></td>
+		{{end}}
 		<td>{{$c.Time}}</td>
 		<td>{{$c.Tag}}</td>
 	</tr>
@@ -633,6 +738,25 @@ Priorities for {{$.Call}} <br> <br>
 </body></html>
 `)))
 
+type UIDirData struct {
+	Name  string
+	Files []string
+}
+
+var dirTemplate = template.Must(template.New("").Parse(addStyle(`
+<!doctype html>
+<html>
+<head>
+	<title>{{$.Name}}</title>
+	{{STYLE}}
+</head>
+<body>
+{{range $f := $.Files}}
+	<a href="/file?name={{$.Name}}/{{$f}}">{{$f}}</a><br>
+{{end}}
+</body></html>
+`)))
+
 func addStyle(html string) string {
 	return strings.Replace(html, "{{STYLE}}", htmlStyle, -1)
 }
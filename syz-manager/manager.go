@@ -23,6 +23,7 @@ import (
 	"github.com/google/syzkaller/cover"
 	"github.com/google/syzkaller/csource"
 	"github.com/google/syzkaller/hash"
+	"github.com/google/syzkaller/hubrpc"
 	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/prog"
 	"github.com/google/syzkaller/report"
@@ -31,10 +32,25 @@ import (
 	"github.com/google/syzkaller/sys"
 	"github.com/google/syzkaller/vm"
 	_ "github.com/google/syzkaller/vm/adb"
+	_ "github.com/google/syzkaller/vm/azure"
+	_ "github.com/google/syzkaller/vm/bhyve"
+	_ "github.com/google/syzkaller/vm/chv"
+	_ "github.com/google/syzkaller/vm/docker"
+	_ "github.com/google/syzkaller/vm/ec2"
+	_ "github.com/google/syzkaller/vm/firecracker"
 	_ "github.com/google/syzkaller/vm/gce"
+	_ "github.com/google/syzkaller/vm/hcloud"
+	_ "github.com/google/syzkaller/vm/hyperv"
+	_ "github.com/google/syzkaller/vm/isolated"
 	_ "github.com/google/syzkaller/vm/kvm"
+	_ "github.com/google/syzkaller/vm/libvirt"
 	_ "github.com/google/syzkaller/vm/local"
+	_ "github.com/google/syzkaller/vm/lxd"
+	_ "github.com/google/syzkaller/vm/physical"
+	_ "github.com/google/syzkaller/vm/plugin"
+	_ "github.com/google/syzkaller/vm/proxmox"
 	_ "github.com/google/syzkaller/vm/qemu"
+	_ "github.com/google/syzkaller/vm/remoteqemu"
 )
 
 var (
@@ -51,6 +67,7 @@ type Manager struct {
 	firstConnect     time.Time
 	stats            map[string]uint64
 	vmStop           chan bool
+	vmPool           *vm.Pool
 	vmChecked        bool
 	fresh            bool
 
@@ -65,9 +82,24 @@ type Manager struct {
 	corpusCover    []cover.Cover
 	prios          [][]float32
 
-	fuzzers   map[string]*Fuzzer
-	hub       *rpc.Client
-	hubCorpus map[hash.Sig]bool
+	fuzzers    map[string]*Fuzzer
+	hub        hubrpc.Client
+	hubCorpus  map[hash.Sig]bool
+	newRepros  []HubRepro  // repros to send to hub
+	newCrashes []HubCrash  // crashes to send to hub
+	hubRepros  chan *Crash // repros received from hub that need to be validated
+
+	snapshotted map[int]*Instance   // instances waiting to be restored from snapshot, by index
+	booted      map[int]vm.Instance // instances booted on startup that are not used yet, by index
+}
+
+// Instance is a VM prepared for running the fuzzer.
+type Instance struct {
+	inst        vm.Instance
+	snapshotter vm.Snapshotter // nil if the instance does not support snapshots
+	fwdAddr     string
+	fuzzerBin   string
+	executorBin string
 }
 
 type Fuzzer struct {
@@ -76,10 +108,12 @@ type Fuzzer struct {
 }
 
 type Crash struct {
-	vmName string
-	desc   string
-	text   []byte
-	output []byte
+	vmName    string
+	desc      string
+	text      []byte
+	output    []byte
+	artifacts string // instance artifacts dir, see vm.Config.Artifacts
+	hub       bool   // reproducer received from hub
 }
 
 func main() {
@@ -120,9 +154,18 @@ func RunManager(cfg *config.Config, syscalls map[int]bool, suppressions []*regex
 		suppressions:    suppressions,
 		corpusCover:     make([]cover.Cover, sys.CallCount),
 		fuzzers:         make(map[string]*Fuzzer),
+		snapshotted:     make(map[int]*Instance),
+		booted:          make(map[int]vm.Instance),
 		fresh:           true,
 		vmStop:          make(chan bool),
+		hubRepros:       make(chan *Crash, 100),
+	}
+
+	var err error
+	if mgr.vmPool, err = vm.NewPool(cfg.Type, cfg.Count); err != nil {
+		Fatalf("%v", err)
 	}
+	mgr.vmPool.SetBootParallelism(cfg.Boot_Parallelism)
 
 	Logf(0, "loading corpus...")
 	mgr.persistentCorpus = newPersistentSet(filepath.Join(cfg.Workdir, "corpus"), func(data []byte) bool {
@@ -240,6 +283,7 @@ func (mgr *Manager) vmLoop() {
 	for i := range instances {
 		instances[i] = mgr.cfg.Count - i - 1
 	}
+	mgr.bootAll()
 	runDone := make(chan *RunResult, 1)
 	pendingRepro := make(map[*Crash]bool)
 	reproducing := make(map[string]bool)
@@ -266,6 +310,8 @@ func (mgr *Manager) vmLoop() {
 			len(pendingRepro), len(reproducing), len(reproQueue))
 		if shutdown == nil {
 			if len(instances) == mgr.cfg.Count {
+				mgr.dropSnapshotted(instances...)
+				mgr.dropBooted()
 				return
 			}
 		} else {
@@ -276,6 +322,9 @@ func (mgr *Manager) vmLoop() {
 				reproQueue = reproQueue[:last]
 				vmIndexes := append([]int{}, instances[len(instances)-reproInstances:]...)
 				instances = instances[:len(instances)-reproInstances]
+				// Repro creates own instances with the same indexes.
+				mgr.dropSnapshotted(vmIndexes...)
+				mgr.dropBooted(vmIndexes...)
 				Logf(1, "loop: starting repro of '%v' on instances %+v", crash.desc, vmIndexes)
 				go func() {
 					res, err := repro.Run(crash.output, mgr.cfg, vmIndexes)
@@ -288,10 +337,7 @@ func (mgr *Manager) vmLoop() {
 				instances = instances[:last]
 				Logf(1, "loop: starting instance %v", idx)
 				go func() {
-					vmCfg, err := config.CreateVMConfig(mgr.cfg, idx)
-					if err != nil {
-						Fatalf("failed to create VM config: %v", err)
-					}
+					vmCfg := mgr.createVMConfig(idx)
 					crash, err := mgr.runInstance(vmCfg, idx == 0)
 					runDone <- &RunResult{idx, crash, err}
 				}()
@@ -336,6 +382,12 @@ func (mgr *Manager) vmLoop() {
 			delete(reproducing, res.crash.desc)
 			instances = append(instances, res.instances...)
 			mgr.saveRepro(res.crash, res.res)
+		case crash := <-mgr.hubRepros:
+			if shutdown != nil && mgr.needRepro(crash.desc) {
+				Logf(1, "loop: add pending repro from hub for '%v'", crash.desc)
+				mgr.saveHubRepro(crash)
+				pendingRepro[crash] = true
+			}
 		case <-shutdown:
 			Logf(1, "loop: shutting down...")
 			shutdown = nil
@@ -343,25 +395,45 @@ func (mgr *Manager) vmLoop() {
 	}
 }
 
-func (mgr *Manager) runInstance(vmCfg *vm.Config, first bool) (*Crash, error) {
-	inst, err := vm.Create(mgr.cfg.Type, vmCfg)
+func (mgr *Manager) createVMConfig(idx int) *vm.Config {
+	vmCfg, err := config.CreateVMConfig(mgr.cfg, idx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create instance: %v", err)
+		Fatalf("failed to create VM config: %v", err)
 	}
-	defer inst.Close()
+	vmCfg.Artifacts = filepath.Join(mgr.cfg.Workdir, "instances", vmCfg.Name)
+	return vmCfg
+}
 
-	fwdAddr, err := inst.Forward(mgr.port)
-	if err != nil {
-		return nil, fmt.Errorf("failed to setup port forwarding: %v", err)
+// bootAll boots all instances concurrently, so that large pools start quickly.
+// Instances that fail to boot are retried when the slot is first used.
+func (mgr *Manager) bootAll() {
+	var cfgs []*vm.Config
+	for idx := 0; idx < mgr.cfg.Count; idx++ {
+		cfgs = append(cfgs, mgr.createVMConfig(idx))
 	}
-	fuzzerBin, err := inst.Copy(filepath.Join(mgr.cfg.Syzkaller, "bin", "syz-fuzzer"))
+	start := time.Now()
+	insts, err := mgr.vmPool.CreateAll(cfgs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to copy binary: %v", err)
+		Logf(0, "%v", err)
+	}
+	booted := 0
+	mgr.mu.Lock()
+	for idx, inst := range insts {
+		if inst != nil {
+			mgr.booted[idx] = inst
+			booted++
+		}
 	}
-	executorBin, err := inst.Copy(filepath.Join(mgr.cfg.Syzkaller, "bin", "syz-executor"))
+	mgr.mu.Unlock()
+	Logf(0, "booted %v/%v test machines in %v", booted, len(cfgs), time.Since(start))
+}
+
+func (mgr *Manager) runInstance(vmCfg *vm.Config, first bool) (*Crash, error) {
+	inst, err := mgr.createInstance(vmCfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to copy binary: %v", err)
+		return nil, err
 	}
+	defer mgr.releaseInstance(vmCfg.Index, inst)
 
 	// Leak detection significantly slows down fuzzing, so detect leaks only on the first instance.
 	leak := first && mgr.cfg.Leak
@@ -374,14 +446,25 @@ func (mgr *Manager) runInstance(vmCfg *vm.Config, first bool) (*Crash, error) {
 
 	// Run the fuzzer binary.
 	start := time.Now()
-	cmd := fmt.Sprintf("%v -executor=%v -name=%v -manager=%v -output=%v -procs=%v -leak=%v -cover=%v -sandbox=%v -debug=%v -v=%d",
-		fuzzerBin, executorBin, vmCfg.Name, fwdAddr, mgr.cfg.Output, procs, leak, mgr.cfg.Cover, mgr.cfg.Sandbox, *flagDebug, fuzzerV)
-	outc, errc, err := inst.Run(time.Hour, mgr.vmStop, cmd)
+	cmd := &vm.Command{Args: []string{
+		inst.fuzzerBin,
+		"-executor=" + inst.executorBin,
+		"-name=" + vmCfg.Name,
+		"-manager=" + inst.fwdAddr,
+		"-output=" + mgr.cfg.Output,
+		fmt.Sprintf("-procs=%v", procs),
+		fmt.Sprintf("-leak=%v", leak),
+		fmt.Sprintf("-cover=%v", mgr.cfg.Cover),
+		"-sandbox=" + mgr.cfg.Sandbox,
+		fmt.Sprintf("-debug=%v", *flagDebug),
+		fmt.Sprintf("-v=%d", fuzzerV),
+	}}
+	outc, errc, err := vm.RunCommand(inst.inst, time.Hour, mgr.vmStop, cmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to run fuzzer: %v", err)
 	}
 
-	desc, text, output, crashed, timedout := vm.MonitorExecution(outc, errc, mgr.cfg.Type == "local", true)
+	desc, text, output, crashed, timedout := vm.MonitorExecution(inst.inst, outc, errc, mgr.cfg.Type == "local", true)
 	if timedout {
 		// This is the only "OK" outcome.
 		Logf(0, "%v: running for %v, restarting", vmCfg.Name, time.Since(start))
@@ -391,7 +474,111 @@ func (mgr *Manager) runInstance(vmCfg *vm.Config, first bool) (*Crash, error) {
 		// syz-fuzzer exited, but it should not.
 		desc = "lost connection to test machine"
 	}
-	return &Crash{vmCfg.Name, desc, text, output}, nil
+	return &Crash{vmCfg.Name, desc, text, output, vmCfg.Artifacts, false}, nil
+}
+
+// createInstance restores the instance snapshotted in the previous run if possible,
+// otherwise creates a new instance, copies binaries into it and snapshots it.
+func (mgr *Manager) createInstance(vmCfg *vm.Config) (*Instance, error) {
+	mgr.mu.Lock()
+	inst := mgr.snapshotted[vmCfg.Index]
+	delete(mgr.snapshotted, vmCfg.Index)
+	mgr.mu.Unlock()
+	if inst != nil {
+		err := inst.snapshotter.Restore()
+		if err == nil {
+			Logf(1, "%v: restored snapshot", vmCfg.Name)
+			return inst, nil
+		}
+		Logf(0, "%v: failed to restore snapshot, recreating instance: %v", vmCfg.Name, err)
+		inst.inst.Close()
+	}
+
+	mgr.mu.Lock()
+	vmInst := mgr.booted[vmCfg.Index]
+	delete(mgr.booted, vmCfg.Index)
+	mgr.mu.Unlock()
+	var err error
+	if vmInst == nil {
+		if vmInst, err = mgr.vmPool.Create(vmCfg); err != nil {
+			return nil, fmt.Errorf("failed to create instance: %v", err)
+		}
+	}
+	inst = &Instance{inst: vmInst}
+	if inst.fwdAddr, err = vmInst.Forward(mgr.port); err != nil {
+		vmInst.Close()
+		return nil, fmt.Errorf("failed to setup port forwarding: %v", err)
+	}
+	bins, err := vmInst.CopyAll([]string{
+		filepath.Join(vm.BinDir(mgr.cfg.Syzkaller, mgr.cfg.Arch), "syz-fuzzer"),
+		filepath.Join(vm.BinDir(mgr.cfg.Syzkaller, mgr.cfg.Arch), "syz-executor"),
+	})
+	if err != nil {
+		vmInst.Close()
+		return nil, fmt.Errorf("failed to copy binaries: %v", err)
+	}
+	inst.fuzzerBin, inst.executorBin = bins[0], bins[1]
+	if s := vm.AsSnapshotter(vmInst); s != nil {
+		if err := s.Snapshot(); err != nil {
+			Logf(0, "%v: failed to snapshot instance: %v", vmCfg.Name, err)
+		} else {
+			inst.snapshotter = s
+		}
+	}
+	return inst, nil
+}
+
+// releaseInstance keeps snapshotted instances for reuse, and closes the rest.
+func (mgr *Manager) releaseInstance(idx int, inst *Instance) {
+	select {
+	case <-vm.Shutdown:
+		inst.inst.Close()
+		return
+	default:
+	}
+	if inst.snapshotter == nil {
+		inst.inst.Close()
+		return
+	}
+	mgr.mu.Lock()
+	mgr.snapshotted[idx] = inst
+	mgr.mu.Unlock()
+}
+
+// dropSnapshotted closes snapshotted instances with the given indexes.
+func (mgr *Manager) dropSnapshotted(indexes ...int) {
+	mgr.mu.Lock()
+	var insts []*Instance
+	for _, idx := range indexes {
+		if inst := mgr.snapshotted[idx]; inst != nil {
+			insts = append(insts, inst)
+			delete(mgr.snapshotted, idx)
+		}
+	}
+	mgr.mu.Unlock()
+	for _, inst := range insts {
+		inst.inst.Close()
+	}
+}
+
+// dropBooted closes unused booted instances with the given indexes, or all of them.
+func (mgr *Manager) dropBooted(indexes ...int) {
+	mgr.mu.Lock()
+	var insts []vm.Instance
+	for idx, inst := range mgr.booted {
+		drop := len(indexes) == 0
+		for _, idx1 := range indexes {
+			drop = drop || idx == idx1
+		}
+		if drop {
+			insts = append(insts, inst)
+			delete(mgr.booted, idx)
+		}
+	}
+	mgr.mu.Unlock()
+	for _, inst := range insts {
+		inst.Close()
+	}
 }
 
 func (mgr *Manager) isSuppressed(crash *Crash) bool {
@@ -412,6 +599,12 @@ func (mgr *Manager) saveCrash(crash *Crash) {
 	Logf(0, "%v: crash: %v", crash.vmName, crash.desc)
 	mgr.mu.Lock()
 	mgr.stats["crashes"]++
+	if mgr.cfg.Hub_Addr != "" && len(mgr.newCrashes) < maxHubCrashes {
+		mgr.newCrashes = append(mgr.newCrashes, HubCrash{
+			Title:  crash.desc,
+			Report: crash.text,
+		})
+	}
 	mgr.mu.Unlock()
 
 	sig := hash.Hash([]byte(crash.desc))
@@ -450,11 +643,29 @@ func (mgr *Manager) saveCrash(crash *Crash) {
 		}
 		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("report%v", oldestI)), []byte(crash.text), 0660)
 	}
+	// The instance is already closed and its slot is not reused until the crash is saved.
+	artifacts := filepath.Join(dir, fmt.Sprintf("artifacts%v", oldestI))
+	os.RemoveAll(artifacts)
+	if crash.artifacts != "" {
+		if err := vm.SnapshotArtifacts(crash.artifacts, artifacts); err != nil {
+			Logf(0, "failed to save instance artifacts: %v", err)
+		}
+	}
 }
 
 const maxReproAttempts = 3
 
+// maxHubCrashes limits the number of crashes queued for hub while it is unreachable.
+const maxHubCrashes = 1000
+
+// maxHubRepros is the same as maxHubCrashes for repros.
+const maxHubRepros = 100
+
 func (mgr *Manager) needRepro(desc string) bool {
+	if mgr.cfg.Arch != vm.HostArch {
+		// Reproduction and C programs use syscall descriptions of the host arch.
+		return false
+	}
 	sig := hash.Hash([]byte(desc))
 	dir := filepath.Join(mgr.crashdir, sig.String())
 	if _, err := os.Stat(filepath.Join(dir, "repro.prog")); err == nil {
@@ -468,9 +679,26 @@ func (mgr *Manager) needRepro(desc string) bool {
 	return false
 }
 
+// saveHubRepro saves description of a crash that has a reproducer on another manager,
+// so that the crash is shown in the crash list while it is being reproduced.
+func (mgr *Manager) saveHubRepro(crash *Crash) {
+	sig := hash.Hash([]byte(crash.desc))
+	dir := filepath.Join(mgr.crashdir, sig.String())
+	os.MkdirAll(dir, 0700)
+	if _, err := os.Stat(filepath.Join(dir, "description")); err == nil {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "description"), []byte(crash.desc+"\n"), 0660); err != nil {
+		Logf(0, "failed to write crash: %v", err)
+	}
+}
+
 func (mgr *Manager) saveRepro(crash *Crash, res *repro.Result) {
 	sig := hash.Hash([]byte(crash.desc))
 	dir := filepath.Join(mgr.crashdir, sig.String())
+	if crash.hub {
+		Logf(0, "repro from hub for '%v' reproduced=%v", crash.desc, res != nil)
+	}
 	if res == nil {
 		for i := 0; i < maxReproAttempts; i++ {
 			name := filepath.Join(dir, fmt.Sprintf("repro%v", i))
@@ -490,8 +718,10 @@ func (mgr *Manager) saveRepro(crash *Crash, res *repro.Result) {
 	if len(crash.text) > 0 {
 		ioutil.WriteFile(filepath.Join(dir, "repro.report"), []byte(crash.text), 0660)
 	}
+	var cprog []byte
 	if res.CRepro {
-		cprog, err := csource.Write(res.Prog, res.Opts)
+		var err error
+		cprog, err = csource.Write(res.Prog, res.Opts)
 		if err == nil {
 			formatted, err := csource.Format(cprog)
 			if err == nil {
@@ -499,9 +729,21 @@ func (mgr *Manager) saveRepro(crash *Crash, res *repro.Result) {
 			}
 			ioutil.WriteFile(filepath.Join(dir, "repro.cprog"), cprog, 0660)
 		} else {
+			cprog = nil
 			Logf(0, "failed to write C source: %v", err)
 		}
 	}
+	if mgr.cfg.Hub_Addr != "" && !crash.hub {
+		mgr.mu.Lock()
+		if len(mgr.newRepros) < maxHubRepros {
+			mgr.newRepros = append(mgr.newRepros, HubRepro{
+				Title: crash.desc,
+				Prog:  append([]byte(opts), prog...),
+				CProg: cprog,
+			})
+		}
+		mgr.mu.Unlock()
+	}
 }
 
 func (mgr *Manager) minimizeCorpus() {
@@ -606,7 +848,12 @@ func (mgr *Manager) NewInput(a *NewInputArgs, r *int) error {
 		Fatalf("fuzzer %v is not connected", a.Name)
 	}
 
-	call := sys.CallID[a.Call]
+	call, ok := sys.CallID[a.Call]
+	if !ok {
+		// Fuzzers of other archs can find inputs with calls that are unknown on the host.
+		Logf(0, "dropping new input with unknown call %v from %v", a.Call, a.Name)
+		return nil
+	}
 	if len(cover.Difference(a.Cover, mgr.corpusCover[call])) == 0 {
 		return nil
 	}
@@ -667,7 +914,13 @@ func (mgr *Manager) hubSync() {
 
 	mgr.minimizeCorpus()
 	if mgr.hub == nil {
-		conn, err := rpc.Dial("tcp", mgr.cfg.Hub_Addr)
+		tlsCfg, err := config.HubTLS(mgr.cfg)
+		if err != nil {
+			Logf(0, "failed to connect to hub at %v: %v", mgr.cfg.Hub_Addr, err)
+			return
+		}
+		conn, err := hubrpc.Dial(mgr.cfg.Hub_Transport, mgr.cfg.Hub_Addr, tlsCfg,
+			time.Duration(mgr.cfg.Hub_Timeout)*time.Second)
 		if err != nil {
 			Logf(0, "failed to connect to hub at %v: %v", mgr.cfg.Hub_Addr, err)
 			return
@@ -676,6 +929,8 @@ func (mgr *Manager) hubSync() {
 		a := &HubConnectArgs{
 			Name:  mgr.cfg.Name,
 			Key:   mgr.cfg.Hub_Key,
+			OS:    "linux",
+			Arch:  mgr.cfg.Arch,
 			Fresh: mgr.fresh,
 			Calls: mgr.enabledCalls,
 		}
@@ -684,7 +939,7 @@ func (mgr *Manager) hubSync() {
 			mgr.hubCorpus[hash.Hash(inp.Prog)] = true
 			a.Corpus = append(a.Corpus, inp.Prog)
 		}
-		if err := mgr.hub.Call("Hub.Connect", a, nil); err != nil {
+		if err := mgr.hub.Connect(a); err != nil {
 			Logf(0, "Hub.Connect rpc failed: %v", err)
 			mgr.hub.Close()
 			mgr.hub = nil
@@ -715,8 +970,8 @@ func (mgr *Manager) hubSync() {
 		delete(mgr.hubCorpus, sig)
 		a.Del = append(a.Del, sig.String())
 	}
-	r := new(HubSyncRes)
-	if err := mgr.hub.Call("Hub.Sync", a, r); err != nil {
+	r, err := mgr.hub.Sync(a)
+	if err != nil {
 		Logf(0, "Hub.Sync rpc failed: %v", err)
 		mgr.hub.Close()
 		mgr.hub = nil
@@ -736,4 +991,63 @@ func (mgr *Manager) hubSync() {
 	mgr.stats["hub drop"] += uint64(dropped)
 	mgr.stats["hub new"] += uint64(len(r.Inputs) - dropped)
 	Logf(0, "hub sync: add %v, del %v, drop %v, new %v", len(a.Add), len(a.Del), dropped, len(r.Inputs)-dropped)
+
+	if len(mgr.newRepros) != 0 {
+		a := &HubAddReprosArgs{
+			Name:   mgr.cfg.Name,
+			Key:    mgr.cfg.Hub_Key,
+			Repros: mgr.newRepros,
+		}
+		if err := mgr.hub.AddRepros(a); err != nil {
+			Logf(0, "Hub.AddRepros rpc failed: %v", err)
+			mgr.hub.Close()
+			mgr.hub = nil
+			return
+		}
+		mgr.stats["hub repro send"] += uint64(len(mgr.newRepros))
+		mgr.newRepros = nil
+	}
+	if len(mgr.newCrashes) != 0 {
+		a := &HubAddCrashesArgs{
+			Name:    mgr.cfg.Name,
+			Key:     mgr.cfg.Hub_Key,
+			Crashes: mgr.newCrashes,
+		}
+		if err := mgr.hub.AddCrashes(a); err != nil {
+			Logf(0, "Hub.AddCrashes rpc failed: %v", err)
+			mgr.hub.Close()
+			mgr.hub = nil
+			return
+		}
+		mgr.newCrashes = nil
+	}
+	repros, err := mgr.hub.GetRepros(&HubGetReprosArgs{
+		Name: mgr.cfg.Name,
+		Key:  mgr.cfg.Hub_Key,
+	})
+	if err != nil {
+		Logf(0, "Hub.GetRepros rpc failed: %v", err)
+		mgr.hub.Close()
+		mgr.hub = nil
+		return
+	}
+	for _, repro := range repros.Repros {
+		if _, err := prog.Deserialize(repro.Prog); err != nil {
+			Logf(0, "dropping repro from hub for '%v': %v", repro.Title, err)
+			continue
+		}
+		// Repro is validated by reproducing the crash from a log with the single program.
+		crash := &Crash{
+			vmName: "hub",
+			desc:   repro.Title,
+			output: append([]byte("executing program 0:\n"), repro.Prog...),
+			hub:    true,
+		}
+		select {
+		case mgr.hubRepros <- crash:
+			mgr.stats["hub repro recv"]++
+		default:
+			Logf(0, "dropping repro from hub for '%v': too many pending repros", repro.Title)
+		}
+	}
 }
@@ -22,9 +22,24 @@ import (
 	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/vm"
 	_ "github.com/google/syzkaller/vm/adb"
+	_ "github.com/google/syzkaller/vm/azure"
+	_ "github.com/google/syzkaller/vm/bhyve"
+	_ "github.com/google/syzkaller/vm/chv"
+	_ "github.com/google/syzkaller/vm/docker"
+	_ "github.com/google/syzkaller/vm/ec2"
+	_ "github.com/google/syzkaller/vm/firecracker"
 	_ "github.com/google/syzkaller/vm/gce"
+	_ "github.com/google/syzkaller/vm/hcloud"
+	_ "github.com/google/syzkaller/vm/hyperv"
+	_ "github.com/google/syzkaller/vm/isolated"
 	_ "github.com/google/syzkaller/vm/kvm"
+	_ "github.com/google/syzkaller/vm/libvirt"
+	_ "github.com/google/syzkaller/vm/lxd"
+	_ "github.com/google/syzkaller/vm/physical"
+	_ "github.com/google/syzkaller/vm/plugin"
+	_ "github.com/google/syzkaller/vm/proxmox"
 	_ "github.com/google/syzkaller/vm/qemu"
+	_ "github.com/google/syzkaller/vm/remoteqemu"
 )
 
 var (
@@ -88,32 +103,34 @@ func runInstance(cfg *config.Config, vmCfg *vm.Config) {
 	}
 	defer inst.Close()
 
-	execprogBin, err := inst.Copy(filepath.Join(cfg.Syzkaller, "bin", "syz-execprog"))
+	files, err := inst.CopyAll([]string{
+		filepath.Join(vm.BinDir(cfg.Syzkaller, cfg.Arch), "syz-execprog"),
+		filepath.Join(vm.BinDir(cfg.Syzkaller, cfg.Arch), "syz-executor"),
+		flag.Args()[0],
+	})
 	if err != nil {
-		Logf(0, "failed to copy execprog: %v", err)
-		return
-	}
-	executorBin, err := inst.Copy(filepath.Join(cfg.Syzkaller, "bin", "syz-executor"))
-	if err != nil {
-		Logf(0, "failed to copy executor: %v", err)
-		return
-	}
-	logFile, err := inst.Copy(flag.Args()[0])
-	if err != nil {
-		Logf(0, "failed to copy log: %v", err)
+		Logf(0, "failed to copy files: %v", err)
 		return
 	}
+	execprogBin, executorBin, logFile := files[0], files[1], files[2]
 
-	cmd := fmt.Sprintf("%v -executor=%v -repeat=0 -procs=%v -cover=0 -sandbox=%v %v",
-		execprogBin, executorBin, cfg.Procs, cfg.Sandbox, logFile)
-	outc, errc, err := inst.Run(time.Hour, nil, cmd)
+	cmd := &vm.Command{Args: []string{
+		execprogBin,
+		"-executor=" + executorBin,
+		"-repeat=0",
+		fmt.Sprintf("-procs=%v", cfg.Procs),
+		"-cover=0",
+		"-sandbox=" + cfg.Sandbox,
+		logFile,
+	}}
+	outc, errc, err := vm.RunCommand(inst, time.Hour, nil, cmd)
 	if err != nil {
 		Logf(0, "failed to run execprog: %v", err)
 		return
 	}
 
 	Logf(0, "%v: crushing...", vmCfg.Name)
-	desc, _, output, crashed, timedout := vm.MonitorExecution(outc, errc, cfg.Type == "local", true)
+	desc, _, output, crashed, timedout := vm.MonitorExecution(inst, outc, errc, cfg.Type == "local", true)
 	if timedout {
 		// This is the only "OK" outcome.
 		Logf(0, "%v: running long enough, restarting", vmCfg.Name)
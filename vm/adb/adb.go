@@ -12,6 +12,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,18 +21,31 @@ import (
 )
 
 func init() {
-	vm.Register("adb", ctor)
+	vm.Register("adb", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are adb-specific parameters (the vm section of the manager config).
+// {{DEVICE}} in the commands is replaced with the device ID.
+type Params struct {
+	Console     string // command that streams console of a device (optional, USB serial consoles are auto-detected otherwise)
+	Power_Cycle string // command that power cycles a hung device (e.g. with a relay)
+}
+
+func (params *Params) Validate() error {
+	return nil
 }
 
 type instance struct {
 	cfg     *vm.Config
-	console string
+	params  *Params
+	console vm.Console
 	closed  chan bool
 }
 
 func ctor(cfg *vm.Config) (vm.Instance, error) {
 	inst := &instance{
 		cfg:    cfg,
+		params: cfg.Params.(*Params),
 		closed: make(chan bool),
 	}
 	closeInst := inst
@@ -46,9 +60,16 @@ func ctor(cfg *vm.Config) (vm.Instance, error) {
 	if err := inst.repair(); err != nil {
 		return nil, err
 	}
-	var err error
-	if inst.console, err = findConsole(inst.cfg.Device); err != nil {
-		return nil, err
+	if inst.console = vm.NewConsole(cfg, nil); inst.console == nil {
+		if inst.params.Console != "" {
+			inst.console = vm.CommandConsole("sh", "-c", strings.Replace(inst.params.Console, "{{DEVICE}}", inst.cfg.Device, -1))
+		} else {
+			con, err := findConsole(inst.cfg.Device)
+			if err != nil {
+				return nil, err
+			}
+			inst.console = vm.CommandConsole("cat", con)
+		}
 	}
 	if err := inst.checkBatteryLevel(); err != nil {
 		return nil, err
@@ -163,6 +184,13 @@ func findConsole(dev string) (string, error) {
 	return con, nil
 }
 
+func (inst *instance) Diagnose() []byte {
+	vm.Sysrq(func(command string) *exec.Cmd {
+		return exec.Command(inst.cfg.Bin, "-s", inst.cfg.Device, "shell", command)
+	})
+	return nil
+}
+
 func (inst *instance) Forward(port int) (string, error) {
 	// If 35099 turns out to be busy, try to forward random ports several times.
 	devicePort := 35099
@@ -217,6 +245,32 @@ func (inst *instance) adb(args ...string) ([]byte, error) {
 }
 
 func (inst *instance) repair() error {
+	if err := inst.reboot(); err != nil {
+		if inst.params.Power_Cycle == "" {
+			return err
+		}
+		// The device is hung hard, power cycle it with the relay.
+		Logf(0, "device %v: %v, power cycling", inst.cfg.Device, err)
+		cmd := exec.Command("sh", "-c", strings.Replace(inst.params.Power_Cycle, "{{DEVICE}}", inst.cfg.Device, -1))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("power cycle failed: %v\n%s", err, out)
+		}
+		if !vm.SleepInterruptible(10 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+		if err := inst.waitForSsh(); err != nil {
+			return err
+		}
+	}
+	// Switch to root for userdebug builds.
+	inst.adb("root")
+	if err := inst.waitForSsh(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (inst *instance) reboot() error {
 	// Assume that the device is in a bad state initially and reboot it.
 	// Ignore errors, maybe we will manage to reboot it anyway.
 	inst.waitForSsh()
@@ -225,21 +279,16 @@ func (inst *instance) repair() error {
 	// and the binary can already be on the device.
 	inst.adb("push", inst.cfg.Executor, "/data/syz-executor")
 	if _, err := inst.adb("shell", "/data/syz-executor", "reboot"); err != nil {
-		return err
+		// Fallback to adb reboot.
+		if _, err := inst.adb("reboot"); err != nil {
+			return err
+		}
 	}
 	// Now give it another 5 minutes to boot.
 	if !vm.SleepInterruptible(10 * time.Second) {
 		return fmt.Errorf("shutdown in progress")
 	}
-	if err := inst.waitForSsh(); err != nil {
-		return err
-	}
-	// Switch to root for userdebug builds.
-	inst.adb("root")
-	if err := inst.waitForSsh(); err != nil {
-		return err
-	}
-	return nil
+	return inst.waitForSsh()
 }
 
 func (inst *instance) waitForSsh() error {
@@ -328,35 +377,24 @@ func (inst *instance) Copy(hostSrc string) (string, error) {
 	return vmDst, nil
 }
 
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.CopyEach(inst, hostSrcs)
+}
+
 func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
-	catRpipe, catWpipe, err := vm.LongPipe()
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	killCon, conDone, err := vm.AttachConsole(merger, inst.console)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	cat := exec.Command("cat", inst.console)
-	cat.Stdout = catWpipe
-	cat.Stderr = catWpipe
-	if err := cat.Start(); err != nil {
-		catRpipe.Close()
-		catWpipe.Close()
-		return nil, nil, fmt.Errorf("failed to start cat %v: %v", inst.console, err)
-
-	}
-	catWpipe.Close()
-	catDone := make(chan error, 1)
-	go func() {
-		err := cat.Wait()
-		if inst.cfg.Debug {
-			Logf(0, "cat exited: %v", err)
-		}
-		catDone <- fmt.Errorf("cat exited: %v", err)
-	}()
-
 	adbRpipe, adbWpipe, err := vm.LongPipe()
 	if err != nil {
-		cat.Process.Kill()
-		catRpipe.Close()
+		killCon()
 		return nil, nil, err
 	}
 	if inst.cfg.Debug {
@@ -366,8 +404,7 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 	adb.Stdout = adbWpipe
 	adb.Stderr = adbWpipe
 	if err := adb.Start(); err != nil {
-		cat.Process.Kill()
-		catRpipe.Close()
+		killCon()
 		adbRpipe.Close()
 		adbWpipe.Close()
 		return nil, nil, fmt.Errorf("failed to start adb: %v", err)
@@ -382,47 +419,18 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 		adbDone <- fmt.Errorf("adb exited: %v", err)
 	}()
 
-	var tee io.Writer
-	if inst.cfg.Debug {
-		tee = os.Stdout
-	}
-	merger := vm.NewOutputMerger(tee)
-	merger.Add(catRpipe)
-	merger.Add(adbRpipe)
+	merger.Add("adb", adbRpipe)
 
-	errc := make(chan error, 1)
-	signal := func(err error) {
-		select {
-		case errc <- err:
-		default:
-		}
-	}
-
-	go func() {
-		select {
-		case <-time.After(timeout):
-			signal(vm.TimeoutErr)
-			cat.Process.Kill()
-			adb.Process.Kill()
-		case <-stop:
-			signal(vm.TimeoutErr)
-			cat.Process.Kill()
-			adb.Process.Kill()
-		case <-inst.closed:
-			if inst.cfg.Debug {
-				Logf(0, "instance closed")
-			}
-			signal(fmt.Errorf("instance closed"))
-			cat.Process.Kill()
-			adb.Process.Kill()
-		case err := <-catDone:
-			signal(err)
-			adb.Process.Kill()
-		case err := <-adbDone:
-			signal(err)
-			cat.Process.Kill()
-		}
-		merger.Wait()
-	}()
-	return merger.Output, errc, nil
+	sv := &vm.Supervisor{
+		Name:        inst.cfg.Name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      adbDone,
+		Console:     conDone,
+		Kill:        func() { adb.Process.Kill() },
+		KillConsole: killCon,
+		Merger:      merger,
+	}
+	return merger.Output, sv.Start(), nil
 }
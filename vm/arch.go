@@ -0,0 +1,79 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+)
+
+// HostArch is the arch of the machine that runs the backends (in GOARCH terms).
+var HostArch = runtime.GOARCH
+
+// Arch describes how to run a kernel of a target arch (Config.Arch).
+type Arch struct {
+	Qemu      string   // qemu-system binary
+	QemuArgs  []string // machine arguments for qemu
+	QemuDrive string   // qemu drive interface for the image
+	RootDev   string   // root device of the image as seen by the kernel
+	Console   string   // serial console device as seen by the kernel
+	Cmdline   string   // arch-specific kernel command line arguments
+}
+
+// Archs are the supported target archs.
+var Archs = map[string]*Arch{
+	"amd64": {
+		Qemu:      "qemu-system-x86_64",
+		QemuDrive: "ide",
+		RootDev:   "/dev/sda",
+		Console:   "ttyS0",
+		Cmdline:   "vsyscall=native earlyprintk=serial",
+	},
+	"arm64": {
+		Qemu:      "qemu-system-aarch64",
+		QemuArgs:  []string{"-machine", "virt", "-cpu", "max"},
+		QemuDrive: "virtio",
+		RootDev:   "/dev/vda",
+		Console:   "ttyAMA0",
+		Cmdline:   "earlycon",
+	},
+	"ppc64le": {
+		Qemu:      "qemu-system-ppc64",
+		QemuArgs:  []string{"-machine", "pseries"},
+		QemuDrive: "virtio",
+		RootDev:   "/dev/vda",
+		Console:   "hvc0",
+	},
+}
+
+// CrossArch returns true if the instance runs a kernel for a different arch than the host,
+// such instances can't use hardware virtualization.
+func (cfg *Config) CrossArch() bool {
+	return cfg.Arch != HostArch
+}
+
+// TargetArch returns description of the target arch of the instance.
+func (cfg *Config) TargetArch() *Arch {
+	return Archs[cfg.Arch]
+}
+
+// BinDir returns the directory with syzkaller binaries for arch in the syzkaller checkout:
+// bin for the host arch and bin/<arch> for other archs (see TARGETARCH in Makefile).
+func BinDir(syzkaller, arch string) string {
+	if arch == "" || arch == HostArch {
+		return filepath.Join(syzkaller, "bin")
+	}
+	return filepath.Join(syzkaller, "bin", arch)
+}
+
+func validateArch(cfg *Config) error {
+	if cfg.Arch == "" {
+		cfg.Arch = HostArch
+	}
+	if Archs[cfg.Arch] == nil {
+		return fmt.Errorf("unknown arch %v", cfg.Arch)
+	}
+	return nil
+}
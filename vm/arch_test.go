@@ -0,0 +1,43 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"testing"
+)
+
+func TestArch(t *testing.T) {
+	Register("test-arch", func(cfg *Config) (Instance, error) {
+		return new(testInstance), nil
+	}, nil)
+	defer delete(backends, "test-arch")
+
+	cfg := &Config{Name: "test-0"}
+	if _, err := Create("test-arch", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Arch != HostArch || cfg.CrossArch() {
+		t.Fatalf("arch is not defaulted to host arch: %v", cfg.Arch)
+	}
+	if _, err := Create("test-arch", &Config{Name: "test-0", Arch: "vax"}); err == nil {
+		t.Fatalf("created instance with unknown arch")
+	}
+	cross := "arm64"
+	if HostArch == cross {
+		cross = "amd64"
+	}
+	cfg = &Config{Name: "test-0", Arch: cross}
+	if _, err := Create("test-arch", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.CrossArch() || cfg.TargetArch() != Archs[cross] {
+		t.Fatalf("bad cross arch config: %+v", cfg)
+	}
+	if dir := BinDir("/syzkaller", HostArch); dir != "/syzkaller/bin" {
+		t.Fatalf("host bin dir: %v", dir)
+	}
+	if dir := BinDir("/syzkaller", cross); dir != "/syzkaller/bin/"+cross {
+		t.Fatalf("cross bin dir: %v", dir)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/fileutil"
+	. "github.com/google/syzkaller/log"
+)
+
+// Names of files in the instance artifacts directory (Config.Artifacts).
+// Create clears the directory and records artifacts for every backend:
+// output of the last command run in the instance (including console output),
+// output of Diagnose calls and files copied into the instance.
+// Backends that use ssh write a log of ssh commands and their failures.
+// The directory is kept after the instance is closed, use SnapshotArtifacts
+// to keep a copy that is not overwritten by the next instance.
+const (
+	ArtifactConsole     = "console.log"
+	ArtifactSsh         = "ssh.log"
+	ArtifactDiagnostics = "diagnostics"
+	ArtifactCopies      = "copies"
+)
+
+// ArtifactPath returns path of the artifact name of the instance,
+// or "" if the instance does not record artifacts.
+func ArtifactPath(cfg *Config, name string) string {
+	if cfg.Artifacts == "" {
+		return ""
+	}
+	return filepath.Join(cfg.Artifacts, name)
+}
+
+// SnapshotArtifacts copies artifacts directory dir to dst.
+// Files are hard linked if possible, artifact files are never modified in place.
+func SnapshotArtifacts(dir, dst string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		return linkFile(path, target)
+	})
+}
+
+func linkFile(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return fileutil.CopyFile(src, dst, false)
+}
+
+func createWithArtifacts(cfg *Config, ctor ctorFunc) (Instance, error) {
+	os.RemoveAll(cfg.Artifacts)
+	for _, dir := range []string{ArtifactDiagnostics, ArtifactCopies} {
+		if err := os.MkdirAll(filepath.Join(cfg.Artifacts, dir), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create artifacts dir: %v", err)
+		}
+	}
+	inst, err := ctor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactsInstance{Instance: inst, cfg: cfg, closed: make(chan bool)}, nil
+}
+
+type artifactsInstance struct {
+	Instance
+	cfg     *Config
+	closed  chan bool
+	mu      sync.Mutex
+	console *os.File
+	tee     *consoleTee
+}
+
+func (inst *artifactsInstance) Copy(hostSrc string) (string, error) {
+	vmDst, err := inst.Instance.Copy(hostSrc)
+	if err == nil {
+		inst.saveCopies([]string{hostSrc})
+	}
+	return vmDst, err
+}
+
+func (inst *artifactsInstance) CopyAll(hostSrcs []string) ([]string, error) {
+	vmDsts, err := inst.Instance.CopyAll(hostSrcs)
+	if err == nil {
+		inst.saveCopies(hostSrcs)
+	}
+	return vmDsts, err
+}
+
+func (inst *artifactsInstance) saveCopies(hostSrcs []string) {
+	for _, hostSrc := range hostSrcs {
+		dst := filepath.Join(inst.cfg.Artifacts, ArtifactCopies, filepath.Base(hostSrc))
+		if err := linkFile(hostSrc, dst); err != nil {
+			Logf(0, "%v: failed to save copied file: %v", inst.cfg.Name, err)
+		}
+	}
+}
+
+func (inst *artifactsInstance) Diagnose() []byte {
+	diag := inst.Instance.Diagnose()
+	if len(diag) != 0 {
+		file := filepath.Join(inst.cfg.Artifacts, ArtifactDiagnostics, time.Now().Format("20060102-150405.000"))
+		if err := ioutil.WriteFile(file, diag, 0600); err != nil {
+			Logf(0, "%v: failed to save diagnostics: %v", inst.cfg.Name, err)
+		}
+	}
+	return diag
+}
+
+func (inst *artifactsInstance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	outc, errc, err := inst.Instance.Run(timeout, stop, command)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inst.teeConsole(outc), errc, nil
+}
+
+func (inst *artifactsInstance) RunCommand(timeout time.Duration, stop <-chan bool, cmd *Command) (<-chan []byte, <-chan error, error) {
+	outc, errc, err := RunCommand(inst.Instance, timeout, stop, cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inst.teeConsole(outc), errc, nil
+}
+
+// teeConsole writes output of a command to the console log and passes it through.
+// The log is recreated for every command, because it can be linked to a snapshot.
+// Many backends return the same output channel for every command, so the tee of the previous
+// command is stopped first, and the output it has read but not passed on goes to the new command.
+func (inst *artifactsInstance) teeConsole(outc <-chan []byte) <-chan []byte {
+	inst.mu.Lock()
+	prev := inst.tee
+	tee := &consoleTee{
+		outc: outc,
+		stop: make(chan bool),
+		done: make(chan []byte, 1),
+	}
+	inst.tee = tee
+	inst.mu.Unlock()
+	var pending []byte
+	if prev != nil {
+		close(prev.stop)
+		if left := <-prev.done; prev.outc == outc {
+			pending = left
+		}
+	}
+
+	inst.mu.Lock()
+	if inst.console != nil {
+		inst.console.Close()
+	}
+	file := filepath.Join(inst.cfg.Artifacts, ArtifactConsole)
+	os.Remove(file)
+	console, err := os.Create(file)
+	if err != nil {
+		Logf(0, "%v: failed to create console log: %v", inst.cfg.Name, err)
+	}
+	inst.console = console
+	inst.mu.Unlock()
+
+	// teec is not buffered, so that the tee holds at most one chunk when the command is done.
+	teec := make(chan []byte)
+	go func() {
+		out, have := pending, pending != nil
+		defer func() {
+			close(teec)
+			if !have {
+				out = nil
+			}
+			tee.done <- out
+		}()
+		for {
+			if have {
+				inst.mu.Lock()
+				if inst.console == console && console != nil {
+					console.Write(out)
+				}
+				inst.mu.Unlock()
+				select {
+				case teec <- out:
+					have = false
+				case <-tee.stop:
+					return
+				case <-inst.closed:
+					return
+				}
+			}
+			select {
+			case out, have = <-outc:
+				if !have {
+					return
+				}
+			case <-tee.stop:
+				return
+			case <-inst.closed:
+				return
+			}
+		}
+	}()
+	return teec
+}
+
+// consoleTee is the tee of output of one command, see teeConsole.
+type consoleTee struct {
+	outc <-chan []byte
+	stop chan bool
+	done chan []byte // receives the chunk that was read from outc but not passed on
+}
+
+func (inst *artifactsInstance) Close() {
+	inst.Instance.Close()
+	close(inst.closed)
+	inst.mu.Lock()
+	if inst.console != nil {
+		inst.console.Close()
+		inst.console = nil
+	}
+	inst.mu.Unlock()
+}
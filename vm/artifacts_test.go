@@ -0,0 +1,144 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type diagInstance struct {
+	shellInstance
+}
+
+func (inst *diagInstance) Diagnose() []byte {
+	return []byte("registers")
+}
+
+func TestArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-artifacts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Register("test-artifacts", func(cfg *Config) (Instance, error) {
+		return new(diagInstance), nil
+	}, nil)
+	defer delete(backends, "test-artifacts")
+
+	artifacts := filepath.Join(dir, "instance")
+	if err := os.MkdirAll(artifacts, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(artifacts, "stale"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	inst, err := Create("test-artifacts", &Config{Name: "test-0", Artifacts: artifacts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(artifacts, "stale")); err == nil {
+		t.Fatalf("artifacts dir is not cleared")
+	}
+	src := filepath.Join(dir, "prog")
+	if err := ioutil.WriteFile(src, []byte("prog"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inst.CopyAll([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{"echo first", "echo second"} {
+		outc, errc, err := inst.Run(time.Minute, nil, command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-errc
+		<-outc
+	}
+	inst.Diagnose()
+	inst.Close()
+
+	snapshot := filepath.Join(dir, "snapshot")
+	if err := SnapshotArtifacts(artifacts, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	check := func(file, want string) {
+		data, err := ioutil.ReadFile(filepath.Join(snapshot, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("%v: got %q, want %q", file, data, want)
+		}
+	}
+	check(ArtifactConsole, "second\n")
+	check(filepath.Join(ArtifactCopies, "prog"), "prog")
+	diags, err := ioutil.ReadDir(filepath.Join(snapshot, ArtifactDiagnostics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 1 {
+		t.Fatalf("got %v diagnostics files, want 1", len(diags))
+	}
+	check(filepath.Join(ArtifactDiagnostics, diags[0].Name()), "registers")
+}
+
+// sharedInstance returns the same output channel for every command, like backends with a console merger.
+type sharedInstance struct {
+	testInstance
+	outc chan []byte
+}
+
+func (inst *sharedInstance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	return inst.outc, make(chan error), nil
+}
+
+func TestArtifactsSharedOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-artifacts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shared := &sharedInstance{outc: make(chan []byte, 1000)}
+	Register("test-artifacts", func(cfg *Config) (Instance, error) {
+		return shared, nil
+	}, nil)
+	defer delete(backends, "test-artifacts")
+
+	inst, err := Create("test-artifacts", &Config{Name: "test-0", Artifacts: filepath.Join(dir, "instance")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+	// Every command stops reading after a half of the output,
+	// the rest must go to the next command in order.
+	sent, received := 0, 0
+	for run := 0; run < 4; run++ {
+		outc, _, err := inst.Run(time.Minute, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run != 3 {
+			for i := 0; i < 100; i++ {
+				shared.outc <- []byte(fmt.Sprintf("%v\n", sent))
+				sent++
+			}
+		}
+		for n := 0; n < 50 || run == 3 && received < sent; n++ {
+			select {
+			case out := <-outc:
+				if want := fmt.Sprintf("%v\n", received); string(out) != want {
+					t.Fatalf("run %v: got %q, want %q", run, out, want)
+				}
+				received++
+			case <-time.After(10 * time.Second):
+				t.Fatalf("run %v: got only %v lines of %v", run, received, sent)
+			}
+		}
+	}
+}
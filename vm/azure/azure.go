@@ -0,0 +1,242 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package azure allows to use Microsoft Azure virtual machines as VMs.
+// It is assumed that syz-manager also runs on Azure as VMs are created in the current
+// resource group/location and by default in the manager's subnet.
+// VMs are created from a managed image. Kernel console output is obtained
+// by polling the boot diagnostics serial log.
+//
+// See https://docs.microsoft.com/en-us/azure/virtual-machines/linux/capture-image
+// for how to create a managed image.
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/azure"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+	"github.com/google/syzkaller/vm/internal/sshutil"
+)
+
+func init() {
+	vm.Register("azure", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are Azure-specific parameters (the vm section of the manager config).
+type Params struct {
+	Machine_Type string // VM size (e.g. "Standard_D2s_v3")
+	Ssh_User     string // admin user of VMs, commands are run with sudo (default: "syzkaller")
+	Subnet       string // subnet resource ID (optional, defaults to the manager subnet)
+	Low_Priority bool   // use low-priority (spot) VMs
+}
+
+func (params *Params) Validate() error {
+	if params.Machine_Type == "" {
+		return fmt.Errorf("machine_type is empty")
+	}
+	// Azure does not allow root as the admin user.
+	if params.Ssh_User == "root" {
+		return fmt.Errorf("ssh_user can't be root")
+	}
+	if params.Ssh_User == "" {
+		params.Ssh_User = "syzkaller"
+	}
+	return nil
+}
+
+type instance struct {
+	cfg     *vm.Config
+	name    string
+	ip      string
+	ssh     *sshutil.Target
+	console vm.Console
+	closed  chan bool
+}
+
+var (
+	initOnce sync.Once
+	Azure    *azure.Context
+)
+
+func initAzure() {
+	var err error
+	Azure, err = azure.NewContext()
+	if err != nil {
+		Fatalf("failed to init azure: %v", err)
+	}
+	Logf(0, "azure initialized: running on %v, internal IP %v, resource group %v, location %v",
+		Azure.Instance, Azure.InternalIP, Azure.ResourceGroup, Azure.Location)
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	initOnce.Do(initAzure)
+	params := cfg.Params.(*Params)
+	ok := false
+	defer func() {
+		if !ok {
+			os.RemoveAll(cfg.Workdir)
+		}
+	}()
+
+	// Azure requires the public key to be passed at VM creation.
+	sshKey := cfg.Sshkey
+	pubKey := filepath.Join(cfg.Workdir, "key.pub")
+	if sshKey == "" {
+		sshKey = filepath.Join(cfg.Workdir, "key")
+		if err := sshutil.Keygen(sshKey); err != nil {
+			return nil, err
+		}
+	} else {
+		out, err := exec.Command("ssh-keygen", "-y", "-f", sshKey).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract public key from %v: %v", sshKey, err)
+		}
+		if err := ioutil.WriteFile(pubKey, out, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write public key: %v", err)
+		}
+	}
+	sshUser := params.Ssh_User
+
+	var ip string
+	err := vm.CreateInstance(cfg.Name, func() error {
+		return Azure.DeleteInstance(cfg.Name, true)
+	}, func() error {
+		var err error
+		ip, err = Azure.CreateInstance(cfg.Name, params.Machine_Type, cfg.Image, sshUser, pubKey,
+			params.Subnet, params.Low_Priority)
+		return err
+	})
+	if err != nil {
+		Azure.DeleteInstance(cfg.Name, false)
+		return nil, err
+	}
+	defer func() {
+		if !ok {
+			Azure.DeleteInstance(cfg.Name, false)
+		}
+	}()
+	ssh := &sshutil.Target{
+		Host:  ip,
+		User:  sshUser,
+		Key:   sshKey,
+		Debug: cfg.Debug,
+		Log:   vm.ArtifactPath(cfg, vm.ArtifactSsh),
+	}
+	ssh.Multiplex(cfg.Workdir)
+	Logf(0, "wait instance to boot: %v (%v)", cfg.Name, ip)
+	if err := ssh.WaitReady(vm.ShutdownContext(), 10*time.Minute); err != nil {
+		ssh.Close()
+		return nil, err
+	}
+	ok = true
+	inst := &instance{
+		cfg:    cfg,
+		name:   cfg.Name,
+		ip:     ip,
+		ssh:    ssh,
+		closed: make(chan bool),
+	}
+	bootLog := vm.NewLogConsole(10*time.Second, func() ([]byte, error) {
+		return Azure.BootLog(inst.name)
+	})
+	// Skip the boot output, we are interested only in what happens during Run.
+	bootLog.Skip()
+	inst.console = vm.NewConsole(cfg, bootLog)
+	return inst, nil
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	inst.ssh.Close()
+	vm.DefaultRetry.Do("delete instance "+inst.name, func() error {
+		return Azure.DeleteInstance(inst.name, false)
+	})
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	inst.ssh.Sysrq()
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", Azure.InternalIP, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(vm.ShutdownContext(), 3*time.Minute)
+	defer cancel()
+	return inst.ssh.Copy(ctx, ".", hostSrcs)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	killCon, conDone, err := vm.AttachConsole(merger, inst.console)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sshRpipe, sshWpipe, err := vm.LongPipe()
+	if err != nil {
+		killCon()
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ssh := inst.ssh.Command(ctx, command)
+	ssh.Stdout = sshWpipe
+	ssh.Stderr = sshWpipe
+	if err := ssh.Start(); err != nil {
+		cancel()
+		killCon()
+		sshRpipe.Close()
+		sshWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to connect to instance: %v", err)
+	}
+	sshWpipe.Close()
+	sshDone := make(chan error, 1)
+	go func() {
+		err := ssh.Wait()
+		cancel()
+		sshDone <- fmt.Errorf("ssh exited: %v", err)
+	}()
+
+	merger.Add("ssh", sshRpipe)
+
+	sv := &vm.Supervisor{
+		Name:        inst.name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      sshDone,
+		Console:     conDone,
+		Kill:        cancel,
+		KillConsole: killCon,
+		Alive:       func() bool { return Azure.IsInstanceRunning(inst.name) },
+		// Give boot diagnostics time to flush the crash report.
+		Linger: 30 * time.Second,
+		Merger: merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
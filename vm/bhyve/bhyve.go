@@ -0,0 +1,382 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package bhyve allows to use bhyve virtual machines as VMs on FreeBSD hosts.
+// Image param is a ZFS snapshot of a zvol with the guest system (e.g. "zroot/syzkaller@clean");
+// every instance boots from a fresh ZFS clone of the snapshot, which makes reset cheap.
+// The guest is loaded with bhyveload (FreeBSD guests) or with the UEFI firmware
+// specified in bhyve_uefi. Kernel console output is read from COM1 attached to a nmdm(4)
+// device (requires nmdm kernel module). The guest is connected with a tap device to
+// bhyve_bridge and must obtain an address with DHCP, the address is looked up in the ARP table.
+//
+// See https://docs.freebsd.org/en/books/handbook/virtualization/#virtualization-host-bhyve
+package bhyve
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("bhyve", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are bhyve-specific parameters (the vm section of the manager config).
+type Params struct {
+	Bridge string // bridge to connect VMs to, must have a DHCP server (default: "bridge0")
+	Uefi   string // UEFI firmware to boot VMs with (optional, bhyveload is used otherwise)
+}
+
+func (params *Params) Validate() error {
+	if params.Bridge == "" {
+		params.Bridge = "bridge0"
+	}
+	if params.Uefi != "" {
+		if _, err := os.Stat(params.Uefi); err != nil {
+			return fmt.Errorf("UEFI firmware '%v' does not exist: %v", params.Uefi, err)
+		}
+	}
+	return nil
+}
+
+type instance struct {
+	cfg      *vm.Config
+	params   *Params
+	name     string
+	clone    string // ZFS clone of the image used as the disk
+	tap      string
+	mac      string
+	console  string
+	ip       string
+	hostAddr string
+	bhyve    *exec.Cmd
+	con      *exec.Cmd
+	waiterC  chan error
+	merger   *vm.OutputMerger
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:     cfg,
+		params:  cfg.Params.(*Params),
+		name:    "syzkaller-" + cfg.Name,
+		tap:     fmt.Sprintf("tap%v", 1000+cfg.Index),
+		mac:     fmt.Sprintf("58:9c:fc:00:%02x:%02x", cfg.Index>>8, cfg.Index&0xff),
+		console: fmt.Sprintf("/dev/nmdm%vsyz", cfg.Index),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	inst.clone = strings.Split(cfg.Image, "@")[0] + "-" + cfg.Name
+	if err := inst.setupNetwork(); err != nil {
+		return nil, err
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = "bhyve"
+	}
+	if !strings.Contains(cfg.Image, "@") {
+		return fmt.Errorf("image must be a ZFS snapshot (e.g. zroot/syzkaller@clean), got %q", cfg.Image)
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 256 {
+		return fmt.Errorf("bad bhyve cpu: %v, want [1-256]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad bhyve mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	if cfg.Index >= 1<<16 {
+		return fmt.Errorf("bad bhyve instance index: %v, want [0-%v)", cfg.Index, 1<<16)
+	}
+	return nil
+}
+
+// setupNetwork creates the tap device, adds it to the bridge and queries host address on the bridge.
+func (inst *instance) setupNetwork() error {
+	if _, err := runCmd("ifconfig", inst.tap); err != nil {
+		if _, err := runCmd("ifconfig", inst.tap, "create"); err != nil {
+			return err
+		}
+		if _, err := runCmd("ifconfig", inst.params.Bridge, "addm", inst.tap); err != nil {
+			return err
+		}
+	}
+	if _, err := runCmd("ifconfig", inst.tap, "up"); err != nil {
+		return err
+	}
+	out, err := runCmd("ifconfig", inst.params.Bridge, "inet")
+	if err != nil {
+		return err
+	}
+	// Output looks like:
+	// bridge0: flags=8843<UP,BROADCAST,RUNNING,SIMPLEX,MULTICAST> metric 0 mtu 1500
+	// 	inet 10.0.0.1 netmask 0xffffff00 broadcast 10.0.0.255
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "inet" {
+			inst.hostAddr = fields[1]
+			return nil
+		}
+	}
+	return fmt.Errorf("bridge %v has no IPv4 address", inst.params.Bridge)
+}
+
+func (inst *instance) boot() error {
+	inst.destroy()
+	if _, err := runCmd("zfs", "clone", inst.cfg.Image, inst.clone); err != nil {
+		return fmt.Errorf("failed to clone image: %v", err)
+	}
+	disk := "/dev/zvol/" + inst.clone
+	if inst.params.Uefi == "" {
+		// bhyveload loads the kernel from the guest disk and exits.
+		if _, err := runCmd("bhyveload", "-m", fmt.Sprintf("%vM", inst.cfg.Mem), "-d", disk,
+			"-c", inst.console+"A", inst.name); err != nil {
+			return err
+		}
+	}
+
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return err
+	}
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	inst.merger = vm.NewOutputMerger(tee)
+	inst.merger.Add("bhyve", rpipe)
+
+	args := []string{
+		"-c", fmt.Sprint(inst.cfg.Cpu),
+		"-m", fmt.Sprintf("%vM", inst.cfg.Mem),
+		"-A", "-H", "-P",
+		"-s", "0,hostbridge",
+		"-s", "1,lpc",
+		"-s", fmt.Sprintf("2,virtio-net,%v,mac=%v", inst.tap, inst.mac),
+		"-s", "3,virtio-blk," + disk,
+		"-l", "com1," + inst.console + "A",
+	}
+	if inst.params.Uefi != "" {
+		args = append(args, "-l", "bootrom,"+inst.params.Uefi)
+	}
+	args = append(args, inst.name)
+	if inst.cfg.Debug {
+		Logf(0, "running command: %v %#v", inst.cfg.Bin, args)
+	}
+	bhyve := exec.Command(inst.cfg.Bin, args...)
+	bhyve.Stdout = wpipe
+	bhyve.Stderr = wpipe
+	if err := bhyve.Start(); err != nil {
+		wpipe.Close()
+		return fmt.Errorf("failed to start %v %+v: %v", inst.cfg.Bin, args, err)
+	}
+	wpipe.Close()
+	inst.bhyve = bhyve
+	inst.waiterC = make(chan error, 1)
+	go func() {
+		err := bhyve.Wait()
+		inst.waiterC <- err
+	}()
+
+	// The other side of the nmdm pair gets the guest COM1 output.
+	conRpipe, conWpipe, err := vm.LongPipe()
+	if err != nil {
+		return err
+	}
+	inst.merger.Add("console", conRpipe)
+	con := exec.Command("cat", inst.console+"B")
+	con.Stdout = conWpipe
+	con.Stderr = conWpipe
+	if err := con.Start(); err != nil {
+		conWpipe.Close()
+		return fmt.Errorf("failed to open console %vB: %v", inst.console, err)
+	}
+	conWpipe.Close()
+	inst.con = con
+	return inst.waitBoot()
+}
+
+func (inst *instance) waitBoot() error {
+	for i := 0; i < 100; i++ {
+		select {
+		case err := <-inst.waiterC:
+			inst.waiterC <- err // repost it for Close
+			return fmt.Errorf("bhyve exited: %v", err)
+		default:
+		}
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+		if inst.ip == "" {
+			ip, err := inst.address()
+			if err != nil {
+				continue
+			}
+			inst.ip = ip
+		}
+		cmd := exec.Command("ssh", append(inst.sshArgs("-p"), "root@"+inst.ip, "pwd")...)
+		if _, err := cmd.CombinedOutput(); err == nil {
+			// Drop the boot output.
+			for {
+				select {
+				case <-inst.merger.Output:
+					continue
+				default:
+				}
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("can't ssh into the instance")
+}
+
+// address looks up address of the guest in the ARP table by the guest MAC address.
+func (inst *instance) address() (string, error) {
+	out, err := runCmd("arp", "-an", "-i", inst.params.Bridge)
+	if err != nil {
+		return "", err
+	}
+	// Output looks like:
+	// ? (10.0.0.23) at 58:9c:fc:00:00:01 on bridge0 expires in 1178 seconds [ethernet]
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[3] == inst.mac {
+			return strings.Trim(fields[1], "()"), nil
+		}
+	}
+	return "", fmt.Errorf("guest has no address yet")
+}
+
+// destroy kills the VM and removes the disk clone.
+func (inst *instance) destroy() {
+	if inst.bhyve != nil {
+		inst.bhyve.Process.Kill()
+		err := <-inst.waiterC
+		inst.waiterC <- err // repost it for waiting goroutines
+	}
+	if inst.con != nil {
+		inst.con.Process.Kill()
+		inst.con.Wait()
+	}
+	if inst.merger != nil {
+		inst.merger.Wait()
+	}
+	runCmd("bhyvectl", "--destroy", "--vm="+inst.name)
+	if inst.clone != "" {
+		runCmd("zfs", "destroy", inst.clone)
+	}
+}
+
+func runCmd(bin string, args ...string) ([]byte, error) {
+	out, err := exec.Command(bin, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v %+v failed: %v\n%s", bin, args, err, out)
+	}
+	return out, nil
+}
+
+func (inst *instance) Close() {
+	// Keep the tap device for the next instance.
+	inst.destroy()
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	out, err := vm.RunTimeout(time.Minute, exec.Command("bhyvectl", "--vm="+inst.name, "--get-all"))
+	if err != nil {
+		Logf(0, "%v: failed to dump registers: %v\n%s", inst.name, err, out)
+		return nil
+	}
+	return append([]byte("\nbhyve registers:\n"), out...)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostAddr, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.Scp(inst.sshArgs("-P"), "root@"+inst.ip, "/", hostSrcs, inst.cfg.Debug)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	inst.merger.Add("ssh", rpipe)
+
+	args := append(inst.sshArgs("-p"), "root@"+inst.ip, command)
+	if inst.cfg.Debug {
+		Logf(0, "running command: ssh %#v", args)
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		wpipe.Close()
+		return nil, nil, err
+	}
+	wpipe.Close()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	sv := &vm.Supervisor{
+		Name:    inst.cfg.Name,
+		Timeout: timeout,
+		Stop:    stop,
+		Exited:  exited,
+		Kill:    func() { cmd.Process.Kill() },
+	}
+	return inst.merger.Output, sv.Start(), nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		"-i", inst.cfg.Sshkey,
+		portArg, "22",
+		"-F", "/dev/null",
+		"-o", "ConnectionAttempts=10",
+		"-o", "ConnectTimeout=10",
+		"-o", "BatchMode=yes",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Backends that boot the kernel directly (Config.Kernel, Config.Initrd and Config.Cmdline)
+// use a freshly built kernel without rebuilding the image. Backends that keep snapshots
+// of booted instances must not restore a snapshot made with a different kernel,
+// they save BootID with the snapshot and discard the snapshot when it changes.
+
+// ValidateBoot checks that the kernel and initrd files exist and makes their paths absolute
+// (backends pass them to daemons that don't share the working directory, e.g. libvirtd).
+func ValidateBoot(cfg *Config) error {
+	if cfg.Initrd != "" && cfg.Kernel == "" {
+		return fmt.Errorf("initrd requires kernel")
+	}
+	for _, file := range []*string{&cfg.Kernel, &cfg.Initrd} {
+		if *file == "" {
+			continue
+		}
+		if _, err := os.Stat(*file); err != nil {
+			return fmt.Errorf("kernel file '%v' does not exist: %v", *file, err)
+		}
+		abs, err := filepath.Abs(*file)
+		if err != nil {
+			return err
+		}
+		*file = abs
+	}
+	return nil
+}
+
+// BootID returns identifier of what the instance boots: image, kernel, initrd, command line
+// and private network.
+// Files are identified by path, size and modification time.
+func BootID(cfg *Config) (string, error) {
+	hash := sha1.New()
+	for _, file := range []string{cfg.Image, cfg.Kernel, cfg.Initrd} {
+		if file == "" {
+			fmt.Fprintf(hash, "none\n")
+			continue
+		}
+		stat, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%v %v %v\n", file, stat.Size(), stat.ModTime().UnixNano())
+	}
+	fmt.Fprintf(hash, "%v\n", cfg.Cmdline)
+	if cfg.Network != nil {
+		// The guest address is baked into snapshots.
+		fmt.Fprintf(hash, "network %v %v\n", cfg.Network.Bridge, cfg.Network.Subnet)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// CheckBootID compares BootID of the instance with the one saved in file by SaveBootID.
+// It returns false if the file does not exist or the boot configuration has changed.
+func CheckBootID(cfg *Config, file string) bool {
+	id, err := BootID(cfg)
+	if err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == id
+}
+
+// SaveBootID saves BootID of the instance to file.
+func SaveBootID(cfg *Config, file string) error {
+	id, err := BootID(cfg)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(id+"\n"), 0600)
+}
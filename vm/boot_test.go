@@ -0,0 +1,56 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBootID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-boot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kernel := filepath.Join(dir, "bzImage")
+	if err := ioutil.WriteFile(kernel, []byte("kernel"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Kernel: kernel, Initrd: filepath.Join(dir, "initrd")}
+	if err := ValidateBoot(cfg); err == nil {
+		t.Fatalf("missing initrd is not detected")
+	}
+	cfg.Initrd = ""
+	if err := ValidateBoot(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "bootid")
+	if CheckBootID(cfg, file) {
+		t.Fatalf("missing boot id matches")
+	}
+	if err := SaveBootID(cfg, file); err != nil {
+		t.Fatal(err)
+	}
+	if !CheckBootID(cfg, file) {
+		t.Fatalf("saved boot id does not match")
+	}
+	cfg.Cmdline = "nokaslr"
+	if CheckBootID(cfg, file) {
+		t.Fatalf("boot id matches after cmdline change")
+	}
+	cfg.Cmdline = ""
+	// Emulate a rebuilt kernel.
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(kernel, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if CheckBootID(cfg, file) {
+		t.Fatalf("boot id matches after kernel change")
+	}
+}
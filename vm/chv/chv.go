@@ -0,0 +1,466 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package chv allows to use cloud-hypervisor VMs as VMs.
+// VMs are controlled over the cloud-hypervisor REST API socket. The kernel is booted directly
+// with the image as the root disk, kernel output is captured from virtio-console (hvc0).
+// Networking is done over a per-instance tap device created by cloud-hypervisor
+// (requires CAP_NET_ADMIN) with a static guest address configured on the kernel command line
+// (requires CONFIG_IP_PNP). If the private network is configured (see vm.NetworkConfig),
+// the tap device is created in advance and attached to the network bridge.
+// After the first successful boot the VM is snapshotted (memory, VM state and a copy of the
+// root disk); subsequent instances restore that snapshot instead of booting from scratch.
+//
+// See https://github.com/cloud-hypervisor/cloud-hypervisor/blob/main/docs/api.md
+// and https://github.com/cloud-hypervisor/cloud-hypervisor/blob/main/docs/snapshot_restore.md
+package chv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("chv", ctor, nil)
+	vm.RegisterNetwork("chv")
+}
+
+type instance struct {
+	cfg      *vm.Config
+	tap      string
+	hostAddr string
+	guestIP  string
+	netPort  *vm.NetworkPort // private network attachment (optional)
+	dir      string          // persistent dir with the root disk copy and the snapshot
+	sock     string
+	api      *http.Client
+	rpipe    io.ReadCloser
+	wpipe    io.WriteCloser
+	chv      *exec.Cmd
+	waiterC  chan error
+	merger   *vm.OutputMerger
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:  cfg,
+		tap:  fmt.Sprintf("syzchv%v", cfg.Index),
+		dir:  filepath.Join(filepath.Dir(cfg.Workdir), cfg.Name+"-chv"),
+		sock: filepath.Join(cfg.Workdir, "chv.sock"),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(inst.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dir: %v", err)
+	}
+	if cfg.Network != nil {
+		port, err := vm.AttachNetwork(cfg)
+		if err != nil {
+			return nil, err
+		}
+		inst.netPort = port
+		inst.tap = port.Tap
+		inst.hostAddr = port.HostIP
+		inst.guestIP = port.GuestIP
+	} else {
+		base := cfg.Index * 4
+		inst.hostAddr = fmt.Sprintf("172.16.%v.%v", base/256, base%256+1)
+		inst.guestIP = fmt.Sprintf("172.16.%v.%v", base/256, base%256+2)
+	}
+	inst.api = &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", inst.sock)
+			},
+		},
+	}
+
+	// Try the fast path first: restore the snapshot of a booted system.
+	if _, err := os.Stat(inst.snapshotFile("snapshot")); err == nil {
+		err := inst.restore()
+		if err == nil {
+			Logf(0, "%v: restored snapshot", cfg.Name)
+			closeInst = nil
+			return inst, nil
+		}
+		// The snapshot may be stale (e.g. the kernel has changed), boot from scratch.
+		Logf(0, "%v: failed to restore snapshot (%v), booting from scratch", cfg.Name, err)
+		inst.kill()
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	if err := inst.snapshot(); err != nil {
+		Logf(0, "%v: failed to snapshot VM, instances will boot from scratch: %v", cfg.Name, err)
+		os.RemoveAll(inst.snapshotFile("snapshot"))
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = "cloud-hypervisor"
+	}
+	if cfg.CrossArch() {
+		return fmt.Errorf("cloud-hypervisor can't run %v kernels on %v host", cfg.Arch, vm.HostArch)
+	}
+	if cfg.Kernel == "" {
+		return fmt.Errorf("chv requires kernel")
+	}
+	if _, err := os.Stat(cfg.Image); err != nil {
+		return fmt.Errorf("image file '%v' does not exist: %v", cfg.Image, err)
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 254 {
+		return fmt.Errorf("bad chv cpu: %v, want [1-254]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad chv mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	if cfg.Index >= 1<<14 {
+		return fmt.Errorf("bad chv instance index: %v, want [0-%v)", cfg.Index, 1<<14)
+	}
+	return nil
+}
+
+func (inst *instance) snapshotFile(name string) string {
+	return filepath.Join(inst.dir, name)
+}
+
+// start starts cloud-hypervisor process and waits for the API socket.
+func (inst *instance) start() error {
+	os.Remove(inst.sock)
+	var err error
+	inst.rpipe, inst.wpipe, err = vm.LongPipe()
+	if err != nil {
+		return err
+	}
+	args := []string{"--api-socket", "path=" + inst.sock}
+	if inst.cfg.Debug {
+		Logf(0, "running command: %v %#v", inst.cfg.Bin, args)
+	}
+	chv := exec.Command(inst.cfg.Bin, args...)
+	// Guest virtio-console goes to stdout.
+	chv.Stdout = inst.wpipe
+	chv.Stderr = inst.wpipe
+	if err := chv.Start(); err != nil {
+		return fmt.Errorf("failed to start %v %+v: %v", inst.cfg.Bin, args, err)
+	}
+	inst.wpipe.Close()
+	inst.wpipe = nil
+	inst.chv = chv
+
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	inst.merger = vm.NewOutputMerger(tee)
+	inst.merger.Add("console", inst.rpipe)
+	inst.rpipe = nil
+
+	inst.waiterC = make(chan error, 1)
+	go func() {
+		err := chv.Wait()
+		inst.waiterC <- err
+	}()
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(inst.sock); err == nil {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("cloud-hypervisor API socket did not appear")
+}
+
+func (inst *instance) boot() error {
+	if err := copyFile(inst.cfg.Image, inst.snapshotFile("rootfs")); err != nil {
+		return err
+	}
+	if err := inst.start(); err != nil {
+		return err
+	}
+	ip := fmt.Sprintf("ip=%v::%v:255.255.255.252::eth0:off", inst.guestIP, inst.hostAddr)
+	// cloud-hypervisor creates the tap device and configures the host address on it,
+	// tap devices of the private network already exist and are attached to the bridge.
+	iface := map[string]interface{}{
+		"tap":  inst.tap,
+		"ip":   inst.hostAddr,
+		"mask": "255.255.255.252",
+	}
+	if inst.netPort != nil {
+		ip = inst.netPort.Cmdline()
+		iface = map[string]interface{}{
+			"tap": inst.tap,
+			"mac": inst.netPort.MAC,
+		}
+	}
+	cmdline := "console=hvc0 panic=86400 vsyscall=native rodata=n oops=panic panic_on_warn=1" +
+		" ftrace_dump_on_oops=orig_cpu slub_debug=UZ net.ifnames=0 biosdevname=0 root=/dev/vda rw " +
+		ip + " " + inst.cfg.Cmdline
+	kernel, err := filepath.Abs(inst.cfg.Kernel)
+	if err != nil {
+		return err
+	}
+	config := map[string]interface{}{
+		"cpus": map[string]interface{}{
+			"boot_vcpus": inst.cfg.Cpu,
+			"max_vcpus":  inst.cfg.Cpu,
+		},
+		"memory": map[string]interface{}{
+			"size": inst.cfg.Mem << 20,
+		},
+		"payload": map[string]interface{}{
+			"kernel":  kernel,
+			"cmdline": cmdline,
+		},
+		"disks": []interface{}{
+			map[string]interface{}{"path": inst.snapshotFile("rootfs")},
+		},
+		"net":     []interface{}{iface},
+		"console": map[string]interface{}{"mode": "Tty"},
+		"serial":  map[string]interface{}{"mode": "Off"},
+	}
+	if err := inst.call("PUT", "/vm.create", config); err != nil {
+		return err
+	}
+	if err := inst.call("PUT", "/vm.boot", nil); err != nil {
+		return err
+	}
+	return inst.waitSSH(10 * time.Minute)
+}
+
+// snapshot pauses the booted VM, saves its state and resumes it.
+func (inst *instance) snapshot() error {
+	if err := inst.call("PUT", "/vm.pause", nil); err != nil {
+		return err
+	}
+	dir := inst.snapshotFile("snapshot")
+	os.RemoveAll(dir)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = copyFile(inst.snapshotFile("rootfs"), inst.snapshotFile("rootfs.snapshot"))
+	}
+	if err == nil {
+		err = inst.call("PUT", "/vm.snapshot", map[string]interface{}{
+			"destination_url": "file://" + dir,
+		})
+	}
+	resumeErr := inst.call("PUT", "/vm.resume", nil)
+	if err != nil {
+		return err
+	}
+	return resumeErr
+}
+
+func (inst *instance) restore() error {
+	// The memory snapshot is consistent only with the root disk saved together with it.
+	if err := copyFile(inst.snapshotFile("rootfs.snapshot"), inst.snapshotFile("rootfs")); err != nil {
+		return err
+	}
+	if err := inst.start(); err != nil {
+		return err
+	}
+	if err := inst.call("PUT", "/vm.restore", map[string]interface{}{
+		"source_url": "file://" + inst.snapshotFile("snapshot"),
+	}); err != nil {
+		return err
+	}
+	if err := inst.call("PUT", "/vm.resume", nil); err != nil {
+		return err
+	}
+	return inst.waitSSH(time.Minute)
+}
+
+func (inst *instance) waitSSH(timeout time.Duration) error {
+	start := time.Now()
+	for {
+		c, err := net.DialTimeout("tcp", inst.guestIP+":22", time.Second)
+		if err == nil {
+			c.SetDeadline(time.Now().Add(3 * time.Second))
+			var tmp [1]byte
+			n, err := c.Read(tmp[:])
+			c.Close()
+			if err == nil && n > 0 {
+				// ssh is up and responding, drop the boot output.
+				for {
+					select {
+					case <-inst.merger.Output:
+						continue
+					default:
+					}
+					return nil
+				}
+			}
+		}
+		select {
+		case err := <-inst.waiterC:
+			inst.waiterC <- err // repost it for Close
+			return fmt.Errorf("cloud-hypervisor stopped: %v", err)
+		case <-vm.Shutdown:
+			return fmt.Errorf("shutdown in progress")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("ssh server did not start")
+		}
+	}
+}
+
+func (inst *instance) call(method, path string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://localhost/api/v1"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := inst.api.Do(req)
+	if err != nil {
+		return fmt.Errorf("cloud-hypervisor %v %v failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("cloud-hypervisor %v %v failed: %v\n%s", method, path, resp.Status, reply)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	// Use reflinks if the filesystem supports them, the images may be large.
+	if out, err := exec.Command("cp", "--reflink=auto", src, dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to copy %v: %v\n%s", src, err, out)
+	}
+	return nil
+}
+
+func (inst *instance) kill() {
+	if inst.chv != nil {
+		inst.chv.Process.Kill()
+		err := <-inst.waiterC
+		inst.waiterC <- err // repost it for waiting goroutines
+		inst.chv = nil
+	}
+	if inst.merger != nil {
+		inst.merger.Wait()
+		inst.merger = nil
+	}
+	if inst.rpipe != nil {
+		inst.rpipe.Close()
+		inst.rpipe = nil
+	}
+	if inst.wpipe != nil {
+		inst.wpipe.Close()
+		inst.wpipe = nil
+	}
+}
+
+func (inst *instance) Close() {
+	// Keep the root disk and the snapshot for the next instance.
+	inst.kill()
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	vm.Sysrq(func(command string) *exec.Cmd {
+		return exec.Command("ssh", append(inst.sshArgs("-p"), "root@"+inst.guestIP, command)...)
+	})
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostAddr, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.Scp(inst.sshArgs("-P"), "root@"+inst.guestIP, "/", hostSrcs, inst.cfg.Debug)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	inst.merger.Add("ssh", rpipe)
+
+	args := append(inst.sshArgs("-p"), "root@"+inst.guestIP, command)
+	if inst.cfg.Debug {
+		Logf(0, "running command: ssh %#v", args)
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		wpipe.Close()
+		return nil, nil, err
+	}
+	wpipe.Close()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	sv := &vm.Supervisor{
+		Name:    inst.cfg.Name,
+		Timeout: timeout,
+		Stop:    stop,
+		Exited:  exited,
+		Kill:    func() { cmd.Process.Kill() },
+	}
+	return inst.merger.Output, sv.Start(), nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		"-i", inst.cfg.Sshkey,
+		portArg, "22",
+		"-F", "/dev/null",
+		"-o", "ConnectionAttempts=10",
+		"-o", "ConnectTimeout=10",
+		"-o", "BatchMode=yes",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
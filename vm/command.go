@@ -0,0 +1,80 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Command is a command to run in a VM with RunCommand.
+type Command struct {
+	Args []string // program and arguments
+	Env  []string // additional environment variables in the form key=value
+	Dir  string   // working directory (optional)
+}
+
+// CommandRunner is optionally implemented by instances that can run a Command
+// natively (e.g. without going through a shell).
+type CommandRunner interface {
+	// RunCommand is like Instance.Run, but for a structured command.
+	RunCommand(timeout time.Duration, stop <-chan bool, cmd *Command) (outc <-chan []byte, errc <-chan error, err error)
+}
+
+// RunCommand runs cmd in inst. Instances that don't implement CommandRunner
+// get cmd as a shell command line with all arguments quoted (see Command.Shell).
+func RunCommand(inst Instance, timeout time.Duration, stop <-chan bool, cmd *Command) (<-chan []byte, <-chan error, error) {
+	if err := cmd.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if r, ok := inst.(CommandRunner); ok {
+		return r.RunCommand(timeout, stop, cmd)
+	}
+	return inst.Run(timeout, stop, cmd.Shell())
+}
+
+func (cmd *Command) Validate() error {
+	if len(cmd.Args) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	for _, env := range cmd.Env {
+		eq := strings.IndexByte(env, '=')
+		if eq <= 0 || !isShellName(env[:eq]) {
+			return fmt.Errorf("bad environment variable %q", env)
+		}
+	}
+	return nil
+}
+
+// Shell returns cmd as a POSIX shell command line with all parts quoted,
+// e.g. cd '/dir' && FOO='bar baz' '/bin/prog' '-flag=1'.
+func (cmd *Command) Shell() string {
+	var parts []string
+	if cmd.Dir != "" {
+		parts = append(parts, "cd", Quote(cmd.Dir), "&&")
+	}
+	for _, env := range cmd.Env {
+		eq := strings.IndexByte(env, '=')
+		parts = append(parts, env[:eq+1]+Quote(env[eq+1:]))
+	}
+	for _, arg := range cmd.Args {
+		parts = append(parts, Quote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Quote quotes s for a POSIX shell.
+func Quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func isShellName(s string) bool {
+	for i, c := range s {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"testing"
+)
+
+func TestCommandShell(t *testing.T) {
+	tests := []struct {
+		cmd  Command
+		want string
+	}{
+		{Command{Args: []string{"ls"}}, `'ls'`},
+		{Command{Args: []string{"/bin/prog", "-a=b c"}, Dir: "/tmp"}, `cd '/tmp' && '/bin/prog' '-a=b c'`},
+		{Command{Args: []string{"echo", "it's"}, Env: []string{"A=1", "B_2=x y"}}, `A='1' B_2='x y' 'echo' 'it'\''s'`},
+		{Command{Args: []string{"env"}, Env: []string{"EMPTY="}}, `EMPTY='' 'env'`},
+	}
+	for i, test := range tests {
+		if err := test.cmd.Validate(); err != nil {
+			t.Fatalf("#%v: %v", i, err)
+		}
+		if got := test.cmd.Shell(); got != test.want {
+			t.Fatalf("#%v: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestCommandValidate(t *testing.T) {
+	for _, cmd := range []Command{
+		{},
+		{Args: []string{"ls"}, Env: []string{"A"}},
+		{Args: []string{"ls"}, Env: []string{"=1"}},
+		{Args: []string{"ls"}, Env: []string{"1A=1"}},
+		{Args: []string{"ls"}, Env: []string{"A;rm=1"}},
+	} {
+		if err := cmd.Validate(); err == nil {
+			t.Fatalf("command %+v is valid", cmd)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+)
+
+// Console is a transport that provides kernel console output of an instance.
+// Backends have a default console, the console section of the manager config
+// overrides it with any of the transports below.
+type Console interface {
+	// Open connects to the console and returns its output and a function that disconnects.
+	// Reads from output return an error when the connection is lost or disconnected.
+	Open() (output io.ReadCloser, disconnect func(), err error)
+}
+
+// ConsoleConfig selects and configures a console transport (the console section of the manager config).
+// All strings can contain {{NAME}}, {{INDEX}} and {{DEVICE}} which are replaced with
+// instance name, index and device.
+type ConsoleConfig struct {
+	Type     string // one of telnet, tcp, ipmi, virsh, poll, command
+	Addr     string // host:port of the console server for telnet and tcp
+	Host     string // BMC address for ipmi
+	User     string // BMC user for ipmi
+	Password string // BMC password for ipmi (optional)
+	Uri      string // libvirt connection URI for virsh (optional)
+	Domain   string // libvirt domain for virsh (default: instance name)
+	Command  string // command that streams console output for command, or prints whole console log for poll
+	Interval int    // poll interval in seconds for poll (default: 10)
+}
+
+func (cfg *ConsoleConfig) Validate() error {
+	switch cfg.Type {
+	case "telnet", "tcp":
+		if cfg.Addr == "" {
+			return fmt.Errorf("addr is empty (required for %v)", cfg.Type)
+		}
+	case "ipmi":
+		if cfg.Host == "" {
+			return fmt.Errorf("host is empty (required for ipmi)")
+		}
+	case "virsh":
+		if cfg.Domain == "" {
+			cfg.Domain = "{{NAME}}"
+		}
+	case "command":
+		if cfg.Command == "" {
+			return fmt.Errorf("command is empty (required for command)")
+		}
+	case "poll":
+		if cfg.Command == "" {
+			return fmt.Errorf("command is empty (required for poll)")
+		}
+		if cfg.Interval < 0 {
+			return fmt.Errorf("bad interval %v", cfg.Interval)
+		}
+		if cfg.Interval == 0 {
+			cfg.Interval = 10
+		}
+	case "":
+		return fmt.Errorf("type is empty")
+	default:
+		return fmt.Errorf("unknown type '%v', want one of telnet/tcp/ipmi/virsh/poll/command", cfg.Type)
+	}
+	return nil
+}
+
+// ParseConsole parses and validates the console section of the manager config.
+// Empty data means that backends use own default consoles, then it returns nil.
+func ParseConsole(data []byte) (*ConsoleConfig, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	cfg := new(ConsoleConfig)
+	if err := checkUnknownFields(data, cfg); err != nil {
+		return nil, fmt.Errorf("bad console: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse console: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("bad console: %v", err)
+	}
+	return cfg, nil
+}
+
+// NewConsole returns the console configured for the instance, or def if the config does not specify one.
+func NewConsole(cfg *Config, def Console) Console {
+	if cfg.Console == nil {
+		return def
+	}
+	c := *cfg.Console
+	repl := strings.NewReplacer("{{NAME}}", cfg.Name, "{{INDEX}}", fmt.Sprint(cfg.Index), "{{DEVICE}}", cfg.Device)
+	for _, s := range []*string{&c.Addr, &c.Host, &c.User, &c.Password, &c.Uri, &c.Domain, &c.Command} {
+		*s = repl.Replace(*s)
+	}
+	switch c.Type {
+	case "telnet":
+		return &tcpConsole{addr: c.Addr, telnet: true}
+	case "tcp":
+		return &tcpConsole{addr: c.Addr}
+	case "ipmi":
+		args := []string{"-I", "lanplus", "-H", c.Host}
+		if c.User != "" {
+			args = append(args, "-U", c.User)
+		}
+		con := &commandConsole{name: "ipmitool"}
+		if c.Password != "" {
+			// Pass the password in environment, so that it is not visible in ps output.
+			args = append(args, "-E")
+			con.env = append(os.Environ(), "IPMI_PASSWORD="+c.Password)
+		}
+		con.args = append(args, "sol", "activate")
+		return &ipmiConsole{con}
+	case "virsh":
+		return &virshConsole{uri: c.Uri, domain: c.Domain}
+	case "poll":
+		return NewLogConsole(time.Duration(c.Interval)*time.Second, func() ([]byte, error) {
+			return exec.Command("sh", "-c", c.Command).Output()
+		})
+	case "command":
+		return CommandConsole("sh", "-c", c.Command)
+	default:
+		panic(fmt.Sprintf("unknown console type %v", c.Type))
+	}
+}
+
+// AttachConsole opens con and adds its output to merger as source "console".
+// done receives an error when the console connection is lost.
+func AttachConsole(merger *OutputMerger, con Console) (disconnect func(), done <-chan error, err error) {
+	r, disconnect, err := con.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	donec := make(chan error, 1)
+	merger.Add("console", &consoleReader{r: r, done: donec})
+	return disconnect, donec, nil
+}
+
+// consoleReader reports the first read error on done.
+type consoleReader struct {
+	r    io.ReadCloser
+	done chan error
+	once sync.Once
+}
+
+func (cr *consoleReader) Read(buf []byte) (int, error) {
+	n, err := cr.r.Read(buf)
+	if err != nil {
+		cr.once.Do(func() {
+			if err == io.EOF {
+				cr.done <- errors.New("console connection closed")
+			} else {
+				cr.done <- err
+			}
+		})
+	}
+	return n, err
+}
+
+func (cr *consoleReader) Close() error {
+	return cr.r.Close()
+}
+
+// CommandConsole returns a console that runs a command that streams console output.
+func CommandConsole(name string, args ...string) Console {
+	return &commandConsole{name: name, args: args}
+}
+
+type commandConsole struct {
+	name string
+	args []string
+	env  []string
+}
+
+func (con *commandConsole) Open() (io.ReadCloser, func(), error) {
+	rpipe, wpipe, err := LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command(con.name, con.args...)
+	cmd.Env = con.env
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	// Some console tools (e.g. ipmitool sol) exit on stdin EOF.
+	if _, err := cmd.StdinPipe(); err != nil {
+		rpipe.Close()
+		wpipe.Close()
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		rpipe.Close()
+		wpipe.Close()
+		return nil, nil, fmt.Errorf("failed to start console %v: %v", cmd.Args, err)
+	}
+	wpipe.Close()
+	return &commandReader{r: rpipe, cmd: cmd}, func() { cmd.Process.Kill() }, nil
+}
+
+type commandReader struct {
+	r    io.ReadCloser
+	cmd  *exec.Cmd
+	once sync.Once
+	err  error
+}
+
+func (cr *commandReader) Read(buf []byte) (int, error) {
+	n, err := cr.r.Read(buf)
+	if err != nil {
+		cr.once.Do(func() {
+			cr.err = fmt.Errorf("console command exited: %v", cr.cmd.Wait())
+		})
+		err = cr.err
+	}
+	return n, err
+}
+
+func (cr *commandReader) Close() error {
+	return cr.r.Close()
+}
+
+// ipmiConsole is IPMI serial-over-LAN console.
+type ipmiConsole struct {
+	*commandConsole
+}
+
+func (con *ipmiConsole) Open() (io.ReadCloser, func(), error) {
+	// Only one SOL session is allowed, a stale session from a killed ipmitool blocks activation.
+	args := append(append([]string{}, con.args[:len(con.args)-1]...), "deactivate")
+	deactivate := exec.Command(con.name, args...)
+	deactivate.Env = con.env
+	RunTimeout(30*time.Second, deactivate)
+	return con.commandConsole.Open()
+}
+
+// virshConsole reads the pty of a libvirt domain serial console.
+// It works only with local libvirt daemons, because the pty is a host file.
+type virshConsole struct {
+	uri    string
+	domain string
+}
+
+func (con *virshConsole) Open() (io.ReadCloser, func(), error) {
+	var args []string
+	if con.uri != "" {
+		args = append(args, "-c", con.uri)
+	}
+	args = append(args, "ttyconsole", con.domain)
+	out, err := RunTimeout(time.Minute, exec.Command("virsh", args...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("virsh ttyconsole failed: %v\n%s", err, out)
+	}
+	return CommandConsole("cat", strings.TrimSpace(string(out))).Open()
+}
+
+// tcpConsole connects to a serial console server (e.g. ser2net or a terminal server).
+type tcpConsole struct {
+	addr   string
+	telnet bool
+}
+
+func (con *tcpConsole) Open() (io.ReadCloser, func(), error) {
+	conn, err := net.DialTimeout("tcp", con.addr, 10*time.Second)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to console %v: %v", con.addr, err)
+	}
+	var r io.ReadCloser = &tcpReader{conn}
+	if con.telnet {
+		r = &telnetReader{conn: conn, r: r}
+	}
+	return r, func() { conn.Close() }, nil
+}
+
+type tcpReader struct {
+	net.Conn
+}
+
+func (r *tcpReader) Read(buf []byte) (int, error) {
+	n, err := r.Conn.Read(buf)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("console connection closed: %v", err)
+	}
+	return n, err
+}
+
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+// telnetReader strips telnet commands from the stream and refuses all options,
+// which leaves a plain NVT connection.
+type telnetReader struct {
+	conn  io.Writer
+	r     io.ReadCloser
+	state int // 0 - data, telnetIAC - after IAC, WILL/WONT/DO/DONT - before option, telnetSB - in subnegotiation
+	sbIAC bool
+}
+
+func (tr *telnetReader) Read(buf []byte) (int, error) {
+	for {
+		n, err := tr.r.Read(buf)
+		n = tr.filter(buf[:n])
+		if n != 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// filter removes commands from data in place and returns the resulting length.
+func (tr *telnetReader) filter(data []byte) int {
+	n := 0
+	var reply []byte
+	for _, c := range data {
+		switch tr.state {
+		case 0:
+			if c == telnetIAC {
+				tr.state = telnetIAC
+				continue
+			}
+			data[n] = c
+			n++
+		case telnetIAC:
+			switch c {
+			case telnetIAC:
+				data[n] = c
+				n++
+				tr.state = 0
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT, telnetSB:
+				tr.state = int(c)
+			default:
+				tr.state = 0
+			}
+		case telnetWILL:
+			reply = append(reply, telnetIAC, telnetDONT, c)
+			tr.state = 0
+		case telnetDO:
+			reply = append(reply, telnetIAC, telnetWONT, c)
+			tr.state = 0
+		case telnetWONT, telnetDONT:
+			tr.state = 0
+		case telnetSB:
+			if tr.sbIAC && c == telnetSE {
+				tr.state = 0
+			}
+			tr.sbIAC = !tr.sbIAC && c == telnetIAC
+		}
+	}
+	if len(reply) != 0 {
+		tr.conn.Write(reply)
+	}
+	return n
+}
+
+func (tr *telnetReader) Close() error {
+	return tr.r.Close()
+}
+
+// LogConsole is a console that periodically fetches the whole console log
+// (e.g. cloud serial log APIs) and streams new output.
+type LogConsole struct {
+	interval time.Duration
+	fetch    func() ([]byte, error)
+	mu       sync.Mutex
+	offset   int // size of the log already sent to the output
+}
+
+func NewLogConsole(interval time.Duration, fetch func() ([]byte, error)) *LogConsole {
+	return &LogConsole{
+		interval: interval,
+		fetch:    fetch,
+	}
+}
+
+// Skip marks the current log as already consumed (e.g. to skip the boot output).
+func (con *LogConsole) Skip() {
+	if log, err := con.fetch(); err == nil {
+		con.mu.Lock()
+		con.offset = len(log)
+		con.mu.Unlock()
+	}
+}
+
+func (con *LogConsole) Open() (io.ReadCloser, func(), error) {
+	rpipe, wpipe, err := LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := make(chan bool)
+	var once sync.Once
+	go con.poll(wpipe, stop)
+	return rpipe, func() { once.Do(func() { close(stop) }) }, nil
+}
+
+func (con *LogConsole) poll(w io.WriteCloser, stop <-chan bool) {
+	defer w.Close()
+	ticker := time.NewTicker(con.interval)
+	defer ticker.Stop()
+	for {
+		// Poll once more after stop to fetch the most recent output.
+		stopped := false
+		select {
+		case <-ticker.C:
+		case <-stop:
+			stopped = true
+		}
+		log, err := con.fetch()
+		if err != nil {
+			Logf(1, "failed to fetch console log: %v", err)
+		} else if !con.write(w, log) {
+			return
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+func (con *LogConsole) write(w io.Writer, log []byte) bool {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	if len(log) < con.offset {
+		// The log was rotated or truncated (e.g. the instance was restarted).
+		con.offset = 0
+	}
+	if len(log) > con.offset {
+		if _, err := w.Write(bytes.Replace(log[con.offset:], []byte("\r\n"), []byte("\n"), -1)); err != nil {
+			return false
+		}
+		con.offset = len(log)
+	}
+	return true
+}
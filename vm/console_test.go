@@ -0,0 +1,130 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConsole(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+		want *ConsoleConfig
+	}{
+		{``, "", nil},
+		{`null`, "", nil},
+		{`{"type": "telnet", "addr": "ts:{{INDEX}}"}`, "", &ConsoleConfig{Type: "telnet", Addr: "ts:{{INDEX}}"}},
+		{`{"type": "virsh"}`, "", &ConsoleConfig{Type: "virsh", Domain: "{{NAME}}"}},
+		{`{"type": "poll", "command": "cat log"}`, "", &ConsoleConfig{Type: "poll", Command: "cat log", Interval: 10}},
+		{`{"type": "tcp"}`, "bad console: addr is empty", nil},
+		{`{"type": "ipmi", "user": "admin"}`, "bad console: host is empty", nil},
+		{`{"type": "serial"}`, "bad console: unknown type 'serial'", nil},
+		{`{"type": "command", "foo": 1}`, "bad console: unknown field 'foo'", nil},
+		{`{}`, "bad console: type is empty", nil},
+	}
+	for i, test := range tests {
+		cfg, err := ParseConsole([]byte(test.data))
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("#%v: got error %q, want %q", i, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%v: unexpected error: %v", i, err)
+		}
+		if test.want == nil {
+			if cfg != nil {
+				t.Fatalf("#%v: got config %+v, want nil", i, cfg)
+			}
+			continue
+		}
+		if *cfg != *test.want {
+			t.Fatalf("#%v: got config %+v, want %+v", i, cfg, test.want)
+		}
+	}
+}
+
+func TestCommandConsole(t *testing.T) {
+	cfg := &Config{
+		Name:    "test-1",
+		Console: &ConsoleConfig{Type: "command", Command: "echo {{NAME}}; exit 1"},
+	}
+	merger := NewOutputMerger(nil)
+	disconnect, done, err := AttachConsole(merger, NewConsole(cfg, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+	select {
+	case err := <-done:
+		if want := "console command exited: exit status 1"; err == nil || err.Error() != want {
+			t.Fatalf("got error %q, want %q", err, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("console command did not exit")
+	}
+	merger.Wait()
+	var output []byte
+	for out := range merger.Output {
+		output = append(output, out...)
+	}
+	if want := "syzkaller: [console]\ntest-1\n"; string(output) != want {
+		t.Fatalf("got output %q, want %q", output, want)
+	}
+}
+
+func TestTelnetFilter(t *testing.T) {
+	input := []byte("a\xff\xfd\x01b\xff\xfb\x03c\xff\xff\xff\xfa\x18\x01\xff\xf0d\xff\xf1e")
+	reply := new(bytes.Buffer)
+	tr := &telnetReader{conn: reply, r: ioutil.NopCloser(bytes.NewReader(input))}
+	var output []byte
+	// Feed data byte-by-byte to check that commands split across reads are handled.
+	for _, c := range input {
+		buf := []byte{c}
+		output = append(output, buf[:tr.filter(buf)]...)
+	}
+	if want := "abc\xffde"; string(output) != want {
+		t.Fatalf("got output %q, want %q", output, want)
+	}
+	if want := "\xff\xfc\x01\xff\xfe\x03"; reply.String() != want {
+		t.Fatalf("got reply %q, want %q", reply.String(), want)
+	}
+}
+
+func TestLogConsole(t *testing.T) {
+	logs := [][]byte{
+		[]byte("boot\r\n"),
+		[]byte("boot\r\nline1\r\n"),
+		[]byte("line2\r\n"),
+		[]byte("line2\r\nline3\r\n"),
+	}
+	fetch := func() ([]byte, error) {
+		log := logs[0]
+		if len(logs) > 1 {
+			logs = logs[1:]
+		}
+		return log, nil
+	}
+	con := NewLogConsole(time.Millisecond, fetch)
+	con.Skip()
+	r, disconnect, err := con.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	disconnect()
+	output, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "line1\nline2\nline3\n"; string(output) != want {
+		t.Fatalf("got output %q, want %q", output, want)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package docker allows to use containers as VMs for fuzzing userspace components
+// or sandboxes (e.g. gVisor with docker_runtime=runsc) where full VMs are not needed.
+// Containers are controlled with the docker command line tool (any OCI runtime
+// configured in docker can be used). The image must contain a shell.
+// Files are copied into a host directory that is bind-mounted into the container
+// at /syzkaller, and commands are run with docker exec.
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/fileutil"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+const mountPoint = "/syzkaller"
+
+func init() {
+	vm.Register("docker", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are docker-specific parameters (the vm section of the manager config).
+type Params struct {
+	Runtime    string // OCI runtime to run containers with (e.g. "runsc" for gVisor)
+	Privileged bool   // run privileged containers
+}
+
+func (params *Params) Validate() error {
+	return nil
+}
+
+type instance struct {
+	cfg      *vm.Config
+	name     string
+	share    string // host dir mounted into the container
+	hostAddr string
+	closed   chan bool
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:    cfg,
+		name:   cfg.Name,
+		share:  filepath.Join(cfg.Workdir, "share"),
+		closed: make(chan bool),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(inst.share, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create share dir: %v", err)
+	}
+	// Containers use the default bridge network, the host is reachable at its gateway.
+	out, err := inst.docker("network", "inspect", "bridge", "--format", "{{range .IPAM.Config}}{{.Gateway}}{{end}}")
+	if err != nil {
+		return nil, err
+	}
+	inst.hostAddr = strings.TrimSpace(string(out))
+	if inst.hostAddr == "" {
+		return nil, fmt.Errorf("failed to determine docker bridge gateway")
+	}
+
+	inst.docker("rm", "--force", inst.name)
+	args := []string{"run", "--detach", "--name", inst.name,
+		"--volume", inst.share + ":" + mountPoint,
+		"--cpus", fmt.Sprint(cfg.Cpu),
+		"--memory", fmt.Sprintf("%vm", cfg.Mem),
+		"--entrypoint", "sleep",
+	}
+	params := cfg.Params.(*Params)
+	if params.Runtime != "" {
+		args = append(args, "--runtime", params.Runtime)
+	}
+	if params.Privileged {
+		args = append(args, "--privileged")
+	}
+	args = append(args, cfg.Image, "infinity")
+	if _, err := inst.docker(args...); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = "docker"
+	}
+	if cfg.Image == "" {
+		return fmt.Errorf("image parameter is empty (required for docker)")
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 1024 {
+		return fmt.Errorf("bad docker cpu: %v, want [1-1024]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad docker mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+func (inst *instance) docker(args ...string) ([]byte, error) {
+	if inst.cfg.Debug {
+		Logf(0, "executing docker %+v", args)
+	}
+	cmd := exec.Command(inst.cfg.Bin, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("docker %+v failed: %v\n%s", args, err, out)
+	}
+	return out, nil
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	inst.docker("rm", "--force", inst.name)
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	// Containers share the host kernel, list processes instead.
+	out, err := vm.RunTimeout(time.Minute, exec.Command(inst.cfg.Bin, "top", inst.name))
+	if err != nil {
+		return nil
+	}
+	return append([]byte("\ncontainer processes:\n"), out...)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostAddr, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	base := filepath.Base(hostSrc)
+	if err := fileutil.CopyFile(hostSrc, filepath.Join(inst.share, base), false); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(filepath.Join(inst.share, base), 0777); err != nil {
+		return "", err
+	}
+	return mountPoint + "/" + base, nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.CopyEach(inst, hostSrcs)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	args := []string{"exec", inst.name, "sh", "-c", command}
+	if inst.cfg.Debug {
+		Logf(0, "running command: docker %#v", args)
+	}
+	cmd := exec.Command(inst.cfg.Bin, args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		rpipe.Close()
+		wpipe.Close()
+		return nil, nil, fmt.Errorf("failed to run command in container: %v", err)
+	}
+	wpipe.Close()
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		done <- fmt.Errorf("docker exec exited: %v", err)
+	}()
+
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	merger.Add("exec", rpipe)
+
+	sv := &vm.Supervisor{
+		Name:    inst.cfg.Name,
+		Timeout: timeout,
+		Stop:    stop,
+		Closed:  inst.closed,
+		Exited:  done,
+		// Killing docker exec does not kill the command inside of the container,
+		// but the whole container is removed on Close.
+		Kill:   func() { cmd.Process.Kill() },
+		Merger: merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
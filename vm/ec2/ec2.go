@@ -0,0 +1,255 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package ec2 allows to use Amazon EC2 instances as VMs.
+// It is assumed that syz-manager also runs on EC2 as VMs are created in the current region
+// and by default in the manager's subnet and security groups.
+// Kernel console output is obtained via EC2 serial console, which must be enabled
+// for the account and supported by the instance type (Nitro-based instances).
+//
+// See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/ec2-serial-console.html
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/ec2"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+	"github.com/google/syzkaller/vm/internal/sshutil"
+)
+
+func init() {
+	vm.Register("ec2", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are EC2-specific parameters (the vm section of the manager config).
+type Params struct {
+	Machine_Type    string   // instance type (e.g. "c5.large")
+	Ssh_User        string   // user of the image to ssh as if sshkey is not specified (default: "ec2-user")
+	Subnet          string   // subnet ID (optional, defaults to the manager subnet)
+	Security_Groups []string // security group IDs (optional, default to the manager security groups)
+	Spot            bool     // use spot instances
+}
+
+func (params *Params) Validate() error {
+	if params.Machine_Type == "" {
+		return fmt.Errorf("machine_type is empty")
+	}
+	if params.Ssh_User == "" {
+		params.Ssh_User = "ec2-user"
+	}
+	return nil
+}
+
+type instance struct {
+	cfg     *vm.Config
+	name    string
+	id      string
+	ip      string
+	ssh     *sshutil.Target
+	console vm.Console
+	closed  chan bool
+}
+
+var (
+	initOnce sync.Once
+	EC2      *ec2.Context
+)
+
+func initEC2() {
+	var err error
+	EC2, err = ec2.NewContext()
+	if err != nil {
+		Fatalf("failed to init ec2: %v", err)
+	}
+	Logf(0, "ec2 initialized: running on %v, internal IP %v, region %v, subnet %v",
+		EC2.Instance, EC2.InternalIP, EC2.Region, EC2.Subnet)
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	initOnce.Do(initEC2)
+	params := cfg.Params.(*Params)
+	ok := false
+	defer func() {
+		if !ok {
+			os.RemoveAll(cfg.Workdir)
+		}
+	}()
+
+	// Create SSH key for the instance.
+	// It is used both for the serial console and, if no other key is specified, for ssh.
+	ec2Key := filepath.Join(cfg.Workdir, "key")
+	if err := sshutil.Keygen(ec2Key); err != nil {
+		return nil, err
+	}
+	if err := EC2.ImportKeyPair(cfg.Name, ec2Key+".pub"); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !ok {
+			EC2.DeleteKeyPair(cfg.Name)
+		}
+	}()
+
+	var id, ip string
+	err := vm.CreateInstance(cfg.Name, func() error {
+		return EC2.DeleteInstancesByName(cfg.Name)
+	}, func() error {
+		var err error
+		id, ip, err = EC2.CreateInstance(cfg.Name, params.Machine_Type, cfg.Image, cfg.Name,
+			params.Subnet, params.Security_Groups, params.Spot)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !ok {
+			EC2.DeleteInstance(id, true)
+		}
+	}()
+	ssh := &sshutil.Target{
+		Host:  ip,
+		Key:   cfg.Sshkey,
+		Debug: cfg.Debug,
+		Log:   vm.ArtifactPath(cfg, vm.ArtifactSsh),
+	}
+	if ssh.Key == "" {
+		// The key pair is installed for the default user of the image.
+		ssh.Key = ec2Key
+		ssh.User = params.Ssh_User
+	}
+	ssh.Multiplex(cfg.Workdir)
+	Logf(0, "wait instance to boot: %v (%v, %v)", cfg.Name, id, ip)
+	if err := ssh.WaitReady(vm.ShutdownContext(), 10*time.Minute); err != nil {
+		ssh.Close()
+		return nil, err
+	}
+	ok = true
+	inst := &instance{
+		cfg:    cfg,
+		name:   cfg.Name,
+		id:     id,
+		ip:     ip,
+		ssh:    ssh,
+		closed: make(chan bool),
+	}
+	con := &sshutil.Target{Key: ec2Key}
+	args := append(con.Args("-p"), EC2.SerialConsoleAddr(id))
+	inst.console = vm.NewConsole(cfg, &serialConsole{
+		Console: vm.CommandConsole("ssh", args...),
+		id:      id,
+		key:     ec2Key + ".pub",
+	})
+	return inst, nil
+}
+
+// serialConsole pushes the instance key to EC2 Instance Connect before connecting,
+// pushed keys are valid only for a short time.
+type serialConsole struct {
+	vm.Console
+	id  string
+	key string
+}
+
+func (con *serialConsole) Open() (io.ReadCloser, func(), error) {
+	err := vm.DefaultRetry.Do("push serial console key", func() error {
+		return EC2.PushSerialConsoleKey(con.id, con.key)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return con.Console.Open()
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	inst.ssh.Close()
+	vm.DefaultRetry.Do("delete instance "+inst.name, func() error {
+		return EC2.DeleteInstance(inst.id, false)
+	})
+	EC2.DeleteKeyPair(inst.name)
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	inst.ssh.Sysrq()
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", EC2.InternalIP, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(vm.ShutdownContext(), 3*time.Minute)
+	defer cancel()
+	return inst.ssh.Copy(ctx, ".", hostSrcs)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	killCon, conDone, err := vm.AttachConsole(merger, inst.console)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sshRpipe, sshWpipe, err := vm.LongPipe()
+	if err != nil {
+		killCon()
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ssh := inst.ssh.Command(ctx, command)
+	ssh.Stdout = sshWpipe
+	ssh.Stderr = sshWpipe
+	if err := ssh.Start(); err != nil {
+		cancel()
+		killCon()
+		sshRpipe.Close()
+		sshWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to connect to instance: %v", err)
+	}
+	sshWpipe.Close()
+	sshDone := make(chan error, 1)
+	go func() {
+		err := ssh.Wait()
+		cancel()
+		sshDone <- fmt.Errorf("ssh exited: %v", err)
+	}()
+
+	merger.Add("ssh", sshRpipe)
+
+	sv := &vm.Supervisor{
+		Name:        inst.name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      sshDone,
+		Console:     conDone,
+		Kill:        cancel,
+		KillConsole: killCon,
+		Alive:       func() bool { return EC2.IsInstanceRunning(inst.id) },
+		Merger:      merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
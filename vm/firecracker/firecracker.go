@@ -0,0 +1,498 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package firecracker allows to use Firecracker microVMs as VMs.
+// The kernel is booted directly with the image as the root drive, networking is done
+// over a per-instance tap device (requires CAP_NET_ADMIN) with a static guest address
+// configured on the kernel command line (requires CONFIG_IP_PNP). If the private network
+// is configured (see vm.NetworkConfig), the tap device is attached to the network bridge.
+// After the first successful boot the microVM is snapshotted (memory, VM state and
+// a copy of the root drive); subsequent instances restore that snapshot, which takes
+// a fraction of a second. The snapshot is discarded when the kernel, initrd, image
+// or command line change, so a freshly built kernel is used without any image rebuilds.
+//
+// See https://github.com/firecracker-microvm/firecracker/blob/main/docs/getting-started.md
+// and https://github.com/firecracker-microvm/firecracker/blob/main/docs/snapshotting/snapshot-support.md
+package firecracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("firecracker", ctor, nil)
+	vm.RegisterNetwork("firecracker")
+}
+
+type instance struct {
+	cfg      *vm.Config
+	tap      string
+	hostAddr string
+	guestIP  string
+	netPort  *vm.NetworkPort // private network attachment (optional)
+	dir      string          // persistent dir with the root drive copy and the snapshot
+	sock     string
+	api      *http.Client
+	rpipe    io.ReadCloser
+	wpipe    io.WriteCloser
+	fc       *exec.Cmd
+	waiterC  chan error
+	merger   *vm.OutputMerger
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:  cfg,
+		tap:  fmt.Sprintf("syzfc%v", cfg.Index),
+		dir:  filepath.Join(filepath.Dir(cfg.Workdir), cfg.Name+"-firecracker"),
+		sock: filepath.Join(cfg.Workdir, "firecracker.sock"),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(inst.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dir: %v", err)
+	}
+	if cfg.Network != nil {
+		port, err := vm.AttachNetwork(cfg)
+		if err != nil {
+			return nil, err
+		}
+		inst.netPort = port
+		inst.tap = port.Tap
+		inst.hostAddr = port.HostIP
+		inst.guestIP = port.GuestIP
+	} else if err := inst.setupTap(); err != nil {
+		return nil, err
+	}
+	inst.api = &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", inst.sock)
+			},
+		},
+	}
+
+	// Try the fast path first: restore the snapshot of a booted system.
+	if !vm.CheckBootID(cfg, inst.snapshotFile("bootid")) {
+		os.Remove(inst.snapshotFile("vmstate"))
+	}
+	if _, err := os.Stat(inst.snapshotFile("vmstate")); err == nil {
+		err := inst.restore()
+		if err == nil {
+			Logf(0, "%v: restored snapshot", cfg.Name)
+			closeInst = nil
+			return inst, nil
+		}
+		// The snapshot may be stale (e.g. the kernel has changed), boot from scratch.
+		Logf(0, "%v: failed to restore snapshot (%v), booting from scratch", cfg.Name, err)
+		inst.kill()
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	if err := inst.snapshot(); err != nil {
+		Logf(0, "%v: failed to snapshot microVM, instances will boot from scratch: %v", cfg.Name, err)
+		os.Remove(inst.snapshotFile("vmstate"))
+	} else if err := vm.SaveBootID(cfg, inst.snapshotFile("bootid")); err != nil {
+		Logf(0, "%v: failed to save boot id, instances will boot from scratch: %v", cfg.Name, err)
+		os.Remove(inst.snapshotFile("vmstate"))
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = "firecracker"
+	}
+	if cfg.CrossArch() {
+		return fmt.Errorf("firecracker can't run %v kernels on %v host", cfg.Arch, vm.HostArch)
+	}
+	if cfg.Kernel == "" {
+		return fmt.Errorf("firecracker requires kernel (uncompressed vmlinux)")
+	}
+	if err := vm.ValidateBoot(cfg); err != nil {
+		return err
+	}
+	if _, err := os.Stat(cfg.Image); err != nil {
+		return fmt.Errorf("image file '%v' does not exist: %v", cfg.Image, err)
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 32 {
+		return fmt.Errorf("bad firecracker cpu: %v, want [1-32]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad firecracker mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	if cfg.Index >= 1<<14 {
+		return fmt.Errorf("bad firecracker instance index: %v, want [0-%v)", cfg.Index, 1<<14)
+	}
+	return nil
+}
+
+// setupTap creates the tap device with a /30 subnet for the instance, if it does not exist yet.
+func (inst *instance) setupTap() error {
+	base := inst.cfg.Index * 4
+	inst.hostAddr = fmt.Sprintf("172.16.%v.%v", base/256, base%256+1)
+	inst.guestIP = fmt.Sprintf("172.16.%v.%v", base/256, base%256+2)
+	if _, err := os.Stat(filepath.Join("/sys/class/net", inst.tap)); err == nil {
+		return nil
+	}
+	for _, args := range [][]string{
+		{"tuntap", "add", inst.tap, "mode", "tap"},
+		{"addr", "add", inst.hostAddr + "/30", "dev", inst.tap},
+		{"link", "set", inst.tap, "up"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to setup tap device: ip %+v: %v\n%s", args, err, out)
+		}
+	}
+	return nil
+}
+
+func (inst *instance) snapshotFile(name string) string {
+	return filepath.Join(inst.dir, name)
+}
+
+// start starts firecracker process and waits for the API socket.
+func (inst *instance) start() error {
+	os.Remove(inst.sock)
+	var err error
+	inst.rpipe, inst.wpipe, err = vm.LongPipe()
+	if err != nil {
+		return err
+	}
+	args := []string{"--api-sock", inst.sock}
+	if inst.cfg.Debug {
+		Logf(0, "running command: %v %#v", inst.cfg.Bin, args)
+	}
+	fc := exec.Command(inst.cfg.Bin, args...)
+	// Guest serial console goes to stdout.
+	fc.Stdout = inst.wpipe
+	fc.Stderr = inst.wpipe
+	if err := fc.Start(); err != nil {
+		return fmt.Errorf("failed to start %v %+v: %v", inst.cfg.Bin, args, err)
+	}
+	inst.wpipe.Close()
+	inst.wpipe = nil
+	inst.fc = fc
+
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	inst.merger = vm.NewOutputMerger(tee)
+	inst.merger.Add("console", inst.rpipe)
+	inst.rpipe = nil
+
+	inst.waiterC = make(chan error, 1)
+	go func() {
+		err := fc.Wait()
+		inst.waiterC <- err
+	}()
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(inst.sock); err == nil {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("firecracker API socket did not appear")
+}
+
+func (inst *instance) boot() error {
+	if err := copyFile(inst.cfg.Image, inst.snapshotFile("rootfs")); err != nil {
+		return err
+	}
+	if err := inst.start(); err != nil {
+		return err
+	}
+	ip := fmt.Sprintf("ip=%v::%v:255.255.255.252::eth0:off", inst.guestIP, inst.hostAddr)
+	iface := map[string]interface{}{
+		"iface_id":      "eth0",
+		"host_dev_name": inst.tap,
+	}
+	if inst.netPort != nil {
+		ip = inst.netPort.Cmdline()
+		iface["guest_mac"] = inst.netPort.MAC
+	}
+	cmdline := "console=ttyS0 reboot=k panic=86400 pci=off vsyscall=native rodata=n oops=panic panic_on_warn=1" +
+		" ftrace_dump_on_oops=orig_cpu slub_debug=UZ net.ifnames=0 biosdevname=0 root=/dev/vda rw " +
+		ip + " " + inst.cfg.Cmdline
+	bootSource := map[string]interface{}{
+		"kernel_image_path": inst.cfg.Kernel,
+		"boot_args":         cmdline,
+	}
+	if inst.cfg.Initrd != "" {
+		bootSource["initrd_path"] = inst.cfg.Initrd
+	}
+	requests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{"PUT", "/boot-source", bootSource},
+		{"PUT", "/drives/rootfs", map[string]interface{}{
+			"drive_id":       "rootfs",
+			"path_on_host":   inst.snapshotFile("rootfs"),
+			"is_root_device": true,
+			"is_read_only":   false,
+		}},
+		{"PUT", "/machine-config", map[string]interface{}{
+			"vcpu_count":   inst.cfg.Cpu,
+			"mem_size_mib": inst.cfg.Mem,
+		}},
+		{"PUT", "/network-interfaces/eth0", iface},
+		{"PUT", "/actions", map[string]interface{}{
+			"action_type": "InstanceStart",
+		}},
+	}
+	for _, req := range requests {
+		if err := inst.call(req.method, req.path, req.body); err != nil {
+			return err
+		}
+	}
+	return inst.waitSSH(10 * time.Minute)
+}
+
+// snapshot pauses the booted microVM, saves its state and resumes it.
+func (inst *instance) snapshot() error {
+	if err := inst.call("PATCH", "/vm", map[string]interface{}{"state": "Paused"}); err != nil {
+		return err
+	}
+	err := copyFile(inst.snapshotFile("rootfs"), inst.snapshotFile("rootfs.snapshot"))
+	if err == nil {
+		err = inst.call("PUT", "/snapshot/create", map[string]interface{}{
+			"snapshot_type": "Full",
+			"snapshot_path": inst.snapshotFile("vmstate"),
+			"mem_file_path": inst.snapshotFile("memory"),
+		})
+	}
+	resumeErr := inst.call("PATCH", "/vm", map[string]interface{}{"state": "Resumed"})
+	if err != nil {
+		return err
+	}
+	return resumeErr
+}
+
+func (inst *instance) restore() error {
+	// The memory snapshot is consistent only with the root drive saved together with it.
+	if err := copyFile(inst.snapshotFile("rootfs.snapshot"), inst.snapshotFile("rootfs")); err != nil {
+		return err
+	}
+	if err := inst.start(); err != nil {
+		return err
+	}
+	if err := inst.call("PUT", "/snapshot/load", map[string]interface{}{
+		"snapshot_path": inst.snapshotFile("vmstate"),
+		"mem_backend": map[string]interface{}{
+			"backend_type": "File",
+			"backend_path": inst.snapshotFile("memory"),
+		},
+		"resume_vm": true,
+	}); err != nil {
+		return err
+	}
+	return inst.waitSSH(time.Minute)
+}
+
+func (inst *instance) waitSSH(timeout time.Duration) error {
+	start := time.Now()
+	for {
+		c, err := net.DialTimeout("tcp", inst.guestIP+":22", time.Second)
+		if err == nil {
+			c.SetDeadline(time.Now().Add(3 * time.Second))
+			var tmp [1]byte
+			n, err := c.Read(tmp[:])
+			c.Close()
+			if err == nil && n > 0 {
+				// ssh is up and responding, drop the boot output.
+				for {
+					select {
+					case <-inst.merger.Output:
+						continue
+					default:
+					}
+					return nil
+				}
+			}
+		}
+		select {
+		case err := <-inst.waiterC:
+			inst.waiterC <- err // repost it for Close
+			return fmt.Errorf("firecracker stopped: %v", err)
+		case <-vm.Shutdown:
+			return fmt.Errorf("shutdown in progress")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("ssh server did not start")
+		}
+	}
+}
+
+func (inst *instance) call(method, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, "http://localhost"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := inst.api.Do(req)
+	if err != nil {
+		return fmt.Errorf("firecracker %v %v failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("firecracker %v %v failed: %v\n%s", method, path, resp.Status, reply)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	// Use reflinks if the filesystem supports them, the images may be large.
+	if out, err := exec.Command("cp", "--reflink=auto", src, dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to copy %v: %v\n%s", src, err, out)
+	}
+	return nil
+}
+
+func (inst *instance) kill() {
+	if inst.fc != nil {
+		inst.fc.Process.Kill()
+		err := <-inst.waiterC
+		inst.waiterC <- err // repost it for waiting goroutines
+		inst.fc = nil
+	}
+	if inst.merger != nil {
+		inst.merger.Wait()
+		inst.merger = nil
+	}
+	if inst.rpipe != nil {
+		inst.rpipe.Close()
+		inst.rpipe = nil
+	}
+	if inst.wpipe != nil {
+		inst.wpipe.Close()
+		inst.wpipe = nil
+	}
+}
+
+// Snapshot replaces the boot snapshot with the current state,
+// so that subsequent instances restore it as well.
+func (inst *instance) Snapshot() error {
+	return inst.snapshot()
+}
+
+func (inst *instance) Restore() error {
+	inst.kill()
+	return inst.restore()
+}
+
+func (inst *instance) Close() {
+	// Keep the tap device, the root drive and the snapshot for the next instance.
+	inst.kill()
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	vm.Sysrq(func(command string) *exec.Cmd {
+		return exec.Command("ssh", append(inst.sshArgs("-p"), "root@"+inst.guestIP, command)...)
+	})
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostAddr, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.Scp(inst.sshArgs("-P"), "root@"+inst.guestIP, "/", hostSrcs, inst.cfg.Debug)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	inst.merger.Add("ssh", rpipe)
+
+	args := append(inst.sshArgs("-p"), "root@"+inst.guestIP, command)
+	if inst.cfg.Debug {
+		Logf(0, "running command: ssh %#v", args)
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		wpipe.Close()
+		return nil, nil, err
+	}
+	wpipe.Close()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	sv := &vm.Supervisor{
+		Name:    inst.cfg.Name,
+		Timeout: timeout,
+		Stop:    stop,
+		Exited:  exited,
+		Kill:    func() { cmd.Process.Kill() },
+	}
+	return inst.merger.Output, sv.Start(), nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		"-i", inst.cfg.Sshkey,
+		portArg, "22",
+		"-F", "/dev/null",
+		"-o", "ConnectionAttempts=10",
+		"-o", "ConnectTimeout=10",
+		"-o", "BatchMode=yes",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
@@ -12,10 +12,11 @@
 package gce
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sync"
 	"time"
@@ -23,21 +24,32 @@ import (
 	"github.com/google/syzkaller/gce"
 	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/vm"
+	"github.com/google/syzkaller/vm/internal/sshutil"
 )
 
 func init() {
-	vm.Register("gce", ctor)
+	vm.Register("gce", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are GCE-specific parameters (the vm section of the manager config).
+type Params struct {
+	Machine_Type string // machine type (e.g. "n1-highcpu-2")
+	Preemptible  bool   // use preemptible instances (regular instances are used if there is no capacity)
+}
+
+func (params *Params) Validate() error {
+	if params.Machine_Type == "" {
+		return fmt.Errorf("machine_type is empty")
+	}
+	return nil
 }
 
 type instance struct {
 	cfg     *vm.Config
 	name    string
 	ip      string
-	offset  int64
-	gceKey  string // per-instance private ssh key associated with the instance
-	sshKey  string // ssh key
-	sshUser string
-	workdir string
+	ssh     *sshutil.Target
+	console vm.Console
 	closed  chan bool
 }
 
@@ -66,21 +78,23 @@ func ctor(cfg *vm.Config) (vm.Instance, error) {
 
 	// Create SSH key for the instance.
 	gceKey := filepath.Join(cfg.Workdir, "key")
-	keygen := exec.Command("ssh-keygen", "-t", "rsa", "-b", "2048", "-N", "", "-C", "syzkaller", "-f", gceKey)
-	if out, err := keygen.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failed to execute ssh-keygen: %v\n%s", err, out)
+	if err := sshutil.Keygen(gceKey); err != nil {
+		return nil, err
 	}
 	gceKeyPub, err := ioutil.ReadFile(gceKey + ".pub")
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %v", err)
 	}
 
-	Logf(0, "deleting instance: %v", cfg.Name)
-	if err := GCE.DeleteInstance(cfg.Name, true); err != nil {
-		return nil, err
-	}
-	Logf(0, "creating instance: %v", cfg.Name)
-	ip, err := GCE.CreateInstance(cfg.Name, cfg.MachineType, cfg.Image, string(gceKeyPub))
+	params := cfg.Params.(*Params)
+	var ip string
+	err = vm.CreateInstance(cfg.Name, func() error {
+		return GCE.DeleteInstance(cfg.Name, true)
+	}, func() error {
+		var err error
+		ip, err = GCE.CreateInstance(cfg.Name, params.Machine_Type, cfg.Image, string(gceKeyPub), params.Preemptible)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -89,109 +103,96 @@ func ctor(cfg *vm.Config) (vm.Instance, error) {
 			GCE.DeleteInstance(cfg.Name, true)
 		}
 	}()
-	sshKey := cfg.Sshkey
-	sshUser := "root"
-	if sshKey == "" {
+	ssh := &sshutil.Target{
+		Host:  ip,
+		Key:   cfg.Sshkey,
+		Debug: cfg.Debug,
+		Log:   vm.ArtifactPath(cfg, vm.ArtifactSsh),
+	}
+	if ssh.Key == "" {
 		// Assuming image supports GCE ssh fanciness.
-		sshKey = gceKey
-		sshUser = "syzkaller"
+		ssh.Key = gceKey
+		ssh.User = "syzkaller"
 	}
+	ssh.Multiplex(cfg.Workdir)
 	Logf(0, "wait instance to boot: %v (%v)", cfg.Name, ip)
-	if err := waitInstanceBoot(ip, sshKey, sshUser); err != nil {
+	if err := ssh.WaitReady(vm.ShutdownContext(), 10*time.Minute); err != nil {
+		ssh.Close()
 		return nil, err
 	}
 	ok = true
 	inst := &instance{
-		cfg:     cfg,
-		name:    cfg.Name,
-		ip:      ip,
-		gceKey:  gceKey,
-		sshKey:  sshKey,
-		sshUser: sshUser,
-		closed:  make(chan bool),
-	}
+		cfg:    cfg,
+		name:   cfg.Name,
+		ip:     ip,
+		ssh:    ssh,
+		closed: make(chan bool),
+	}
+	con := &sshutil.Target{
+		Host: "ssh-serialport.googleapis.com",
+		Port: 9600,
+		User: fmt.Sprintf("%v.%v.%v.syzkaller.port=1", GCE.ProjectID, GCE.ZoneID, inst.name),
+		Key:  gceKey,
+	}
+	inst.console = vm.NewConsole(cfg, vm.CommandConsole("ssh", append(con.Args("-p"), con.Dest())...))
 	return inst, nil
 }
 
 func (inst *instance) Close() {
 	close(inst.closed)
-	GCE.DeleteInstance(inst.name, false)
+	inst.ssh.Close()
+	vm.DefaultRetry.Do("delete instance "+inst.name, func() error {
+		return GCE.DeleteInstance(inst.name, false)
+	})
 	os.RemoveAll(inst.cfg.Workdir)
 }
 
+func (inst *instance) Diagnose() []byte {
+	inst.ssh.Sysrq()
+	return nil
+}
+
 func (inst *instance) Forward(port int) (string, error) {
 	return fmt.Sprintf("%v:%v", GCE.InternalIP, port), nil
 }
 
 func (inst *instance) Copy(hostSrc string) (string, error) {
-	vmDst := "./" + filepath.Base(hostSrc)
-	args := append(sshArgs(inst.sshKey, "-P", 22), hostSrc, inst.sshUser+"@"+inst.name+":"+vmDst)
-	cmd := exec.Command("scp", args...)
-	if err := cmd.Start(); err != nil {
-		return "", err
-	}
-	done := make(chan bool)
-	go func() {
-		select {
-		case <-time.After(time.Minute):
-			cmd.Process.Kill()
-		case <-done:
-		}
-	}()
-	err := cmd.Wait()
-	close(done)
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
 	if err != nil {
 		return "", err
 	}
-	return vmDst, nil
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(vm.ShutdownContext(), 3*time.Minute)
+	defer cancel()
+	return inst.ssh.Copy(ctx, ".", hostSrcs)
 }
 
 func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
-	conRpipe, conWpipe, err := vm.LongPipe()
-	if err != nil {
-		return nil, nil, err
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
 	}
-
-	conAddr := fmt.Sprintf("%v.%v.%v.syzkaller.port=1@ssh-serialport.googleapis.com", GCE.ProjectID, GCE.ZoneID, inst.name)
-	conArgs := append(sshArgs(inst.gceKey, "-p", 9600), conAddr)
-	con := exec.Command("ssh", conArgs...)
-	con.Env = []string{}
-	con.Stdout = conWpipe
-	con.Stderr = conWpipe
-	if _, err := con.StdinPipe(); err != nil { // SSH would close connection on stdin EOF
-		conRpipe.Close()
-		conWpipe.Close()
+	merger := vm.NewOutputMerger(tee)
+	killCon, conDone, err := vm.AttachConsole(merger, inst.console)
+	if err != nil {
 		return nil, nil, err
 	}
-	if err := con.Start(); err != nil {
-		conRpipe.Close()
-		conWpipe.Close()
-		return nil, nil, fmt.Errorf("failed to connect to console server: %v", err)
-
-	}
-	conWpipe.Close()
-	conDone := make(chan error, 1)
-	go func() {
-		err := con.Wait()
-		conDone <- fmt.Errorf("console connection closed: %v", err)
-	}()
 
 	sshRpipe, sshWpipe, err := vm.LongPipe()
 	if err != nil {
-		con.Process.Kill()
-		sshRpipe.Close()
+		killCon()
 		return nil, nil, err
 	}
-	if inst.sshUser != "root" {
-		command = fmt.Sprintf("sudo bash -c '%v'", command)
-	}
-	args := append(sshArgs(inst.sshKey, "-p", 22), inst.sshUser+"@"+inst.name, command)
-	ssh := exec.Command("ssh", args...)
+	ctx, cancel := context.WithCancel(context.Background())
+	ssh := inst.ssh.Command(ctx, command)
 	ssh.Stdout = sshWpipe
 	ssh.Stderr = sshWpipe
 	if err := ssh.Start(); err != nil {
-		con.Process.Kill()
-		conRpipe.Close()
+		cancel()
+		killCon()
 		sshRpipe.Close()
 		sshWpipe.Close()
 		return nil, nil, fmt.Errorf("failed to connect to instance: %v", err)
@@ -200,75 +201,37 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 	sshDone := make(chan error, 1)
 	go func() {
 		err := ssh.Wait()
+		cancel()
 		sshDone <- fmt.Errorf("ssh exited: %v", err)
 	}()
 
-	merger := vm.NewOutputMerger(nil)
-	merger.Add(conRpipe)
-	merger.Add(sshRpipe)
-
-	errc := make(chan error, 1)
-	signal := func(err error) {
-		select {
-		case errc <- err:
-		default:
-		}
-	}
-
-	go func() {
-		select {
-		case <-time.After(timeout):
-			signal(vm.TimeoutErr)
-			con.Process.Kill()
-			ssh.Process.Kill()
-		case <-stop:
-			signal(vm.TimeoutErr)
-			con.Process.Kill()
-			ssh.Process.Kill()
-		case <-inst.closed:
-			signal(fmt.Errorf("instance closed"))
-			con.Process.Kill()
-			ssh.Process.Kill()
-		case err := <-conDone:
-			signal(err)
-			ssh.Process.Kill()
-		case err := <-sshDone:
-			// Check if the instance was terminated due to preemption or host maintenance.
-			time.Sleep(time.Second) // just to avoid any GCE races
-			if !GCE.IsInstanceRunning(inst.name) {
-				Logf(1, "%v: ssh exited but instance is not running", inst.name)
-				err = vm.TimeoutErr
-			}
-			signal(err)
-			con.Process.Kill()
-		}
-		merger.Wait()
-	}()
-	return merger.Output, errc, nil
+	merger.Add("ssh", sshRpipe)
+
+	sv := &vm.Supervisor{
+		Name:        inst.name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      sshDone,
+		Console:     conDone,
+		Kill:        cancel,
+		KillConsole: killCon,
+		Alive:       inst.alive,
+		Merger:      merger,
+	}
+	return merger.Output, sv.Start(), nil
 }
 
-func waitInstanceBoot(ip, sshKey, sshUser string) error {
-	for i := 0; i < 100; i++ {
-		if !vm.SleepInterruptible(5 * time.Second) {
-			return fmt.Errorf("shutdown in progress")
-		}
-		cmd := exec.Command("ssh", append(sshArgs(sshKey, "-p", 22), sshUser+"@"+ip, "pwd")...)
-		if _, err := cmd.CombinedOutput(); err == nil {
-			return nil
-		}
+// alive checks that the instance is still running. Preempted instances are not considered
+// to be crashed, they are just lost.
+func (inst *instance) alive() bool {
+	if GCE.IsInstanceRunning(inst.name) {
+		return true
 	}
-	return fmt.Errorf("can't ssh into the instance")
-}
-
-func sshArgs(sshKey, portArg string, port int) []string {
-	return []string{
-		portArg, fmt.Sprint(port),
-		"-i", sshKey,
-		"-F", "/dev/null",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-o", "BatchMode=yes",
-		"-o", "IdentitiesOnly=yes",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "ConnectTimeout=5",
+	if preempted, err := GCE.IsInstancePreempted(inst.name); err != nil {
+		Logf(0, "%v: %v", inst.name, err)
+	} else if preempted {
+		Logf(0, "%v: instance is preempted", inst.name)
 	}
+	return false
 }
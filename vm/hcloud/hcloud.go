@@ -0,0 +1,223 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package hcloud allows to use Hetzner Cloud servers as VMs.
+// It is assumed that syz-manager also runs on Hetzner Cloud as servers are created
+// in the current datacenter and connect back to the manager public IP.
+// Servers are created from an image or snapshot (image param).
+// Hetzner Cloud does not provide access to serial console output,
+// so kernel output is streamed with 'dmesg -w' over a separate ssh connection.
+package hcloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/hcloud"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+	"github.com/google/syzkaller/vm/internal/sshutil"
+)
+
+func init() {
+	vm.Register("hcloud", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are Hetzner Cloud-specific parameters (the vm section of the manager config).
+type Params struct {
+	Machine_Type string // server type (e.g. "cx21")
+}
+
+func (params *Params) Validate() error {
+	if params.Machine_Type == "" {
+		return fmt.Errorf("machine_type is empty")
+	}
+	return nil
+}
+
+type instance struct {
+	cfg     *vm.Config
+	name    string
+	id      int
+	ip      string
+	ssh     *sshutil.Target
+	console vm.Console
+	closed  chan bool
+}
+
+var (
+	initOnce sync.Once
+	HCloud   *hcloud.Context
+)
+
+func initHCloud() {
+	var err error
+	HCloud, err = hcloud.NewContext()
+	if err != nil {
+		Fatalf("failed to init hcloud: %v", err)
+	}
+	Logf(0, "hcloud initialized: running on %v, public IP %v, datacenter %v",
+		HCloud.Instance, HCloud.PublicIP, HCloud.Datacenter)
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	initOnce.Do(initHCloud)
+	ok := false
+	defer func() {
+		if !ok {
+			os.RemoveAll(cfg.Workdir)
+		}
+	}()
+
+	// Create SSH key for the instance.
+	sshKey := filepath.Join(cfg.Workdir, "key")
+	if err := sshutil.Keygen(sshKey); err != nil {
+		return nil, err
+	}
+	sshKeyPub, err := ioutil.ReadFile(sshKey + ".pub")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	keyID, err := HCloud.CreateSSHKey(cfg.Name, string(sshKeyPub))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !ok {
+			HCloud.DeleteSSHKey(cfg.Name)
+		}
+	}()
+
+	params := cfg.Params.(*Params)
+	var srv *hcloud.Server
+	err = vm.CreateInstance(cfg.Name, func() error {
+		return HCloud.DeleteServersByName(cfg.Name)
+	}, func() error {
+		var err error
+		srv, err = HCloud.CreateServer(cfg.Name, params.Machine_Type, cfg.Image, keyID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !ok {
+			HCloud.DeleteServer(srv.ID)
+		}
+	}()
+	ip := srv.PublicNet.IPv4.IP
+	ssh := &sshutil.Target{
+		Host:  ip,
+		Key:   sshKey,
+		Debug: cfg.Debug,
+		Log:   vm.ArtifactPath(cfg, vm.ArtifactSsh),
+	}
+	ssh.Multiplex(cfg.Workdir)
+	Logf(0, "wait instance to boot: %v (%v)", cfg.Name, ip)
+	if err := ssh.WaitReady(vm.ShutdownContext(), 10*time.Minute); err != nil {
+		ssh.Close()
+		return nil, err
+	}
+	ok = true
+	inst := &instance{
+		cfg:    cfg,
+		name:   cfg.Name,
+		id:     srv.ID,
+		ip:     ip,
+		ssh:    ssh,
+		closed: make(chan bool),
+	}
+	inst.console = vm.NewConsole(cfg, vm.CommandConsole("ssh", append(ssh.Args("-p"), ssh.Dest(), "dmesg -w")...))
+	return inst, nil
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	inst.ssh.Close()
+	vm.DefaultRetry.Do("delete instance "+inst.name, func() error {
+		return HCloud.DeleteServer(inst.id)
+	})
+	HCloud.DeleteSSHKey(inst.name)
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	inst.ssh.Sysrq()
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", HCloud.PublicIP, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(vm.ShutdownContext(), 3*time.Minute)
+	defer cancel()
+	return inst.ssh.Copy(ctx, "/root", hostSrcs)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	killCon, conDone, err := vm.AttachConsole(merger, inst.console)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sshRpipe, sshWpipe, err := vm.LongPipe()
+	if err != nil {
+		killCon()
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ssh := inst.ssh.Command(ctx, command)
+	ssh.Stdout = sshWpipe
+	ssh.Stderr = sshWpipe
+	if err := ssh.Start(); err != nil {
+		cancel()
+		killCon()
+		sshRpipe.Close()
+		sshWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to connect to instance: %v", err)
+	}
+	sshWpipe.Close()
+	sshDone := make(chan error, 1)
+	go func() {
+		err := ssh.Wait()
+		cancel()
+		sshDone <- fmt.Errorf("ssh exited: %v", err)
+	}()
+
+	merger.Add("ssh", sshRpipe)
+
+	sv := &vm.Supervisor{
+		Name:        inst.name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      sshDone,
+		Console:     conDone,
+		Kill:        cancel,
+		KillConsole: killCon,
+		Alive:       func() bool { return HCloud.IsServerRunning(inst.id) },
+		Merger:      merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+)
+
+// HooksConfig describes scripts run at instance lifecycle points (the hooks section of the manager config).
+// Host scripts run on the host with SYZ_VM_NAME, SYZ_VM_INDEX, SYZ_VM_WORKDIR and SYZ_VM_HOOK
+// in the environment. Guest scripts are copied into the instance and run there with sh.
+// Pre-boot and post-boot hooks that fail fail instance creation, pre-destroy failures are only logged.
+// The guest pre-destroy hook also runs for crashed or hung instances, so it has a separate short timeout.
+// The hooks are run for all backends by Create and Close of the created instance.
+type HooksConfig struct {
+	PreBoot         string // host script run before the instance is created
+	PostBoot        string // host script run after the instance is booted
+	PreDestroy      string // host script run before the instance is destroyed
+	GuestPostBoot   string // guest script run after the instance is booted (e.g. to load a module)
+	GuestPreDestroy string // guest script run before the instance is destroyed (e.g. to collect /proc)
+	Outdir          string // directory to save guest script output to as NAME-HOOK.log (optional)
+	Timeout         int    // timeout for every script in seconds (default: 300)
+	DestroyTimeout  int    // timeout for the guest pre-destroy script in seconds (default: 30)
+}
+
+func (cfg *HooksConfig) Validate() error {
+	for _, script := range []string{cfg.PreBoot, cfg.PostBoot, cfg.PreDestroy, cfg.GuestPostBoot, cfg.GuestPreDestroy} {
+		if script == "" {
+			continue
+		}
+		if _, err := os.Stat(script); err != nil {
+			return fmt.Errorf("bad script: %v", err)
+		}
+	}
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("bad timeout %v", cfg.Timeout)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 300
+	}
+	if cfg.DestroyTimeout < 0 {
+		return fmt.Errorf("bad destroy timeout %v", cfg.DestroyTimeout)
+	}
+	if cfg.DestroyTimeout == 0 {
+		cfg.DestroyTimeout = 30
+	}
+	return nil
+}
+
+// ParseHooks parses and validates the hooks section of the manager config.
+// Empty data means that there are no hooks, then it returns nil.
+func ParseHooks(data []byte) (*HooksConfig, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	cfg := new(HooksConfig)
+	if err := checkUnknownFields(data, cfg); err != nil {
+		return nil, fmt.Errorf("bad hooks: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse hooks: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("bad hooks: %v", err)
+	}
+	return cfg, nil
+}
+
+// createWithHooks creates an instance with ctor running the configured hooks around it.
+func createWithHooks(cfg *Config, ctor ctorFunc) (Instance, error) {
+	if err := runHostHook(cfg, "pre-boot", cfg.Hooks.PreBoot); err != nil {
+		return nil, err
+	}
+	inst, err := ctor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := runHostHook(cfg, "post-boot", cfg.Hooks.PostBoot); err != nil {
+		inst.Close()
+		return nil, err
+	}
+	if err := runGuestHook(cfg, inst, "post-boot", cfg.Hooks.GuestPostBoot, cfg.Hooks.Timeout); err != nil {
+		inst.Close()
+		return nil, err
+	}
+	return &hookInstance{Instance: inst, cfg: cfg}, nil
+}
+
+type hookInstance struct {
+	Instance
+	cfg *Config
+}
+
+func (inst *hookInstance) RunCommand(timeout time.Duration, stop <-chan bool, cmd *Command) (<-chan []byte, <-chan error, error) {
+	return RunCommand(inst.Instance, timeout, stop, cmd)
+}
+
+func (inst *hookInstance) Close() {
+	// Copying the script into a dead instance may hang on its own,
+	// so the whole guest hook is bounded by the destroy timeout.
+	done := make(chan error, 1)
+	go func() {
+		done <- runGuestHook(inst.cfg, inst.Instance, "pre-destroy", inst.cfg.Hooks.GuestPreDestroy,
+			inst.cfg.Hooks.DestroyTimeout)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			Logf(0, "%v: %v", inst.cfg.Name, err)
+		}
+	case <-time.After(time.Duration(inst.cfg.Hooks.DestroyTimeout) * time.Second):
+		Logf(0, "%v: pre-destroy guest hook %v timed out", inst.cfg.Name, inst.cfg.Hooks.GuestPreDestroy)
+	}
+	if err := runHostHook(inst.cfg, "pre-destroy", inst.cfg.Hooks.PreDestroy); err != nil {
+		Logf(0, "%v: %v", inst.cfg.Name, err)
+	}
+	inst.Instance.Close()
+}
+
+func runHostHook(cfg *Config, hook, script string) error {
+	if script == "" {
+		return nil
+	}
+	cmd := exec.Command(script)
+	cmd.Env = append(os.Environ(),
+		"SYZ_VM_NAME="+cfg.Name,
+		fmt.Sprintf("SYZ_VM_INDEX=%v", cfg.Index),
+		"SYZ_VM_WORKDIR="+cfg.Workdir,
+		"SYZ_VM_HOOK="+hook,
+	)
+	out, err := RunTimeout(time.Duration(cfg.Hooks.Timeout)*time.Second, cmd)
+	if cfg.Debug {
+		Logf(0, "%v: %v hook %v output:\n%s", cfg.Name, hook, script, out)
+	}
+	if err != nil {
+		return fmt.Errorf("%v hook %v failed: %v\n%s", hook, script, err, out)
+	}
+	return nil
+}
+
+var hookStatusRe = regexp.MustCompile(`SYZ_HOOK_STATUS=([0-9]+)`)
+
+func runGuestHook(cfg *Config, inst Instance, hook, script string, timeout int) error {
+	if script == "" {
+		return nil
+	}
+	vmScript, err := inst.Copy(script)
+	if err != nil {
+		return fmt.Errorf("%v guest hook %v: failed to copy: %v", hook, script, err)
+	}
+	// Backends report command exit differently, so the script prints own exit status.
+	cmd := &Command{Args: []string{"sh", "-c", `sh "$0"; echo SYZ_HOOK_STATUS=$?`, vmScript}}
+	outc, errc, err := RunCommand(inst, time.Duration(timeout)*time.Second, nil, cmd)
+	if err != nil {
+		return fmt.Errorf("%v guest hook %v: failed to run: %v", hook, script, err)
+	}
+	var output []byte
+	var runErr error
+loop:
+	for {
+		select {
+		case out, ok := <-outc:
+			if !ok {
+				outc = nil
+				continue
+			}
+			output = append(output, out...)
+		case runErr = <-errc:
+			break loop
+		}
+	}
+	// Collect output that is still in flight.
+	for timer := time.After(time.Second); outc != nil; {
+		select {
+		case out, ok := <-outc:
+			if !ok {
+				outc = nil
+			}
+			output = append(output, out...)
+		case <-timer:
+			outc = nil
+		}
+	}
+	if cfg.Hooks.Outdir != "" {
+		file := filepath.Join(cfg.Hooks.Outdir, fmt.Sprintf("%v-%v.log", cfg.Name, hook))
+		if err := ioutil.WriteFile(file, output, 0640); err != nil {
+			Logf(0, "%v: failed to save %v guest hook output: %v", cfg.Name, hook, err)
+		}
+	}
+	if cfg.Debug {
+		Logf(0, "%v: %v guest hook %v output:\n%s", cfg.Name, hook, script, output)
+	}
+	match := hookStatusRe.FindSubmatch(output)
+	if match == nil {
+		return fmt.Errorf("%v guest hook %v did not finish: %v\n%s", hook, script, runErr, output)
+	}
+	if string(match[1]) != "0" {
+		return fmt.Errorf("%v guest hook %v failed with status %s\n%s", hook, script, match[1], output)
+	}
+	return nil
+}
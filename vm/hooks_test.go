@@ -0,0 +1,158 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shellInstance runs commands on the host with sh.
+type shellInstance struct {
+	testInstance
+}
+
+func (inst *shellInstance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	outc := make(chan []byte, 1)
+	errc := make(chan error, 1)
+	out, err := exec.Command("sh", "-c", command).CombinedOutput()
+	outc <- out
+	errc <- fmt.Errorf("command exited: %v", err)
+	return outc, errc, nil
+}
+
+func TestHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hooks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	script := func(name, body string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	host := `echo "$SYZ_VM_HOOK $SYZ_VM_NAME $SYZ_VM_INDEX" >> ` + log
+	hooks := &HooksConfig{
+		PreBoot:         script("pre-boot", host),
+		PostBoot:        script("post-boot", host),
+		PreDestroy:      script("pre-destroy", host),
+		GuestPostBoot:   script("guest-post-boot", "echo guest-post-boot >> "+log),
+		GuestPreDestroy: script("guest-pre-destroy", "echo guest-pre-destroy >> "+log+"; echo state"),
+		Outdir:          dir,
+	}
+	if err := hooks.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	var inst *shellInstance
+	Register("test-hooks", func(cfg *Config) (Instance, error) {
+		inst = new(shellInstance)
+		return inst, nil
+	}, nil)
+	defer delete(backends, "test-hooks")
+
+	vmInst, err := Create("test-hooks", &Config{Name: "test-3", Index: 3, Hooks: hooks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmInst.Close()
+	if !inst.closed {
+		t.Fatalf("instance is not closed")
+	}
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "pre-boot test-3 3\npost-boot test-3 3\nguest-post-boot\nguest-pre-destroy\npre-destroy test-3 3\n"
+	if string(data) != want {
+		t.Fatalf("got hooks log:\n%s\nwant:\n%s", data, want)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(dir, "test-3-pre-destroy.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(out), "state\n") {
+		t.Fatalf("got guest hook output %q", out)
+	}
+}
+
+func TestHooksFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hooks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fail := filepath.Join(dir, "fail")
+	if err := ioutil.WriteFile(fail, []byte("#!/bin/sh\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var inst *shellInstance
+	Register("test-hooks", func(cfg *Config) (Instance, error) {
+		inst = new(shellInstance)
+		return inst, nil
+	}, nil)
+	defer delete(backends, "test-hooks")
+
+	for _, hooks := range []*HooksConfig{
+		{PreBoot: fail},
+		{PostBoot: fail},
+		{GuestPostBoot: fail},
+	} {
+		hooks.Validate()
+		inst = nil
+		if _, err := Create("test-hooks", &Config{Name: "test-0", Hooks: hooks}); err == nil {
+			t.Fatalf("hooks %+v: creation did not fail", hooks)
+		}
+		if inst != nil && !inst.closed {
+			t.Fatalf("hooks %+v: instance is not closed", hooks)
+		}
+	}
+}
+
+func TestHooksDestroyTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hooks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hang := filepath.Join(dir, "hang")
+	if err := ioutil.WriteFile(hang, []byte("#!/bin/sh\nsleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var inst *shellInstance
+	Register("test-hooks", func(cfg *Config) (Instance, error) {
+		inst = new(shellInstance)
+		return inst, nil
+	}, nil)
+	defer delete(backends, "test-hooks")
+
+	hooks := &HooksConfig{GuestPreDestroy: hang, DestroyTimeout: 1}
+	if err := hooks.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if hooks.Timeout != 300 {
+		t.Fatalf("got timeout %v, want 300", hooks.Timeout)
+	}
+	vmInst, err := Create("test-hooks", &Config{Name: "test-0", Hooks: hooks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	vmInst.Close()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("close took %v", d)
+	}
+	if !inst.closed {
+		t.Fatalf("instance is not closed")
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package hyperv allows to use Hyper-V virtual machines as VMs on Windows hosts.
+// VMs are controlled with PowerShell Hyper-V cmdlets. Every pool index gets a persistent VM
+// with a differencing disk on top of the configured VHDX template. The kernel must be
+// installed in the template, direct kernel boot is not supported by Hyper-V.
+// After the first successful boot the running VM is checkpointed, and subsequent instances
+// restore that checkpoint instead of booting from scratch.
+// Kernel console output is read from COM1 exposed as a named pipe on the host,
+// the guest kernel needs console=ttyS0. The guest needs Hyper-V integration services
+// (hv_kvp_daemon) to report its IP address.
+//
+// See https://docs.microsoft.com/en-us/powershell/module/hyper-v for the cmdlets.
+package hyperv
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+const snapshot = "syzkaller-clean"
+
+func init() {
+	vm.Register("hyperv", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are Hyper-V-specific parameters (the vm section of the manager config).
+type Params struct {
+	Switch string // virtual switch to connect VMs to (default: "Default Switch")
+}
+
+func (params *Params) Validate() error {
+	if params.Switch == "" {
+		params.Switch = "Default Switch"
+	}
+	return nil
+}
+
+type instance struct {
+	cfg      *vm.Config
+	params   *Params
+	name     string
+	disk     string
+	pipe     string
+	ip       string
+	hostAddr string
+	closed   chan bool
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:    cfg,
+		params: cfg.Params.(*Params),
+		name:   cfg.Name,
+		disk:   filepath.Join(filepath.Dir(cfg.Workdir), cfg.Name+".vhdx"),
+		pipe:   "syzkaller-" + cfg.Name,
+		closed: make(chan bool),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	hostAddr, err := inst.hostAddress()
+	if err != nil {
+		return nil, err
+	}
+	inst.hostAddr = hostAddr
+
+	// Try the fast path first: restore the checkpoint of a booted system.
+	restored := false
+	if _, err := inst.ps("Restore-VMSnapshot -VMName %v -Name %v -Confirm:$false; Start-VM -Name %v",
+		quote(inst.name), quote(snapshot), quote(inst.name)); err == nil {
+		restored = true
+		Logf(0, "%v: restored checkpoint", inst.name)
+	} else {
+		if err := inst.create(); err != nil {
+			return nil, err
+		}
+	}
+	if err := inst.waitBoot(); err != nil {
+		if !restored {
+			return nil, err
+		}
+		// The checkpoint may be stale (e.g. the template has changed), recreate the VM.
+		Logf(0, "%v: restored VM does not respond (%v), booting from scratch", inst.name, err)
+		if err := inst.create(); err != nil {
+			return nil, err
+		}
+		if err := inst.waitBoot(); err != nil {
+			return nil, err
+		}
+		restored = false
+	}
+	if !restored {
+		if _, err := inst.ps("Checkpoint-VM -Name %v -SnapshotName %v", quote(inst.name), quote(snapshot)); err != nil {
+			Logf(0, "%v: failed to checkpoint VM, instances will boot from scratch: %v", inst.name, err)
+		}
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = "powershell.exe"
+	}
+	if _, err := os.Stat(cfg.Image); err != nil {
+		return fmt.Errorf("image file '%v' does not exist: %v", cfg.Image, err)
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 240 {
+		return fmt.Errorf("bad hyperv cpu: %v, want [1-240]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad hyperv mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+// create (re)creates the differencing disk and the VM and starts it.
+func (inst *instance) create() error {
+	inst.ps("Stop-VM -Name %v -TurnOff -Force", quote(inst.name))
+	inst.ps("Remove-VM -Name %v -Force", quote(inst.name))
+	os.Remove(inst.disk)
+	image, err := filepath.Abs(inst.cfg.Image)
+	if err != nil {
+		return err
+	}
+	if _, err := inst.ps("New-VHD -Path %v -ParentPath %v -Differencing",
+		quote(inst.disk), quote(image)); err != nil {
+		return fmt.Errorf("failed to create differencing disk: %v", err)
+	}
+	name := quote(inst.name)
+	script := []string{
+		fmt.Sprintf("New-VM -Name %v -Generation 1 -MemoryStartupBytes %vMB -VHDPath %v -SwitchName %v",
+			name, inst.cfg.Mem, quote(inst.disk), quote(inst.params.Switch)),
+		fmt.Sprintf("Set-VMProcessor -VMName %v -Count %v", name, inst.cfg.Cpu),
+		fmt.Sprintf("Set-VMMemory -VMName %v -DynamicMemoryEnabled $false", name),
+		fmt.Sprintf("Set-VMComPort -VMName %v -Number 1 -Path %v", name, quote(`\\.\pipe\`+inst.pipe)),
+		// Standard checkpoints include memory state, so restore resumes the running system.
+		fmt.Sprintf("Set-VM -Name %v -CheckpointType Standard -AutomaticStopAction TurnOff", name),
+		fmt.Sprintf("Start-VM -Name %v", name),
+	}
+	if _, err := inst.ps("%v", strings.Join(script, "; ")); err != nil {
+		return fmt.Errorf("failed to create VM: %v", err)
+	}
+	return nil
+}
+
+func (inst *instance) waitBoot() error {
+	inst.ip = ""
+	for i := 0; i < 100; i++ {
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+		if inst.ip == "" {
+			ip, err := inst.address()
+			if err != nil {
+				continue
+			}
+			inst.ip = ip
+		}
+		cmd := exec.Command("ssh", append(inst.sshArgs("-p"), "root@"+inst.ip, "pwd")...)
+		if _, err := cmd.CombinedOutput(); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("can't ssh into the instance")
+}
+
+// address returns IPv4 address of the VM as reported by the integration services.
+func (inst *instance) address() (string, error) {
+	out, err := inst.ps("(Get-VMNetworkAdapter -VMName %v).IPAddresses", quote(inst.name))
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range strings.Fields(string(out)) {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("VM has no address yet")
+}
+
+// hostAddress returns IPv4 address of the host on the virtual switch.
+func (inst *instance) hostAddress() (string, error) {
+	out, err := inst.ps("(Get-NetIPAddress -InterfaceAlias %v -AddressFamily IPv4).IPAddress",
+		quote("vEthernet ("+inst.params.Switch+")"))
+	if err != nil {
+		return "", fmt.Errorf("failed to query host address on switch %v: %v", inst.params.Switch, err)
+	}
+	addr := strings.TrimSpace(string(out))
+	if net.ParseIP(addr) == nil {
+		return "", fmt.Errorf("failed to parse host address on switch %v: %q", inst.params.Switch, addr)
+	}
+	return addr, nil
+}
+
+func (inst *instance) ps(format string, args ...interface{}) ([]byte, error) {
+	script := fmt.Sprintf(format, args...)
+	if inst.cfg.Debug {
+		Logf(0, "executing powershell: %v", script)
+	}
+	cmd := exec.Command(inst.cfg.Bin, "-NoProfile", "-NonInteractive", "-Command",
+		"$ErrorActionPreference = 'Stop'; "+script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("powershell '%v' failed: %v\n%s", script, err, out)
+	}
+	return out, nil
+}
+
+// quote returns s as a single-quoted PowerShell string literal.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	// Keep the VM, the disk and the checkpoint for the next instance.
+	inst.ps("Stop-VM -Name %v -TurnOff -Force", quote(inst.name))
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	// The kernel prints backtraces of all CPUs on NMI to the console.
+	if _, err := inst.ps("Debug-VM -Name %v -InjectNonMaskableInterrupt -Force", quote(inst.name)); err != nil {
+		Logf(0, "%v: failed to inject NMI: %v", inst.name, err)
+	}
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostAddr, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.Scp(inst.sshArgs("-P"), "root@"+inst.ip, "/", hostSrcs, inst.cfg.Debug)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	conRpipe, conWpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Relay the COM1 named pipe to stdout, the separate process can be simply killed.
+	relay := fmt.Sprintf("$p = New-Object System.IO.Pipes.NamedPipeClientStream('.', %v, [System.IO.Pipes.PipeDirection]::In); "+
+		"$p.Connect(10000); $p.CopyTo([Console]::OpenStandardOutput())", quote(inst.pipe))
+	con := exec.Command(inst.cfg.Bin, "-NoProfile", "-NonInteractive", "-Command", relay)
+	con.Stdout = conWpipe
+	con.Stderr = conWpipe
+	if err := con.Start(); err != nil {
+		conRpipe.Close()
+		conWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to open console pipe %v: %v", inst.pipe, err)
+	}
+	conWpipe.Close()
+	conDone := make(chan error, 1)
+	go func() {
+		err := con.Wait()
+		conDone <- fmt.Errorf("console connection closed: %v", err)
+	}()
+
+	sshRpipe, sshWpipe, err := vm.LongPipe()
+	if err != nil {
+		con.Process.Kill()
+		conRpipe.Close()
+		return nil, nil, err
+	}
+	args := append(inst.sshArgs("-p"), "root@"+inst.ip, command)
+	if inst.cfg.Debug {
+		Logf(0, "running command: ssh %#v", args)
+	}
+	ssh := exec.Command("ssh", args...)
+	ssh.Stdout = sshWpipe
+	ssh.Stderr = sshWpipe
+	if err := ssh.Start(); err != nil {
+		con.Process.Kill()
+		conRpipe.Close()
+		sshRpipe.Close()
+		sshWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to connect to instance: %v", err)
+	}
+	sshWpipe.Close()
+	sshDone := make(chan error, 1)
+	go func() {
+		err := ssh.Wait()
+		sshDone <- fmt.Errorf("ssh exited: %v", err)
+	}()
+
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	merger.Add("console", conRpipe)
+	merger.Add("ssh", sshRpipe)
+
+	sv := &vm.Supervisor{
+		Name:        inst.cfg.Name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      sshDone,
+		Console:     conDone,
+		Kill:        func() { ssh.Process.Kill() },
+		KillConsole: func() { con.Process.Kill() },
+		Merger:      merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		portArg, "22",
+		"-i", inst.cfg.Sshkey,
+		"-F", "/dev/null",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "BatchMode=yes",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "ConnectTimeout=10",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
@@ -0,0 +1,246 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package sshutil implements ssh access to test machines for cloud VM backends:
+// connection options, waiting for the machine to come up, file transfer
+// and remote command execution. Host keys of test machines are not checked,
+// because machines are recreated all the time and get new keys.
+package sshutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+// Target is a machine accessible over ssh.
+type Target struct {
+	Host  string // host name or IP address
+	Port  int    // ssh port (default: 22)
+	User  string // user name (default: root), commands of other users are run with sudo
+	Key   string // private key file
+	Sftp  bool   // transfer files with sftp instead of scp (e.g. for images without scp)
+	Debug bool
+	Log   string // file to append commands and their failures to (optional), see vm.ArtifactSsh
+
+	controlPath string
+}
+
+func (t *Target) logf(msg string, args ...interface{}) {
+	if t.Log == "" {
+		return
+	}
+	f, err := os.OpenFile(t.Log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%v %v\n", time.Now().Format("2006/01/02 15:04:05"), fmt.Sprintf(msg, args...))
+}
+
+// Multiplex makes all commands and transfers reuse a single master connection
+// which is kept open in background. The control socket is created in dir.
+// Multiplexing is not used if the socket path is too long for a unix socket.
+func (t *Target) Multiplex(dir string) {
+	path := filepath.Join(dir, "ssh-mux")
+	if len(path) > 100 {
+		Logf(1, "%v: not using ssh multiplexing, control path %v is too long", t.Host, path)
+		return
+	}
+	t.controlPath = path
+}
+
+// Close stops the master connection, if any.
+func (t *Target) Close() {
+	if t.controlPath == "" {
+		return
+	}
+	args := append(t.Args("-p"), "-O", "exit", t.Dest())
+	runTimeout(time.Minute, exec.Command("ssh", args...))
+}
+
+// Dest returns user@host.
+func (t *Target) Dest() string {
+	user := t.User
+	if user == "" {
+		user = "root"
+	}
+	return user + "@" + t.Host
+}
+
+// Args returns ssh/scp/sftp options for the target, portFlag is -p for ssh and -P for scp and sftp.
+func (t *Target) Args(portFlag string) []string {
+	port := t.Port
+	if port == 0 {
+		port = 22
+	}
+	args := []string{
+		portFlag, fmt.Sprint(port),
+		"-F", "/dev/null",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=error",
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "ConnectionAttempts=3",
+		"-o", "ServerAliveInterval=10",
+	}
+	if t.Key != "" {
+		args = append(args, "-i", t.Key, "-o", "IdentitiesOnly=yes")
+	}
+	if t.controlPath != "" {
+		args = append(args,
+			"-o", "ControlMaster=auto",
+			"-o", "ControlPath="+t.controlPath,
+			"-o", "ControlPersist=10m",
+		)
+	}
+	if t.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
+
+// Command returns ssh command that runs command on the target.
+// The command is killed when ctx is done.
+func (t *Target) Command(ctx context.Context, command string) *exec.Cmd {
+	if t.User != "" && t.User != "root" {
+		command = "sudo bash -c " + vm.Quote(command)
+	}
+	args := append(t.Args("-p"), t.Dest(), command)
+	if t.Debug {
+		Logf(0, "running command: ssh %#v", args)
+	}
+	t.logf("ssh %v %v", t.Dest(), command)
+	return exec.CommandContext(ctx, "ssh", args...)
+}
+
+// Run runs command on the target and returns its combined output.
+func (t *Target) Run(ctx context.Context, command string) ([]byte, error) {
+	out, err := t.Command(ctx, command).CombinedOutput()
+	if err != nil {
+		t.logf("ssh %v failed: %v\n%s", command, err, out)
+		return out, fmt.Errorf("ssh %v failed: %v\n%s", command, err, out)
+	}
+	return out, nil
+}
+
+// Sysrq runs vm.SysrqCommand on the target, see vm.Sysrq.
+func (t *Target) Sysrq() {
+	vm.Sysrq(func(command string) *exec.Cmd {
+		return t.Command(vm.ShutdownContext(), command)
+	})
+}
+
+// WaitReady waits up to timeout until commands can be executed on the target.
+func (t *Target) WaitReady(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var err error
+	for {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("can't ssh into %v: %v", t.Host, ctx.Err())
+		}
+		ctx1, cancel := context.WithTimeout(ctx, time.Minute)
+		_, err = t.Run(ctx1, "pwd")
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("can't ssh into %v: %v", t.Host, err)
+		}
+	}
+}
+
+// Copy copies hostSrcs into directory vmDir on the target in a single session
+// and returns file names on the target.
+func (t *Target) Copy(ctx context.Context, vmDir string, hostSrcs []string) ([]string, error) {
+	var vmDsts []string
+	for _, hostSrc := range hostSrcs {
+		vmDsts = append(vmDsts, strings.TrimSuffix(vmDir, "/")+"/"+filepath.Base(hostSrc))
+	}
+	var cmd *exec.Cmd
+	if t.Sftp {
+		batch := new(bytes.Buffer)
+		for i, hostSrc := range hostSrcs {
+			src, err := sftpQuote(hostSrc)
+			if err != nil {
+				return nil, err
+			}
+			dst, err := sftpQuote(vmDsts[i])
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(batch, "put %v %v\nchmod 755 %v\n", src, dst, dst)
+		}
+		args := append(t.Args("-P"), "-b", "-", t.Dest())
+		cmd = exec.CommandContext(ctx, "sftp", args...)
+		cmd.Stdin = batch
+	} else {
+		args := append(append(t.Args("-P"), hostSrcs...), t.Dest()+":"+vmDir)
+		cmd = exec.CommandContext(ctx, "scp", args...)
+	}
+	if t.Debug {
+		Logf(0, "running command: %v %#v", cmd.Path, cmd.Args[1:])
+	}
+	t.logf("%v %v to %v:%v", filepath.Base(cmd.Path), strings.Join(hostSrcs, " "), t.Dest(), vmDir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.logf("%v failed: %v\n%s", filepath.Base(cmd.Path), err, out)
+		return nil, fmt.Errorf("%v failed: %v\n%s", filepath.Base(cmd.Path), err, out)
+	}
+	return vmDsts, nil
+}
+
+// sftpQuote quotes path for an sftp batch file. Inside double quotes sftp unescapes
+// backslash and quote, and treats escaped glob characters literally.
+// Newlines can't be quoted, they would start a new batch command.
+func sftpQuote(path string) (string, error) {
+	if strings.ContainsAny(path, "\n\r") {
+		return "", fmt.Errorf("can't transfer %q with sftp: path contains a newline", path)
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte('"')
+	for _, c := range []byte(path) {
+		switch c {
+		case '\\', '"', '*', '?', '[':
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(c)
+	}
+	buf.WriteByte('"')
+	return buf.String(), nil
+}
+
+func runTimeout(timeout time.Duration, cmd *exec.Cmd) {
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+	if err := cmd.Start(); err != nil {
+		return
+	}
+	timer := time.AfterFunc(timeout, func() {
+		cmd.Process.Kill()
+	})
+	cmd.Wait()
+	timer.Stop()
+}
+
+// Keygen creates a new rsa key pair in file key and key.pub.
+func Keygen(key string) error {
+	os.Remove(key)
+	os.Remove(key + ".pub")
+	cmd := exec.Command("ssh-keygen", "-t", "rsa", "-b", "2048", "-N", "", "-C", "syzkaller", "-f", key)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to execute ssh-keygen: %v\n%s", err, out)
+	}
+	return nil
+}
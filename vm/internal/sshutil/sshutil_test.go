@@ -0,0 +1,77 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sshutil
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		target  Target
+		command string
+		dest    string
+		cmd     string
+	}{
+		{Target{Host: "10.0.0.1"}, "ls", "root@10.0.0.1", "ls"},
+		{Target{Host: "10.0.0.1", User: "root"}, "ls", "root@10.0.0.1", "ls"},
+		{Target{Host: "10.0.0.1", User: "syzkaller"}, "ls", "syzkaller@10.0.0.1", "sudo bash -c 'ls'"},
+		{Target{Host: "10.0.0.1", User: "syzkaller"}, "echo 'a b'", "syzkaller@10.0.0.1", `sudo bash -c 'echo '\''a b'\'''`},
+	}
+	for i, test := range tests {
+		cmd := test.target.Command(context.Background(), test.command)
+		args := cmd.Args[len(cmd.Args)-2:]
+		if args[0] != test.dest || args[1] != test.cmd {
+			t.Fatalf("#%v: got %q, want [%q %q]", i, args, test.dest, test.cmd)
+		}
+	}
+}
+
+func TestArgs(t *testing.T) {
+	target := &Target{Host: "10.0.0.1", Port: 2222, Key: "/key"}
+	target.Multiplex("/workdir")
+	args := strings.Join(target.Args("-P"), " ")
+	for _, want := range []string{
+		"-P 2222 ",
+		"-o StrictHostKeyChecking=no",
+		"-i /key -o IdentitiesOnly=yes",
+		"-o ControlPath=/workdir/ssh-mux",
+	} {
+		if !strings.Contains(args, want) {
+			t.Fatalf("args %q don't contain %q", args, want)
+		}
+	}
+	target = &Target{Host: "10.0.0.1"}
+	target.Multiplex("/" + strings.Repeat("x", 100))
+	args = strings.Join(target.Args("-p"), " ")
+	if !strings.HasPrefix(args, "-p 22 ") || strings.Contains(args, "Control") || strings.Contains(args, "-i ") {
+		t.Fatalf("bad args: %q", args)
+	}
+}
+
+func TestSftpQuote(t *testing.T) {
+	tests := []struct {
+		path   string
+		quoted string
+	}{
+		{"/tmp/syz-fuzzer", `"/tmp/syz-fuzzer"`},
+		{"/tmp/a b", `"/tmp/a b"`},
+		{`/tmp/a"; !rm -rf /`, `"/tmp/a\"; !rm -rf /"`},
+		{`/tmp/a\b*?[c]`, `"/tmp/a\\b\*\?\[c]"`},
+	}
+	for i, test := range tests {
+		quoted, err := sftpQuote(test.path)
+		if err != nil {
+			t.Fatalf("#%v: %v", i, err)
+		}
+		if quoted != test.quoted {
+			t.Fatalf("#%v: got %v, want %v", i, quoted, test.quoted)
+		}
+	}
+	if _, err := sftpQuote("/tmp/a\nput /etc/shadow"); err == nil {
+		t.Fatalf("path with a newline is not rejected")
+	}
+}
@@ -0,0 +1,431 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package isolated allows to run programs directly on the host like the local backend,
+// but confined in user, mount, pid, net, ipc and uts namespaces and in a cgroup
+// with memory and CPU limits (mem and cpu of the manager config).
+// This is useful for fuzzing of sandboxes or LSM policies where a VM is not needed.
+//
+// Output of the program is read from a pseudo-terminal which serves as the console.
+// The program runs as root of the user namespace, which is mapped to the user running
+// the manager. The net namespace has only loopback, ports requested with Forward
+// are proxied to the host over unix sockets in the instance workdir.
+// Cgroups require cgroup v2 and a writable parent cgroup.
+package isolated
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/syzkaller/fileutil"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == initName {
+		// We are the init process of an instance, see containerInit.
+		containerInit()
+	}
+	vm.Register("isolated", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are isolated-specific parameters (the vm section of the manager config).
+type Params struct {
+	Cgroup string // parent cgroup v2 directory for instance cgroups (default: "/sys/fs/cgroup/syzkaller")
+	Pids   int    // max number of processes in an instance (default: 10000)
+}
+
+func (params *Params) Validate() error {
+	if params.Cgroup == "" {
+		params.Cgroup = "/sys/fs/cgroup/syzkaller"
+	}
+	if params.Pids < 0 {
+		return fmt.Errorf("bad pids %v", params.Pids)
+	}
+	if params.Pids == 0 {
+		params.Pids = 10000
+	}
+	return nil
+}
+
+type instance struct {
+	cfg    *vm.Config
+	cgroup string
+	ports  []int
+	closed chan bool
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	params := cfg.Params.(*Params)
+	inst := &instance{
+		cfg:    cfg,
+		cgroup: filepath.Join(params.Cgroup, cfg.Name),
+		closed: make(chan bool),
+	}
+	if err := inst.setupCgroup(params); err != nil {
+		os.RemoveAll(cfg.Workdir)
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (inst *instance) setupCgroup(params *Params) error {
+	if err := os.MkdirAll(params.Cgroup, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup: %v", err)
+	}
+	if err := writeFile(filepath.Join(params.Cgroup, "cgroup.subtree_control"), "+memory +cpu +pids"); err != nil {
+		return err
+	}
+	// Remove a stale cgroup of the previous instance, if any.
+	syscall.Rmdir(inst.cgroup)
+	if err := os.Mkdir(inst.cgroup, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup: %v", err)
+	}
+	limits := map[string]string{
+		"pids.max": strconv.Itoa(params.Pids),
+	}
+	if inst.cfg.Mem > 0 {
+		limits["memory.max"] = strconv.Itoa(inst.cfg.Mem << 20)
+		limits["memory.swap.max"] = "0"
+	}
+	if inst.cfg.Cpu > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%v 100000", inst.cfg.Cpu*100000)
+	}
+	for file, val := range limits {
+		if err := writeFile(filepath.Join(inst.cgroup, file), val); err != nil {
+			syscall.Rmdir(inst.cgroup)
+			return err
+		}
+	}
+	return nil
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	syscall.Rmdir(inst.cgroup)
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	inst.ports = append(inst.ports, port)
+	return fmt.Sprintf("127.0.0.1:%v", port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDst := filepath.Join(inst.cfg.Workdir, filepath.Base(hostSrc))
+	if err := fileutil.CopyFile(hostSrc, vmDst, false); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(vmDst, 0777); err != nil {
+		return "", err
+	}
+	return vmDst, nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.CopyEach(inst, hostSrcs)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	console, tty, err := openPty()
+	if err != nil {
+		return nil, nil, err
+	}
+	var listeners []net.Listener
+	closeListeners := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	var ports []string
+	for _, port := range inst.ports {
+		ln, err := proxyPort(inst.cfg.Workdir, port)
+		if err != nil {
+			closeListeners()
+			console.Close()
+			tty.Close()
+			return nil, nil, err
+		}
+		listeners = append(listeners, ln)
+		ports = append(ports, strconv.Itoa(port))
+	}
+
+	// Init blocks on the pipe until we've moved it into the cgroup,
+	// so that nothing it starts escapes the limits.
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		closeListeners()
+		console.Close()
+		tty.Close()
+		return nil, nil, err
+	}
+	args := []string{inst.cfg.Name, inst.cfg.Workdir, strings.Join(ports, ","), command}
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Args[0] = initName
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	cmd.ExtraFiles = []*os.File{ready}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	if inst.cfg.Debug {
+		Logf(0, "running command: %v", command)
+	}
+	if err := cmd.Start(); err != nil {
+		closeListeners()
+		console.Close()
+		tty.Close()
+		ready.Close()
+		readyW.Close()
+		return nil, nil, fmt.Errorf("failed to start instance init: %v", err)
+	}
+	tty.Close()
+	ready.Close()
+	if err := writeFile(filepath.Join(inst.cgroup, "cgroup.procs"), strconv.Itoa(cmd.Process.Pid)); err != nil {
+		readyW.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		closeListeners()
+		console.Close()
+		return nil, nil, err
+	}
+	_, err = readyW.Write([]byte{1})
+	readyW.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		closeListeners()
+		console.Close()
+		return nil, nil, fmt.Errorf("failed to release instance init: %v", err)
+	}
+
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	merger.Add("console", console)
+	exited := make(chan error, 1)
+	go func() {
+		// Init is pid 1 of the pid namespace, the whole namespace is killed when it exits.
+		err := cmd.Wait()
+		closeListeners()
+		exited <- fmt.Errorf("command exited: %v", err)
+	}()
+
+	sv := &vm.Supervisor{
+		Name:    inst.cfg.Name,
+		Timeout: timeout,
+		Stop:    stop,
+		Closed:  inst.closed,
+		Exited:  exited,
+		Kill:    func() { cmd.Process.Kill() },
+		Merger:  merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
+
+// proxyPort listens on a unix socket in dir and proxies connections to host port.
+// The init process listens on the port in the instance net namespace and connects to the socket.
+func proxyPort(dir string, port int) (net.Listener, error) {
+	sock := portSocket(dir, port)
+	os.Remove(sock)
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v: %v", sock, err)
+	}
+	go proxy(ln, "tcp", fmt.Sprintf("127.0.0.1:%v", port))
+	return ln, nil
+}
+
+func portSocket(dir string, port int) string {
+	return filepath.Join(dir, fmt.Sprintf("port-%v.sock", port))
+}
+
+func proxy(ln net.Listener, network, addr string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			target, err := net.Dial(network, addr)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+const initName = "syz-isolated-init"
+
+// containerInit runs as pid 1 in the instance namespaces:
+// it sets up the namespaces, starts port proxies, runs the command and reaps all processes.
+// Args are: name, workdir, comma-separated forwarded ports, command.
+// Fd 3 is a pipe on which the parent signals that init was moved into the instance cgroup.
+func containerInit() {
+	if len(os.Args) != 5 {
+		initFail(fmt.Errorf("bad args %q", os.Args))
+	}
+	if err := waitReady(os.NewFile(3, "ready")); err != nil {
+		initFail(err)
+	}
+	name, workdir, ports, command := os.Args[1], os.Args[2], os.Args[3], os.Args[4]
+	if err := setupNamespaces(name); err != nil {
+		initFail(err)
+	}
+	for _, port := range strings.Split(ports, ",") {
+		if port == "" {
+			continue
+		}
+		p, _ := strconv.Atoi(port)
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%v", p))
+		if err != nil {
+			initFail(err)
+		}
+		go proxy(ln, "unix", portSocket(workdir, p))
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = workdir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		initFail(err)
+	}
+	// Reap all processes reparented to us, until the command exits.
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			initFail(err)
+		}
+		if pid == cmd.Process.Pid {
+			os.Exit(status.ExitStatus())
+		}
+	}
+}
+
+// waitReady blocks until the parent writes a byte to the pipe.
+// EOF without the byte means that the parent failed to set up the cgroup.
+func waitReady(ready *os.File) error {
+	defer ready.Close()
+	var buf [1]byte
+	if _, err := ready.Read(buf[:]); err != nil {
+		return fmt.Errorf("failed to wait for cgroup setup: %v", err)
+	}
+	return nil
+}
+
+func setupNamespaces(name string) error {
+	// Don't propagate our mounts to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make / private: %v", err)
+	}
+	// Mount proc of the new pid namespace.
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %v", err)
+	}
+	if err := syscall.Sethostname([]byte(name)); err != nil {
+		return fmt.Errorf("failed to set hostname: %v", err)
+	}
+	return loopbackUp()
+}
+
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	ifr.flags = syscall.IFF_UP | syscall.IFF_LOOPBACK | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS,
+		uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return fmt.Errorf("failed to bring up lo: %v", errno)
+	}
+	return nil
+}
+
+func initFail(err error) {
+	fmt.Fprintf(os.Stderr, "%v: %v\n", initName, err)
+	os.Exit(1)
+}
+
+// openPty opens a new pseudo-terminal in raw output mode and returns its master and slave.
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open pty: %v", err)
+	}
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %v", err)
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pty number: %v", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%v", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pty slave: %v", err)
+	}
+	// Don't translate \n to \r\n in the output.
+	var termios syscall.Termios
+	if err := ioctl(slave, syscall.TCGETS, unsafe.Pointer(&termios)); err == nil {
+		termios.Oflag &^= syscall.OPOST
+		termios.Lflag &^= syscall.ECHO
+		ioctl(slave, syscall.TCSETS, unsafe.Pointer(&termios))
+	}
+	return master, slave, nil
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func writeFile(file, data string) error {
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		return fmt.Errorf("failed to write %v: %v", file, err)
+	}
+	return nil
+}
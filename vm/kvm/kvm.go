@@ -24,7 +24,7 @@ const (
 )
 
 func init() {
-	vm.Register("kvm", ctor)
+	vm.Register("kvm", ctor, nil)
 }
 
 type instance struct {
@@ -181,6 +181,12 @@ func (inst *instance) Close() {
 	os.Remove(inst.sandboxPath + ".sock")
 }
 
+func (inst *instance) Diagnose() []byte {
+	// lkvm prints registers and stack of all vcpus on its output, which is the console.
+	vm.RunTimeout(time.Minute, exec.Command(inst.cfg.Bin, "debug", "--name", inst.sandbox, "--dump"))
+	return nil
+}
+
 func (inst *instance) Forward(port int) (string, error) {
 	return fmt.Sprintf("%v:%v", hostAddr, port), nil
 }
@@ -197,6 +203,10 @@ func (inst *instance) Copy(hostSrc string) (string, error) {
 	return vmDst, nil
 }
 
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.CopyEach(inst, hostSrcs)
+}
+
 func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
 	outputC := make(chan []byte, 10)
 	errorC := make(chan error, 1)
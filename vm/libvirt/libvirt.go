@@ -0,0 +1,524 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package libvirt allows to use libvirt-managed (KVM) domains as VMs.
+// Domains are controlled through the libvirt RPC API (github.com/digitalocean/go-libvirt,
+// which does not need cgo or libvirt client libraries). Every pool index gets a persistent domain
+// with a qcow2 overlay on top of the configured image; after the first successful
+// boot the running domain is snapshotted, and subsequent instances revert
+// to that snapshot instead of booting from scratch. If kernel is specified in the config,
+// it is booted directly (with the optional initrd), the snapshot is discarded
+// when the kernel, initrd, image or command line change.
+// Domains use KVM, so only kernels of the host arch are supported.
+// Domains are attached to the libvirt "default" network, or to the private network
+// (see vm.NetworkConfig) with an unmanaged tap device if it is configured.
+// Domain templates contain {{NAME}}, {{DISK}}, {{CPU}}, {{MEM}}, {{BOOT}} and {{INTERFACE}}
+// placeholders.
+//
+// See https://libvirt.org/formatdomain.html for the domain XML format.
+package libvirt
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+const (
+	hostAddr    = "192.168.122.1" // host address on the libvirt "default" network
+	snapshot    = "syzkaller-clean"
+	runSnapshot = "syzkaller-run" // snapshot created with Snapshot method
+
+	monitorCommandHmp = 1 // VIR_DOMAIN_QEMU_MONITOR_COMMAND_HMP
+)
+
+func init() {
+	vm.Register("libvirt", ctor, func() vm.Params { return new(Params) })
+	vm.RegisterNetwork("libvirt")
+}
+
+// Params are libvirt-specific parameters (the vm section of the manager config).
+type Params struct {
+	Uri      string // libvirt connection URI (default: "qemu:///system")
+	Template string // domain XML template (optional, a default one is used otherwise)
+}
+
+func (params *Params) Validate() error {
+	if params.Uri == "" {
+		params.Uri = "qemu:///system"
+	}
+	if params.Template != "" {
+		if _, err := os.Stat(params.Template); err != nil {
+			return fmt.Errorf("domain template '%v' does not exist: %v", params.Template, err)
+		}
+	}
+	return nil
+}
+
+type instance struct {
+	cfg     *vm.Config
+	params  *Params
+	lv      *libvirt.Libvirt
+	dom     libvirt.Domain
+	netPort *vm.NetworkPort // private network attachment (optional)
+	name    string
+	disk    string
+	bootID  string // file with vm.BootID of the snapshot
+	ip      string
+	console vm.Console
+	closed  chan bool
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:    cfg,
+		params: cfg.Params.(*Params),
+		name:   cfg.Name,
+		disk:   filepath.Join(filepath.Dir(cfg.Workdir), cfg.Name+".qcow2"),
+		bootID: filepath.Join(filepath.Dir(cfg.Workdir), cfg.Name+".bootid"),
+		closed: make(chan bool),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Network != nil {
+		port, err := vm.AttachNetwork(cfg)
+		if err != nil {
+			return nil, err
+		}
+		inst.netPort = port
+		inst.ip = port.GuestIP
+	}
+	uri, err := url.Parse(inst.params.Uri)
+	if err != nil {
+		return nil, fmt.Errorf("bad libvirt uri %v: %v", inst.params.Uri, err)
+	}
+	if inst.lv, err = libvirt.ConnectToURI(uri); err != nil {
+		return nil, err
+	}
+
+	// Try the fast path first: revert the domain to the snapshot of a booted system.
+	reverted := false
+	if !vm.CheckBootID(cfg, inst.bootID) {
+		Logf(0, "%v: no snapshot of the current kernel and image, booting from scratch", inst.name)
+		if err := inst.define(); err != nil {
+			return nil, err
+		}
+	} else if err := inst.revert(snapshot); err == nil {
+		reverted = true
+		Logf(0, "%v: reverted to snapshot", inst.name)
+	} else {
+		if err := inst.define(); err != nil {
+			return nil, err
+		}
+	}
+	if err := inst.waitBoot(); err != nil {
+		if !reverted {
+			return nil, err
+		}
+		// The snapshot may be stale (e.g. the image has changed), recreate the domain.
+		Logf(0, "%v: reverted domain does not respond (%v), booting from scratch", inst.name, err)
+		if err := inst.define(); err != nil {
+			return nil, err
+		}
+		if err := inst.waitBoot(); err != nil {
+			return nil, err
+		}
+		reverted = false
+	}
+	if !reverted {
+		if err := inst.snapshot(snapshot); err != nil {
+			Logf(0, "%v: failed to snapshot domain, instances will boot from scratch: %v", inst.name, err)
+		} else if err := vm.SaveBootID(cfg, inst.bootID); err != nil {
+			Logf(0, "%v: failed to save boot id, instances will boot from scratch: %v", inst.name, err)
+		}
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.CrossArch() {
+		return fmt.Errorf("libvirt kvm domains can't run %v kernels on %v host", cfg.Arch, vm.HostArch)
+	}
+	if _, err := os.Stat(cfg.Image); err != nil {
+		return fmt.Errorf("image file '%v' does not exist: %v", cfg.Image, err)
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	if err := vm.ValidateBoot(cfg); err != nil {
+		return err
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 1024 {
+		return fmt.Errorf("bad libvirt cpu: %v, want [1-1024]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad libvirt mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+// define (re)creates the overlay disk and the persistent domain from the template and starts the domain.
+func (inst *instance) define() error {
+	os.Remove(inst.bootID)
+	if dom, err := inst.lv.DomainLookupByName(inst.name); err == nil {
+		inst.lv.DomainDestroy(dom)
+		if err := inst.lv.DomainUndefineFlags(dom, libvirt.DomainUndefineSnapshotsMetadata); err != nil {
+			return fmt.Errorf("failed to undefine domain: %v", err)
+		}
+	}
+	os.Remove(inst.disk)
+	image, err := filepath.Abs(inst.cfg.Image)
+	if err != nil {
+		return err
+	}
+	format := "raw"
+	if strings.HasSuffix(image, ".qcow2") {
+		format = "qcow2"
+	}
+	qemuImg := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", image, "-F", format, inst.disk)
+	if out, err := qemuImg.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create overlay disk: %v\n%s", err, out)
+	}
+	template := defaultTemplate
+	if inst.params.Template != "" {
+		data, err := ioutil.ReadFile(inst.params.Template)
+		if err != nil {
+			return fmt.Errorf("failed to read domain template: %v", err)
+		}
+		template = string(data)
+	}
+	if inst.netPort != nil && !strings.Contains(template, "{{INTERFACE}}") {
+		return fmt.Errorf("domain template does not contain {{INTERFACE}} required for private network")
+	}
+	iface := defaultInterface
+	if inst.netPort != nil {
+		iface = fmt.Sprintf(networkInterface, escape(inst.netPort.Tap), escape(inst.netPort.MAC))
+	}
+	boot := ""
+	if inst.cfg.Kernel != "" {
+		arch := inst.cfg.TargetArch()
+		cmdline := "console=" + arch.Console + " " + arch.Cmdline + " rodata=n oops=panic panic_on_warn=1 panic=86400" +
+			" ftrace_dump_on_oops=orig_cpu slub_debug=UZ net.ifnames=0 biosdevname=0" +
+			" root=/dev/vda "
+		if inst.netPort != nil {
+			cmdline += inst.netPort.Cmdline() + " "
+		}
+		cmdline += inst.cfg.Cmdline
+		boot = fmt.Sprintf("<kernel>%v</kernel>", escape(inst.cfg.Kernel))
+		if inst.cfg.Initrd != "" {
+			boot += fmt.Sprintf("<initrd>%v</initrd>", escape(inst.cfg.Initrd))
+		}
+		boot += fmt.Sprintf("<cmdline>%v</cmdline>", escape(cmdline))
+	}
+	domain := strings.NewReplacer(
+		"{{NAME}}", escape(inst.name),
+		"{{DISK}}", escape(inst.disk),
+		"{{CPU}}", fmt.Sprint(inst.cfg.Cpu),
+		"{{MEM}}", fmt.Sprint(inst.cfg.Mem),
+		"{{BOOT}}", boot,
+		"{{INTERFACE}}", iface,
+	).Replace(template)
+	if inst.cfg.Debug {
+		Logf(0, "%v: defining domain:\n%v", inst.name, domain)
+	}
+	dom, err := inst.lv.DomainDefineXML(domain)
+	if err != nil {
+		return fmt.Errorf("failed to define domain: %v", err)
+	}
+	inst.dom = dom
+	if err := inst.lv.DomainCreate(dom); err != nil {
+		return fmt.Errorf("failed to start domain: %v", err)
+	}
+	return nil
+}
+
+func (inst *instance) snapshot(name string) error {
+	desc := fmt.Sprintf("<domainsnapshot><name>%v</name></domainsnapshot>", escape(name))
+	if _, err := inst.lv.DomainSnapshotCreateXML(inst.dom, desc, 0); err != nil {
+		return fmt.Errorf("failed to create snapshot %v: %v", name, err)
+	}
+	return nil
+}
+
+// revert reverts the domain to the snapshot and leaves it running.
+func (inst *instance) revert(name string) error {
+	if inst.dom.Name == "" {
+		dom, err := inst.lv.DomainLookupByName(inst.name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup domain: %v", err)
+		}
+		inst.dom = dom
+	}
+	snap, err := inst.lv.DomainSnapshotLookupByName(inst.dom, name, 0)
+	if err != nil {
+		return fmt.Errorf("failed to lookup snapshot %v: %v", name, err)
+	}
+	flags := libvirt.DomainSnapshotRevertRunning | libvirt.DomainSnapshotRevertForce
+	if err := inst.lv.DomainRevertToSnapshot(snap, uint32(flags)); err != nil {
+		return fmt.Errorf("failed to revert to snapshot %v: %v", name, err)
+	}
+	return nil
+}
+
+func (inst *instance) waitBoot() error {
+	for i := 0; i < 100; i++ {
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+		if inst.ip == "" {
+			ip, err := inst.address()
+			if err != nil {
+				continue
+			}
+			inst.ip = ip
+		}
+		cmd := exec.Command("ssh", append(inst.sshArgs("-p"), "root@"+inst.ip, "pwd")...)
+		if _, err := cmd.CombinedOutput(); err == nil {
+			pty, err := inst.consolePty()
+			if err != nil {
+				return err
+			}
+			inst.console = vm.NewConsole(inst.cfg, vm.CommandConsole("cat", pty))
+			return nil
+		}
+	}
+	return fmt.Errorf("can't ssh into the instance")
+}
+
+// address returns IPv4 address of the domain as reported by the DHCP server.
+func (inst *instance) address() (string, error) {
+	ifaces, err := inst.lv.DomainInterfaceAddresses(inst.dom, uint32(libvirt.DomainInterfaceAddressesSrcLease), 0)
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		for _, addr := range iface.Addrs {
+			if addr.Type == int32(libvirt.IPAddrTypeIpv4) {
+				return addr.Addr, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("domain has no address yet")
+}
+
+// consolePty returns host pty of the domain serial console from the live domain XML.
+func (inst *instance) consolePty() (string, error) {
+	desc, err := inst.lv.DomainGetXMLDesc(inst.dom, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get domain xml: %v", err)
+	}
+	var domain struct {
+		Consoles []struct {
+			Type   string `xml:"type,attr"`
+			Source struct {
+				Path string `xml:"path,attr"`
+			} `xml:"source"`
+		} `xml:"devices>console"`
+	}
+	if err := xml.Unmarshal([]byte(desc), &domain); err != nil {
+		return "", fmt.Errorf("failed to parse domain xml: %v", err)
+	}
+	for _, con := range domain.Consoles {
+		if con.Type == "pty" && con.Source.Path != "" {
+			return con.Source.Path, nil
+		}
+	}
+	return "", fmt.Errorf("domain has no pty console")
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	if inst.lv == nil {
+		os.RemoveAll(inst.cfg.Workdir)
+		return
+	}
+	// Keep the domain definition, the disk and the snapshot for the next instance.
+	if inst.dom.Name != "" {
+		inst.lv.DomainDestroy(inst.dom)
+	}
+	inst.lv.Disconnect()
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Snapshot() error {
+	if snap, err := inst.lv.DomainSnapshotLookupByName(inst.dom, runSnapshot, 0); err == nil {
+		inst.lv.DomainSnapshotDelete(snap, 0)
+	}
+	return inst.snapshot(runSnapshot)
+}
+
+func (inst *instance) Restore() error {
+	if err := inst.revert(runSnapshot); err != nil {
+		return err
+	}
+	return inst.waitBoot()
+}
+
+func (inst *instance) Diagnose() []byte {
+	out, err := inst.lv.QEMUDomainMonitorCommand(inst.dom, "info registers", monitorCommandHmp)
+	if err != nil {
+		Logf(0, "%v: failed to dump registers: %v", inst.name, err)
+		return nil
+	}
+	return append([]byte("\nqemu registers:\n"), out...)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	if inst.netPort != nil {
+		return fmt.Sprintf("%v:%v", inst.netPort.HostIP, port), nil
+	}
+	return fmt.Sprintf("%v:%v", hostAddr, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.Scp(inst.sshArgs("-P"), "root@"+inst.ip, "/", hostSrcs, inst.cfg.Debug)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	killCon, conDone, err := vm.AttachConsole(merger, inst.console)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sshRpipe, sshWpipe, err := vm.LongPipe()
+	if err != nil {
+		killCon()
+		return nil, nil, err
+	}
+	args := append(inst.sshArgs("-p"), "root@"+inst.ip, command)
+	if inst.cfg.Debug {
+		Logf(0, "running command: ssh %#v", args)
+	}
+	ssh := exec.Command("ssh", args...)
+	ssh.Stdout = sshWpipe
+	ssh.Stderr = sshWpipe
+	if err := ssh.Start(); err != nil {
+		killCon()
+		sshRpipe.Close()
+		sshWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to connect to instance: %v", err)
+	}
+	sshWpipe.Close()
+	sshDone := make(chan error, 1)
+	go func() {
+		err := ssh.Wait()
+		sshDone <- fmt.Errorf("ssh exited: %v", err)
+	}()
+
+	merger.Add("ssh", sshRpipe)
+
+	sv := &vm.Supervisor{
+		Name:        inst.name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      sshDone,
+		Console:     conDone,
+		Kill:        func() { ssh.Process.Kill() },
+		KillConsole: killCon,
+		Merger:      merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		portArg, "22",
+		"-i", inst.cfg.Sshkey,
+		"-F", "/dev/null",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "BatchMode=yes",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "ConnectTimeout=10",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
+
+func escape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+const defaultTemplate = `
+<domain type='kvm'>
+	<name>{{NAME}}</name>
+	<memory unit='MiB'>{{MEM}}</memory>
+	<vcpu>{{CPU}}</vcpu>
+	<os>
+		<type>hvm</type>
+		{{BOOT}}
+	</os>
+	<features>
+		<acpi/>
+	</features>
+	<on_poweroff>destroy</on_poweroff>
+	<on_reboot>destroy</on_reboot>
+	<on_crash>destroy</on_crash>
+	<devices>
+		<disk type='file' device='disk'>
+			<driver name='qemu' type='qcow2'/>
+			<source file='{{DISK}}'/>
+			<target dev='vda' bus='virtio'/>
+		</disk>
+		{{INTERFACE}}
+		<serial type='pty'>
+			<target port='0'/>
+		</serial>
+		<console type='pty'>
+			<target type='serial' port='0'/>
+		</console>
+	</devices>
+</domain>
+`
+
+const defaultInterface = `<interface type='network'>
+			<source network='default'/>
+			<model type='virtio'/>
+		</interface>`
+
+// networkInterface attaches the domain to the tap device of the private network.
+const networkInterface = `<interface type='ethernet'>
+			<target dev='%v' managed='no'/>
+			<mac address='%v'/>
+			<model type='virtio'/>
+		</interface>`
@@ -17,7 +17,7 @@ import (
 )
 
 func init() {
-	vm.Register("local", ctor)
+	vm.Register("local", ctor, nil)
 }
 
 type instance struct {
@@ -48,6 +48,10 @@ func (inst *instance) Close() {
 	os.RemoveAll(inst.cfg.Workdir)
 }
 
+func (inst *instance) Diagnose() []byte {
+	return nil
+}
+
 func (inst *instance) Forward(port int) (string, error) {
 	return fmt.Sprintf("127.0.0.1:%v", port), nil
 }
@@ -63,7 +67,18 @@ func (inst *instance) Copy(hostSrc string) (string, error) {
 	return vmDst, nil
 }
 
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.CopyEach(inst, hostSrcs)
+}
+
 func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	for strings.Index(command, "  ") != -1 {
+		command = strings.Replace(command, "  ", " ", -1)
+	}
+	return inst.RunCommand(timeout, stop, &vm.Command{Args: strings.Split(command, " ")})
+}
+
+func (inst *instance) RunCommand(timeout time.Duration, stop <-chan bool, command *vm.Command) (<-chan []byte, <-chan error, error) {
 	rpipe, wpipe, err := os.Pipe()
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create pipe: %v", err)
@@ -71,11 +86,9 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 	for sz := 128 << 10; sz <= 2<<20; sz *= 2 {
 		syscall.Syscall(syscall.SYS_FCNTL, wpipe.Fd(), syscall.F_SETPIPE_SZ, uintptr(sz))
 	}
-	for strings.Index(command, "  ") != -1 {
-		command = strings.Replace(command, "  ", " ", -1)
-	}
-	args := strings.Split(command, " ")
-	cmd := exec.Command(args[0], args[1:]...)
+	cmd := exec.Command(command.Args[0], command.Args[1:]...)
+	cmd.Env = append(os.Environ(), command.Env...)
+	cmd.Dir = command.Dir
 	cmd.Stdout = wpipe
 	cmd.Stderr = wpipe
 	if err := cmd.Start(); err != nil {
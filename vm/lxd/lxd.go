@@ -0,0 +1,271 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package lxd allows to use LXD privileged system containers or LXD virtual machines as VMs.
+// Instances are controlled with the lxc command line tool. Every pool index gets a persistent
+// instance created from the image (an LXD image alias or fingerprint) and snapshotted
+// before the first start; subsequent instances restore that snapshot, which resets the root
+// filesystem. Commands are run with lxc exec (VMs need lxd-agent in the image).
+// Console output is obtained by polling the instance console log.
+// Note that containers share the host kernel, so kernel crashes in containers
+// take down the host, use lxd_vm for kernel fuzzing.
+//
+// See https://linuxcontainers.org/lxd/docs/master/ for details.
+package lxd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+const snapshot = "syzkaller-clean"
+
+func init() {
+	vm.Register("lxd", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are LXD-specific parameters (the vm section of the manager config).
+type Params struct {
+	Vm      bool   // use virtual machines instead of system containers
+	Network string // network to attach instances to (default: "lxdbr0")
+}
+
+func (params *Params) Validate() error {
+	if params.Network == "" {
+		params.Network = "lxdbr0"
+	}
+	return nil
+}
+
+type instance struct {
+	cfg      *vm.Config
+	params   *Params
+	name     string
+	hostAddr string
+	log      *vm.LogConsole // console log poller, the default console
+	console  vm.Console
+	closed   chan bool
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:    cfg,
+		params: cfg.Params.(*Params),
+		name:   cfg.Name,
+		closed: make(chan bool),
+	}
+	inst.log = vm.NewLogConsole(time.Second, inst.consoleLog)
+	inst.console = vm.NewConsole(cfg, inst.log)
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if err := inst.queryHostAddr(); err != nil {
+		return nil, err
+	}
+	inst.lxc("stop", inst.name, "--force")
+	// Try the fast path first: restore the pristine snapshot of the instance.
+	if _, err := inst.lxc("restore", inst.name, snapshot); err == nil {
+		Logf(0, "%v: restored snapshot", inst.name)
+	} else {
+		if err := inst.create(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := inst.lxc("start", inst.name); err != nil {
+		return nil, err
+	}
+	if err := inst.waitBoot(); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = "lxc"
+	}
+	if cfg.Image == "" {
+		return fmt.Errorf("image parameter is empty (required for lxd)")
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 1024 {
+		return fmt.Errorf("bad lxd cpu: %v, want [1-1024]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad lxd mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+// create (re)creates the instance from the image and snapshots it before the first start.
+func (inst *instance) create() error {
+	inst.lxc("delete", inst.name, "--force")
+	args := []string{"init", inst.cfg.Image, inst.name,
+		"--network", inst.params.Network,
+		"-c", fmt.Sprintf("limits.cpu=%v", inst.cfg.Cpu),
+		"-c", fmt.Sprintf("limits.memory=%vMiB", inst.cfg.Mem),
+	}
+	if inst.params.Vm {
+		args = append(args, "--vm")
+	} else {
+		args = append(args, "-c", "security.privileged=true", "-c", "security.nesting=true")
+	}
+	if _, err := inst.lxc(args...); err != nil {
+		return err
+	}
+	if _, err := inst.lxc("snapshot", inst.name, snapshot); err != nil {
+		Logf(0, "%v: failed to snapshot instance, instances will be recreated: %v", inst.name, err)
+	}
+	return nil
+}
+
+func (inst *instance) waitBoot() error {
+	for i := 0; i < 100; i++ {
+		if !vm.SleepInterruptible(time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+		// Wait for networking, otherwise the fuzzer won't be able to connect to the manager.
+		if _, err := inst.lxc("exec", inst.name, "--", "ping", "-c", "1", "-W", "1", inst.hostAddr); err == nil {
+			// Skip the boot output, we are interested only in what happens during Run.
+			inst.log.Skip()
+			return nil
+		}
+	}
+	return fmt.Errorf("instance does not respond")
+}
+
+// queryHostAddr queries IPv4 address of the host on the instance network.
+func (inst *instance) queryHostAddr() error {
+	out, err := inst.lxc("network", "get", inst.params.Network, "ipv4.address")
+	if err != nil {
+		return err
+	}
+	// Output looks like: 10.29.177.1/24
+	addr := strings.Split(strings.TrimSpace(string(out)), "/")[0]
+	if addr == "" || addr == "none" {
+		return fmt.Errorf("network %v has no IPv4 address", inst.params.Network)
+	}
+	inst.hostAddr = addr
+	return nil
+}
+
+func (inst *instance) consoleLog() ([]byte, error) {
+	return inst.lxc("console", inst.name, "--show-log")
+}
+
+func (inst *instance) lxc(args ...string) ([]byte, error) {
+	if inst.cfg.Debug {
+		Logf(0, "executing lxc %+v", args)
+	}
+	cmd := exec.Command(inst.cfg.Bin, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("lxc %+v failed: %v\n%s", args, err, out)
+	}
+	return out, nil
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	// Keep the instance and the snapshot for the next instance.
+	inst.lxc("stop", inst.name, "--force")
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	if !inst.params.Vm {
+		// Containers share the host kernel, list processes instead.
+		out, err := vm.RunTimeout(time.Minute, exec.Command(inst.cfg.Bin, "exec", inst.name, "--", "ps", "aux"))
+		if err != nil {
+			return nil
+		}
+		return append([]byte("\ncontainer processes:\n"), out...)
+	}
+	vm.Sysrq(func(command string) *exec.Cmd {
+		return exec.Command(inst.cfg.Bin, "exec", inst.name, "--", "sh", "-c", command)
+	})
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostAddr, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDst := filepath.Join("/", filepath.Base(hostSrc))
+	if _, err := inst.lxc("file", "push", "--mode", "0755", hostSrc, inst.name+vmDst); err != nil {
+		return "", err
+	}
+	return vmDst, nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.CopyEach(inst, hostSrcs)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	killCon, conDone, err := vm.AttachConsole(merger, inst.console)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	outRpipe, outWpipe, err := vm.LongPipe()
+	if err != nil {
+		killCon()
+		return nil, nil, err
+	}
+	args := []string{"exec", inst.name, "--", "sh", "-c", command}
+	if inst.cfg.Debug {
+		Logf(0, "running command: lxc %#v", args)
+	}
+	cmd := exec.Command(inst.cfg.Bin, args...)
+	cmd.Stdout = outWpipe
+	cmd.Stderr = outWpipe
+	if err := cmd.Start(); err != nil {
+		killCon()
+		outRpipe.Close()
+		outWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to run command in instance: %v", err)
+	}
+	outWpipe.Close()
+	cmdDone := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		cmdDone <- fmt.Errorf("lxc exec exited: %v", err)
+	}()
+
+	merger.Add("exec", outRpipe)
+
+	sv := &vm.Supervisor{
+		Name:        inst.name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      cmdDone,
+		Console:     conDone,
+		Kill:        func() { cmd.Process.Kill() },
+		KillConsole: killCon,
+		Merger:      merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
@@ -5,16 +5,42 @@ package vm
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"sync"
+	"time"
 )
 
+// OutputMerger merges output of several sources (e.g. console and ssh) into a single stream
+// of complete lines. Sources are tagged in the stream with a "syzkaller: [name]" line
+// every time the stream switches to output of a different source; lines themselves
+// are not modified because crash parsing relies on raw console lines.
+// Lines written to tee are prefixed with the source name.
+// Sources that produce too much output are rate limited, and sources that accumulate
+// too much undelivered output are truncated; both are recorded in the stream with a marker.
+// Console sources (named "console") are not rate limited because crash detection
+// needs complete console output, and keep more undelivered output.
 type OutputMerger struct {
 	Output chan []byte
 	tee    io.Writer
+	teeMu  sync.Mutex
 	wg     sync.WaitGroup
+	mu     sync.Mutex
+	last   string // source of the last chunk sent to Output
 }
 
+var (
+	// MergerRateLimit is the maximum number of bytes per second accepted from a single
+	// non-console source (0 disables rate limiting).
+	MergerRateLimit = 1 << 20
+	// MergerMaxPending is the maximum amount of undelivered output buffered for a single source.
+	MergerMaxPending = 4 << 20
+	// MergerMaxConsolePending is the same as MergerMaxPending for console sources.
+	MergerMaxConsolePending = 16 << 20
+)
+
+const consoleSource = "console"
+
 func NewOutputMerger(tee io.Writer) *OutputMerger {
 	return &OutputMerger{
 		Output: make(chan []byte, 1000),
@@ -27,38 +53,57 @@ func (merger *OutputMerger) Wait() {
 	close(merger.Output)
 }
 
-func (merger *OutputMerger) Add(r io.ReadCloser) {
+// Add adds source r named name to the merger. r is closed when it returns an error.
+// Output of sources with empty name is not tagged.
+func (merger *OutputMerger) Add(name string, r io.ReadCloser) {
 	merger.wg.Add(1)
 	go func() {
 		var pending []byte
+		teed := 0 // pending[:teed] is already written to tee
+		dropped := 0
+		limiter := &rateLimiter{limit: MergerRateLimit}
+		maxPending := MergerMaxPending
+		if name == consoleSource {
+			limiter.limit = 0
+			maxPending = MergerMaxConsolePending
+		}
 		var buf [4 << 10]byte
 		for {
 			n, err := r.Read(buf[:])
 			if n != 0 {
-				pending = append(pending, buf[:n]...)
+				if limiter.allow(n) {
+					if dropped != 0 {
+						pending = appendMarker(pending, name, "rate limited", dropped)
+						dropped = 0
+					}
+					pending = append(pending, buf[:n]...)
+				} else {
+					dropped += n
+				}
+				if len(pending) > maxPending {
+					pending, teed = merger.truncate(name, pending, teed, maxPending/2)
+				}
 				if pos := bytes.LastIndexByte(pending, '\n'); pos != -1 {
 					out := pending[:pos+1]
-					if merger.tee != nil {
-						merger.tee.Write(out)
-					}
-					select {
-					case merger.Output <- append([]byte{}, out...):
+					merger.teeLines(name, out[teed:])
+					teed = len(out)
+					if merger.send(name, append([]byte{}, out...)) {
 						r := copy(pending[:], pending[pos+1:])
 						pending = pending[:r]
-					default:
+						teed = 0
 					}
 				}
 			}
 			if err != nil {
+				if dropped != 0 {
+					pending = appendMarker(pending, name, "rate limited", dropped)
+				}
 				if len(pending) != 0 {
-					pending = append(pending, '\n')
-					if merger.tee != nil {
-						merger.tee.Write(pending)
-					}
-					select {
-					case merger.Output <- pending:
-					default:
+					if pending[len(pending)-1] != '\n' {
+						pending = append(pending, '\n')
 					}
+					merger.teeLines(name, pending[teed:])
+					merger.send(name, pending)
 				}
 				r.Close()
 				merger.wg.Done()
@@ -67,3 +112,97 @@ func (merger *OutputMerger) Add(r io.ReadCloser) {
 		}
 	}()
 }
+
+// send delivers out of source name to Output if the consumer keeps up.
+// If the previous chunk came from a different source, out is prefixed with a tag line.
+func (merger *OutputMerger) send(name string, out []byte) bool {
+	merger.mu.Lock()
+	defer merger.mu.Unlock()
+	if name != "" && name != merger.last {
+		out = append([]byte(fmt.Sprintf("syzkaller: [%v]\n", name)), out...)
+	}
+	select {
+	case merger.Output <- out:
+		merger.last = name
+		return true
+	default:
+		return false
+	}
+}
+
+// truncate discards the head of pending leaving approximately keep bytes of complete lines
+// and replaces the head with a marker. The tail is kept because it is the most recent output
+// (e.g. the crash that caused the output storm). teed is the length of the already teed
+// prefix of pending, truncate returns the new pending and its teed prefix length.
+func (merger *OutputMerger) truncate(name string, pending []byte, teed, keep int) ([]byte, int) {
+	from := len(pending) - keep
+	if pos := bytes.IndexByte(pending[from:], '\n'); pos != -1 && from+pos+1 < len(pending) {
+		from += pos + 1
+	}
+	marker := appendMarker(nil, name, "truncated", from)
+	merger.teeLines(name, marker)
+	newTeed := len(marker)
+	if teed > from {
+		newTeed += teed - from
+	}
+	return append(marker, pending[from:]...), newTeed
+}
+
+func (merger *OutputMerger) teeLines(name string, data []byte) {
+	if merger.tee == nil || len(data) == 0 {
+		return
+	}
+	merger.teeMu.Lock()
+	defer merger.teeMu.Unlock()
+	if name == "" {
+		merger.tee.Write(data)
+		return
+	}
+	tagged := make([]byte, 0, len(data)+len(data)/16)
+	for len(data) != 0 {
+		pos := bytes.IndexByte(data, '\n') + 1
+		if pos == 0 {
+			pos = len(data)
+		}
+		tagged = append(tagged, '[')
+		tagged = append(tagged, name...)
+		tagged = append(tagged, "] "...)
+		tagged = append(tagged, data[:pos]...)
+		data = data[pos:]
+	}
+	merger.tee.Write(tagged)
+}
+
+// appendMarker terminates the current line in buf and appends a line that says
+// that dropped bytes of output of source name were discarded.
+func appendMarker(buf []byte, name, what string, dropped int) []byte {
+	if len(buf) != 0 && buf[len(buf)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+	if name != "" {
+		name += " "
+	}
+	return append(buf, fmt.Sprintf("syzkaller: %voutput %v, dropped %v bytes\n", name, what, dropped)...)
+}
+
+// rateLimiter accepts up to limit bytes per second.
+type rateLimiter struct {
+	limit int
+	start time.Time
+	bytes int
+}
+
+func (rl *rateLimiter) allow(n int) bool {
+	if rl.limit <= 0 {
+		return true
+	}
+	if now := time.Now(); now.Sub(rl.start) >= time.Second {
+		rl.start = now
+		rl.bytes = 0
+	}
+	if rl.bytes+n > rl.limit {
+		return false
+	}
+	rl.bytes += n
+	return true
+}
@@ -5,6 +5,7 @@ package vm
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,14 +19,14 @@ func TestMerger(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer wp1.Close()
-	merger.Add(rp1)
+	merger.Add("", rp1)
 
 	rp2, wp2, err := LongPipe()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer wp2.Close()
-	merger.Add(rp2)
+	merger.Add("", rp2)
 
 	wp1.Write([]byte("111"))
 	select {
@@ -71,3 +72,142 @@ func TestMerger(t *testing.T) {
 		t.Fatalf("bad tee: '%s', want '%s'", got, want)
 	}
 }
+
+func TestMergerTags(t *testing.T) {
+	tee := new(bytes.Buffer)
+	merger := NewOutputMerger(tee)
+
+	rp1, wp1, err := LongPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	merger.Add("console", rp1)
+
+	rp2, wp2, err := LongPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	merger.Add("ssh", rp2)
+
+	wp1.Write([]byte("111\n"))
+	got := string(<-merger.Output)
+	if want := "syzkaller: [console]\n111\n"; got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+
+	wp1.Write([]byte("222\n"))
+	got = string(<-merger.Output)
+	if want := "222\n"; got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+
+	wp2.Write([]byte("333\n444\n"))
+	got = string(<-merger.Output)
+	if want := "syzkaller: [ssh]\n333\n444\n"; got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+
+	wp1.Write([]byte("555\n"))
+	got = string(<-merger.Output)
+	if want := "syzkaller: [console]\n555\n"; got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+
+	wp1.Close()
+	wp2.Close()
+	merger.Wait()
+	want := "[console] 111\n[console] 222\n[ssh] 333\n[ssh] 444\n[console] 555\n"
+	if got := string(tee.Bytes()); got != want {
+		t.Fatalf("bad tee: '%s', want '%s'", got, want)
+	}
+}
+
+func TestMergerTruncate(t *testing.T) {
+	defer func(pending int) {
+		MergerMaxPending = pending
+	}(MergerMaxPending)
+	MergerMaxPending = 64
+	tee := new(bytes.Buffer)
+	merger := NewOutputMerger(tee)
+
+	rp, wp, err := LongPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	merger.Add("ssh", rp)
+
+	// The tail of the output must be preserved.
+	wp.Write(bytes.Repeat([]byte("0123456789\n"), 10))
+	got := string(<-merger.Output)
+	want := "syzkaller: [ssh]\nsyzkaller: ssh output truncated, dropped 88 bytes\n0123456789\n0123456789\n"
+	if got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+
+	wp.Write(append(bytes.Repeat([]byte("0"), 100), "ab"...))
+	wp.Close()
+	got = string(<-merger.Output)
+	if want := "syzkaller: ssh output truncated, dropped 70 bytes\n"; got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+	got = string(<-merger.Output)
+	if want := strings.Repeat("0", 30) + "ab\n"; got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+
+	merger.Wait()
+	want = "[ssh] syzkaller: ssh output truncated, dropped 88 bytes\n[ssh] 0123456789\n[ssh] 0123456789\n" +
+		"[ssh] syzkaller: ssh output truncated, dropped 70 bytes\n[ssh] " + strings.Repeat("0", 30) + "ab\n"
+	if got := string(tee.Bytes()); got != want {
+		t.Fatalf("bad tee: '%s', want '%s'", got, want)
+	}
+}
+
+func TestMergerRateLimit(t *testing.T) {
+	defer func(rate int) {
+		MergerRateLimit = rate
+	}(MergerRateLimit)
+	MergerRateLimit = 16
+	merger := NewOutputMerger(nil)
+
+	rp, wp, err := LongPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	merger.Add("ssh", rp)
+
+	wp.Write([]byte("0123456789\n"))
+	got := string(<-merger.Output)
+	if want := "syzkaller: [ssh]\n0123456789\n"; got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+
+	wp.Write([]byte("0123456789abcdef\n"))
+	select {
+	case <-merger.Output:
+		t.Fatalf("merger did not rate limit output")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	wp.Write([]byte("ab\n"))
+	got = string(<-merger.Output)
+	if want := "syzkaller: ssh output rate limited, dropped 17 bytes\nab\n"; got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+
+	// Console output is not rate limited.
+	rp, wp1, err := LongPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	merger.Add("console", rp)
+	wp1.Write([]byte("0123456789abcdef0123456789abcdef\n"))
+	got = string(<-merger.Output)
+	if want := "syzkaller: [console]\n0123456789abcdef0123456789abcdef\n"; got != want {
+		t.Fatalf("bad line: '%s', want '%s'", got, want)
+	}
+
+	wp.Close()
+	wp1.Close()
+	merger.Wait()
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// NetworkConfig describes a private network for instances (the network section of the manager config).
+// The network is a host bridge without uplinks, forwarding from and to it is dropped
+// and bridge ports are isolated from each other. So instances can reach only the host
+// (e.g. the manager RPC) and guests fuzzing the network stack can't disturb the lab
+// network or each other. Every instance gets a tap device attached to the bridge
+// and a static address in the subnet. Setting up the network requires root.
+// Use different bridges and subnets for managers running on the same host.
+type NetworkConfig struct {
+	Bridge string // bridge name, at most 10 characters (default: "syzbr0")
+	Subnet string // IPv4 subnet in CIDR notation, the host gets the first address (default: "10.77.0.0/16")
+}
+
+func (cfg *NetworkConfig) Validate() error {
+	if cfg.Bridge == "" {
+		cfg.Bridge = "syzbr0"
+	}
+	// Tap names are bridge-index and interface names are limited to 15 characters.
+	if len(cfg.Bridge) > 10 {
+		return fmt.Errorf("bridge name %q is too long, want at most 10 characters", cfg.Bridge)
+	}
+	if cfg.Subnet == "" {
+		cfg.Subnet = "10.77.0.0/16"
+	}
+	_, subnet, err := net.ParseCIDR(cfg.Subnet)
+	if err != nil {
+		return fmt.Errorf("bad subnet: %v", err)
+	}
+	if subnet.IP.To4() == nil {
+		return fmt.Errorf("subnet %v is not IPv4", cfg.Subnet)
+	}
+	if ones, _ := subnet.Mask.Size(); ones > 24 {
+		return fmt.Errorf("subnet %v is too small, want at most /24", cfg.Subnet)
+	}
+	return nil
+}
+
+// ParseNetwork parses and validates the network section of the manager config.
+// Empty data means that instances use backend default networking, then it returns nil.
+func ParseNetwork(data []byte) (*NetworkConfig, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	cfg := new(NetworkConfig)
+	if err := checkUnknownFields(data, cfg); err != nil {
+		return nil, fmt.Errorf("bad network: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse network: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("bad network: %v", err)
+	}
+	return cfg, nil
+}
+
+// NetworkPort is attachment of an instance to the private network.
+type NetworkPort struct {
+	Tap     string // tap device attached to the bridge
+	MAC     string // guest MAC address
+	GuestIP string
+	HostIP  string
+	Netmask string
+}
+
+// Cmdline returns kernel command line parameter that configures the guest address
+// (requires CONFIG_IP_PNP). Images booted without a kernel must configure the address themselves.
+func (port *NetworkPort) Cmdline() string {
+	return fmt.Sprintf("ip=%v::%v:%v::eth0:off", port.GuestIP, port.HostIP, port.Netmask)
+}
+
+var (
+	networkMu      sync.Mutex
+	networkBridges = make(map[string]bool)
+)
+
+// AttachNetwork sets up the private network described by cfg.Network (once per bridge)
+// and attaches instance cfg.Index to it. Tap devices are kept after instances are closed
+// and reused for the next instance in the same slot.
+func AttachNetwork(cfg *Config) (*NetworkPort, error) {
+	netCfg := cfg.Network
+	_, subnet, err := net.ParseCIDR(netCfg.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := subnet.Mask.Size()
+	if cfg.Index+2 >= 1<<uint(bits-ones)-1 {
+		return nil, fmt.Errorf("subnet %v is too small for instance %v", netCfg.Subnet, cfg.Index)
+	}
+	guestIP := subnetAddr(subnet, cfg.Index+2)
+	port := &NetworkPort{
+		Tap:     fmt.Sprintf("%v-%v", netCfg.Bridge, cfg.Index),
+		MAC:     fmt.Sprintf("52:54:00:%02x:%02x:%02x", guestIP[1], guestIP[2], guestIP[3]),
+		GuestIP: guestIP.String(),
+		HostIP:  subnetAddr(subnet, 1).String(),
+		Netmask: net.IP(subnet.Mask).String(),
+	}
+
+	networkMu.Lock()
+	defer networkMu.Unlock()
+	if !networkBridges[netCfg.Bridge] {
+		if err := setupBridge(netCfg.Bridge, fmt.Sprintf("%v/%v", port.HostIP, ones)); err != nil {
+			return nil, err
+		}
+		networkBridges[netCfg.Bridge] = true
+	}
+	if err := setupTap(netCfg.Bridge, port.Tap); err != nil {
+		return nil, err
+	}
+	return port, nil
+}
+
+func subnetAddr(subnet *net.IPNet, n int) net.IP {
+	ip := append(net.IP{}, subnet.IP.To4()...)
+	for i := len(ip) - 1; i >= 0 && n != 0; i-- {
+		n += int(ip[i])
+		ip[i] = byte(n)
+		n >>= 8
+	}
+	return ip
+}
+
+func setupBridge(bridge, hostAddr string) error {
+	if _, err := netCmd("ip", "link", "show", bridge); err != nil {
+		if _, err := netCmd("ip", "link", "add", "name", bridge, "type", "bridge"); err != nil {
+			return err
+		}
+	}
+	if out, _ := netCmd("ip", "-4", "addr", "show", "dev", bridge); !strings.Contains(out, " "+hostAddr+" ") {
+		if _, err := netCmd("ip", "addr", "add", hostAddr, "dev", bridge); err != nil {
+			return err
+		}
+	}
+	if _, err := netCmd("ip", "link", "set", bridge, "up"); err != nil {
+		return err
+	}
+	// Don't route anything from or to the private network.
+	for _, dir := range []string{"-i", "-o"} {
+		rule := []string{"FORWARD", dir, bridge, "-j", "DROP"}
+		if _, err := netCmd("iptables", append([]string{"-C"}, rule...)...); err != nil {
+			if _, err := netCmd("iptables", append([]string{"-I"}, rule...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setupTap(bridge, tap string) error {
+	if _, err := netCmd("ip", "link", "show", tap); err != nil {
+		if _, err := netCmd("ip", "tuntap", "add", "dev", tap, "mode", "tap"); err != nil {
+			return err
+		}
+	}
+	if _, err := netCmd("ip", "link", "set", tap, "master", bridge); err != nil {
+		return err
+	}
+	// Isolated ports can talk only to the bridge itself, but not to each other.
+	if _, err := netCmd("bridge", "link", "set", "dev", tap, "isolated", "on"); err != nil {
+		return err
+	}
+	if _, err := netCmd("ip", "link", "set", tap, "up"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func netCmd(bin string, args ...string) (string, error) {
+	out, err := exec.Command(bin, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v %v failed: %v\n%s", bin, strings.Join(args, " "), err, out)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+		want *NetworkConfig
+	}{
+		{``, "", nil},
+		{`null`, "", nil},
+		{`{}`, "", &NetworkConfig{Bridge: "syzbr0", Subnet: "10.77.0.0/16"}},
+		{`{"bridge": "br1", "subnet": "192.168.8.0/22"}`, "", &NetworkConfig{Bridge: "br1", Subnet: "192.168.8.0/22"}},
+		{`{"bridge": "syzkaller-br"}`, "bad network: bridge name", nil},
+		{`{"subnet": "10.0.0.0/28"}`, "bad network: subnet 10.0.0.0/28 is too small", nil},
+		{`{"subnet": "fd00::/64"}`, "bad network: subnet fd00::/64 is not IPv4", nil},
+		{`{"subnet": "foo"}`, "bad network: bad subnet", nil},
+		{`{"uplink": "eth0"}`, "bad network: unknown field 'uplink'", nil},
+	}
+	for i, test := range tests {
+		cfg, err := ParseNetwork([]byte(test.data))
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("#%v: got error %q, want %q", i, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%v: unexpected error: %v", i, err)
+		}
+		if test.want == nil {
+			if cfg != nil {
+				t.Fatalf("#%v: got config %+v, want nil", i, cfg)
+			}
+			continue
+		}
+		if *cfg != *test.want {
+			t.Fatalf("#%v: got config %+v, want %+v", i, cfg, test.want)
+		}
+	}
+}
+
+func TestSubnetAddr(t *testing.T) {
+	tests := []struct {
+		subnet string
+		n      int
+		want   string
+	}{
+		{"10.77.0.0/16", 1, "10.77.0.1"},
+		{"10.77.0.0/16", 255, "10.77.0.255"},
+		{"10.77.0.0/16", 258, "10.77.1.2"},
+		{"192.168.8.0/22", 1001, "192.168.11.233"},
+	}
+	for _, test := range tests {
+		_, subnet, err := net.ParseCIDR(test.subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := subnetAddr(subnet, test.n).String(); got != test.want {
+			t.Fatalf("%v+%v: got %v, want %v", test.subnet, test.n, got, test.want)
+		}
+	}
+}
+
+func TestCreateNetworkUnsupported(t *testing.T) {
+	Register("test-nonet", func(cfg *Config) (Instance, error) {
+		t.Fatal("ctor is called")
+		return nil, nil
+	}, nil)
+	defer delete(backends, "test-nonet")
+	_, err := Create("test-nonet", &Config{Network: &NetworkConfig{}})
+	if want := "instance type 'test-nonet' does not support private networks"; err == nil || err.Error() != want {
+		t.Fatalf("got error %q, want %q", err, want)
+	}
+}
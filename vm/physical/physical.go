@@ -0,0 +1,249 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package physical allows to use real machines as VMs.
+// Machines are listed in devices param (host names or addresses) and are controlled
+// with ssh as root. Kernel console output is obtained by running console command
+// (e.g. IPMI serial-over-LAN: "ipmitool -I lanplus -H {{DEVICE}}-bmc -U admin -E sol activate"),
+// and hung machines are recovered by running power_cycle command
+// (e.g. "ipmitool -I lanplus -H {{DEVICE}}-bmc -U admin -E chassis power cycle",
+// a PDU outlet toggle or wakeonlan). {{DEVICE}} in the commands is replaced with the machine name.
+// The commands are executed with sh -c. Any other console transport can be used
+// with the console section of the manager config.
+package physical
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("physical", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are physical machine-specific parameters (the vm section of the manager config).
+type Params struct {
+	Console     string // command that streams console of a machine (optional)
+	Power_Cycle string // command that power cycles a machine (optional, hung machines are not recovered otherwise)
+}
+
+func (params *Params) Validate() error {
+	return nil
+}
+
+type instance struct {
+	cfg      *vm.Config
+	params   *Params
+	host     string
+	hostAddr string
+	console  vm.Console // nil if the machine does not have a console
+	closed   chan bool
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:    cfg,
+		params: cfg.Params.(*Params),
+		host:   cfg.Device,
+		closed: make(chan bool),
+	}
+	var con vm.Console
+	if inst.params.Console != "" {
+		con = vm.CommandConsole("sh", "-c", inst.command(inst.params.Console))
+	}
+	inst.console = vm.NewConsole(cfg, con)
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if err := inst.repair(); err != nil {
+		return nil, err
+	}
+	// Use the address of the interface the machine is reachable through.
+	conn, err := net.Dial("udp", net.JoinHostPort(inst.host, "22"))
+	if err != nil {
+		return nil, err
+	}
+	inst.hostAddr = conn.LocalAddr().(*net.UDPAddr).IP.String()
+	conn.Close()
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Device == "" {
+		return fmt.Errorf("empty physical machine name")
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	return nil
+}
+
+func (inst *instance) repair() error {
+	// Assume that the machine is in a bad state initially and reboot it.
+	if err := inst.waitForSsh(time.Minute); err == nil {
+		inst.ssh("rm -Rf /syzkaller*; reboot").Run()
+		// Give it some time to go down.
+		if !vm.SleepInterruptible(30 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+		if err := inst.waitForSsh(10 * time.Minute); err == nil {
+			return nil
+		}
+	}
+	if inst.params.Power_Cycle == "" {
+		return fmt.Errorf("machine %v is dead and power_cycle is not specified", inst.host)
+	}
+	Logf(0, "%v: power cycling", inst.host)
+	cmd := exec.Command("sh", "-c", inst.command(inst.params.Power_Cycle))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("power cycle failed: %v\n%s", err, out)
+	}
+	if !vm.SleepInterruptible(30 * time.Second) {
+		return fmt.Errorf("shutdown in progress")
+	}
+	if err := inst.waitForSsh(10 * time.Minute); err != nil {
+		return fmt.Errorf("machine %v is dead and unrepairable: %v", inst.host, err)
+	}
+	return nil
+}
+
+func (inst *instance) waitForSsh(timeout time.Duration) error {
+	var err error
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if _, err = inst.ssh("pwd").CombinedOutput(); err == nil {
+			return nil
+		}
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+	return fmt.Errorf("can't ssh into the machine: %v", err)
+}
+
+func (inst *instance) command(template string) string {
+	return strings.Replace(template, "{{DEVICE}}", inst.host, -1)
+}
+
+func (inst *instance) ssh(command string) *exec.Cmd {
+	args := append(inst.sshArgs("-p"), "root@"+inst.host, command)
+	if inst.cfg.Debug {
+		Logf(0, "running command: ssh %#v", args)
+	}
+	return exec.Command("ssh", args...)
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	vm.Sysrq(inst.ssh)
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostAddr, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.Scp(inst.sshArgs("-P"), "root@"+inst.host, "/", hostSrcs, inst.cfg.Debug)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+
+	killCon := func() {}
+	var conDone <-chan error
+	if inst.console != nil {
+		var err error
+		killCon, conDone, err = vm.AttachConsole(merger, inst.console)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sshRpipe, sshWpipe, err := vm.LongPipe()
+	if err != nil {
+		killCon()
+		return nil, nil, err
+	}
+	ssh := inst.ssh(command)
+	ssh.Stdout = sshWpipe
+	ssh.Stderr = sshWpipe
+	if err := ssh.Start(); err != nil {
+		killCon()
+		sshRpipe.Close()
+		sshWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to connect to machine: %v", err)
+	}
+	sshWpipe.Close()
+	merger.Add("ssh", sshRpipe)
+	sshDone := make(chan error, 1)
+	go func() {
+		err := ssh.Wait()
+		sshDone <- fmt.Errorf("ssh exited: %v", err)
+	}()
+
+	sv := &vm.Supervisor{
+		Name:        inst.cfg.Name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      sshDone,
+		Console:     conDone,
+		Kill:        func() { ssh.Process.Kill() },
+		KillConsole: killCon,
+		// Give the console time to deliver the crash report.
+		Linger: 10 * time.Second,
+		Merger: merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		portArg, "22",
+		"-i", inst.cfg.Sshkey,
+		"-F", "/dev/null",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "BatchMode=yes",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "ConnectTimeout=10",
+		"-o", "ServerAliveInterval=10",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
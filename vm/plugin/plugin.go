@@ -0,0 +1,513 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package plugin allows to use VMs managed by an external program (plugin),
+// e.g. to integrate a proprietary lab or provisioning system.
+//
+// The plugin is started for every instance, it receives requests as JSON objects
+// on stdin and sends responses and events as JSON objects to stdout (one object per line).
+// stderr of the plugin is passed through.
+//
+//	request:  {"id": 1, "method": "create", "params": {...}}
+//	response: {"id": 1, "result": {...}} or {"id": 1, "error": "message"}
+//
+// Methods, their params and results:
+//
+//	create   {"name": "vm-0", "index": 0, "arch": "amd64", "workdir": ..., "image": ..., "config": ...} -> {}
+//	copy     {"files": ["/host/file"]} -> {"files": ["/vm/file"]}
+//	forward  {"port": 1234} -> {"addr": "10.0.0.1:1234"}
+//	run      {"command": "..."} -> {}
+//	kill     {"run": 2} -> {}
+//	diagnose {} -> {"output": "base64 data"}
+//	close    {} -> {}, then the plugin must exit
+//
+// create must return when the instance is ready to execute commands.
+// Output of a command started by run request N, the kernel console output
+// and the command exit are reported with events:
+//
+//	{"run": N, "output": "base64 data"}
+//	{"run": N, "console": "base64 data"}
+//	{"run": N, "exited": true, "error": "exit status 1"}
+//
+// Console output is not rate limited, so it must not be mixed into command output.
+//
+// The exited event must be sent for killed commands as well,
+// kill requests for already exited commands must succeed.
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("plugin", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are plugin-specific parameters (the vm section of the manager config).
+type Params struct {
+	Command string          // plugin binary
+	Args    []string        // plugin arguments (optional)
+	Config  json.RawMessage // passed to the plugin in create request as is (optional)
+}
+
+func (params *Params) Validate() error {
+	if params.Command == "" {
+		return fmt.Errorf("command is empty")
+	}
+	return nil
+}
+
+type instance struct {
+	cfg     *vm.Config
+	plugin  *plugin
+	console vm.Console // nil if the console is provided by the plugin
+	closed  chan bool
+}
+
+type createParams struct {
+	Name    string          `json:"name"`
+	Index   int             `json:"index"`
+	Arch    string          `json:"arch"`
+	Workdir string          `json:"workdir"`
+	Image   string          `json:"image,omitempty"`
+	Kernel  string          `json:"kernel,omitempty"`
+	Initrd  string          `json:"initrd,omitempty"`
+	Cmdline string          `json:"cmdline,omitempty"`
+	Sshkey  string          `json:"sshkey,omitempty"`
+	Device  string          `json:"device,omitempty"`
+	Cpu     int             `json:"cpu,omitempty"`
+	Mem     int             `json:"mem,omitempty"`
+	Debug   bool            `json:"debug,omitempty"`
+	Config  json.RawMessage `json:"config,omitempty"`
+}
+
+type files struct {
+	Files []string `json:"files"`
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	params := cfg.Params.(*Params)
+	p, err := startPlugin(params.Command, params.Args)
+	if err != nil {
+		os.RemoveAll(cfg.Workdir)
+		return nil, err
+	}
+	inst := &instance{
+		cfg:     cfg,
+		plugin:  p,
+		console: vm.NewConsole(cfg, nil),
+		closed:  make(chan bool),
+	}
+	Logf(0, "creating instance: %v", cfg.Name)
+	create := &createParams{
+		Name:    cfg.Name,
+		Index:   cfg.Index,
+		Arch:    cfg.Arch,
+		Workdir: cfg.Workdir,
+		Image:   cfg.Image,
+		Kernel:  cfg.Kernel,
+		Initrd:  cfg.Initrd,
+		Cmdline: cfg.Cmdline,
+		Sshkey:  cfg.Sshkey,
+		Device:  cfg.Device,
+		Cpu:     cfg.Cpu,
+		Mem:     cfg.Mem,
+		Debug:   cfg.Debug,
+		Config:  params.Config,
+	}
+	if err := p.call("create", create, nil); err != nil {
+		p.stop()
+		os.RemoveAll(cfg.Workdir)
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	if err := inst.plugin.call("close", struct{}{}, nil); err != nil {
+		Logf(0, "%v: %v", inst.cfg.Name, err)
+	}
+	inst.plugin.stop()
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	var res struct {
+		Output []byte `json:"output"`
+	}
+	if err := inst.plugin.call("diagnose", struct{}{}, &res); err != nil {
+		Logf(0, "%v: %v", inst.cfg.Name, err)
+		return nil
+	}
+	return res.Output
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	var res struct {
+		Addr string `json:"addr"`
+	}
+	if err := inst.plugin.call("forward", map[string]int{"port": port}, &res); err != nil {
+		return "", err
+	}
+	return res.Addr, nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	res := new(files)
+	if err := inst.plugin.call("copy", &files{hostSrcs}, res); err != nil {
+		return nil, err
+	}
+	if len(res.Files) != len(hostSrcs) {
+		return nil, fmt.Errorf("plugin copied %v files, want %v", len(res.Files), len(hostSrcs))
+	}
+	return res.Files, nil
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+
+	killCon := func() {}
+	var conDone <-chan error
+	if inst.console != nil {
+		var err error
+		killCon, conDone, err = vm.AttachConsole(merger, inst.console)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		killCon()
+		return nil, nil, err
+	}
+	crpipe, cwpipe, err := vm.LongPipe()
+	if err != nil {
+		killCon()
+		rpipe.Close()
+		wpipe.Close()
+		return nil, nil, err
+	}
+	id, events, err := inst.plugin.run(command)
+	if err != nil {
+		killCon()
+		rpipe.Close()
+		wpipe.Close()
+		crpipe.Close()
+		cwpipe.Close()
+		return nil, nil, err
+	}
+	merger.Add("plugin", rpipe)
+	merger.Add("console", crpipe)
+	exited := make(chan error, 1)
+	go func() {
+		for {
+			ev := events.next()
+			if ev == nil {
+				// The plugin exited without sending the exited event.
+				ev = &response{Exited: true, Error: inst.plugin.exitError().Error()}
+			}
+			if len(ev.Output) != 0 {
+				wpipe.Write(ev.Output)
+			}
+			if len(ev.Console) != 0 {
+				cwpipe.Write(ev.Console)
+			}
+			if ev.Exited {
+				wpipe.Close()
+				cwpipe.Close()
+				if ev.Error == "" {
+					exited <- fmt.Errorf("command exited")
+				} else {
+					exited <- fmt.Errorf("command exited: %v", ev.Error)
+				}
+				return
+			}
+		}
+	}()
+
+	sv := &vm.Supervisor{
+		Name:    inst.cfg.Name,
+		Timeout: timeout,
+		Stop:    stop,
+		Closed:  inst.closed,
+		Exited:  exited,
+		Console: conDone,
+		Kill: func() {
+			if err := inst.plugin.call("kill", map[string]int64{"run": id}, nil); err != nil {
+				Logf(0, "%v: %v", inst.cfg.Name, err)
+			}
+		},
+		KillConsole: killCon,
+		// The instance is lost if the plugin crashed.
+		Alive:  inst.plugin.alive,
+		Merger: merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
+
+type request struct {
+	ID     int64       `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type response struct {
+	ID      int64           `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   string          `json:"error"`
+	Run     int64           `json:"run"`
+	Output  []byte          `json:"output"`
+	Console []byte          `json:"console"`
+	Exited  bool            `json:"exited"`
+}
+
+// plugin is a running plugin process.
+type plugin struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	enc   *json.Encoder
+	done  chan bool // closed when the plugin exits
+
+	mu     sync.Mutex
+	lastID int64
+	calls  map[int64]chan *response
+	runs   map[int64]*eventQueue
+	err    error // set when the plugin exits
+}
+
+func startPlugin(bin string, args []string) (*plugin, error) {
+	cmd := exec.Command(bin, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin %v: %v", bin, err)
+	}
+	p := &plugin{
+		cmd:   cmd,
+		stdin: stdin,
+		enc:   json.NewEncoder(stdin),
+		done:  make(chan bool),
+		calls: make(map[int64]chan *response),
+		runs:  make(map[int64]*eventQueue),
+	}
+	go p.loop(stdout)
+	return p, nil
+}
+
+// loop dispatches responses and events to waiting callers until the plugin exits.
+// It never blocks on callers: call response channels have room for the only response,
+// and run events are queued.
+func (p *plugin) loop(stdout io.Reader) {
+	dec := json.NewDecoder(stdout)
+	var err error
+	for {
+		res := new(response)
+		if err = dec.Decode(res); err != nil {
+			break
+		}
+		p.mu.Lock()
+		if res.Run != 0 {
+			if q := p.runs[res.Run]; q != nil {
+				q.push(res)
+				if res.Exited {
+					q.close()
+					delete(p.runs, res.Run)
+				}
+			}
+		} else if ch := p.calls[res.ID]; ch != nil {
+			ch <- res
+			delete(p.calls, res.ID)
+		}
+		p.mu.Unlock()
+	}
+	if err == io.EOF {
+		err = p.cmd.Wait()
+	} else {
+		err = fmt.Errorf("bad plugin output: %v", err)
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+	}
+	// Waiters see closed channels and queues and pick up the error with exitError.
+	p.mu.Lock()
+	p.err = fmt.Errorf("plugin exited: %v", err)
+	for _, ch := range p.calls {
+		close(ch)
+	}
+	for _, q := range p.runs {
+		q.close()
+	}
+	p.calls, p.runs = nil, nil
+	p.mu.Unlock()
+	close(p.done)
+}
+
+func (p *plugin) exitError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *plugin) send(method string, params interface{}, run bool) (int64, chan *response, *eventQueue, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0, nil, nil, p.err
+	}
+	p.lastID++
+	id := p.lastID
+	res := make(chan *response, 1)
+	var events *eventQueue
+	p.calls[id] = res
+	if run {
+		events = newEventQueue()
+		p.runs[id] = events
+	}
+	if err := p.enc.Encode(&request{id, method, params}); err != nil {
+		delete(p.calls, id)
+		delete(p.runs, id)
+		return 0, nil, nil, fmt.Errorf("failed to send %v request to plugin: %v", method, err)
+	}
+	return id, res, events, nil
+}
+
+func (p *plugin) call(method string, params, result interface{}) error {
+	_, resc, _, err := p.send(method, params, false)
+	if err != nil {
+		return err
+	}
+	return p.wait(method, resc, result)
+}
+
+func (p *plugin) run(command string) (int64, *eventQueue, error) {
+	id, resc, events, err := p.send("run", map[string]string{"command": command}, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := p.wait("run", resc, nil); err != nil {
+		p.mu.Lock()
+		delete(p.runs, id)
+		p.mu.Unlock()
+		return 0, nil, err
+	}
+	return id, events, nil
+}
+
+func (p *plugin) wait(method string, resc chan *response, result interface{}) error {
+	res, ok := <-resc
+	if !ok {
+		return p.exitError()
+	}
+	if res.Error != "" {
+		return fmt.Errorf("plugin %v failed: %v", method, res.Error)
+	}
+	if result != nil && len(res.Result) != 0 {
+		if err := json.Unmarshal(res.Result, result); err != nil {
+			return fmt.Errorf("bad plugin %v result: %v", method, err)
+		}
+	}
+	return nil
+}
+
+func (p *plugin) alive() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop closes plugin stdin and waits for it to exit, the plugin is killed if it does not exit in time.
+func (p *plugin) stop() {
+	p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(time.Minute):
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// eventQueue is an unbounded queue of events of a single run, so that a stalled output
+// consumer does not block dispatching of responses to other requests (e.g. kill).
+type eventQueue struct {
+	mu     sync.Mutex
+	events []*response
+	closed bool
+	ready  chan bool // non-empty when there are new events or the queue is closed
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{ready: make(chan bool, 1)}
+}
+
+func (q *eventQueue) push(ev *response) {
+	q.mu.Lock()
+	q.events = append(q.events, ev)
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *eventQueue) notify() {
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
+
+// next returns the next event, it returns nil when the queue is closed and drained.
+func (q *eventQueue) next() *response {
+	for {
+		q.mu.Lock()
+		if len(q.events) != 0 {
+			ev := q.events[0]
+			q.events[0] = nil
+			q.events = q.events[1:]
+			q.mu.Unlock()
+			return ev
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return nil
+		}
+		<-q.ready
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/vm"
+)
+
+// TestMain runs the test binary as a fake plugin if SYZ_TEST_PLUGIN is set.
+func TestMain(m *testing.M) {
+	if os.Getenv("SYZ_TEST_PLUGIN") != "" {
+		fakePlugin()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func fakePlugin() {
+	enc := json.NewEncoder(os.Stdout)
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		var req struct {
+			ID     int64
+			Method string
+			Params map[string]interface{}
+		}
+		if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+			panic(err)
+		}
+		switch req.Method {
+		case "create":
+			if req.Params["name"] != "test-0" {
+				enc.Encode(map[string]interface{}{"id": req.ID, "error": "bad name"})
+				continue
+			}
+			enc.Encode(map[string]interface{}{"id": req.ID})
+		case "forward":
+			enc.Encode(map[string]interface{}{"id": req.ID, "result": map[string]string{
+				"addr": fmt.Sprintf("10.0.0.1:%v", req.Params["port"])}})
+		case "copy":
+			var files []string
+			for _, f := range req.Params["files"].([]interface{}) {
+				files = append(files, "/vm/"+f.(string))
+			}
+			enc.Encode(map[string]interface{}{"id": req.ID, "result": map[string]interface{}{"files": files}})
+		case "run":
+			enc.Encode(map[string]interface{}{"id": req.ID})
+			switch req.Params["command"] {
+			case "hang":
+				continue
+			case "flood":
+				for i := 0; i < 1000; i++ {
+					enc.Encode(map[string]interface{}{"run": req.ID, "output": []byte("output\n")})
+				}
+				continue
+			case "panic":
+				for i := 0; i < 100; i++ {
+					enc.Encode(map[string]interface{}{"run": req.ID, "console": []byte("Kernel panic\n")})
+				}
+				enc.Encode(map[string]interface{}{"run": req.ID, "exited": true})
+				continue
+			}
+			enc.Encode(map[string]interface{}{"run": req.ID, "output": []byte(req.Params["command"].(string))})
+			enc.Encode(map[string]interface{}{"run": req.ID, "exited": true, "error": "exit status 1"})
+		case "diagnose":
+			enc.Encode(map[string]interface{}{"id": req.ID, "result": map[string]interface{}{"output": []byte("diag")}})
+		case "kill":
+			enc.Encode(map[string]interface{}{"id": req.ID})
+			enc.Encode(map[string]interface{}{"run": req.Params["run"], "exited": true, "error": "killed"})
+		case "close":
+			enc.Encode(map[string]interface{}{"id": req.ID})
+			return
+		default:
+			enc.Encode(map[string]interface{}{"id": req.ID, "error": "unknown method " + req.Method})
+		}
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	os.Setenv("SYZ_TEST_PLUGIN", "1")
+	defer os.Unsetenv("SYZ_TEST_PLUGIN")
+	workdir, err := ioutil.TempDir("", "syz-plugin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	cfg := &vm.Config{
+		Name:    "test-0",
+		Workdir: workdir,
+		Params:  &Params{Command: os.Args[0]},
+	}
+	inst, err := ctor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	addr, err := inst.Forward(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "10.0.0.1:1234" {
+		t.Fatalf("got addr %q", addr)
+	}
+	files, err := inst.CopyAll([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, " ") != "/vm/a /vm/b" {
+		t.Fatalf("got files %q", files)
+	}
+	if _, err := inst.Copy("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if diag := inst.Diagnose(); string(diag) != "diag" {
+		t.Fatalf("got diagnose output %q", diag)
+	}
+
+	output, errc, err := inst.Run(time.Minute, nil, "echo hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err == nil || err.Error() != "command exited: exit status 1" {
+		t.Fatalf("got error %v", err)
+	}
+	var out []byte
+	for data := range output {
+		out = append(out, data...)
+	}
+	if string(out) != "syzkaller: [plugin]\necho hello\n" {
+		t.Fatalf("got output %q", out)
+	}
+
+	stop := make(chan bool)
+	_, errc, err = inst.Run(time.Minute, stop, "hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	if err := <-errc; err != vm.TimeoutErr {
+		t.Fatalf("got error %v, want %v", err, vm.TimeoutErr)
+	}
+}
+
+func TestPluginConsole(t *testing.T) {
+	os.Setenv("SYZ_TEST_PLUGIN", "1")
+	defer os.Unsetenv("SYZ_TEST_PLUGIN")
+	// Console output must not be rate limited like command output.
+	defer func(limit int) { vm.MergerRateLimit = limit }(vm.MergerRateLimit)
+	vm.MergerRateLimit = 1
+	workdir, err := ioutil.TempDir("", "syz-plugin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	cfg := &vm.Config{
+		Name:    "test-0",
+		Workdir: workdir,
+		Params:  &Params{Command: os.Args[0]},
+	}
+	inst, err := ctor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+	output, errc, err := inst.Run(time.Minute, nil, "panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err == nil || err.Error() != "command exited" {
+		t.Fatalf("got error %v", err)
+	}
+	var out []byte
+	for data := range output {
+		out = append(out, data...)
+	}
+	if want := "syzkaller: [console]\n" + strings.Repeat("Kernel panic\n", 100); string(out) != want {
+		t.Fatalf("got output %q", out)
+	}
+}
+
+func TestPluginCreateError(t *testing.T) {
+	os.Setenv("SYZ_TEST_PLUGIN", "1")
+	defer os.Unsetenv("SYZ_TEST_PLUGIN")
+	cfg := &vm.Config{
+		Name:   "test-1",
+		Params: &Params{Command: os.Args[0]},
+	}
+	if _, err := ctor(cfg); err == nil || err.Error() != "plugin create failed: bad name" {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestPluginStalledOutput(t *testing.T) {
+	os.Setenv("SYZ_TEST_PLUGIN", "1")
+	defer os.Unsetenv("SYZ_TEST_PLUGIN")
+	p, err := startPlugin(os.Args[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.stop()
+	// Nobody consumes the output, but responses must still be delivered.
+	id, events, err := p.run("flood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- p.call("kill", map[string]int64{"run": id}, nil)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("kill is blocked by undelivered output")
+	}
+	n := 0
+	for ev := events.next(); ev != nil; ev = events.next() {
+		if ev.Exited {
+			if ev.Error != "killed" {
+				t.Fatalf("got exit error %q", ev.Error)
+			}
+			break
+		}
+		n++
+	}
+	if n != 1000 {
+		t.Fatalf("got %v output events, want 1000", n)
+	}
+}
+
+func TestPluginExit(t *testing.T) {
+	os.Setenv("SYZ_TEST_PLUGIN", "1")
+	defer os.Unsetenv("SYZ_TEST_PLUGIN")
+	p, err := startPlugin(os.Args[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, events, err := p.run("hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The plugin exits after close without reporting exit of the hanging command.
+	if err := p.call("close", struct{}{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ev := events.next(); ev != nil {
+		t.Fatalf("got event %+v after plugin exit", ev)
+	}
+	if err := p.call("diagnose", struct{}{}, nil); err == nil || !strings.HasPrefix(err.Error(), "plugin exited") {
+		t.Fatalf("got error %v", err)
+	}
+	p.stop()
+}
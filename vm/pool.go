@@ -0,0 +1,553 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+)
+
+// Pool manages a fixed set of instance slots of a single type.
+// It boots instances on behalf of the caller, checks that a freshly booted instance
+// is usable, replaces instances that fail to boot or fail the check (with backoff),
+// and keeps per-slot status that can be shown to the user.
+// Instances that break while in use (commands can't be started in them anymore)
+// are transparently replaced with a new instance in the same slot, see poolInstance.Run.
+type Pool struct {
+	typ     string
+	bootSem chan bool // limits number of concurrent boots, nil if not limited
+	mu      sync.Mutex
+	slots   []SlotStatus
+	metrics []InstanceMetrics
+}
+
+type SlotState int
+
+const (
+	SlotIdle SlotState = iota
+	SlotBooting
+	SlotRunning
+	SlotBroken
+)
+
+func (s SlotState) String() string {
+	switch s {
+	case SlotIdle:
+		return "idle"
+	case SlotBooting:
+		return "booting"
+	case SlotRunning:
+		return "running"
+	case SlotBroken:
+		return "broken"
+	default:
+		return fmt.Sprintf("state%v", int(s))
+	}
+}
+
+type SlotStatus struct {
+	State        SlotState
+	Since        time.Time // when the slot entered the current state
+	Boots        int       // successful boots
+	BootFailures int       // failed boots and health checks
+	Failures     int       // consecutive failed boots, reset on successful boot
+	Swaps        int       // broken instances replaced while in use
+	LastError    string
+}
+
+// InstanceMetrics are lifecycle metrics of instances booted in a pool slot.
+// Last* durations describe the last successful boot, everything else is accumulated over all instances.
+// They allow to spot degrading hypervisors or flaky cloud zones.
+type InstanceMetrics struct {
+	LastBoot  time.Duration // duration of backend instance creation
+	LastReady time.Duration // time from the start of the boot until the instance executed the first command
+	Restarts  int           // instances booted after the first one
+	Crashes   int           // crashes detected by MonitorExecution
+	CopyBytes int64         // bytes copied into instances
+	CopyTime  time.Duration
+	Runs      int // commands executed by Run
+	RunTime   time.Duration
+}
+
+// CopyThroughput returns average Copy throughput in bytes per second.
+func (m *InstanceMetrics) CopyThroughput() float64 {
+	if m.CopyTime <= 0 {
+		return 0
+	}
+	return float64(m.CopyBytes) / m.CopyTime.Seconds()
+}
+
+// AvgRunTime returns average duration of commands executed by Run.
+func (m *InstanceMetrics) AvgRunTime() time.Duration {
+	if m.Runs == 0 {
+		return 0
+	}
+	return m.RunTime / time.Duration(m.Runs)
+}
+
+var (
+	// PoolBootAttempts is the number of times an instance is recreated before Create gives up.
+	PoolBootAttempts = 3
+	// PoolBackoff is the initial delay before instance recreation, it is doubled on every failure.
+	PoolBackoff = 10 * time.Second
+	// PoolHealthTimeout limits duration of the health check.
+	PoolHealthTimeout = time.Minute
+)
+
+func NewPool(typ string, count int) (*Pool, error) {
+	if _, ok := backends[typ]; !ok {
+		return nil, fmt.Errorf("unknown instance type '%v'", typ)
+	}
+	if count <= 0 {
+		return nil, fmt.Errorf("bad instance count %v", count)
+	}
+	pool := &Pool{
+		typ:     typ,
+		slots:   make([]SlotStatus, count),
+		metrics: make([]InstanceMetrics, count),
+	}
+	for i := range pool.slots {
+		pool.slots[i].Since = time.Now()
+	}
+	return pool, nil
+}
+
+// SetBootParallelism limits the number of instances that are booted at the same time
+// (e.g. to not exceed cloud API quotas or overload the host), 0 means no limit.
+func (pool *Pool) SetBootParallelism(n int) {
+	pool.bootSem = nil
+	if n > 0 {
+		pool.bootSem = make(chan bool, n)
+	}
+}
+
+// Count returns number of slots in the pool.
+func (pool *Pool) Count() int {
+	return len(pool.slots)
+}
+
+// Create creates and boots a new instance in slot cfg.Index.
+// Instances that fail to boot or fail the health check are recreated up to PoolBootAttempts times.
+// The returned instance releases the slot on Close.
+func (pool *Pool) Create(cfg *Config) (Instance, error) {
+	idx := cfg.Index
+	if idx < 0 || idx >= len(pool.slots) {
+		return nil, fmt.Errorf("bad instance index %v (pool size %v)", idx, len(pool.slots))
+	}
+	inst, err := pool.boot(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &poolInstance{Instance: inst, pool: pool, idx: idx, cfg: cfg}, nil
+}
+
+// CreateAll creates instances for all cfgs concurrently (subject to SetBootParallelism).
+// It returns instances in the same order, nil for instances that failed to boot,
+// and *BootError if any of them failed.
+func (pool *Pool) CreateAll(cfgs []*Config) ([]Instance, error) {
+	insts := make([]Instance, len(cfgs))
+	errs := make([]error, len(cfgs))
+	var wg sync.WaitGroup
+	for i, cfg := range cfgs {
+		wg.Add(1)
+		go func(i int, cfg *Config) {
+			defer wg.Done()
+			insts[i], errs[i] = pool.Create(cfg)
+		}(i, cfg)
+	}
+	wg.Wait()
+	berr := &BootError{Total: len(cfgs)}
+	for i, err := range errs {
+		if err != nil {
+			berr.Slots = append(berr.Slots, cfgs[i].Index)
+			berr.Errors = append(berr.Errors, err)
+		}
+	}
+	if len(berr.Errors) != 0 {
+		return insts, berr
+	}
+	return insts, nil
+}
+
+// BootError describes instances that failed to boot in CreateAll.
+type BootError struct {
+	Total  int
+	Slots  []int
+	Errors []error
+}
+
+func (err *BootError) Error() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "failed to boot %v out of %v instances:", len(err.Slots), err.Total)
+	for i, slot := range err.Slots {
+		fmt.Fprintf(buf, "\nslot %v: %v", slot, err.Errors[i])
+	}
+	return buf.String()
+}
+
+// boot creates a healthy instance in slot cfg.Index with retries.
+func (pool *Pool) boot(cfg *Config) (Instance, error) {
+	idx := cfg.Index
+	backoff := PoolBackoff
+	var err error
+	for attempt := 0; attempt < PoolBootAttempts; attempt++ {
+		if attempt != 0 {
+			Logf(0, "%v: recreating instance in %v (attempt %v/%v): %v",
+				cfg.Name, backoff, attempt+1, PoolBootAttempts, err)
+			if !SleepInterruptible(backoff) {
+				return nil, fmt.Errorf("shutdown in progress")
+			}
+			backoff *= 2
+		}
+		if pool.bootSem != nil {
+			select {
+			case pool.bootSem <- true:
+			case <-Shutdown:
+				return nil, fmt.Errorf("shutdown in progress")
+			}
+		}
+		pool.setState(idx, SlotBooting, nil)
+		// Backends remove the workdir on failures.
+		if err = os.MkdirAll(cfg.Workdir, 0777); err != nil {
+			err = fmt.Errorf("failed to create instance workdir: %v", err)
+			pool.setState(idx, SlotBroken, err)
+			if pool.bootSem != nil {
+				<-pool.bootSem
+			}
+			return nil, err
+		}
+		var inst Instance
+		start := time.Now()
+		inst, err = Create(pool.typ, cfg)
+		boot := time.Since(start)
+		if err == nil {
+			if err = checkHealth(inst); err != nil {
+				inst.Close()
+				err = fmt.Errorf("health check failed: %v", err)
+			}
+		}
+		if pool.bootSem != nil {
+			<-pool.bootSem
+		}
+		if err == nil {
+			pool.updateMetrics(idx, func(m *InstanceMetrics) {
+				if m.LastBoot != 0 {
+					m.Restarts++
+				}
+				m.LastBoot = boot
+				m.LastReady = time.Since(start)
+			})
+			pool.setState(idx, SlotRunning, nil)
+			return inst, nil
+		}
+		pool.setState(idx, SlotBroken, err)
+	}
+	return nil, err
+}
+
+// Status returns a snapshot of all slots state.
+func (pool *Pool) Status() []SlotStatus {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return append([]SlotStatus{}, pool.slots...)
+}
+
+// Metrics returns a snapshot of lifecycle metrics of all slots.
+func (pool *Pool) Metrics() []InstanceMetrics {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return append([]InstanceMetrics{}, pool.metrics...)
+}
+
+func (pool *Pool) updateMetrics(idx int, fn func(m *InstanceMetrics)) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	fn(&pool.metrics[idx])
+}
+
+func (pool *Pool) setState(idx int, state SlotState, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	slot := &pool.slots[idx]
+	switch {
+	case state == SlotRunning:
+		slot.Boots++
+		slot.Failures = 0
+		slot.LastError = ""
+	case err != nil:
+		slot.BootFailures++
+		slot.Failures++
+		slot.LastError = err.Error()
+	}
+	slot.State = state
+	slot.Since = time.Now()
+}
+
+// checkHealth verifies that commands can be executed in the instance.
+// Backends differ in what they report on successful command exit,
+// so the check looks for the command output instead.
+func checkHealth(inst Instance) error {
+	const marker = "syz-health-check-ok"
+	stop := make(chan bool)
+	defer close(stop)
+	outc, errc, err := inst.Run(PoolHealthTimeout, stop, "echo "+marker)
+	if err != nil {
+		return err
+	}
+	var output []byte
+	var timeout <-chan time.Time
+	for {
+		select {
+		case out, ok := <-outc:
+			if !ok {
+				outc = nil
+				continue
+			}
+			output = append(output, out...)
+			if bytes.Contains(output, []byte(marker)) {
+				return nil
+			}
+		case err = <-errc:
+			// Give the output some time to arrive.
+			errc = nil
+			timeout = time.After(time.Second)
+		case <-timeout:
+			if err == nil {
+				err = fmt.Errorf("no output")
+			}
+			return err
+		}
+	}
+}
+
+type poolInstance struct {
+	Instance
+	pool   *Pool
+	idx    int
+	cfg    *Config
+	closed bool
+	broken bool // the instance is closed by swap, but the replacement failed to boot
+
+	// Setup done by the user of the instance, replayed in the same order on a replacement instance.
+	setup []setupOp
+}
+
+type setupOpKind int
+
+const (
+	setupForward setupOpKind = iota
+	setupCopy
+	setupSnapshot
+)
+
+type setupOp struct {
+	kind     setupOpKind
+	port     int      // for setupForward
+	addr     string   // for setupForward
+	hostSrcs []string // for setupCopy
+	vmDsts   []string // for setupCopy
+}
+
+var errBroken = errors.New("instance is broken")
+
+func (inst *poolInstance) Forward(port int) (string, error) {
+	if inst.broken {
+		return "", errBroken
+	}
+	addr, err := inst.Instance.Forward(port)
+	if err != nil {
+		return "", err
+	}
+	inst.setup = append(inst.setup, setupOp{kind: setupForward, port: port, addr: addr})
+	return addr, nil
+}
+
+func (inst *poolInstance) Diagnose() []byte {
+	if inst.broken {
+		return nil
+	}
+	return inst.Instance.Diagnose()
+}
+
+func (inst *poolInstance) Snapshot() error {
+	if err := AsSnapshotter(inst.Instance).Snapshot(); err != nil {
+		return err
+	}
+	inst.setup = append(inst.setup, setupOp{kind: setupSnapshot})
+	return nil
+}
+
+// Restore returns the instance to the snapshot. If the restore fails or the instance
+// does not respond after it, the instance is replaced with a new one, see swap.
+func (inst *poolInstance) Restore() error {
+	err := errBroken
+	if !inst.broken {
+		if err = AsSnapshotter(inst.Instance).Restore(); err == nil {
+			if err = checkHealth(inst.Instance); err == nil {
+				return nil
+			}
+			err = fmt.Errorf("health check failed: %v", err)
+		}
+	}
+	if swapErr := inst.swap(err); swapErr != nil {
+		return fmt.Errorf("%v (failed to replace instance: %v)", err, swapErr)
+	}
+	return nil
+}
+
+func (inst *poolInstance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *poolInstance) CopyAll(hostSrcs []string) ([]string, error) {
+	if inst.broken {
+		return nil, errBroken
+	}
+	start := time.Now()
+	vmDsts, err := inst.Instance.CopyAll(hostSrcs)
+	if err != nil {
+		return nil, err
+	}
+	dur := time.Since(start)
+	var size int64
+	for _, hostSrc := range hostSrcs {
+		if st, err := os.Stat(hostSrc); err == nil {
+			size += st.Size()
+		}
+	}
+	inst.pool.updateMetrics(inst.idx, func(m *InstanceMetrics) {
+		m.CopyBytes += size
+		m.CopyTime += dur
+	})
+	inst.setup = append(inst.setup, setupOp{kind: setupCopy, hostSrcs: hostSrcs, vmDsts: vmDsts})
+	return vmDsts, nil
+}
+
+// Run runs command in the instance. If the command can't be started, the instance is considered broken
+// (e.g. a cloud instance stuck in an error state) and is replaced with a new one, see swap.
+// Instances are not health checked before commands: that would consume console output
+// that the command gets on backends that share one output channel between commands.
+func (inst *poolInstance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	return inst.run(func() (<-chan []byte, <-chan error, error) {
+		return inst.Instance.Run(timeout, stop, command)
+	})
+}
+
+func (inst *poolInstance) RunCommand(timeout time.Duration, stop <-chan bool, cmd *Command) (<-chan []byte, <-chan error, error) {
+	return inst.run(func() (<-chan []byte, <-chan error, error) {
+		return RunCommand(inst.Instance, timeout, stop, cmd)
+	})
+}
+
+func (inst *poolInstance) run(fn func() (<-chan []byte, <-chan error, error)) (<-chan []byte, <-chan error, error) {
+	start := time.Now()
+	var outc <-chan []byte
+	var errc <-chan error
+	err := errBroken
+	if !inst.broken {
+		outc, errc, err = fn()
+	}
+	if err != nil {
+		if swapErr := inst.swap(err); swapErr != nil {
+			return nil, nil, fmt.Errorf("%v (failed to replace instance: %v)", err, swapErr)
+		}
+		start = time.Now()
+		if outc, errc, err = fn(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return outc, inst.countRun(start, errc), nil
+}
+
+// swap replaces the broken instance with a new one in the same slot and repeats
+// port forwarding, copying and snapshotting done on the old instance in the original order.
+// The replacement is transparent only if it gives the same addresses and file names.
+func (inst *poolInstance) swap(cause error) error {
+	Logf(0, "%v: replacing broken instance: %v", inst.cfg.Name, cause)
+	inst.Instance.Close()
+	inst.broken = true
+	newInst, err := inst.pool.boot(inst.cfg)
+	if err != nil {
+		return err
+	}
+	inst.Instance = newInst
+	inst.broken = false
+	inst.pool.mu.Lock()
+	inst.pool.slots[inst.idx].Swaps++
+	inst.pool.mu.Unlock()
+	for _, op := range inst.setup {
+		if err := replaySetup(newInst, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replaySetup(inst Instance, op setupOp) error {
+	switch op.kind {
+	case setupForward:
+		addr, err := inst.Forward(op.port)
+		if err != nil {
+			return err
+		}
+		if addr != op.addr {
+			return fmt.Errorf("port %v is forwarded to %v instead of %v", op.port, addr, op.addr)
+		}
+	case setupCopy:
+		vmDsts, err := inst.CopyAll(op.hostSrcs)
+		if err != nil {
+			return err
+		}
+		for i := range vmDsts {
+			if vmDsts[i] != op.vmDsts[i] {
+				return fmt.Errorf("%v is copied to %v instead of %v", op.hostSrcs[i], vmDsts[i], op.vmDsts[i])
+			}
+		}
+	case setupSnapshot:
+		s := AsSnapshotter(inst)
+		if s == nil {
+			return fmt.Errorf("replacement does not support snapshots")
+		}
+		if err := s.Snapshot(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (inst *poolInstance) countRun(start time.Time, errc <-chan error) <-chan error {
+	// Run duration is known when the command finishes, so intercept the error.
+	errc1 := make(chan error, 1)
+	go func() {
+		err := <-errc
+		dur := time.Since(start)
+		inst.pool.updateMetrics(inst.idx, func(m *InstanceMetrics) {
+			m.Runs++
+			m.RunTime += dur
+		})
+		errc1 <- err
+	}()
+	return errc1
+}
+
+func (inst *poolInstance) Close() {
+	if inst.closed {
+		return
+	}
+	inst.closed = true
+	if !inst.broken {
+		inst.Instance.Close()
+	}
+	inst.pool.setState(inst.idx, SlotIdle, nil)
+}
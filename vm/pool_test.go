@@ -0,0 +1,361 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testInstance struct {
+	healthy bool
+	closed  bool
+}
+
+func (inst *testInstance) Copy(hostSrc string) (string, error) {
+	return hostSrc, nil
+}
+
+func (inst *testInstance) CopyAll(hostSrcs []string) ([]string, error) {
+	return CopyEach(inst, hostSrcs)
+}
+
+func (inst *testInstance) Forward(port int) (string, error) {
+	return fmt.Sprintf("localhost:%v", port), nil
+}
+
+func (inst *testInstance) Diagnose() []byte {
+	return nil
+}
+
+func (inst *testInstance) Close() {
+	inst.closed = true
+}
+
+func (inst *testInstance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	outc := make(chan []byte, 1)
+	errc := make(chan error, 1)
+	if inst.healthy {
+		outc <- []byte("syz-health-check-ok\n")
+		errc <- nil
+	} else {
+		errc <- fmt.Errorf("lost connection")
+	}
+	return outc, errc, nil
+}
+
+func TestPool(t *testing.T) {
+	PoolBackoff = time.Millisecond
+	// Slot 0 boots fine, slot 1 fails to boot once and then recovers,
+	// slot 2 always fails the health check.
+	attempts := make(map[int]int)
+	var instances []*testInstance
+	Register("test", func(cfg *Config) (Instance, error) {
+		attempts[cfg.Index]++
+		if cfg.Index == 1 && attempts[cfg.Index] == 1 {
+			return nil, fmt.Errorf("failed to boot")
+		}
+		inst := &testInstance{healthy: cfg.Index != 2}
+		instances = append(instances, inst)
+		return inst, nil
+	}, nil)
+	workdir, err := ioutil.TempDir("", "syz-pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	pool, err := NewPool("test", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(idx int) (Instance, error) {
+		return pool.Create(&Config{Index: idx, Name: fmt.Sprintf("test-%v", idx), Workdir: workdir})
+	}
+
+	inst0, err := create(0)
+	if err != nil {
+		t.Fatalf("failed to create instance 0: %v", err)
+	}
+	inst1, err := create(1)
+	if err != nil {
+		t.Fatalf("failed to create instance 1: %v", err)
+	}
+	if _, err := create(2); err == nil {
+		t.Fatalf("created unhealthy instance 2")
+	}
+	if attempts[2] != PoolBootAttempts {
+		t.Fatalf("instance 2 was created %v times, want %v", attempts[2], PoolBootAttempts)
+	}
+	for _, inst := range instances {
+		if !inst.healthy && !inst.closed {
+			t.Fatalf("unhealthy instance is not closed")
+		}
+	}
+
+	status := pool.Status()
+	want := []SlotStatus{
+		{State: SlotRunning, Boots: 1},
+		{State: SlotRunning, Boots: 1, BootFailures: 1},
+		{State: SlotBroken, BootFailures: 3, Failures: 3},
+	}
+	for i, s := range status {
+		if s.State != want[i].State || s.Boots != want[i].Boots ||
+			s.BootFailures != want[i].BootFailures || s.Failures != want[i].Failures {
+			t.Fatalf("slot %v: got %+v, want %+v", i, s, want[i])
+		}
+	}
+	if status[2].LastError == "" {
+		t.Fatalf("slot 2 does not have last error")
+	}
+
+	file := filepath.Join(workdir, "file")
+	if err := ioutil.WriteFile(file, []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inst0.Copy(file); err != nil {
+		t.Fatal(err)
+	}
+	_, errc, err := inst0.Run(time.Minute, nil, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-errc
+	metrics := pool.Metrics()
+	if m := metrics[0]; m.CopyBytes != 10 || m.Runs != 1 || m.LastBoot == 0 || m.LastReady < m.LastBoot {
+		t.Fatalf("bad slot 0 metrics: %+v", m)
+	}
+	if m := metrics[2]; m.LastBoot != 0 || m.Runs != 0 {
+		t.Fatalf("bad slot 2 metrics: %+v", m)
+	}
+
+	inst0.Close()
+	inst1.Close()
+	for i, s := range pool.Status()[:2] {
+		if s.State != SlotIdle {
+			t.Fatalf("slot %v is %v after close, want idle", i, s.State)
+		}
+	}
+	if _, err := create(3); err == nil {
+		t.Fatalf("created instance outside of the pool")
+	}
+	inst0, err = create(0)
+	if err != nil {
+		t.Fatalf("failed to recreate instance 0: %v", err)
+	}
+	inst0.Close()
+	if m := pool.Metrics()[0]; m.Restarts != 1 {
+		t.Fatalf("slot 0 has %v restarts, want 1", m.Restarts)
+	}
+}
+
+// brokenInstance fails to start commands after it is broken.
+type brokenInstance struct {
+	testInstance
+	broken   bool
+	forwards int
+	copies   int
+	ops      []string
+}
+
+func (inst *brokenInstance) Forward(port int) (string, error) {
+	inst.forwards++
+	inst.ops = append(inst.ops, fmt.Sprintf("forward %v", port))
+	return inst.testInstance.Forward(port)
+}
+
+func (inst *brokenInstance) CopyAll(hostSrcs []string) ([]string, error) {
+	inst.copies++
+	inst.ops = append(inst.ops, fmt.Sprintf("copy %v", hostSrcs))
+	return inst.testInstance.CopyAll(hostSrcs)
+}
+
+func (inst *brokenInstance) Snapshot() error {
+	inst.ops = append(inst.ops, "snapshot")
+	return nil
+}
+
+func (inst *brokenInstance) Restore() error {
+	return nil
+}
+
+func (inst *brokenInstance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	if inst.broken {
+		return nil, nil, fmt.Errorf("instance is in error state")
+	}
+	return inst.testInstance.Run(timeout, stop, command)
+}
+
+func TestPoolSwap(t *testing.T) {
+	PoolBackoff = time.Millisecond
+	var instances []*brokenInstance
+	Register("test-swap", func(cfg *Config) (Instance, error) {
+		inst := &brokenInstance{testInstance: testInstance{healthy: true}}
+		instances = append(instances, inst)
+		return inst, nil
+	}, nil)
+	defer delete(backends, "test-swap")
+	workdir, err := ioutil.TempDir("", "syz-pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	pool, err := NewPool("test-swap", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := pool.Create(&Config{Name: "test-0", Workdir: workdir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inst.Forward(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inst.CopyAll([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	instances[0].broken = true
+	_, errc, err := inst.Run(time.Minute, nil, "true")
+	if err != nil {
+		t.Fatalf("broken instance is not replaced: %v", err)
+	}
+	<-errc
+	if len(instances) != 2 || !instances[0].closed {
+		t.Fatalf("got %v instances, first closed=%v", len(instances), instances[0].closed)
+	}
+	if instances[1].forwards != 1 || instances[1].copies != 1 {
+		t.Fatalf("replacement setup is not replayed: %+v", instances[1])
+	}
+	if s := pool.Status()[0]; s.State != SlotRunning || s.Swaps != 1 || s.Boots != 2 {
+		t.Fatalf("bad slot status after swap: %+v", s)
+	}
+	inst.Close()
+	if !instances[1].closed {
+		t.Fatalf("replacement is not closed")
+	}
+}
+
+func TestPoolSwapRestore(t *testing.T) {
+	PoolBackoff = time.Millisecond
+	var instances []*brokenInstance
+	Register("test-swap", func(cfg *Config) (Instance, error) {
+		inst := &brokenInstance{testInstance: testInstance{healthy: true}}
+		instances = append(instances, inst)
+		return inst, nil
+	}, nil)
+	defer delete(backends, "test-swap")
+	workdir, err := ioutil.TempDir("", "syz-pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	pool, err := NewPool("test-swap", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := pool.Create(&Config{Name: "test-0", Workdir: workdir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+	if _, err := inst.Forward(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inst.CopyAll([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AsSnapshotter(inst).Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inst.Forward(2); err != nil {
+		t.Fatal(err)
+	}
+	// Commands still start, but the instance does not respond after the restore.
+	instances[0].healthy = false
+	if err := AsSnapshotter(inst).Restore(); err != nil {
+		t.Fatalf("broken instance is not replaced: %v", err)
+	}
+	if len(instances) != 2 || !instances[0].closed {
+		t.Fatalf("got %v instances, first closed=%v", len(instances), instances[0].closed)
+	}
+	want := "[forward 1 copy [a] snapshot forward 2]"
+	if got := fmt.Sprint(instances[1].ops); got != want {
+		t.Fatalf("replayed setup %v, want %v", got, want)
+	}
+	// Commands that fail after start don't cause a replacement.
+	instances[1].healthy = false
+	_, errc, err := inst.Run(time.Minute, nil, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-errc
+	if len(instances) != 2 {
+		t.Fatalf("instance is replaced after a failed command")
+	}
+}
+
+func TestPoolCreateAll(t *testing.T) {
+	PoolBackoff = time.Millisecond
+	// Slot 3 always fails to boot, at most 2 instances boot at the same time.
+	var mu sync.Mutex
+	booting, maxBooting := 0, 0
+	Register("test-all", func(cfg *Config) (Instance, error) {
+		mu.Lock()
+		booting++
+		if maxBooting < booting {
+			maxBooting = booting
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		booting--
+		mu.Unlock()
+		if cfg.Index == 3 {
+			return nil, fmt.Errorf("failed to boot")
+		}
+		return &testInstance{healthy: true}, nil
+	}, nil)
+	defer delete(backends, "test-all")
+	workdir, err := ioutil.TempDir("", "syz-pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	pool, err := NewPool("test-all", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetBootParallelism(2)
+	var cfgs []*Config
+	for i := 0; i < 5; i++ {
+		cfgs = append(cfgs, &Config{Index: i, Name: fmt.Sprintf("test-%v", i), Workdir: workdir})
+	}
+	insts, err := pool.CreateAll(cfgs)
+	berr, ok := err.(*BootError)
+	if !ok {
+		t.Fatalf("got error %v, want *BootError", err)
+	}
+	if berr.Total != 5 || len(berr.Slots) != 1 || berr.Slots[0] != 3 {
+		t.Fatalf("bad boot error: %v", berr)
+	}
+	if maxBooting != 2 {
+		t.Fatalf("booted %v instances at the same time, want 2", maxBooting)
+	}
+	for i, inst := range insts {
+		if (inst == nil) != (i == 3) {
+			t.Fatalf("instance %v: got %v", i, inst)
+		}
+		if inst != nil {
+			inst.Close()
+		}
+	}
+}
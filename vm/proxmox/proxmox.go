@@ -0,0 +1,299 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package proxmox allows to use Proxmox VE virtual machines as VMs.
+// VMs are created as linked clones of a template VM (its VMID is specified in image param)
+// on proxmox_node. The template needs a cloud-init drive, qemu-guest-agent installed
+// (it is used to obtain VM IP address) and a kernel with console=ttyS0.
+// The ssh key (generated per instance if sshkey is not specified) is injected with cloud-init.
+// Kernel console output is streamed from serial0 over the termproxy websocket.
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/proxmox"
+	"github.com/google/syzkaller/vm"
+	"github.com/google/syzkaller/vm/internal/sshutil"
+)
+
+func init() {
+	vm.Register("proxmox", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are Proxmox VE-specific parameters (the vm section of the manager config).
+type Params struct {
+	Url      string // API endpoint (e.g. "https://pve.example.com:8006")
+	Node     string // cluster node to create VMs on
+	Insecure bool   // don't verify TLS certificate of the API endpoint
+}
+
+func (params *Params) Validate() error {
+	if params.Url == "" {
+		return fmt.Errorf("url is empty")
+	}
+	if params.Node == "" {
+		return fmt.Errorf("node is empty")
+	}
+	return nil
+}
+
+type instance struct {
+	cfg      *vm.Config
+	name     string
+	vmid     int
+	ip       string
+	hostAddr string
+	ssh      *sshutil.Target
+	closed   chan bool
+}
+
+var (
+	initOnce sync.Once
+	Proxmox  *proxmox.Context
+)
+
+func initProxmox(params *Params) {
+	var err error
+	Proxmox, err = proxmox.NewContext(params.Url, params.Node, params.Insecure)
+	if err != nil {
+		Fatalf("failed to init proxmox: %v", err)
+	}
+	Logf(0, "proxmox initialized: %v, node %v", params.Url, Proxmox.Node)
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	template, err := strconv.Atoi(cfg.Image)
+	if err != nil {
+		return nil, fmt.Errorf("image must be VMID of the template VM, got %q", cfg.Image)
+	}
+	initOnce.Do(func() { initProxmox(cfg.Params.(*Params)) })
+	ok := false
+	defer func() {
+		if !ok {
+			os.RemoveAll(cfg.Workdir)
+		}
+	}()
+
+	sshKey := cfg.Sshkey
+	pubKey := filepath.Join(cfg.Workdir, "key.pub")
+	if sshKey == "" {
+		sshKey = filepath.Join(cfg.Workdir, "key")
+		if err := sshutil.Keygen(sshKey); err != nil {
+			return nil, err
+		}
+	} else {
+		out, err := exec.Command("ssh-keygen", "-y", "-f", sshKey).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract public key from %v: %v", sshKey, err)
+		}
+		if err := ioutil.WriteFile(pubKey, out, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write public key: %v", err)
+		}
+	}
+	sshKeyPub, err := ioutil.ReadFile(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+
+	config := map[string]string{
+		"cores":     fmt.Sprint(cfg.Cpu),
+		"memory":    fmt.Sprint(cfg.Mem),
+		"serial0":   "socket",
+		"agent":     "1",
+		"ciuser":    "root",
+		"ipconfig0": "ip=dhcp",
+		// PVE expects the keys to be additionally URL-encoded, with spaces as %20.
+		"sshkeys": strings.Replace(url.QueryEscape(string(sshKeyPub)), "+", "%20", -1),
+	}
+	var vmid int
+	err = vm.CreateInstance(cfg.Name, func() error {
+		return Proxmox.DeleteVMsByName(cfg.Name)
+	}, func() error {
+		var err error
+		vmid, err = Proxmox.CloneVM(template, cfg.Name, config)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !ok {
+			Proxmox.DeleteVM(vmid)
+		}
+	}()
+	inst := &instance{
+		cfg:    cfg,
+		name:   cfg.Name,
+		vmid:   vmid,
+		ssh:    &sshutil.Target{Key: sshKey, Debug: cfg.Debug, Log: vm.ArtifactPath(cfg, vm.ArtifactSsh)},
+		closed: make(chan bool),
+	}
+	inst.ssh.Multiplex(cfg.Workdir)
+	Logf(0, "wait instance to boot: %v (%v)", cfg.Name, vmid)
+	if err := inst.waitBoot(); err != nil {
+		inst.ssh.Close()
+		return nil, err
+	}
+	ok = true
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Cpu <= 0 || cfg.Cpu > 512 {
+		return fmt.Errorf("bad proxmox cpu: %v, want [1-512]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad proxmox mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+func (inst *instance) waitBoot() error {
+	for i := 0; i < 100; i++ {
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+		if inst.ip == "" {
+			ip, err := Proxmox.VMAddress(inst.vmid)
+			if err != nil {
+				continue
+			}
+			inst.ip = ip
+			inst.ssh.Host = ip
+		}
+		ctx, cancel := context.WithTimeout(vm.ShutdownContext(), time.Minute)
+		_, err := inst.ssh.Run(ctx, "pwd")
+		cancel()
+		if err == nil {
+			// Use the address of the interface the VM is reachable through.
+			conn, err := net.Dial("udp", inst.ip+":22")
+			if err != nil {
+				return err
+			}
+			inst.hostAddr = conn.LocalAddr().(*net.UDPAddr).IP.String()
+			conn.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("can't ssh into the instance")
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	inst.ssh.Close()
+	vm.DefaultRetry.Do("delete instance "+inst.name, func() error {
+		return Proxmox.DeleteVM(inst.vmid)
+	})
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Diagnose() []byte {
+	inst.ssh.Sysrq()
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostAddr, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(vm.ShutdownContext(), 3*time.Minute)
+	defer cancel()
+	return inst.ssh.Copy(ctx, "/root", hostSrcs)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	var con io.ReadCloser
+	err := vm.DefaultRetry.Do("connect to serial console", func() error {
+		var err error
+		con, err = Proxmox.SerialConsole(inst.vmid)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	conRpipe, conWpipe, err := vm.LongPipe()
+	if err != nil {
+		con.Close()
+		return nil, nil, err
+	}
+	conDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conWpipe, con)
+		conWpipe.Close()
+		conDone <- fmt.Errorf("console connection closed: %v", err)
+	}()
+
+	sshRpipe, sshWpipe, err := vm.LongPipe()
+	if err != nil {
+		con.Close()
+		conRpipe.Close()
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ssh := inst.ssh.Command(ctx, command)
+	ssh.Stdout = sshWpipe
+	ssh.Stderr = sshWpipe
+	if err := ssh.Start(); err != nil {
+		cancel()
+		con.Close()
+		conRpipe.Close()
+		sshRpipe.Close()
+		sshWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to connect to instance: %v", err)
+	}
+	sshWpipe.Close()
+	sshDone := make(chan error, 1)
+	go func() {
+		err := ssh.Wait()
+		cancel()
+		sshDone <- fmt.Errorf("ssh exited: %v", err)
+	}()
+
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	merger.Add("console", conRpipe)
+	merger.Add("ssh", sshRpipe)
+
+	sv := &vm.Supervisor{
+		Name:        inst.name,
+		Timeout:     timeout,
+		Stop:        stop,
+		Closed:      inst.closed,
+		Exited:      sshDone,
+		Console:     conDone,
+		Kill:        cancel,
+		KillConsole: func() { con.Close() },
+		Alive:       func() bool { return Proxmox.IsVMRunning(inst.vmid) },
+		Merger:      merger,
+	}
+	return merger.Output, sv.Start(), nil
+}
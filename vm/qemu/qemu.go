@@ -25,14 +25,17 @@ const (
 )
 
 func init() {
-	vm.Register("qemu", ctor)
+	vm.Register("qemu", ctor, nil)
+	vm.RegisterNetwork("qemu")
 }
 
 type instance struct {
 	cfg     *vm.Config
-	port    int
+	port    int             // host port forwarded to guest ssh port (user networking only)
+	netPort *vm.NetworkPort // private network attachment (optional)
 	rpipe   io.ReadCloser
 	wpipe   io.WriteCloser
+	monitor string // qemu human monitor unix socket
 	qemu    *exec.Cmd
 	waiterC chan error
 	merger  *vm.OutputMerger
@@ -53,7 +56,10 @@ func ctor(cfg *vm.Config) (vm.Instance, error) {
 }
 
 func ctorImpl(cfg *vm.Config) (vm.Instance, error) {
-	inst := &instance{cfg: cfg}
+	inst := &instance{
+		cfg:     cfg,
+		monitor: filepath.Join(cfg.Workdir, "monitor.sock"),
+	}
 	closeInst := inst
 	defer func() {
 		if closeInst != nil {
@@ -65,6 +71,13 @@ func ctorImpl(cfg *vm.Config) (vm.Instance, error) {
 		return nil, err
 	}
 
+	if cfg.Network != nil {
+		var err error
+		if inst.netPort, err = vm.AttachNetwork(cfg); err != nil {
+			return nil, err
+		}
+	}
+
 	if cfg.Image == "9p" {
 		inst.cfg.Sshkey = filepath.Join(inst.cfg.Workdir, "key")
 		keygen := exec.Command("ssh-keygen", "-t", "rsa", "-b", "2048", "-N", "", "-C", "", "-f", inst.cfg.Sshkey)
@@ -93,7 +106,7 @@ func ctorImpl(cfg *vm.Config) (vm.Instance, error) {
 
 func validateConfig(cfg *vm.Config) error {
 	if cfg.Bin == "" {
-		cfg.Bin = "qemu-system-x86_64"
+		cfg.Bin = cfg.TargetArch().Qemu
 	}
 	if cfg.Image == "9p" {
 		if cfg.Kernel == "" {
@@ -107,6 +120,9 @@ func validateConfig(cfg *vm.Config) error {
 			return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
 		}
 	}
+	if err := vm.ValidateBoot(cfg); err != nil {
+		return err
+	}
 	if cfg.Cpu <= 0 || cfg.Cpu > 1024 {
 		return fmt.Errorf("bad qemu cpu: %v, want [1-1024]", cfg.Cpu)
 	}
@@ -142,33 +158,53 @@ func (inst *instance) close(removeWorkDir bool) {
 }
 
 func (inst *instance) Boot() error {
-	for {
-		// Find an unused TCP port.
-		inst.port = rand.Intn(64<<10-1<<10) + 1<<10
-		ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%v", inst.port))
-		if err == nil {
-			ln.Close()
-			break
+	var netArgs []string
+	if inst.netPort != nil {
+		netArgs = []string{
+			"-net", "nic,macaddr=" + inst.netPort.MAC,
+			"-net", fmt.Sprintf("tap,ifname=%v,script=no,downscript=no", inst.netPort.Tap),
+		}
+	} else {
+		for {
+			// Find an unused TCP port.
+			inst.port = rand.Intn(64<<10-1<<10) + 1<<10
+			ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%v", inst.port))
+			if err == nil {
+				ln.Close()
+				break
+			}
+		}
+		netArgs = []string{
+			"-net", "nic",
+			"-net", fmt.Sprintf("user,host=%v,hostfwd=tcp::%v-:22", hostAddr, inst.port),
 		}
 	}
 	// TODO: ignores inst.cfg.Cpu
-	args := []string{
+	args := append([]string{
 		"-m", strconv.Itoa(inst.cfg.Mem),
-		"-net", "nic",
-		"-net", fmt.Sprintf("user,host=%v,hostfwd=tcp::%v-:22", hostAddr, inst.port),
+	}, netArgs...)
+	args = append(args,
 		"-display", "none",
 		"-serial", "stdio",
+		"-monitor", fmt.Sprintf("unix:%v,server,nowait", inst.monitor),
 		"-no-reboot",
 		"-numa", "node,nodeid=0,cpus=0-1", "-numa", "node,nodeid=1,cpus=2-3",
 		"-smp", "sockets=2,cores=2,threads=1",
-	}
-	if inst.cfg.BinArgs == "" {
+	)
+	arch := inst.cfg.TargetArch()
+	if inst.cfg.BinArgs == "" && inst.cfg.Arch == "amd64" && !inst.cfg.CrossArch() {
 		// This is reasonable defaults for x86 kvm-enabled host.
 		args = append(args,
 			"-enable-kvm",
 			"-usb", "-usbdevice", "mouse", "-usbdevice", "tablet",
 			"-soundhw", "all",
 		)
+	} else if inst.cfg.BinArgs == "" {
+		// Other archs are emulated unless they match the host.
+		args = append(args, arch.QemuArgs...)
+		if !inst.cfg.CrossArch() {
+			args = append(args, "-enable-kvm")
+		}
 	} else {
 		args = append(args, strings.Split(inst.cfg.BinArgs, " ")...)
 	}
@@ -179,7 +215,7 @@ func (inst *instance) Boot() error {
 		)
 	} else {
 		args = append(args,
-			"-hda", inst.cfg.Image,
+			"-drive", fmt.Sprintf("file=%v,index=0,media=disk,if=%v", inst.cfg.Image, arch.QemuDrive),
 			"-snapshot",
 		)
 	}
@@ -189,13 +225,16 @@ func (inst *instance) Boot() error {
 		)
 	}
 	if inst.cfg.Kernel != "" {
-		cmdline := "console=ttyS0 vsyscall=native rodata=n oops=panic panic_on_warn=1 panic=86400" +
-			" ftrace_dump_on_oops=orig_cpu earlyprintk=serial slub_debug=UZ net.ifnames=0 biosdevname=0 "
+		cmdline := "console=" + arch.Console + " " + arch.Cmdline + " rodata=n oops=panic panic_on_warn=1 panic=86400" +
+			" ftrace_dump_on_oops=orig_cpu slub_debug=UZ net.ifnames=0 biosdevname=0 "
 		if inst.cfg.Image == "9p" {
 			cmdline += "root=/dev/root rootfstype=9p rootflags=trans=virtio,version=9p2000.L,cache=loose "
 			cmdline += "init=" + filepath.Join(inst.cfg.Workdir, "init.sh") + " "
 		} else {
-			cmdline += "root=/dev/sda "
+			cmdline += "root=" + arch.RootDev + " "
+		}
+		if inst.netPort != nil {
+			cmdline += inst.netPort.Cmdline() + " "
 		}
 		args = append(args,
 			"-kernel", inst.cfg.Kernel,
@@ -222,7 +261,7 @@ func (inst *instance) Boot() error {
 		tee = os.Stdout
 	}
 	inst.merger = vm.NewOutputMerger(tee)
-	inst.merger.Add(inst.rpipe)
+	inst.merger.Add("console", inst.rpipe)
 	inst.rpipe = nil
 
 	var bootOutput []byte
@@ -250,7 +289,7 @@ func (inst *instance) Boot() error {
 	time.Sleep(10 * time.Second)
 	start := time.Now()
 	for {
-		c, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%v", inst.port), 3*time.Second)
+		c, err := net.DialTimeout("tcp", net.JoinHostPort(inst.sshHost(), strconv.Itoa(inst.sshPort())), 3*time.Second)
 		if err == nil {
 			c.SetDeadline(time.Now().Add(3 * time.Second))
 			var tmp [1]byte
@@ -280,40 +319,36 @@ func (inst *instance) Boot() error {
 	return nil
 }
 
+func (inst *instance) Diagnose() []byte {
+	out, err := inst.hmp("info registers", time.Minute)
+	if err != nil {
+		Logf(0, "%v: failed to dump registers: %v", inst.cfg.Name, err)
+		return nil
+	}
+	return []byte("\nqemu registers:\n" + out)
+}
+
 func (inst *instance) Forward(port int) (string, error) {
+	if inst.netPort != nil {
+		return fmt.Sprintf("%v:%v", inst.netPort.HostIP, port), nil
+	}
 	return fmt.Sprintf("%v:%v", hostAddr, port), nil
 }
 
 func (inst *instance) Copy(hostSrc string) (string, error) {
-	basePath := "/"
-	if inst.cfg.Image == "9p" {
-		basePath = "/tmp"
-	}
-	vmDst := filepath.Join(basePath, filepath.Base(hostSrc))
-	args := append(inst.sshArgs("-P"), hostSrc, "root@localhost:"+vmDst)
-	cmd := exec.Command("scp", args...)
-	if inst.cfg.Debug {
-		Logf(0, "running command: scp %#v", args)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stdout
-	}
-	if err := cmd.Start(); err != nil {
-		return "", err
-	}
-	done := make(chan bool)
-	go func() {
-		select {
-		case <-time.After(3 * time.Minute):
-			cmd.Process.Kill()
-		case <-done:
-		}
-	}()
-	err := cmd.Wait()
-	close(done)
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
 	if err != nil {
 		return "", err
 	}
-	return vmDst, nil
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	vmDir := "/"
+	if inst.cfg.Image == "9p" {
+		vmDir = "/tmp"
+	}
+	return vm.Scp(inst.sshArgs("-P"), "root@"+inst.sshHost(), vmDir, hostSrcs, inst.cfg.Debug)
 }
 
 func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
@@ -321,9 +356,9 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 	if err != nil {
 		return nil, nil, err
 	}
-	inst.merger.Add(rpipe)
+	inst.merger.Add("ssh", rpipe)
 
-	args := append(inst.sshArgs("-p"), "root@localhost", command)
+	args := append(inst.sshArgs("-p"), "root@"+inst.sshHost(), command)
 	if inst.cfg.Debug {
 		Logf(0, "running command: ssh %#v", args)
 	}
@@ -335,38 +370,24 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 		return nil, nil, err
 	}
 	wpipe.Close()
-	errc := make(chan error, 1)
-	signal := func(err error) {
-		select {
-		case errc <- err:
-		default:
-		}
-	}
-
-	done := make(chan bool)
-	go func() {
-		select {
-		case <-time.After(timeout):
-			signal(vm.TimeoutErr)
-			cmd.Process.Kill()
-		case <-stop:
-			signal(vm.TimeoutErr)
-			cmd.Process.Kill()
-		case <-done:
-		}
-	}()
+	exited := make(chan error, 1)
 	go func() {
-		err := cmd.Wait()
-		close(done)
-		signal(err)
+		exited <- cmd.Wait()
 	}()
-	return inst.merger.Output, errc, nil
+	sv := &vm.Supervisor{
+		Name:    inst.cfg.Name,
+		Timeout: timeout,
+		Stop:    stop,
+		Exited:  exited,
+		Kill:    func() { cmd.Process.Kill() },
+	}
+	return inst.merger.Output, sv.Start(), nil
 }
 
 func (inst *instance) sshArgs(portArg string) []string {
 	args := []string{
 		"-i", inst.cfg.Sshkey,
-		portArg, strconv.Itoa(inst.port),
+		portArg, strconv.Itoa(inst.sshPort()),
 		"-F", "/dev/null",
 		"-o", "ConnectionAttempts=10",
 		"-o", "ConnectTimeout=10",
@@ -382,6 +403,84 @@ func (inst *instance) sshArgs(portArg string) []string {
 	return args
 }
 
+func (inst *instance) sshHost() string {
+	if inst.netPort != nil {
+		return inst.netPort.GuestIP
+	}
+	return "localhost"
+}
+
+func (inst *instance) sshPort() int {
+	if inst.netPort != nil {
+		return 22
+	}
+	return inst.port
+}
+
+// Snapshot saves VM state with savevm. This requires the image to be a disk
+// that supports snapshots, so it does not work with 9p.
+func (inst *instance) Snapshot() error {
+	return inst.hmpNoOutput("savevm syzkaller")
+}
+
+func (inst *instance) Restore() error {
+	return inst.hmpNoOutput("loadvm syzkaller")
+}
+
+// hmpNoOutput executes a monitor command that prints nothing on success.
+func (inst *instance) hmpNoOutput(command string) error {
+	out, err := inst.hmp(command, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("%v failed: %v", command, out)
+	}
+	return nil
+}
+
+// hmp executes a qemu human monitor command and returns its output.
+func (inst *instance) hmp(command string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("unix", inst.monitor, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to qemu monitor: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	// Skip the greeting.
+	if _, err := readPrompt(conn); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return "", fmt.Errorf("failed to write to qemu monitor: %v", err)
+	}
+	out, err := readPrompt(conn)
+	if err != nil {
+		return "", err
+	}
+	// The monitor echoes the command first.
+	if pos := strings.IndexByte(out, '\n'); pos != -1 {
+		out = out[pos+1:]
+	} else {
+		out = ""
+	}
+	return strings.Replace(out, "\r", "", -1), nil
+}
+
+func readPrompt(conn net.Conn) (string, error) {
+	const prompt = "(qemu) "
+	var out []byte
+	buf := make([]byte, 4<<10)
+	for !strings.HasSuffix(string(out), prompt) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return "", fmt.Errorf("failed to read from qemu monitor: %v", err)
+		}
+		out = append(out, buf[:n]...)
+	}
+	return string(out[:len(out)-len(prompt)]), nil
+}
+
 const initScript = `#! /bin/bash
 set -eux
 mount -t proc none /proc
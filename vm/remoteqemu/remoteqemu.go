@@ -0,0 +1,494 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package remoteqemu allows to use qemu VMs running on remote hypervisor hosts.
+// Instances are spread over the hosts param (ssh destinations, e.g. "user@host", using the
+// user ssh configuration and agent) round-robin. The image, kernel and initrd are uploaded
+// into the dir param on every host once, then qemu is launched over ssh with the serial console
+// on the ssh session stdout. The guest ssh port and the qemu monitor socket are forwarded
+// back over the same ssh connection, and the manager port is forwarded to the remote host
+// for the fuzzer. Thus the manager machine does not need KVM and remote hosts need only
+// qemu and sshd. The machine is set up for the target arch like in the qemu backend,
+// remote hosts are assumed to have the manager host arch, so only that arch uses KVM.
+package remoteqemu
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+const (
+	hostAddr = "10.0.2.10"
+)
+
+func init() {
+	vm.Register("remoteqemu", ctor, func() vm.Params { return new(Params) })
+}
+
+// Params are remoteqemu-specific parameters (the vm section of the manager config).
+type Params struct {
+	Hosts []string // ssh destinations of hypervisor hosts (e.g. "user@host")
+	Dir   string   // dir on the hosts to upload image and kernel to (default: "/tmp/syzkaller")
+}
+
+func (params *Params) Validate() error {
+	if len(params.Hosts) == 0 {
+		return fmt.Errorf("hosts is empty")
+	}
+	if params.Dir == "" {
+		params.Dir = "/tmp/syzkaller"
+	}
+	return nil
+}
+
+type instance struct {
+	cfg      *vm.Config
+	host     string
+	dir      string // remote dir with uploaded files
+	port     int    // local port forwarded to the guest ssh port
+	monitor  string // local socket forwarded to the qemu monitor
+	qemu     *exec.Cmd
+	waiterC  chan error
+	merger   *vm.OutputMerger
+	forwards []*exec.Cmd
+}
+
+var (
+	uploadMu sync.Mutex
+	uploaded = make(map[string]error)
+)
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	for i := 0; ; i++ {
+		inst, err := ctorImpl(cfg)
+		if err == nil {
+			return inst, nil
+		}
+		// Either qemu failed to bind the guest ssh port on the remote host,
+		// or ssh failed to bind the local end of the forwarding.
+		if i < 100 && (strings.Contains(err.Error(), "could not set up host forwarding rule") ||
+			strings.Contains(err.Error(), "Could not request local forwarding")) {
+			continue
+		}
+		os.RemoveAll(cfg.Workdir)
+		return nil, err
+	}
+}
+
+func ctorImpl(cfg *vm.Config) (vm.Instance, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	params := cfg.Params.(*Params)
+	inst := &instance{
+		cfg:     cfg,
+		host:    params.Hosts[cfg.Index%len(params.Hosts)],
+		dir:     params.Dir,
+		monitor: filepath.Join(cfg.Workdir, "monitor.sock"),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.close(false)
+		}
+	}()
+
+	if err := inst.upload(); err != nil {
+		return nil, err
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = cfg.TargetArch().Qemu
+	}
+	if _, err := os.Stat(cfg.Image); err != nil {
+		return fmt.Errorf("image file '%v' does not exist: %v", cfg.Image, err)
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 1024 {
+		return fmt.Errorf("bad qemu cpu: %v, want [1-1024]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad qemu mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+// upload copies image, kernel and initrd to the remote host, once per host.
+func (inst *instance) upload() error {
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+	if err, ok := uploaded[inst.host]; ok {
+		return err
+	}
+	err := func() error {
+		Logf(0, "uploading files to %v:%v", inst.host, inst.dir)
+		if out, err := inst.hostSsh("mkdir -p " + quote(inst.dir)).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to create remote dir: %v\n%s", err, out)
+		}
+		for _, file := range []string{inst.cfg.Image, inst.cfg.Kernel, inst.cfg.Initrd} {
+			if file == "" {
+				continue
+			}
+			args := append(hostSshArgs(), file, inst.host+":"+inst.remoteFile(file))
+			if out, err := exec.Command("scp", args...).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to upload %v to %v: %v\n%s", file, inst.host, err, out)
+			}
+		}
+		return nil
+	}()
+	uploaded[inst.host] = err
+	return err
+}
+
+func (inst *instance) remoteFile(file string) string {
+	return inst.dir + "/" + filepath.Base(file)
+}
+
+func (inst *instance) boot() error {
+	inst.port = rand.Intn(64<<10-1<<10) + 1<<10
+	remotePort := rand.Intn(64<<10-1<<10) + 1<<10
+	remoteMonitor := fmt.Sprintf("%v/%v-%v.monitor", inst.dir, inst.cfg.Name, remotePort)
+	os.Remove(inst.monitor)
+
+	args := []string{
+		"-m", strconv.Itoa(inst.cfg.Mem),
+		"-smp", strconv.Itoa(inst.cfg.Cpu),
+		"-net", "nic",
+		"-net", fmt.Sprintf("user,host=%v,hostfwd=tcp:127.0.0.1:%v-:22", hostAddr, remotePort),
+		"-display", "none",
+		"-serial", "file:/dev/stdout",
+		"-monitor", fmt.Sprintf("unix:%v,server,nowait", remoteMonitor),
+		"-no-reboot",
+	}
+	arch := inst.cfg.TargetArch()
+	args = append(args,
+		"-drive", fmt.Sprintf("file=%v,index=0,media=disk,if=%v", inst.remoteFile(inst.cfg.Image), arch.QemuDrive),
+		"-snapshot",
+	)
+	if inst.cfg.BinArgs == "" {
+		args = append(args, arch.QemuArgs...)
+		if !inst.cfg.CrossArch() {
+			args = append(args, "-enable-kvm")
+		}
+	} else {
+		args = append(args, strings.Split(inst.cfg.BinArgs, " ")...)
+	}
+	if inst.cfg.Initrd != "" {
+		args = append(args, "-initrd", inst.remoteFile(inst.cfg.Initrd))
+	}
+	if inst.cfg.Kernel != "" {
+		cmdline := "console=" + arch.Console + " " + arch.Cmdline + " rodata=n oops=panic panic_on_warn=1 panic=86400" +
+			" ftrace_dump_on_oops=orig_cpu slub_debug=UZ net.ifnames=0 biosdevname=0 " +
+			"root=" + arch.RootDev + " "
+		args = append(args,
+			"-kernel", inst.remoteFile(inst.cfg.Kernel),
+			"-append", cmdline+inst.cfg.Cmdline,
+		)
+	}
+	qemuCmd := quote(inst.cfg.Bin)
+	for _, arg := range args {
+		qemuCmd += " " + quote(arg)
+	}
+	// Kill qemu when the ssh connection goes away (stdin is closed).
+	script := fmt.Sprintf("%v </dev/null & pid=$!; cat >/dev/null; kill $pid; rm -f %v",
+		qemuCmd, quote(remoteMonitor))
+	if inst.cfg.Debug {
+		Logf(0, "running command on %v: %v", inst.host, script)
+	}
+	sshArgs := append(hostSshArgs(),
+		"-o", "ExitOnForwardFailure=yes",
+		"-L", fmt.Sprintf("127.0.0.1:%v:127.0.0.1:%v", inst.port, remotePort),
+		"-L", fmt.Sprintf("%v:%v", inst.monitor, remoteMonitor),
+		inst.host, script)
+
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return err
+	}
+	qemu := exec.Command("ssh", sshArgs...)
+	qemu.Stdout = wpipe
+	qemu.Stderr = wpipe
+	if _, err := qemu.StdinPipe(); err != nil {
+		rpipe.Close()
+		wpipe.Close()
+		return err
+	}
+	if err := qemu.Start(); err != nil {
+		rpipe.Close()
+		wpipe.Close()
+		return fmt.Errorf("failed to start ssh %+v: %v", sshArgs, err)
+	}
+	wpipe.Close()
+	inst.qemu = qemu
+
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	inst.merger = vm.NewOutputMerger(tee)
+	inst.merger.Add("console", rpipe)
+
+	var bootOutput []byte
+	bootOutputStop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case out := <-inst.merger.Output:
+				bootOutput = append(bootOutput, out...)
+			case <-bootOutputStop:
+				close(bootOutputStop)
+				return
+			}
+		}
+	}()
+
+	inst.waiterC = make(chan error, 1)
+	go func() {
+		err := qemu.Wait()
+		inst.waiterC <- err
+	}()
+
+	// Wait for ssh server to come up.
+	time.Sleep(10 * time.Second)
+	start := time.Now()
+	for {
+		c, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%v", inst.port), 3*time.Second)
+		if err == nil {
+			c.SetDeadline(time.Now().Add(3 * time.Second))
+			var tmp [1]byte
+			n, err := c.Read(tmp[:])
+			c.Close()
+			if err == nil && n > 0 {
+				break // ssh is up and responding
+			}
+			time.Sleep(3 * time.Second)
+		}
+		select {
+		case err := <-inst.waiterC:
+			inst.waiterC <- err     // repost it for Close
+			time.Sleep(time.Second) // wait for any pending output
+			bootOutputStop <- true
+			<-bootOutputStop
+			return fmt.Errorf("qemu on %v stopped: %v\n%v\n", inst.host, err, string(bootOutput))
+		default:
+		}
+		if time.Since(start) > 10*time.Minute {
+			bootOutputStop <- true
+			<-bootOutputStop
+			return fmt.Errorf("ssh server did not start:\n%v\n", string(bootOutput))
+		}
+	}
+	bootOutputStop <- true
+	return nil
+}
+
+func (inst *instance) Close() {
+	inst.close(true)
+}
+
+func (inst *instance) close(removeWorkDir bool) {
+	for _, fwd := range inst.forwards {
+		fwd.Process.Kill()
+		fwd.Wait()
+	}
+	if inst.qemu != nil {
+		inst.qemu.Process.Kill()
+		err := <-inst.waiterC
+		inst.waiterC <- err // repost it for waiting goroutines
+	}
+	if inst.merger != nil {
+		inst.merger.Wait()
+	}
+	if removeWorkDir {
+		os.RemoveAll(inst.cfg.Workdir)
+	}
+}
+
+// Forward forwards port from the remote host to the local port,
+// the guest reaches the remote host loopback via qemu user networking host address.
+func (inst *instance) Diagnose() []byte {
+	out, err := inst.hmp("info registers", time.Minute)
+	if err != nil {
+		Logf(0, "%v: failed to dump registers: %v", inst.cfg.Name, err)
+		return nil
+	}
+	return []byte("\nqemu registers:\n" + out)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	for i := 0; i < 100; i++ {
+		remotePort := rand.Intn(64<<10-1<<10) + 1<<10
+		args := append(hostSshArgs(),
+			"-N",
+			"-o", "ExitOnForwardFailure=yes",
+			"-R", fmt.Sprintf("127.0.0.1:%v:127.0.0.1:%v", remotePort, port),
+			inst.host)
+		fwd := exec.Command("ssh", args...)
+		if err := fwd.Start(); err != nil {
+			return "", err
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- fwd.Wait()
+		}()
+		select {
+		case err := <-done:
+			// Most likely the remote port is busy, try another one.
+			Logf(1, "%v: failed to forward port %v: %v", inst.host, remotePort, err)
+			continue
+		case <-time.After(5 * time.Second):
+		}
+		inst.forwards = append(inst.forwards, fwd)
+		return fmt.Sprintf("%v:%v", hostAddr, remotePort), nil
+	}
+	return "", fmt.Errorf("failed to forward port to %v", inst.host)
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDsts, err := inst.CopyAll([]string{hostSrc})
+	if err != nil {
+		return "", err
+	}
+	return vmDsts[0], nil
+}
+
+func (inst *instance) CopyAll(hostSrcs []string) ([]string, error) {
+	return vm.Scp(inst.sshArgs("-P"), "root@localhost", "/", hostSrcs, inst.cfg.Debug)
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	inst.merger.Add("ssh", rpipe)
+
+	args := append(inst.sshArgs("-p"), "root@localhost", command)
+	if inst.cfg.Debug {
+		Logf(0, "running command: ssh %#v", args)
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		wpipe.Close()
+		return nil, nil, err
+	}
+	wpipe.Close()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	sv := &vm.Supervisor{
+		Name:    inst.cfg.Name,
+		Timeout: timeout,
+		Stop:    stop,
+		Exited:  exited,
+		Kill:    func() { cmd.Process.Kill() },
+	}
+	return inst.merger.Output, sv.Start(), nil
+}
+
+// hmp executes a qemu human monitor command and returns its output.
+func (inst *instance) hmp(command string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("unix", inst.monitor, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to qemu monitor: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	// Skip the greeting.
+	if _, err := readPrompt(conn); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return "", fmt.Errorf("failed to write to qemu monitor: %v", err)
+	}
+	out, err := readPrompt(conn)
+	if err != nil {
+		return "", err
+	}
+	// The monitor echoes the command first.
+	if pos := strings.IndexByte(out, '\n'); pos != -1 {
+		out = out[pos+1:]
+	} else {
+		out = ""
+	}
+	return strings.Replace(out, "\r", "", -1), nil
+}
+
+func readPrompt(conn net.Conn) (string, error) {
+	const prompt = "(qemu) "
+	var out []byte
+	buf := make([]byte, 4<<10)
+	for !strings.HasSuffix(string(out), prompt) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return "", fmt.Errorf("failed to read from qemu monitor: %v", err)
+		}
+		out = append(out, buf[:n]...)
+	}
+	return string(out[:len(out)-len(prompt)]), nil
+}
+
+// hostSsh returns command that runs command on the remote host.
+func (inst *instance) hostSsh(command string) *exec.Cmd {
+	return exec.Command("ssh", append(hostSshArgs(), inst.host, command)...)
+}
+
+// hostSshArgs returns ssh args for connections to remote hosts,
+// which use the user ssh configuration.
+func hostSshArgs() []string {
+	return []string{
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "ServerAliveInterval=10",
+		"-o", "LogLevel=error",
+	}
+}
+
+// sshArgs returns ssh args for connections to the guest via the forwarded port.
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		"-i", inst.cfg.Sshkey,
+		portArg, strconv.Itoa(inst.port),
+		"-F", "/dev/null",
+		"-o", "ConnectionAttempts=10",
+		"-o", "ConnectTimeout=10",
+		"-o", "BatchMode=yes",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
+
+// quote returns s quoted for a POSIX shell.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+)
+
+// ErrorClass is a class of transient errors of cloud APIs.
+type ErrorClass int
+
+const (
+	ErrorPermanent  ErrorClass = iota // not worth retrying
+	ErrorRateLimit                    // request is throttled (HTTP 429 and the like)
+	ErrorServer                       // server-side failure (HTTP 5xx)
+	ErrorConnection                   // network failure (connection reset, timeout)
+)
+
+func (class ErrorClass) String() string {
+	switch class {
+	case ErrorRateLimit:
+		return "rate limit"
+	case ErrorServer:
+		return "server error"
+	case ErrorConnection:
+		return "connection error"
+	default:
+		return "permanent error"
+	}
+}
+
+// API clients of cloud backends return errors with response status
+// or command output in the message, so the errors are classified by text.
+var errorClasses = []struct {
+	class ErrorClass
+	re    *regexp.Regexp
+}{
+	{ErrorRateLimit, regexp.MustCompile(`\b429 [A-Z]|Error 429|RequestLimitExceeded|(?i)too many requests|rate ?limit|throttl`)},
+	{ErrorServer, regexp.MustCompile(`\b50[0-4] [A-Z]|Error 50[0-4]|InternalError|ServiceUnavailable`)},
+	{ErrorConnection, regexp.MustCompile(`(?i)connection reset|connection refused|broken pipe|unexpected EOF|i/o timeout|TLS handshake timeout|no such host`)},
+}
+
+// ClassifyError returns class of the error of a cloud API call.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorPermanent
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrorConnection
+	}
+	msg := err.Error()
+	for _, ec := range errorClasses {
+		if ec.re.MatchString(msg) {
+			return ec.class
+		}
+	}
+	return ErrorPermanent
+}
+
+// Retry describes retries of cloud API calls that fail with transient errors.
+// The delay before the next attempt starts at Backoff and is doubled on every failure,
+// throttled requests wait 4 times longer.
+type Retry struct {
+	Attempts   int           // max number of attempts
+	Backoff    time.Duration // delay before the second attempt
+	MaxBackoff time.Duration // max delay between attempts
+	Budget     time.Duration // total time after which failures are not retried anymore
+}
+
+// DefaultRetry is used by cloud backends.
+var DefaultRetry = &Retry{
+	Attempts:   6,
+	Backoff:    2 * time.Second,
+	MaxBackoff: time.Minute,
+	Budget:     5 * time.Minute,
+}
+
+// Do calls fn until it succeeds, fails with a permanent error or retries are exhausted,
+// and returns the last error. what describes the call in logs.
+// Retries are interrupted by Shutdown.
+func (r *Retry) Do(what string, fn func() error) error {
+	start := time.Now()
+	backoff := r.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		class := ClassifyError(err)
+		if err == nil || class == ErrorPermanent {
+			return err
+		}
+		delay := backoff
+		if class == ErrorRateLimit {
+			delay *= 4
+		}
+		if delay > r.MaxBackoff {
+			delay = r.MaxBackoff
+		}
+		// Spread out retries of instances that failed at the same time.
+		delay += time.Duration(rand.Int63n(int64(delay)/5 + 1))
+		if attempt >= r.Attempts || time.Since(start)+delay > r.Budget {
+			return fmt.Errorf("%v: giving up after %v attempts: %v", what, attempt, err)
+		}
+		Logf(0, "%v: %v, retrying in %v (attempt %v/%v): %v", what, class, delay, attempt, r.Attempts, err)
+		if !SleepInterruptible(delay) {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// CreateInstance creates cloud instance name with create, retrying failures with DefaultRetry.
+// Every attempt first deletes instances named name with del, which also cleans up
+// after a failed creation attempt.
+func CreateInstance(name string, del, create func() error) error {
+	return DefaultRetry.Do("create instance "+name, func() error {
+		Logf(0, "deleting instance: %v", name)
+		if err := del(); err != nil {
+			return err
+		}
+		Logf(0, "creating instance: %v", name)
+		return create()
+	})
+}
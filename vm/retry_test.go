@@ -0,0 +1,99 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err   string
+		class ErrorClass
+	}{
+		{"POST /servers: 429 Too Many Requests", ErrorRateLimit},
+		{"googleapi: Error 429: Rate Limit Exceeded, rateLimitExceeded", ErrorRateLimit},
+		{"aws ec2 run-instances failed: exit status 254\nAn error occurred (RequestLimitExceeded)", ErrorRateLimit},
+		{"az vm create failed: exit status 1\n(TooManyRequests) Too many requests", ErrorRateLimit},
+		{"GET /nodes/pve/qemu: 503 Service Unavailable", ErrorServer},
+		{"googleapi: Error 500: Internal error encountered., backendError", ErrorServer},
+		{"aws ec2 run-instances failed: exit status 254\nAn error occurred (InternalError)", ErrorServer},
+		{"Post https://api.hetzner.cloud/v1/servers: read tcp: connection reset by peer", ErrorConnection},
+		{"Get https://pve:8006/api2/json/version: net/http: TLS handshake timeout", ErrorConnection},
+		{"googleapi: Error 404: The resource was not found, notFound", ErrorPermanent},
+		{"POST /servers: invalid_input: server name is already used", ErrorPermanent},
+		{"failed to create instance: instance 503 is invalid", ErrorPermanent},
+	}
+	for _, test := range tests {
+		if class := ClassifyError(errors.New(test.err)); class != test.class {
+			t.Errorf("%q: got %v, want %v", test.err, class, test.class)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	r := &Retry{
+		Attempts:   3,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		Budget:     time.Minute,
+	}
+	calls := 0
+	err := r.Do("test", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("503 Service Unavailable")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("transient errors: got err=%v calls=%v", err, calls)
+	}
+
+	calls = 0
+	err = r.Do("test", func() error {
+		calls++
+		return errors.New("connection reset by peer")
+	})
+	if err == nil || calls != 3 {
+		t.Fatalf("exhausted retries: got err=%v calls=%v", err, calls)
+	}
+
+	calls = 0
+	err = r.Do("test", func() error {
+		calls++
+		return errors.New("not found")
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("permanent error: got err=%v calls=%v", err, calls)
+	}
+}
+
+func TestCreateInstance(t *testing.T) {
+	defer func(r *Retry) { DefaultRetry = r }(DefaultRetry)
+	DefaultRetry = &Retry{
+		Attempts:   3,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		Budget:     time.Minute,
+	}
+	var calls []string
+	err := CreateInstance("test", func() error {
+		calls = append(calls, "delete")
+		return nil
+	}, func() error {
+		calls = append(calls, "create")
+		if len(calls) < 4 {
+			return errors.New("503 Service Unavailable")
+		}
+		return nil
+	})
+	// Every attempt cleans up after the previous one.
+	if err != nil || strings.Join(calls, " ") != "delete create delete create" {
+		t.Fatalf("got err=%v calls=%v", err, calls)
+	}
+}
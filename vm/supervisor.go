@@ -0,0 +1,93 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+)
+
+// Supervisor implements the common part of Instance.Run: it waits until the command exits,
+// times out, is stopped or the instance is closed, terminates the command and the console,
+// and reports the result on the Run error channel.
+// Backends parameterize it with their kill and liveness callbacks.
+type Supervisor struct {
+	Name    string // instance name for logging
+	Timeout time.Duration
+	Stop    <-chan bool
+	Closed  <-chan bool  // closed when the instance is closed (optional)
+	Exited  <-chan error // receives the command exit status
+	Console <-chan error // receives console connection loss (optional)
+
+	// Kill terminates the command.
+	Kill func()
+	// KillConsole disconnects the console (optional).
+	KillConsole func()
+	// Alive checks that the instance is still running after the command exited
+	// or the console connection was lost (optional).
+	// Lost instances (e.g. preempted or evicted cloud instances) are reported as TimeoutErr.
+	Alive func() bool
+	// Linger is the time given to the console to deliver the crash report after the command exits.
+	Linger time.Duration
+	// Merger is the merger created for this Run (optional), it is waited for after termination.
+	Merger *OutputMerger
+}
+
+// Start starts supervision of the command in background and returns the Run error channel.
+func (s *Supervisor) Start() <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		err := s.wait()
+		if s.KillConsole != nil {
+			s.KillConsole()
+		}
+		errc <- err
+		if s.Merger != nil {
+			s.Merger.Wait()
+		}
+	}()
+	return errc
+}
+
+func (s *Supervisor) wait() error {
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		s.Kill()
+		return TimeoutErr
+	case <-s.Stop:
+		s.Kill()
+		return TimeoutErr
+	case <-s.Closed:
+		s.Kill()
+		return errors.New("instance closed")
+	case err := <-s.Console:
+		s.Kill()
+		if s.lost("console connection closed") {
+			return TimeoutErr
+		}
+		return err
+	case err := <-s.Exited:
+		if s.lost("command exited") {
+			return TimeoutErr
+		}
+		time.Sleep(s.Linger)
+		return err
+	}
+}
+
+func (s *Supervisor) lost(what string) bool {
+	if s.Alive == nil {
+		return false
+	}
+	time.Sleep(time.Second) // just to avoid any cloud API races
+	if s.Alive() {
+		return false
+	}
+	Logf(1, "%v: %v but instance is not running", s.Name, what)
+	return true
+}
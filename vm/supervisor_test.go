@@ -0,0 +1,74 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSupervisor(t *testing.T) {
+	errExit := errors.New("ssh exited")
+	errCon := errors.New("console connection closed")
+	tests := []struct {
+		event  string
+		alive  bool
+		err    error
+		killed bool
+	}{
+		{"timeout", true, TimeoutErr, true},
+		{"stop", true, TimeoutErr, true},
+		{"close", true, errors.New("instance closed"), true},
+		{"console", true, errCon, true},
+		{"console", false, TimeoutErr, true},
+		{"exit", true, errExit, false},
+		{"exit", false, TimeoutErr, false},
+	}
+	for i, test := range tests {
+		stop := make(chan bool)
+		closed := make(chan bool)
+		exited := make(chan error, 1)
+		console := make(chan error, 1)
+		killed, consoleKilled := false, false
+		sv := &Supervisor{
+			Name:        "test",
+			Timeout:     time.Hour,
+			Stop:        stop,
+			Closed:      closed,
+			Exited:      exited,
+			Console:     console,
+			Kill:        func() { killed = true },
+			KillConsole: func() { consoleKilled = true },
+			Alive:       func() bool { return test.alive },
+		}
+		switch test.event {
+		case "timeout":
+			sv.Timeout = time.Millisecond
+		case "stop":
+			close(stop)
+		case "close":
+			close(closed)
+		case "console":
+			console <- errCon
+		case "exit":
+			exited <- errExit
+		}
+		var err error
+		select {
+		case err = <-sv.Start():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("#%v: supervisor did not finish", i)
+		}
+		if err == nil || err.Error() != test.err.Error() {
+			t.Fatalf("#%v: got error %v, want %v", i, err, test.err)
+		}
+		if killed != test.killed {
+			t.Fatalf("#%v: killed %v, want %v", i, killed, test.killed)
+		}
+		if !consoleKilled {
+			t.Fatalf("#%v: console is not disconnected", i)
+		}
+	}
+}
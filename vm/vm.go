@@ -5,13 +5,21 @@ package vm
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/report"
 )
 
@@ -20,6 +28,10 @@ type Instance interface {
 	// Copy copies a hostSrc file into vm and returns file name in vm.
 	Copy(hostSrc string) (string, error)
 
+	// CopyAll copies hostSrcs files into vm at once (e.g. in a single scp session)
+	// and returns file names in vm in the same order.
+	CopyAll(hostSrcs []string) ([]string, error)
+
 	// Forward setups forwarding from within VM to host port port
 	// and returns address to use in VM.
 	Forward(port int) (string, error)
@@ -30,35 +42,111 @@ type Instance interface {
 	// Command is terminated after timeout. Send on the stop chan can be used to terminate it earlier.
 	Run(timeout time.Duration, stop <-chan bool, command string) (outc <-chan []byte, errc <-chan error, err error)
 
+	// Diagnose collects additional state of a VM that stopped producing output
+	// (e.g. register dumps or task backtraces) and returns output to append to the crash report.
+	// Diagnostic output that the VM prints on its console is delivered via Run output instead.
+	Diagnose() []byte
+
 	// Close stops and destroys the VM.
 	Close()
 }
 
+// Snapshotter is optionally implemented by instances that can save their state
+// and quickly return to it later, which is much faster than recreating the instance.
+type Snapshotter interface {
+	// Snapshot saves the current state of the VM replacing the previous snapshot.
+	Snapshot() error
+
+	// Restore returns the VM to the state saved by Snapshot.
+	// Commands running in the VM are terminated.
+	Restore() error
+}
+
+// AsSnapshotter returns inst as Snapshotter, or nil if inst does not support snapshots.
+func AsSnapshotter(inst Instance) Snapshotter {
+	if pi, ok := inst.(*poolInstance); ok {
+		// The pool instance snapshots the replacement if the instance is swapped.
+		if AsSnapshotter(pi.Instance) == nil {
+			return nil
+		}
+		return pi
+	}
+	s, _ := unwrap(inst).(Snapshotter)
+	return s
+}
+
+// unwrap returns the backend instance behind wrappers added by this package.
+func unwrap(inst Instance) Instance {
+	for {
+		switch w := inst.(type) {
+		case *poolInstance:
+			inst = w.Instance
+		case *hookInstance:
+			inst = w.Instance
+		case *artifactsInstance:
+			inst = w.Instance
+		default:
+			return inst
+		}
+	}
+}
+
 type Config struct {
-	Name        string
-	Index       int
-	Workdir     string
-	Bin         string
-	BinArgs     string
-	Initrd      string
-	Kernel      string
-	Cmdline     string
-	Image       string
-	Sshkey      string
-	Executor    string
-	Device      string
-	MachineType string
-	Cpu         int
-	Mem         int
-	Debug       bool
+	Name      string
+	Index     int
+	Arch      string // target arch in GOARCH terms (default: HostArch), see Archs
+	Workdir   string
+	Bin       string
+	BinArgs   string
+	Initrd    string
+	Kernel    string
+	Cmdline   string
+	Image     string
+	Sshkey    string
+	Executor  string
+	Device    string
+	Cpu       int
+	Mem       int
+	Debug     bool
+	Params    Params         // backend-specific parameters returned by ParseParams
+	Console   *ConsoleConfig // console that overrides the backend default (optional), see NewConsole
+	Network   *NetworkConfig // private network for the instance (optional), see AttachNetwork
+	Hooks     *HooksConfig   // lifecycle hook scripts (optional)
+	Artifacts string         // directory to record instance artifacts to (optional), see ArtifactConsole
+}
+
+// Params is a backend-specific config section (the vm parameter in the manager config).
+// Backends define own params types and access them as cfg.Params.(*ParamsType).
+type Params interface {
+	// Validate checks parameters values and fills in defaults.
+	Validate() error
 }
 
 type ctorFunc func(cfg *Config) (Instance, error)
 
-var ctors = make(map[string]ctorFunc)
+type backend struct {
+	ctor    ctorFunc
+	params  func() Params
+	network bool
+}
+
+var backends = make(map[string]*backend)
 
-func Register(typ string, ctor ctorFunc) {
-	ctors[typ] = ctor
+// Register registers a VM type. params returns backend parameters with default values,
+// it is nil if the backend does not have any parameters.
+func Register(typ string, ctor ctorFunc, params func() Params) {
+	backends[typ] = &backend{ctor: ctor, params: params}
+}
+
+// RegisterNetwork marks a registered VM type as supporting private networks (see Config.Network).
+func RegisterNetwork(typ string) {
+	backends[typ].network = true
+}
+
+// SupportsNetwork returns whether VM type typ supports private networks (see Config.Network).
+func SupportsNetwork(typ string) bool {
+	b := backends[typ]
+	return b != nil && b.network
 }
 
 // Close to interrupt all pending operations.
@@ -66,13 +154,84 @@ var Shutdown = make(chan struct{})
 
 // Create creates and boots a new VM instance.
 func Create(typ string, cfg *Config) (Instance, error) {
-	ctor := ctors[typ]
-	if ctor == nil {
+	b, ok := backends[typ]
+	if !ok {
 		return nil, fmt.Errorf("unknown instance type '%v'", typ)
 	}
+	if cfg.Params == nil && b.params != nil {
+		params, err := ParseParams(typ, nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Params = params
+	}
+	if cfg.Network != nil && !b.network {
+		return nil, fmt.Errorf("instance type '%v' does not support private networks", typ)
+	}
+	if err := validateArch(cfg); err != nil {
+		return nil, err
+	}
+	ctor := b.ctor
+	if cfg.Artifacts != "" {
+		ctor = func(cfg *Config) (Instance, error) { return createWithArtifacts(cfg, b.ctor) }
+	}
+	if cfg.Hooks != nil {
+		return createWithHooks(cfg, ctor)
+	}
 	return ctor(cfg)
 }
 
+// ParseParams parses and validates backend-specific parameters of VM type typ.
+// Empty data means default parameters.
+func ParseParams(typ string, data []byte) (Params, error) {
+	b, ok := backends[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown instance type '%v'", typ)
+	}
+	empty := len(bytes.TrimSpace(data)) == 0 || string(bytes.TrimSpace(data)) == "null"
+	if b.params == nil {
+		if !empty {
+			return nil, fmt.Errorf("type %v does not support vm param", typ)
+		}
+		return nil, nil
+	}
+	params := b.params()
+	if !empty {
+		if err := checkUnknownFields(data, params); err != nil {
+			return nil, fmt.Errorf("bad %v vm param: %v", typ, err)
+		}
+		if err := json.Unmarshal(data, params); err != nil {
+			return nil, fmt.Errorf("failed to parse %v vm param: %v", typ, err)
+		}
+	}
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("bad %v vm param: %v", typ, err)
+	}
+	return params, nil
+}
+
+// checkUnknownFields checks that all fields in data are present in the struct v points to.
+func checkUnknownFields(data []byte, v interface{}) error {
+	f := make(map[string]interface{})
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	typ := reflect.TypeOf(v).Elem()
+	for k := range f {
+		ok := false
+		for i := 0; i < typ.NumField(); i++ {
+			if strings.ToLower(k) == strings.ToLower(typ.Field(i).Name) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("unknown field '%v'", k)
+		}
+	}
+	return nil
+}
+
 func LongPipe() (io.ReadCloser, io.WriteCloser, error) {
 	r, w, err := os.Pipe()
 	if err != nil {
@@ -86,7 +245,75 @@ func LongPipe() (io.ReadCloser, io.WriteCloser, error) {
 
 var TimeoutErr = errors.New("timeout")
 
-func MonitorExecution(outc <-chan []byte, errc <-chan error, local, needOutput bool) (desc string, text, output []byte, crashed, timedout bool) {
+// SysrqCommand dumps state of all tasks and backtraces of all CPUs to the kernel console.
+const SysrqCommand = "echo 1 > /proc/sys/kernel/sysrq; echo t > /proc/sysrq-trigger; echo l > /proc/sysrq-trigger"
+
+// Sysrq runs SysrqCommand in a VM that can still execute commands, for Diagnose implementations.
+// command returns a host command that executes the given shell command in the VM.
+func Sysrq(command func(string) *exec.Cmd) {
+	RunTimeout(time.Minute, command(SysrqCommand))
+}
+
+// RunTimeout runs cmd, kills it after timeout and returns its combined output.
+func RunTimeout(timeout time.Duration, cmd *exec.Cmd) ([]byte, error) {
+	output := new(bytes.Buffer)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(timeout, func() {
+		cmd.Process.Kill()
+	})
+	err := cmd.Wait()
+	if !timer.Stop() {
+		return output.Bytes(), fmt.Errorf("timeout: %v", err)
+	}
+	return output.Bytes(), err
+}
+
+// CopyEach implements Instance.CopyAll for backends that can't copy several files at once.
+func CopyEach(inst Instance, hostSrcs []string) ([]string, error) {
+	var vmDsts []string
+	for _, hostSrc := range hostSrcs {
+		vmDst, err := inst.Copy(hostSrc)
+		if err != nil {
+			return nil, err
+		}
+		vmDsts = append(vmDsts, vmDst)
+	}
+	return vmDsts, nil
+}
+
+// Scp copies hostSrcs into directory vmDir on target (user@host) in a single scp session
+// and returns file names on target. args are scp options (e.g. port and key).
+func Scp(args []string, target, vmDir string, hostSrcs []string, debug bool) ([]string, error) {
+	var vmDsts []string
+	for _, hostSrc := range hostSrcs {
+		vmDsts = append(vmDsts, strings.TrimSuffix(vmDir, "/")+"/"+filepath.Base(hostSrc))
+	}
+	args = append(append(append([]string{}, args...), hostSrcs...), target+":"+vmDir)
+	if debug {
+		Logf(0, "running command: scp %#v", args)
+	}
+	out, err := RunTimeout(3*time.Minute, exec.Command("scp", args...))
+	if debug {
+		os.Stdout.Write(out)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scp failed: %v\n%s", err, out)
+	}
+	return vmDsts, nil
+}
+
+func MonitorExecution(inst Instance, outc <-chan []byte, errc <-chan error, local, needOutput bool) (desc string, text, output []byte, crashed, timedout bool) {
+	if pi, ok := inst.(*poolInstance); ok {
+		defer func() {
+			if crashed {
+				pi.pool.updateMetrics(pi.idx, func(m *InstanceMetrics) { m.Crashes++ })
+			}
+		}()
+	}
 	waitForOutput := func() {
 		dur := time.Second
 		if needOutput {
@@ -129,6 +356,14 @@ func MonitorExecution(outc <-chan []byte, errc <-chan error, local, needOutput b
 		return desc, text, output[start:end], true, false
 	}
 
+	diagnose := func(desc string) (string, []byte, []byte, bool, bool) {
+		diag := inst.Diagnose()
+		// Give it some time to print diagnostic output on the console.
+		waitForOutput()
+		output = append(output, diag...)
+		return desc, diag, output, true, false
+	}
+
 	lastExecuteTime := time.Now()
 	ticker := time.NewTimer(3 * time.Minute)
 	tickerFired := false
@@ -173,12 +408,12 @@ func MonitorExecution(outc <-chan []byte, errc <-chan error, local, needOutput b
 			// In some cases kernel constantly prints something to console,
 			// but fuzzer is not actually executing programs.
 			if !local && time.Since(lastExecuteTime) > 3*time.Minute {
-				return "test machine is not executing programs", nil, output, true, false
+				return diagnose("test machine is not executing programs")
 			}
 		case <-ticker.C:
 			tickerFired = true
 			if !local {
-				return "no output from test machine", nil, output, true, false
+				return diagnose("no output from test machine")
 			}
 		case <-Shutdown:
 			return "", nil, nil, false, false
@@ -196,3 +431,21 @@ func SleepInterruptible(d time.Duration) bool {
 		return false
 	}
 }
+
+var (
+	shutdownOnce sync.Once
+	shutdownCtx  context.Context
+)
+
+// ShutdownContext returns a context that is canceled when shutdown is in progress.
+func ShutdownContext() context.Context {
+	shutdownOnce.Do(func() {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithCancel(context.Background())
+		go func() {
+			<-Shutdown
+			cancel()
+		}()
+	})
+	return shutdownCtx
+}
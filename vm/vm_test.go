@@ -0,0 +1,68 @@
+// Copyright 2016 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testParams struct {
+	Hosts []string
+	Dir   string
+}
+
+func (params *testParams) Validate() error {
+	if len(params.Hosts) == 0 {
+		return fmt.Errorf("hosts is empty")
+	}
+	if params.Dir == "" {
+		params.Dir = "/tmp"
+	}
+	return nil
+}
+
+func TestParseParams(t *testing.T) {
+	Register("test-params", nil, func() Params { return new(testParams) })
+	Register("test-noparams", nil, nil)
+	tests := []struct {
+		typ  string
+		data string
+		err  string
+		want *testParams
+	}{
+		{"test-params", `{"hosts": ["a", "b"]}`, "", &testParams{Hosts: []string{"a", "b"}, Dir: "/tmp"}},
+		{"test-params", `{"Hosts": ["a"], "dir": "/x"}`, "", &testParams{Hosts: []string{"a"}, Dir: "/x"}},
+		{"test-params", ``, "bad test-params vm param: hosts is empty", nil},
+		{"test-params", `{"hosts": ["a"], "foo": 1}`, "bad test-params vm param: unknown field 'foo'", nil},
+		{"test-params", `{"hosts": "a"}`, "failed to parse test-params vm param: ", nil},
+		{"test-noparams", ``, "", nil},
+		{"test-noparams", `null`, "", nil},
+		{"test-noparams", `{"hosts": ["a"]}`, "type test-noparams does not support vm param", nil},
+		{"test-unknown", ``, "unknown instance type 'test-unknown'", nil},
+	}
+	for i, test := range tests {
+		params, err := ParseParams(test.typ, []byte(test.data))
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("#%v: got error %q, want %q", i, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%v: unexpected error: %v", i, err)
+		}
+		if test.want == nil {
+			if params != nil {
+				t.Fatalf("#%v: got params %+v, want nil", i, params)
+			}
+			continue
+		}
+		got := params.(*testParams)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Fatalf("#%v: got params %+v, want %+v", i, got, test.want)
+		}
+	}
+}